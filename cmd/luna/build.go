@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"luna/compiler"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// luna build [-o out.wasm] [-legacy-exceptions] [-O] [-dce] [-report] [-relocatable] file.wat
+// Without -o the binary is written next to the file (file.wasm, or file.o with -relocatable)
+// -O runs the optimizer, -dce removes the dead code, -report prints what they changed
+// -relocatable writes an object file for wasm-ld (see compiler.AssembleObject)
+func runBuild(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	output := flags.String("o", "", "output file (default: the input file with the .wasm extension)")
+	legacyExceptions := flags.Bool("legacy-exceptions", false, "accept the legacy exception handling instructions (try, catch, delegate, rethrow)")
+	optimize := flags.Bool("O", false, "fold constants and simplify local.get/local.set patterns")
+	dce := flags.Bool("dce", false, "remove the functions, globals and types that are never used and the code that never runs")
+	report := flags.Bool("report", false, "print the changes made by -O and -dce")
+	relocatable := flags.Bool("relocatable", false, "write a relocatable object file (with the linking and reloc.CODE sections) that can be linked with wasm-ld")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: luna build [-o out.wasm] [-legacy-exceptions] [-O] [-dce] [-report] [-relocatable] file.wat")
+		return 2
+	}
+	file := flags.Arg(0)
+
+	input, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "luna build:", err)
+		return 1
+	}
+
+	ast, err := compiler.Parser(compiler.Tokenize(string(input)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "luna build: %s: %v\n", file, err)
+		return 1
+	}
+	module, err := compiler.BuildWithOptions(ast, compiler.Options{LegacyExceptions: *legacyExceptions})
+	if err == nil {
+		err = compiler.Validate(module)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "luna build: %s: %v\n", file, err)
+		return 1
+	}
+
+	if *dce {
+		dead := compiler.EliminateDeadCode(module)
+		if *report {
+			fmt.Println(dead)
+		}
+	}
+	if *optimize {
+		optimizations := compiler.Optimize(module)
+		if *report {
+			for _, optimization := range optimizations {
+				fmt.Println(optimization)
+			}
+			fmt.Printf("%d optimizations\n", len(optimizations))
+		}
+	}
+	var wasm compiler.Module
+	extension := ".wasm"
+	if *relocatable {
+		wasm, err = compiler.AssembleObject(module)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "luna build: %s: %v\n", file, err)
+			return 1
+		}
+		extension = ".o"
+	} else {
+		wasm = compiler.Assemble(module)
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(file, filepath.Ext(file)) + extension
+	}
+	if err := os.WriteFile(*output, wasm.Bytes(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "luna build:", err)
+		return 1
+	}
+	return 0
+}
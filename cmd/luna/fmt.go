@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"luna/formatter"
+	"os"
+)
+
+// luna fmt [-check] [-w] [-fold | -flat] [files...]
+// Without files it formats the standard input
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "do not print, list the files that are not formatted and exit with 1")
+	write := flags.Bool("w", false, "write the result to the file instead of the standard output")
+	fold := flags.Bool("fold", false, "convert flat instructions to the folded form")
+	flat := flags.Bool("flat", false, "convert folded instructions to the flat form")
+	indent := flags.String("indent", "  ", "indentation unit")
+	flags.Parse(args)
+
+	options := formatter.Options{Indent: *indent, Fold: *fold, Flatten: *flat}
+
+	if flags.NArg() == 0 {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "luna fmt:", err)
+			return 1
+		}
+		formatted, err := formatter.Format(string(input), options)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "luna fmt: <stdin>:", err)
+			return 1
+		}
+		if *check {
+			if formatted != string(input) {
+				fmt.Println("<stdin>")
+				return 1
+			}
+			return 0
+		}
+		fmt.Print(formatted)
+		return 0
+	}
+
+	status := 0
+	for _, file := range flags.Args() {
+		input, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "luna fmt:", err)
+			status = 1
+			continue
+		}
+
+		formatted, err := formatter.Format(string(input), options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "luna fmt: %s: %v\n", file, err)
+			status = 1
+			continue
+		}
+
+		switch {
+		case *check:
+			if formatted != string(input) {
+				fmt.Println(file)
+				status = 1
+			}
+		case *write:
+			if formatted != string(input) {
+				if err := os.WriteFile(file, []byte(formatted), 0644); err != nil {
+					fmt.Fprintln(os.Stderr, "luna fmt:", err)
+					status = 1
+				}
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+
+	return status
+}
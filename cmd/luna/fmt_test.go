@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stdout runs a command and returns its exit status and what it printed
+func stdout(t *testing.T, run func() int) (int, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	status := run()
+	os.Stdout = saved
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return status, string(out)
+}
+
+func TestFmtCheck(t *testing.T) {
+	dir := t.TempDir()
+	formatted := filepath.Join(dir, "formatted.wat")
+	messy := filepath.Join(dir, "messy.wat")
+	broken := filepath.Join(dir, "broken.wat")
+	os.WriteFile(formatted, []byte("(module\n  (func $f (result i32)\n    i32.const 1))\n"), 0644)
+	os.WriteFile(messy, []byte("(module (func $f (result i32) i32.const 1))"), 0644)
+	os.WriteFile(broken, []byte("(module (func"), 0644)
+
+	tests := []struct {
+		args   []string
+		status int
+		out    string
+	}{
+		{[]string{"-check", formatted}, 0, ""},
+		// the files that are not formatted are listed
+		{[]string{"-check", formatted, messy}, 1, messy + "\n"},
+		{[]string{"-check", broken}, 1, ""},
+		// a formatted file is not formatted in the folded form
+		{[]string{"-check", "-fold", formatted}, 1, formatted + "\n"},
+		{[]string{"-check", "-flat", formatted}, 0, ""},
+	}
+	for _, test := range tests {
+		status, out := stdout(t, func() int { return runFmt(test.args) })
+		if status != test.status || out != test.out {
+			t.Errorf("luna fmt %v: got %d %q, want %d %q", test.args, status, out, test.status, test.out)
+		}
+	}
+
+	// -check never writes the files
+	if input, _ := os.ReadFile(messy); string(input) != "(module (func $f (result i32) i32.const 1))" {
+		t.Errorf("-check changed the file: %q", input)
+	}
+
+	// -w formats them, then -check is happy
+	if status, _ := stdout(t, func() int { return runFmt([]string{"-w", messy}) }); status != 0 {
+		t.Fatalf("-w: exit status %d", status)
+	}
+	if status, out := stdout(t, func() int { return runFmt([]string{"-check", messy}) }); status != 0 {
+		t.Errorf("-check after -w: got %d %q", status, out)
+	}
+}
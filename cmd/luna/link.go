@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"luna/compiler"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// luna link [-o out.wasm] [-legacy-exceptions] [name=]file.wat|file.wasm...
+// Every file is a module named after the file (math.wat is "math"), the imports from it are linked to its exports,
+// name=file gives it another name (e.g. env=runtime.wat links the imports from "env")
+func runLink(args []string) int {
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	output := flags.String("o", "out.wasm", "output file")
+	legacyExceptions := flags.Bool("legacy-exceptions", false, "accept the legacy exception handling instructions (try, catch, delegate, rethrow)")
+	files := parseInterspersed(flags, args)
+
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: luna link [-o out.wasm] [-legacy-exceptions] [name=]file.wat|file.wasm...")
+		return 2
+	}
+
+	inputs := []compiler.LinkInput{}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if i := strings.Index(file, "="); i >= 0 {
+			name, file = file[:i], file[i+1:]
+		}
+		module, err := readModule(file, compiler.Options{LegacyExceptions: *legacyExceptions})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "luna link:", err)
+			return 1
+		}
+		inputs = append(inputs, compiler.LinkInput{Name: name, Module: module})
+	}
+
+	module, err := compiler.Link(inputs)
+	if err == nil {
+		err = compiler.Validate(module)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "luna link:", err)
+		return 1
+	}
+
+	if err := os.WriteFile(*output, compiler.Assemble(module).Bytes(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "luna link:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"luna/compiler"
+	"luna/types"
+	"os"
+)
+
+// Luna command line
+// The browser build lives in the root main.go, this one runs in the terminal
+//
+//	go build -o ./dist/luna ./cmd/luna
+
+const usage = `Usage: luna <command> [arguments]
+
+Commands:
+  build   compile a .wat file to .wasm
+  fmt     format .wat files
+  link    merge .wat and .wasm modules into one
+  rewrite strip custom sections, change the exports and reorder the functions of a module
+  stats   print the size of the sections and of the functions of a module
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "build":
+		os.Exit(runBuild(args))
+	case "fmt":
+		os.Exit(runFmt(args))
+	case "link":
+		os.Exit(runLink(args))
+	case "rewrite":
+		os.Exit(runRewrite(args))
+	case "stats":
+		os.Exit(runStats(args))
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "luna: unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// readModule compiles a .wat file (or decodes a binary module, .wasm or .o) and validates it
+func readModule(file string, options compiler.Options) (*types.Module, error) {
+	input, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var module *types.Module
+	if isBinary(input) {
+		module, err = compiler.Decode(input)
+	} else {
+		var ast []types.AstNode
+		ast, err = compiler.Parser(compiler.Tokenize(string(input)))
+		if err == nil {
+			module, err = compiler.BuildWithOptions(ast, options)
+		}
+	}
+	if err == nil {
+		err = compiler.Validate(module)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return module, nil
+}
+
+// Binary modules start with the magic number \0asm, whatever their extension
+func isBinary(input []byte) bool {
+	return bytes.HasPrefix(input, []byte("\x00asm"))
+}
+
+// parseInterspersed parses the flags wherever they are, so they can follow the files (luna link a.wat b.wat -o out.wasm)
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	files := []string{}
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return files
+		}
+		files = append(files, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"luna/compiler"
+	"luna/defaults"
+	"luna/types"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// luna rewrite [-o out.wasm] [-strip name]... [-strip-all] [-rename old=new]... [-export name=kind:index]... [-unexport name]... [-order profile.txt] file.wasm|file.wat
+// Changes a compiled module without its source: the custom sections are removed, the exports renamed, added or removed
+// and the functions reordered by a profile (a function per line, by index or by name, the hottest first).
+// The input is never overwritten (unless -o says so): file.wasm is written to file.rewritten.wasm,
+// a .wat file is compiled first and written to file.wasm
+func runRewrite(args []string) int {
+	flags := flag.NewFlagSet("rewrite", flag.ExitOnError)
+	output := flags.String("o", "", "output file (default: file.rewritten.wasm, or file.wasm for a .wat file)")
+	strip := listFlag{}
+	flags.Var(&strip, "strip", "remove a custom section (name, producers...), a name ending with * is a prefix (.debug_*)")
+	stripAll := flags.Bool("strip-all", false, "remove all the custom sections")
+	renames := listFlag{}
+	flags.Var(&renames, "rename", "rename an export (old=new), in the order of the flags")
+	exports := listFlag{}
+	flags.Var(&exports, "export", "add an export (name=kind:index, e.g. helper=func:3)")
+	unexports := listFlag{}
+	flags.Var(&unexports, "unexport", "remove an export")
+	order := flags.String("order", "", "reorder the functions by a profile file")
+	legacyExceptions := flags.Bool("legacy-exceptions", false, "accept the legacy exception handling instructions (try, catch, delegate, rethrow)")
+	report := flags.Bool("report", false, "print the custom sections that were removed")
+	files := parseInterspersed(flags, args)
+
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: luna rewrite [-o out.wasm] [-strip name]... [-strip-all] [-rename old=new]... [-export name=kind:index]... [-unexport name]... [-order profile.txt] file.wasm|file.wat")
+		return 2
+	}
+	file := files[0]
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "luna rewrite: %s: %v\n", file, err)
+		return 1
+	}
+
+	rewrite := compiler.Rewrite{Strip: strip, Remove: unexports}
+	if *stripAll {
+		rewrite.Strip = []string{"*"}
+	}
+	for _, rename := range renames {
+		old, name, ok := strings.Cut(rename, "=")
+		if !ok {
+			return fail(fmt.Errorf("-rename %s: expected old=new", rename))
+		}
+		rewrite.Rename = append(rewrite.Rename, compiler.ExportRename{Old: old, New: name})
+	}
+	for _, export := range exports {
+		parsed, err := parseExport(export)
+		if err != nil {
+			return fail(err)
+		}
+		rewrite.Add = append(rewrite.Add, parsed)
+	}
+
+	input, err := os.ReadFile(file)
+	if err != nil {
+		return fail(err)
+	}
+	binary := input
+	// the $ids of a .wat file can be used in the profile, they are not in the binary
+	ids := map[string]string{}
+	if !isBinary(input) {
+		module, err := readModule(file, compiler.Options{LegacyExceptions: *legacyExceptions})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "luna rewrite:", err)
+			return 1
+		}
+		binary = compiler.Assemble(module).Bytes()
+		for i, fn := range module.Funcs {
+			if fn.Name != "" {
+				ids[fn.Name] = strconv.Itoa(i)
+			}
+		}
+	}
+	if *output == "" {
+		*output = rewrittenName(file, isBinary(input))
+	}
+
+	if *order != "" {
+		profile, err := readProfile(*order)
+		if err != nil {
+			return fail(err)
+		}
+		for _, name := range profile {
+			if index, ok := ids[name]; ok {
+				name = index
+			}
+			rewrite.Order = append(rewrite.Order, name)
+		}
+	}
+
+	rewritten, err := compiler.RewriteBinary(binary, rewrite)
+	if err != nil {
+		return fail(err)
+	}
+	if *report {
+		for _, name := range rewritten.Removed {
+			fmt.Fprintf(os.Stderr, "%s: removed custom section %q\n", file, name)
+		}
+	}
+
+	if err := os.WriteFile(*output, rewritten.Binary, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "luna rewrite:", err)
+		return 1
+	}
+	return 0
+}
+
+// rewrittenName is the default output: a sibling of the binary (a.wasm is a.rewritten.wasm), or the binary of a .wat file
+func rewrittenName(file string, binary bool) string {
+	extension := filepath.Ext(file)
+	if binary {
+		return strings.TrimSuffix(file, extension) + ".rewritten" + extension
+	}
+	return strings.TrimSuffix(file, extension) + ".wasm"
+}
+
+// listFlag is a flag that can be repeated (-strip name -strip producers)
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseExport reads name=kind:index, the kinds are the ones of the text format (func, table, memory, global, tag)
+func parseExport(export string) (types.Export, error) {
+	name, target, ok := strings.Cut(export, "=")
+	kind, index, ok2 := strings.Cut(target, ":")
+	if !ok || !ok2 {
+		return types.Export{}, fmt.Errorf("-export %s: expected name=kind:index", export)
+	}
+	if kind == "memory" {
+		kind = "mem"
+	}
+	code, ok := defaults.ExportSection[kind]
+	if !ok {
+		return types.Export{}, fmt.Errorf("-export %s: unknown kind %q", export, kind)
+	}
+	number, err := strconv.ParseUint(index, 10, 32)
+	if err != nil {
+		return types.Export{}, fmt.Errorf("-export %s: bad index %q", export, index)
+	}
+	return types.Export{Name: name, Kind: code, Index: uint32(number)}, nil
+}
+
+// readProfile reads the functions of a profile, the first word of every line
+// (so the counts of a profiler can follow the name), empty lines and # comments are skipped
+func readProfile(file string) ([]string, error) {
+	input, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	functions := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			functions = append(functions, fields[0])
+		}
+	}
+	return functions, scanner.Err()
+}
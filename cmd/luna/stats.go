@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"luna/compiler"
+	"os"
+	"text/tabwriter"
+)
+
+// luna stats [-json] [-top n] [-legacy-exceptions] file.wat|file.wasm
+// The sizes of the sections and of the function bodies, the largest functions and the most used opcodes.
+// A .wat file is compiled first, so the sizes are the ones of the binary luna build writes
+func runStats(args []string) int {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the statistics as JSON")
+	top := flags.Int("top", 10, "how many functions and opcodes to print (0 for all of them)")
+	legacyExceptions := flags.Bool("legacy-exceptions", false, "accept the legacy exception handling instructions (try, catch, delegate, rethrow)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: luna stats [-json] [-top n] [-legacy-exceptions] file.wat|file.wasm")
+		return 2
+	}
+	file := flags.Arg(0)
+
+	binary, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "luna stats:", err)
+		return 1
+	}
+	names := map[uint32]string{}
+	if !isBinary(binary) {
+		module, err := readModule(file, compiler.Options{LegacyExceptions: *legacyExceptions})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "luna stats:", err)
+			return 1
+		}
+		binary = compiler.Assemble(module).Bytes()
+		for i, fn := range module.Funcs {
+			if fn.Name != "" {
+				names[uint32(i)] = fn.Name
+			}
+		}
+	}
+
+	stats, err := compiler.Stats(binary)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "luna stats: %s: %v\n", file, err)
+		return 1
+	}
+	// the $ids are not in the binary, but they are better names than the exports
+	for i, function := range stats.Functions {
+		if name, ok := names[function.Index]; ok {
+			stats.Functions[i].Name = name
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(stats); err != nil {
+			fmt.Fprintln(os.Stderr, "luna stats:", err)
+			return 1
+		}
+		return 0
+	}
+	printStats(os.Stdout, file, stats, *top)
+	return 0
+}
+
+func printStats(out io.Writer, file string, stats compiler.Statistics, top int) {
+	limit := func(n int) int {
+		if top > 0 && top < n {
+			return top
+		}
+		return n
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(out, "%s: %d bytes\n\n", file, stats.Size)
+	fmt.Fprintln(w, "section\tsize\t%\tcount")
+	for _, section := range stats.Sections {
+		name := section.Name
+		if section.ID == 0 {
+			name = fmt.Sprintf("custom %q", section.Name)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%d\n", name, section.Size, 100*float64(section.Size)/float64(stats.Size), section.Count)
+	}
+	w.Flush()
+
+	functions := stats.LargestFunctions()
+	fmt.Fprintf(out, "\nlargest functions (%d of %d)\n", limit(len(functions)), len(functions))
+	fmt.Fprintln(w, "index\tsize\tinstructions\tname")
+	for _, function := range functions[:limit(len(functions))] {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", function.Index, function.Size, function.Instructions, function.Name)
+	}
+	w.Flush()
+
+	opcodes := stats.SortedOpcodes()
+	fmt.Fprintf(out, "\nopcodes (%d of %d)\n", limit(len(opcodes)), len(opcodes))
+	for _, opcode := range opcodes[:limit(len(opcodes))] {
+		fmt.Fprintf(w, "%s\t%d\n", opcode.Name, opcode.Count)
+	}
+	w.Flush()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"luna/compiler"
+	"testing"
+)
+
+func TestPrintStats(t *testing.T) {
+	stats := compiler.Statistics{
+		Size: 65,
+		Sections: []compiler.SectionStatistics{
+			{ID: 1, Name: "type", Size: 8, Count: 1},
+			{ID: 10, Name: "code", Size: 44, Count: 2},
+			{ID: 0, Name: "producers", Size: 13},
+		},
+		Functions: []compiler.FunctionStatistics{
+			{Index: 0, Name: "small", Size: 10, Instructions: 3},
+			{Index: 1, Name: "big", Size: 31, Instructions: 12},
+		},
+		Opcodes: map[string]int{"end": 2, "local.get": 5, "i32.add": 5, "call": 1},
+	}
+
+	out := &bytes.Buffer{}
+	printStats(out, "a.wasm", stats, 2)
+	want := `a.wasm: 65 bytes
+
+section             size  %     count
+type                8     12.3  1
+code                44    67.7  2
+custom "producers"  13    20.0  0
+
+largest functions (2 of 2)
+index  size  instructions  name
+1      31    12            big
+0      10    3             small
+
+opcodes (2 of 4)
+i32.add    5
+local.get  5
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
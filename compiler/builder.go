@@ -0,0 +1,1258 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/texts"
+	"luna/types"
+)
+
+// The builder gives a meaning to the AST.
+// It walks the fields of the module (func, table, memory, global, tag, import, export...)
+// and builds a types.Module, resolving the names ($ids) into indices along the way.
+// See https://webassembly.github.io/spec/core/text/modules.html
+
+// Index spaces
+// Functions, tables, memories and globals are referenced by their index
+// (the position in the module) or by their $id
+// See https://webassembly.github.io/spec/core/syntax/modules.html#indices
+const (
+	typeSpace   = "type"
+	funcSpace   = "func"
+	tableSpace  = "table"
+	memorySpace = "memory"
+	globalSpace = "global"
+	elemSpace   = "elem"
+	dataSpace   = "data"
+	tagSpace    = "tag"
+)
+
+// Options change what the compiler accepts
+type Options struct {
+	// Accept the legacy exception handling instructions (try, catch, catch_all, delegate and rethrow)
+	LegacyExceptions bool
+	// Run the peephole optimizer before encoding (see Optimize)
+	Optimize bool
+	// Remove the functions, globals and types that are never used (see EliminateDeadCode)
+	EliminateDeadCode bool
+}
+
+type builder struct {
+	module  *types.Module
+	options Options
+	// $id -> index, for every index space
+	names map[string]map[string]uint32
+	// export names must be unique
+	exportNames map[string]bool
+	// Index spaces that already have a definition, imports can not come after them
+	defined map[string]bool
+	// The $ids of the fields of every struct type (fields have their own index space in each struct)
+	fields map[uint32]map[string]uint32
+}
+
+func Build(ast []types.AstNode) (*types.Module, error) {
+	return BuildWithOptions(ast, Options{})
+}
+
+func BuildWithOptions(ast []types.AstNode, options Options) (*types.Module, error) {
+	b := &builder{
+		module:      &types.Module{},
+		options:     options,
+		names:       map[string]map[string]uint32{},
+		exportNames: map[string]bool{},
+		defined:     map[string]bool{},
+		fields:      map[uint32]map[string]uint32{},
+	}
+
+	fields, err := moduleFields(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	// First we give an index to every definition,
+	// so that a field can reference a field that comes after it
+	// e.g. a function that calls a function defined later
+	counts := map[string]uint32{}
+	for _, field := range fields {
+		space := keyword(field)
+		definition := field
+
+		// (import "module" "name" (func $id ...)) defines a function
+		if space == "import" && len(field.Children) == 4 {
+			definition = field.Children[3]
+			space = keyword(definition)
+		}
+
+		// (rec (type $a ...) (type $b ...)) defines several types
+		if space == "rec" {
+			for _, definition := range field.Children[1:] {
+				if id := optionalId(definition); id != "" {
+					if err := b.declare(definition, typeSpace, id, counts[typeSpace]); err != nil {
+						return nil, err
+					}
+				}
+				counts[typeSpace]++
+			}
+			continue
+		}
+
+		switch space {
+		case typeSpace, funcSpace, tableSpace, memorySpace, globalSpace, elemSpace, dataSpace, tagSpace:
+			if id := optionalId(definition); id != "" {
+				if err := b.declare(field, space, id, counts[space]); err != nil {
+					return nil, err
+				}
+			}
+			counts[space]++
+
+			// (table funcref (elem ...)) defines an elem segment too
+			if space == tableSpace && hasList(field, "elem") {
+				counts[elemSpace]++
+			}
+		}
+	}
+
+	// The type definitions come first, the types that functions
+	// declare inline are appended after them (see typeUse)
+	for _, field := range fields {
+		switch keyword(field) {
+		case "type":
+			err = b.buildType(field, 1)
+		case "rec":
+			err = b.buildRec(field)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Then we build the rest
+	for _, field := range fields {
+		switch keyword(field) {
+		case "type", "rec":
+			// already built
+		case "func":
+			err = b.buildFunc(field)
+		case "table":
+			err = b.buildTable(field)
+		case "memory":
+			err = b.buildMemory(field)
+		case "global":
+			err = b.buildGlobal(field)
+		case "tag":
+			err = b.buildTag(field)
+		case "import":
+			err = b.buildImport(field)
+		case "export":
+			err = b.buildExport(field)
+		case "elem":
+			err = b.buildElem(field)
+		case "data":
+			err = b.buildData(field)
+		case "start":
+			err = b.buildStart(field)
+		default:
+			err = nodeError(field, "unknown module field %s", describe(field))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.module, nil
+}
+
+// The fields are usually wrapped in (module $name? ...)
+// but the module can also be omitted
+// See https://webassembly.github.io/spec/core/text/modules.html#text-module
+func moduleFields(ast []types.AstNode) ([]types.AstNode, error) {
+	if len(ast) == 1 && keyword(ast[0]) == "module" {
+		fields := ast[0].Children[1:]
+		if len(fields) > 0 && fields[0].Type == texts.Id {
+			fields = fields[1:]
+		}
+		ast = fields
+	}
+
+	for _, field := range ast {
+		if field.Type != texts.ListNode {
+			return nil, nodeError(field, "unexpected %s, a module field was expected", describe(field))
+		}
+	}
+	return ast, nil
+}
+
+func (b *builder) declare(node types.AstNode, space string, id string, index uint32) error {
+	if b.names[space] == nil {
+		b.names[space] = map[string]uint32{}
+	}
+	if _, exists := b.names[space][id]; exists {
+		return nodeError(node, "duplicate %s %s", space, id)
+	}
+	b.names[space][id] = index
+	return nil
+}
+
+// resolve turns a reference (an index or an $id) into an index
+func (b *builder) resolve(node types.AstNode, space string) (uint32, error) {
+	switch node.Type {
+	case texts.Number:
+		index, err := parseUnsigned(node.Value, 32)
+		if err != nil {
+			return 0, nodeError(node, "%v", err)
+		}
+		return uint32(index), nil
+	case texts.Id:
+		index, ok := b.names[space][node.Value]
+		if !ok {
+			return 0, nodeError(node, "unknown %s %s", space, node.Value)
+		}
+		return index, nil
+	}
+	return 0, nodeError(node, "unexpected %s, a %s index was expected", describe(node), space)
+}
+
+// Inline exports (export "name") can be attached to any definition
+// (func $add (export "add") ...) is a shortcut for (func $add ...) (export "add" (func $add))
+// See https://webassembly.github.io/spec/core/text/modules.html#text-func-abbrev
+func (b *builder) inlineExports(c *cursor, kind string, index uint32) error {
+	for c.isList("export") {
+		export := c.next()
+		if len(export.Children) != 2 || export.Children[1].Type != texts.TypeLiteral {
+			return nodeError(*export, "expected (export \"name\")")
+		}
+		if err := b.addExport(export.Children[1], kind, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builder) addExport(name types.AstNode, kind string, index uint32) error {
+	decoded, err := decodeName(name.Value)
+	if err != nil {
+		return nodeError(name, "%v", err)
+	}
+	if b.exportNames[decoded] {
+		return nodeError(name, "duplicate export %s", name.Value)
+	}
+	b.exportNames[decoded] = true
+
+	b.module.Exports = append(b.module.Exports, types.Export{
+		Name:  decoded,
+		Kind:  defaults.ExportSection[exportKinds[kind]],
+		Index: index,
+	})
+	return nil
+}
+
+// Index spaces to the keys of defaults.ExportSection
+var exportKinds = map[string]string{
+	funcSpace:   "func",
+	tableSpace:  "table",
+	memorySpace: "mem",
+	globalSpace: "global",
+	tagSpace:    "tag",
+}
+
+// (import "module" "name" (func $id? typeuse))
+// (import "module" "name" (table $id? min max? reftype))
+// (import "module" "name" (memory $id? min max?))
+// (import "module" "name" (global $id? type))
+// (import "module" "name" (tag $id? typeuse))
+// It is the same as the inline import (func $id? (import "module" "name") typeuse)
+// See https://webassembly.github.io/spec/core/text/modules.html#imports
+func (b *builder) buildImport(field types.AstNode) error {
+	if len(field.Children) != 4 || field.Children[1].Type != texts.TypeLiteral || field.Children[2].Type != texts.TypeLiteral {
+		return nodeError(field, "expected (import \"module\" \"name\" (kind ...))")
+	}
+
+	description := field.Children[3]
+	if _, ok := exportKinds[keyword(description)]; !ok {
+		return nodeError(description, "expected (func ...), (table ...), (memory ...), (global ...) or (tag ...)")
+	}
+	if hasList(description, "export") || hasList(description, "import") {
+		return nodeError(description, "unexpected inline export or import in an import")
+	}
+
+	// Rewrite it as an inline import, after the $id
+	children := []types.AstNode{description.Children[0]}
+	rest := description.Children[1:]
+	if len(rest) > 0 && rest[0].Type == texts.Id {
+		children = append(children, rest[0])
+		rest = rest[1:]
+	}
+	inline := types.AstNode{Type: texts.ListNode, Children: field.Children[:3], Line: field.Line, Column: field.Column}
+	children = append(append(children, inline), rest...)
+	description = types.AstNode{Type: texts.ListNode, Children: children, Line: description.Line, Column: description.Column}
+
+	switch keyword(description) {
+	case "func":
+		return b.buildFunc(description)
+	case "table":
+		return b.buildTable(description)
+	case "memory":
+		return b.buildMemory(description)
+	case "global":
+		return b.buildGlobal(description)
+	}
+	return b.buildTag(description)
+}
+
+// Inline imports (import "module" "name") come after the inline exports
+// Imports must come before the definitions of the same kind
+// so that the imported ones take the first indices
+func (b *builder) inlineImport(c *cursor, space string) (*types.Import, error) {
+	if !c.isList("import") {
+		b.defined[space] = true
+		return nil, nil
+	}
+
+	list := c.next()
+	if len(list.Children) != 3 || list.Children[1].Type != texts.TypeLiteral || list.Children[2].Type != texts.TypeLiteral {
+		return nil, nodeError(*list, "expected (import \"module\" \"name\")")
+	}
+	if b.defined[space] {
+		return nil, nodeError(*list, "import after %s definition", space)
+	}
+
+	module, err := decodeName(list.Children[1].Value)
+	if err != nil {
+		return nil, nodeError(list.Children[1], "%v", err)
+	}
+	name, err := decodeName(list.Children[2].Value)
+	if err != nil {
+		return nil, nodeError(list.Children[2], "%v", err)
+	}
+	return &types.Import{Module: module, Name: name}, nil
+}
+
+// (func $id? (export "name")* (param ...)* (result ...)* (local ...)* instructions*)
+// See https://webassembly.github.io/spec/core/text/modules.html#functions
+func (b *builder) buildFunc(field types.AstNode) error {
+	c := newCursor(field)
+	index := uint32(len(b.module.Funcs))
+	fn := types.Func{Name: c.id()}
+
+	if err := b.inlineExports(c, funcSpace, index); err != nil {
+		return err
+	}
+	imported, err := b.inlineImport(c, funcSpace)
+	if err != nil {
+		return err
+	}
+
+	// Params and locals share the same index space
+	// See https://webassembly.github.io/spec/core/syntax/modules.html#syntax-local
+	locals := map[string]uint32{}
+	typeIndex, funcType, err := b.typeUse(c, locals)
+	if err != nil {
+		return err
+	}
+	fn.Type = typeIndex
+
+	// Imported functions are only a signature
+	if imported != nil {
+		if !c.done() {
+			return nodeError(*c.peek(), "unexpected %s in an imported function", describe(*c.peek()))
+		}
+		fn.Import = imported
+		b.module.Funcs = append(b.module.Funcs, fn)
+		return nil
+	}
+
+	fn.Locals = []types.ValueType{}
+	for c.isList("local") {
+		values, err := b.valueTypes(*c.next(), locals, len(funcType.Params)+len(fn.Locals))
+		if err != nil {
+			return err
+		}
+		fn.Locals = append(fn.Locals, values...)
+	}
+
+	body, err := b.parseBody(c.rest(), &context{locals: locals})
+	if err != nil {
+		return err
+	}
+	fn.Body = body
+
+	b.module.Funcs = append(b.module.Funcs, fn)
+	return nil
+}
+
+// (type $id? (func (param ...)* (result ...)*))
+// and with the GC proposal
+// (type $id? (struct (field $id? (mut valtype))*)), (type $id? (array (mut valtype)))
+// (type $id? (sub final? $super* composite)) for the types that can be extended (or that extend another one)
+// See https://webassembly.github.io/gc/core/text/modules.html#type-definitions
+func (b *builder) buildType(field types.AstNode, rec int) error {
+	c := newCursor(field)
+	c.id()
+	index := uint32(len(b.module.Types))
+
+	definition := c.next()
+	if definition == nil || definition.Type != texts.ListNode || !c.done() {
+		return nodeError(field, "expected (type $id? (func ...)), (type $id? (struct ...)), (type $id? (array ...)) or (type $id? (sub ...))")
+	}
+
+	typeDef := types.TypeDef{Final: true, Rec: rec}
+
+	if keyword(*definition) == "sub" {
+		d := newCursor(*definition)
+		typeDef.Final = false
+		if next := d.peek(); next != nil && next.Type == texts.TypeToken && next.Value == "final" {
+			d.next()
+			typeDef.Final = true
+		}
+		for countIndices(d) > 0 {
+			super, err := b.resolve(*d.next(), typeSpace)
+			if err != nil {
+				return err
+			}
+			typeDef.Supers = append(typeDef.Supers, super)
+		}
+		definition = d.next()
+		if definition == nil || !d.done() {
+			return nodeError(field, "expected (sub final? supertype* (func ...))")
+		}
+	}
+
+	d := newCursor(*definition)
+	switch keyword(*definition) {
+	case "func":
+		// Params can be named but the names are not used
+		funcType, err := b.signature(d, map[string]uint32{})
+		if err != nil {
+			return err
+		}
+		typeDef.Kind = types.FuncType
+		typeDef.FunctionType = funcType
+
+	// (field $x i32) names a single field, (field i32 i64) declares several
+	case "struct":
+		typeDef.Kind = types.StructType
+		typeDef.Fields = []types.Field{}
+		names := map[string]uint32{}
+		for d.isList("field") {
+			list := d.next()
+			f := newCursor(*list)
+			if name := f.id(); name != "" {
+				if _, exists := names[name]; exists {
+					return nodeError(*list, "duplicate field %s", name)
+				}
+				if len(list.Children) != 3 {
+					return nodeError(*list, "a named field declares exactly one type")
+				}
+				names[name] = uint32(len(typeDef.Fields))
+			}
+			for !f.done() {
+				fieldType, err := b.fieldType(*f.next())
+				if err != nil {
+					return err
+				}
+				typeDef.Fields = append(typeDef.Fields, fieldType)
+			}
+		}
+		b.fields[index] = names
+
+	// (array (mut i8)) or (array (field (mut i8)))
+	case "array":
+		typeDef.Kind = types.ArrayType
+		element := d.next()
+		if element != nil && keyword(*element) == "field" {
+			f := newCursor(*element)
+			f.id()
+			element = f.next()
+		}
+		if element == nil {
+			return nodeError(*definition, "missing array element type")
+		}
+		fieldType, err := b.fieldType(*element)
+		if err != nil {
+			return err
+		}
+		typeDef.Fields = []types.Field{fieldType}
+
+	default:
+		return nodeError(*definition, "unexpected %s, expected (func ...), (struct ...) or (array ...)", describe(*definition))
+	}
+
+	if !d.done() {
+		return nodeError(*d.peek(), "unexpected %s", describe(*d.peek()))
+	}
+
+	b.module.Types = append(b.module.Types, typeDef)
+	return nil
+}
+
+// (rec (type ...)*)
+// The types of a group can reference each other (e.g. a list whose next field is a list)
+// See https://webassembly.github.io/gc/core/text/modules.html#type-definitions
+func (b *builder) buildRec(field types.AstNode) error {
+	definitions := field.Children[1:]
+	for i, definition := range definitions {
+		if keyword(definition) != "type" {
+			return nodeError(definition, "unexpected %s, expected (type ...)", describe(definition))
+		}
+		rec := 0
+		if i == 0 {
+			rec = len(definitions)
+		}
+		if err := b.buildType(definition, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A field type: a value type or a packed type (i8, i16), (mut ...) if it can be changed
+func (b *builder) fieldType(node types.AstNode) (types.Field, error) {
+	field := types.Field{}
+	if keyword(node) == "mut" {
+		if len(node.Children) != 2 {
+			return field, nodeError(node, "expected (mut storagetype)")
+		}
+		field.Mutable = true
+		node = node.Children[1]
+	}
+
+	if packed, ok := types.PackedType[node.Value]; ok && node.Type != texts.ListNode {
+		field.Type = types.ValueType(packed.(int))
+		return field, nil
+	}
+	value, err := b.valueType(node)
+	field.Type = value
+	return field, err
+}
+
+// Fields are referenced by index or by their $id in the struct type
+func (b *builder) fieldIndex(typeIndex uint32, node types.AstNode) (uint32, error) {
+	if node.Type != texts.Id {
+		return b.resolve(node, "field")
+	}
+	index, ok := b.fields[typeIndex][node.Value]
+	if !ok {
+		return 0, nodeError(node, "unknown field %s", node.Value)
+	}
+	return index, nil
+}
+
+// Type use
+// A function (or call_indirect) references its type with (type $t)
+// and/or declares it inline with (param ...) and (result ...)
+//   - (type $t) alone uses the type $t
+//   - (type $t) (param ...) (result ...) uses $t, the inline declaration must match it
+//   - (param ...) (result ...) alone uses the first identical type,
+//     if there is none it is added at the end of the types
+//
+// See https://webassembly.github.io/spec/core/text/modules.html#type-uses
+func (b *builder) typeUse(c *cursor, locals map[string]uint32) (uint32, types.FunctionType, error) {
+	index, funcType, explicit, err := b.optionalTypeUse(c, locals)
+	if err != nil || explicit {
+		return index, funcType, err
+	}
+	return b.typeIndex(funcType), funcType, nil
+}
+
+// optionalTypeUse reads a type use without adding the implicit type
+// it reports whether the type was referenced with (type $t)
+func (b *builder) optionalTypeUse(c *cursor, locals map[string]uint32) (uint32, types.FunctionType, bool, error) {
+	var reference *types.AstNode
+	if c.isList("type") {
+		reference = c.next()
+	}
+
+	inline, err := b.signature(c, locals)
+	if err != nil || reference == nil {
+		return 0, inline, false, err
+	}
+
+	if len(reference.Children) != 2 {
+		return 0, inline, false, nodeError(*reference, "expected (type index)")
+	}
+	index, err := b.resolve(reference.Children[1], typeSpace)
+	if err != nil {
+		return 0, inline, false, err
+	}
+	if int(index) >= len(b.module.Types) {
+		return 0, inline, false, nodeError(reference.Children[1], "unknown type %s", reference.Children[1].Value)
+	}
+	if b.module.Types[index].Kind != types.FuncType {
+		return 0, inline, false, nodeError(reference.Children[1], "type %s is not a function type", reference.Children[1].Value)
+	}
+	funcType := b.module.Types[index].FunctionType
+
+	declared := len(inline.Params) > 0 || len(inline.Results) > 0
+	if declared && !(sameValueTypes(inline.Params, funcType.Params) && sameValueTypes(inline.Results, funcType.Results)) {
+		return 0, inline, false, nodeError(*reference, "inline function type does not match type %s", reference.Children[1].Value)
+	}
+	return index, funcType, true, nil
+}
+
+// signature reads (param ...)* (result ...)*
+// Named params are added to the locals map (if any)
+func (b *builder) signature(c *cursor, locals map[string]uint32) (types.FunctionType, error) {
+	funcType := types.FunctionType{Params: []types.ValueType{}, Results: []types.ValueType{}}
+
+	for c.isList("param") {
+		params, err := b.valueTypes(*c.next(), locals, len(funcType.Params))
+		if err != nil {
+			return funcType, err
+		}
+		funcType.Params = append(funcType.Params, params...)
+	}
+
+	for c.isList("result") {
+		results, err := b.valueTypes(*c.next(), nil, 0)
+		if err != nil {
+			return funcType, err
+		}
+		funcType.Results = append(funcType.Results, results...)
+	}
+
+	return funcType, nil
+}
+
+// Reuse an identical function type or add a new one
+// (only a final function type outside of a rec group is identical, the others are distinct types)
+func (b *builder) typeIndex(funcType types.FunctionType) uint32 {
+	for i, t := range b.module.Types {
+		if t.Kind != types.FuncType || !t.Final || len(t.Supers) > 0 || t.Rec != 1 {
+			continue
+		}
+		if sameValueTypes(t.Params, funcType.Params) && sameValueTypes(t.Results, funcType.Results) {
+			return uint32(i)
+		}
+	}
+	b.module.Types = append(b.module.Types, types.TypeDef{Kind: types.FuncType, FunctionType: funcType, Final: true, Rec: 1})
+	return uint32(len(b.module.Types) - 1)
+}
+
+func sameValueTypes(a, b []types.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// valueTypes reads (param i32 i64), (param $name i32), (result i32), (local $x i32)...
+// Named params and locals are added to the locals map
+func (b *builder) valueTypes(list types.AstNode, locals map[string]uint32, firstIndex int) ([]types.ValueType, error) {
+	children := list.Children[1:]
+
+	if len(children) > 0 && children[0].Type == texts.Id {
+		if locals == nil {
+			return nil, nodeError(children[0], "unexpected %s", children[0].Value)
+		}
+		if len(children) != 2 {
+			return nil, nodeError(list, "a named %s declares exactly one type", keyword(list))
+		}
+		if _, exists := locals[children[0].Value]; exists {
+			return nil, nodeError(children[0], "duplicate local %s", children[0].Value)
+		}
+		locals[children[0].Value] = uint32(firstIndex)
+		children = children[1:]
+	}
+
+	values := []types.ValueType{}
+	for _, child := range children {
+		value, err := b.valueType(child)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (b *builder) valueType(node types.AstNode) (types.ValueType, error) {
+	if keyword(node) == "ref" {
+		return b.reference(node)
+	}
+	value, ok := types.ValType[node.Value]
+	if node.Type == texts.ListNode || !ok {
+		return 0, nodeError(node, "unexpected %s, a value type was expected", describe(node))
+	}
+	return types.ValueType(value.(int)), nil
+}
+
+// (ref null? heaptype), the heap type is abstract (func, any, struct...) or a type of the module ($t)
+// See https://webassembly.github.io/gc/core/text/types.html#reference-types
+func (b *builder) reference(node types.AstNode) (types.ValueType, error) {
+	c := newCursor(node)
+	nullable := false
+	if next := c.peek(); next != nil && next.Type == texts.TypeToken && next.Value == "null" {
+		c.next()
+		nullable = true
+	}
+
+	heap := c.next()
+	if heap == nil || !c.done() {
+		return 0, nodeError(node, "expected (ref null? heaptype)")
+	}
+	heapType, err := b.heapType(*heap)
+	if err != nil {
+		return 0, err
+	}
+	return types.Ref(heapType, nullable), nil
+}
+
+func (b *builder) heapType(node types.AstNode) (int, error) {
+	if node.Type == texts.Id || node.Type == texts.Number {
+		index, err := b.resolve(node, typeSpace)
+		return types.ConcreteHeap(index), err
+	}
+	heapType, ok := types.HeapType[node.Value]
+	if node.Type == texts.ListNode || !ok {
+		return 0, nodeError(node, "unexpected %s, a heap type was expected", describe(node))
+	}
+	return heapType.(int), nil
+}
+
+// (table $id? (export "name")* min max? funcref)
+// See https://webassembly.github.io/spec/core/text/modules.html#tables
+func (b *builder) buildTable(field types.AstNode) error {
+	c := newCursor(field)
+	index := uint32(len(b.module.Tables))
+	table := types.Table{Name: c.id()}
+
+	if err := b.inlineExports(c, tableSpace, index); err != nil {
+		return err
+	}
+	imported, err := b.inlineImport(c, tableSpace)
+	if err != nil {
+		return err
+	}
+	table.Import = imported
+
+	// (table reftype (elem ...)) declares a table just big enough for the elements
+	// See https://webassembly.github.io/spec/core/text/modules.html#text-table-abbrev
+	if next := c.peek(); next != nil && next.Type != texts.Number && imported == nil {
+		elemType, err := b.refType(*c.next())
+		if err != nil {
+			return err
+		}
+		table.ElemType = elemType
+
+		if !c.isList("elem") {
+			return nodeError(field, "missing table limits")
+		}
+		list := c.next()
+		elem := types.Elem{Mode: types.SegmentActive, Table: index, Type: elemType}
+		elem.Offset = []types.Instruction{{Name: "i32.const", Immediates: []interface{}{int32(0)}}}
+		if err := b.elemList(newCursor(*list), &elem, true); err != nil {
+			return err
+		}
+
+		size := uint64(len(elem.Funcs) + len(elem.Exprs))
+		table.Limits = types.Limits{Min: size, Max: size, HasMax: true}
+		b.module.Tables = append(b.module.Tables, table)
+		b.module.Elems = append(b.module.Elems, elem)
+		return nil
+	}
+
+	limits, err := parseLimits(c, field, 32)
+	if err != nil {
+		return err
+	}
+	table.Limits = limits
+
+	elemType := c.next()
+	if elemType == nil {
+		return nodeError(field, "missing table element type")
+	}
+	value, err := b.refType(*elemType)
+	if err != nil {
+		return err
+	}
+	table.ElemType = value
+
+	if !c.done() {
+		return nodeError(*c.peek(), "unexpected %s", describe(*c.peek()))
+	}
+
+	b.module.Tables = append(b.module.Tables, table)
+	return nil
+}
+
+func (b *builder) refType(node types.AstNode) (types.ValueType, error) {
+	if keyword(node) == "ref" {
+		return b.reference(node)
+	}
+	value, ok := types.RefType[node.Value]
+	if node.Type == texts.ListNode || !ok {
+		return 0, nodeError(node, "unexpected %s, a reference type was expected", describe(node))
+	}
+	return types.ValueType(value.(int)), nil
+}
+
+// (memory $id? (export "name")* i64? min max? shared?)
+// See https://webassembly.github.io/spec/core/text/modules.html#memories
+func (b *builder) buildMemory(field types.AstNode) error {
+	c := newCursor(field)
+	index := uint32(len(b.module.Memories))
+	memory := types.Memory{Name: c.id()}
+
+	if err := b.inlineExports(c, memorySpace, index); err != nil {
+		return err
+	}
+	imported, err := b.inlineImport(c, memorySpace)
+	if err != nil {
+		return err
+	}
+	memory.Import = imported
+
+	// The index type: i32 (the default) or i64 for 64 bit addresses
+	// See https://github.com/WebAssembly/memory64/blob/main/proposals/memory64/Overview.md
+	bits := 32
+	if next := c.peek(); next != nil && next.Type == texts.TypeNum && (next.Value == "i32" || next.Value == "i64") {
+		if c.next().Value == "i64" {
+			bits = 64
+		}
+	}
+
+	limits, err := parseLimits(c, field, bits)
+	if err != nil {
+		return err
+	}
+	memory.Limits = limits
+	memory.Limits.Is64 = bits == 64
+
+	// (memory 1 10 shared)
+	if next := c.peek(); next != nil && next.Type == texts.TypeToken && next.Value == "shared" {
+		c.next()
+		memory.Limits.Shared = true
+	}
+
+	if !c.done() {
+		return nodeError(*c.peek(), "unexpected %s", describe(*c.peek()))
+	}
+
+	b.module.Memories = append(b.module.Memories, memory)
+	return nil
+}
+
+// min max? (u32 numbers, u64 for the memories with 64 bit addresses)
+// See https://webassembly.github.io/spec/core/text/types.html#limits
+func parseLimits(c *cursor, field types.AstNode, bits int) (types.Limits, error) {
+	limits := types.Limits{}
+
+	min := c.next()
+	if min == nil || min.Type != texts.Number {
+		return limits, nodeError(field, "missing limits")
+	}
+	value, err := parseUnsigned(min.Value, bits)
+	if err != nil {
+		return limits, nodeError(*min, "%v", err)
+	}
+	limits.Min = value
+
+	if max := c.peek(); max != nil && max.Type == texts.Number {
+		c.next()
+		value, err := parseUnsigned(max.Value, bits)
+		if err != nil {
+			return limits, nodeError(*max, "%v", err)
+		}
+		limits.Max = value
+		limits.HasMax = true
+
+		if limits.Max < limits.Min {
+			return limits, nodeError(*max, "size minimum must not be greater than maximum")
+		}
+	}
+
+	return limits, nil
+}
+
+// (global $id? (export "name")* i32 expression) or (global $id? (mut i32) expression)
+// See https://webassembly.github.io/spec/core/text/modules.html#globals
+func (b *builder) buildGlobal(field types.AstNode) error {
+	c := newCursor(field)
+	index := uint32(len(b.module.Globals))
+	global := types.Global{Name: c.id()}
+
+	if err := b.inlineExports(c, globalSpace, index); err != nil {
+		return err
+	}
+	imported, err := b.inlineImport(c, globalSpace)
+	if err != nil {
+		return err
+	}
+	global.Import = imported
+
+	globalType := c.next()
+	if globalType == nil {
+		return nodeError(field, "missing global type")
+	}
+	if keyword(*globalType) == "mut" {
+		if len(globalType.Children) != 2 {
+			return nodeError(*globalType, "expected (mut valtype)")
+		}
+		global.Mutable = true
+		globalType = &globalType.Children[1]
+	}
+
+	value, err := b.valueType(*globalType)
+	if err != nil {
+		return err
+	}
+	global.Type = value
+
+	// Imported globals are initialized by the host
+	if imported != nil {
+		if !c.done() {
+			return nodeError(*c.peek(), "unexpected %s in an imported global", describe(*c.peek()))
+		}
+		b.module.Globals = append(b.module.Globals, global)
+		return nil
+	}
+
+	init, err := b.parseBody(c.rest(), &context{})
+	if err != nil {
+		return err
+	}
+	global.Init = init
+
+	b.module.Globals = append(b.module.Globals, global)
+	return nil
+}
+
+// (tag $id? (export "name")* (import "module" "name")? typeuse)
+// A tag is the signature of an exception: the params are the values it carries
+// See https://webassembly.github.io/exception-handling/core/text/modules.html#tags
+func (b *builder) buildTag(field types.AstNode) error {
+	c := newCursor(field)
+	index := uint32(len(b.module.Tags))
+	tag := types.Tag{Name: c.id()}
+
+	if err := b.inlineExports(c, tagSpace, index); err != nil {
+		return err
+	}
+	imported, err := b.inlineImport(c, tagSpace)
+	if err != nil {
+		return err
+	}
+	tag.Import = imported
+
+	// Params can be named but the names are not used
+	typeIndex, _, err := b.typeUse(c, map[string]uint32{})
+	if err != nil {
+		return err
+	}
+	tag.Type = typeIndex
+
+	if !c.done() {
+		return nodeError(*c.peek(), "unexpected %s", describe(*c.peek()))
+	}
+
+	b.module.Tags = append(b.module.Tags, tag)
+	return nil
+}
+
+// (export "name" (func $f)), (export "name" (table $t)), (export "name" (memory $m)), (export "name" (global $g)), (export "name" (tag $e))
+// See https://webassembly.github.io/spec/core/text/modules.html#exports
+func (b *builder) buildExport(field types.AstNode) error {
+	if len(field.Children) != 3 || field.Children[1].Type != texts.TypeLiteral || field.Children[2].Type != texts.ListNode {
+		return nodeError(field, "expected (export \"name\" (kind index))")
+	}
+
+	target := field.Children[2]
+	space := keyword(target)
+	if _, ok := exportKinds[space]; !ok || len(target.Children) != 2 {
+		return nodeError(target, "expected (func index), (table index), (memory index), (global index) or (tag index)")
+	}
+
+	index, err := b.resolve(target.Children[1], space)
+	if err != nil {
+		return err
+	}
+
+	return b.addExport(field.Children[1], space, index)
+}
+
+// (start $f)
+// See https://webassembly.github.io/spec/core/text/modules.html#start-function
+func (b *builder) buildStart(field types.AstNode) error {
+	if len(field.Children) != 2 {
+		return nodeError(field, "expected (start funcidx)")
+	}
+	if b.module.Start != nil {
+		return nodeError(field, "multiple start sections")
+	}
+
+	index, err := b.resolve(field.Children[1], funcSpace)
+	if err != nil {
+		return err
+	}
+	b.module.Start = &index
+	return nil
+}
+
+// Active segments say where they go: (memory $m)? or (table $t)?
+// followed by the offset (offset instructions*) or a single folded instruction (i32.const 0)
+// See https://webassembly.github.io/spec/core/text/modules.html#text-data-abbrev
+func (b *builder) segmentTarget(c *cursor, space string) (uint32, []types.Instruction, bool, error) {
+	index := uint32(0)
+	if c.isList(space) {
+		target := c.next()
+		if len(target.Children) != 2 {
+			return 0, nil, false, nodeError(*target, "expected (%s index)", space)
+		}
+		resolved, err := b.resolve(target.Children[1], space)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		index = resolved
+
+		if next := c.peek(); next == nil || next.Type != texts.ListNode {
+			return 0, nil, false, nodeError(*target, "missing offset")
+		}
+	}
+
+	offset := c.peek()
+	if offset == nil || offset.Type != texts.ListNode {
+		return index, nil, false, nil
+	}
+	c.next()
+
+	nodes := []types.AstNode{*offset}
+	if keyword(*offset) == "offset" {
+		nodes = offset.Children[1:]
+	}
+	expression, err := b.parseBody(nodes, &context{})
+	return index, expression, true, err
+}
+
+// (data $id? (memory $m)? (offset ...) "bytes"*) active
+// (data $id? "bytes"*) passive
+// See https://webassembly.github.io/spec/core/text/modules.html#data-segments
+func (b *builder) buildData(field types.AstNode) error {
+	c := newCursor(field)
+	data := types.Data{Name: c.id(), Mode: types.SegmentPassive, Bytes: []byte{}}
+
+	memory, offset, active, err := b.segmentTarget(c, memorySpace)
+	if err != nil {
+		return err
+	}
+	if active {
+		data.Mode = types.SegmentActive
+		data.Memory = memory
+		data.Offset = offset
+	}
+
+	// The bytes can be split in multiple strings
+	for _, node := range c.rest() {
+		if node.Type != texts.TypeLiteral {
+			return nodeError(node, "unexpected %s, a string was expected", describe(node))
+		}
+		bytes, err := decodeString(node.Value)
+		if err != nil {
+			return nodeError(node, "%v", err)
+		}
+		data.Bytes = append(data.Bytes, bytes...)
+	}
+
+	b.module.Datas = append(b.module.Datas, data)
+	return nil
+}
+
+// (elem $id? (table $t)? (offset ...) elements) active
+// (elem $id? elements) passive
+// (elem $id? declare elements) declarative
+// the elements are either functions (func $f*) or expressions of a reference type (funcref (item ...)*)
+// See https://webassembly.github.io/spec/core/text/modules.html#element-segments
+func (b *builder) buildElem(field types.AstNode) error {
+	c := newCursor(field)
+	elem := types.Elem{Name: c.id(), Mode: types.SegmentPassive, Type: types.ValueType(types.RefType["funcref"].(int))}
+
+	// Declarative segments are never copied, they only declare
+	// the functions that can be referenced with ref.func
+	if next := c.peek(); next != nil && next.Type == texts.TypeToken && next.Value == "declare" {
+		c.next()
+		elem.Mode = types.SegmentDeclarative
+	}
+
+	table, offset, active, err := b.segmentTarget(c, tableSpace)
+	if err != nil {
+		return err
+	}
+	if active {
+		elem.Mode = types.SegmentActive
+		elem.Table = table
+		elem.Offset = offset
+	}
+
+	if err := b.elemList(c, &elem, active); err != nil {
+		return err
+	}
+
+	b.module.Elems = append(b.module.Elems, elem)
+	return nil
+}
+
+// elemList reads func $f* or reftype (item instructions*)*
+// The func keyword can be omitted only in the short forms (e.g. (elem (i32.const 0) $f))
+func (b *builder) elemList(c *cursor, elem *types.Elem, short bool) error {
+	next := c.peek()
+	switch {
+	case next != nil && next.Type == texts.TypeToken && next.Value == "func":
+		c.next()
+
+	case next != nil && (next.Type == texts.TypeToken && types.RefType[next.Value] != nil || keyword(*next) == "ref"):
+		elemType, err := b.refType(*c.next())
+		if err != nil {
+			return err
+		}
+		elem.Type = elemType
+		elem.Exprs = [][]types.Instruction{}
+
+		// (item instructions*) or a single folded instruction
+		for _, node := range c.rest() {
+			if node.Type != texts.ListNode {
+				return nodeError(node, "unexpected %s, an element expression was expected", describe(node))
+			}
+			nodes := []types.AstNode{node}
+			if keyword(node) == "item" {
+				nodes = node.Children[1:]
+			}
+			expression, err := b.parseBody(nodes, &context{})
+			if err != nil {
+				return err
+			}
+			elem.Exprs = append(elem.Exprs, expression)
+		}
+		return nil
+
+	// The short form can also contain expressions (e.g. (table funcref (elem (ref.func $f))))
+	case short && next != nil && next.Type == texts.ListNode:
+		elem.Exprs = [][]types.Instruction{}
+		for _, node := range c.rest() {
+			expression, err := b.parseBody([]types.AstNode{node}, &context{})
+			if err != nil {
+				return err
+			}
+			elem.Exprs = append(elem.Exprs, expression)
+		}
+		return nil
+
+	case !short:
+		return nodeError(c.nodes[0], "expected func or a reference type before the elements")
+	}
+
+	elem.Funcs = []uint32{}
+	for _, node := range c.rest() {
+		index, err := b.resolve(node, funcSpace)
+		if err != nil {
+			return err
+		}
+		elem.Funcs = append(elem.Funcs, index)
+	}
+	return nil
+}
+
+// Helpers to walk the AST
+
+// keyword returns the first atom of a list (e.g. func for (func ...))
+func keyword(node types.AstNode) string {
+	if node.Type != texts.ListNode || len(node.Children) == 0 || node.Children[0].Type == texts.ListNode {
+		return ""
+	}
+	return node.Children[0].Value
+}
+
+// hasList reports whether a list contains a list with the keyword
+func hasList(node types.AstNode, k string) bool {
+	for _, child := range node.Children {
+		if keyword(child) == k {
+			return true
+		}
+	}
+	return false
+}
+
+// optionalId returns the $id that follows the keyword of a list (if any)
+func optionalId(node types.AstNode) string {
+	if len(node.Children) > 1 && node.Children[1].Type == texts.Id {
+		return node.Children[1].Value
+	}
+	return ""
+}
+
+func describe(node types.AstNode) string {
+	if node.Type == texts.ListNode {
+		if keyword(node) != "" {
+			return "(" + keyword(node) + " ...)"
+		}
+		return "list"
+	}
+	return node.Value
+}
+
+func nodeError(node types.AstNode, format string, args ...interface{}) error {
+	return fmt.Errorf("%d:%d: %s", node.Line, node.Column, fmt.Sprintf(format, args...))
+}
+
+// cursor reads the children of a list one by one (skipping the keyword)
+type cursor struct {
+	nodes []types.AstNode
+	pos   int
+}
+
+func newCursor(list types.AstNode) *cursor {
+	return &cursor{nodes: list.Children, pos: 1}
+}
+
+func (c *cursor) done() bool {
+	return c.pos >= len(c.nodes)
+}
+
+func (c *cursor) peek() *types.AstNode {
+	if c.done() {
+		return nil
+	}
+	return &c.nodes[c.pos]
+}
+
+func (c *cursor) next() *types.AstNode {
+	node := c.peek()
+	if node != nil {
+		c.pos++
+	}
+	return node
+}
+
+// isList reports whether the next node is a list that starts with one of the keywords
+func (c *cursor) isList(keywords ...string) bool {
+	node := c.peek()
+	if node == nil {
+		return false
+	}
+	for _, k := range keywords {
+		if keyword(*node) == k {
+			return true
+		}
+	}
+	return false
+}
+
+// id consumes the optional $id
+func (c *cursor) id() string {
+	if node := c.peek(); node != nil && node.Type == texts.Id {
+		c.pos++
+		return node.Value
+	}
+	return ""
+}
+
+// rest consumes all the remaining nodes
+func (c *cursor) rest() []types.AstNode {
+	rest := c.nodes[c.pos:]
+	c.pos = len(c.nodes)
+	return rest
+}
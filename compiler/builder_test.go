@@ -0,0 +1,129 @@
+package compiler
+
+import (
+	"bytes"
+	"luna/types"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func built(input string) (*types.Module, error) {
+	ast, err := Parser(Tokenize(input))
+	if err != nil {
+		return nil, err
+	}
+	return BuildWithOptions(ast, Options{})
+}
+
+func TestBuildExports(t *testing.T) {
+	tests := []struct {
+		name, input string
+		want        []types.Export
+	}{
+		{
+			"inline",
+			`(module
+			  (func (export "f"))
+			  (table (export "t") 1 funcref)
+			  (memory (export "m") 1)
+			  (global (export "g") i32 (i32.const 0)))`,
+			[]types.Export{{Name: "f", Kind: 0x00, Index: 0}, {Name: "t", Kind: 0x01, Index: 0}, {Name: "m", Kind: 0x02, Index: 0}, {Name: "g", Kind: 0x03, Index: 0}},
+		},
+		{
+			"top-level",
+			`(module
+			  (func) (table 1 funcref) (memory 1) (global i32 (i32.const 0))
+			  (export "f" (func 0))
+			  (export "t" (table 0))
+			  (export "m" (memory 0))
+			  (export "g" (global 0)))`,
+			[]types.Export{{Name: "f", Kind: 0x00, Index: 0}, {Name: "t", Kind: 0x01, Index: 0}, {Name: "m", Kind: 0x02, Index: 0}, {Name: "g", Kind: 0x03, Index: 0}},
+		},
+		{
+			"more than one inline export",
+			`(module (func (export "a") (export "b")))`,
+			[]types.Export{{Name: "a", Kind: 0x00, Index: 0}, {Name: "b", Kind: 0x00, Index: 0}},
+		},
+		{
+			// the exports follow the order of the module
+			"mixed",
+			`(module (export "second" (func $b)) (func $a (export "first")) (func $b))`,
+			[]types.Export{{Name: "second", Kind: 0x00, Index: 1}, {Name: "first", Kind: 0x00, Index: 0}},
+		},
+		{
+			// the imports come first in every index space
+			"index resolution",
+			`(module
+			  (import "env" "f" (func $imported))
+			  (import "env" "g" (global $h i32))
+			  (func $f)
+			  (global $g (mut i32) (i32.const 0))
+			  (memory $m 1)
+			  (export "f" (func $f))
+			  (export "imported" (func $imported))
+			  (export "g" (global $g))
+			  (export "h" (global 0))
+			  (export "by index" (func 1))
+			  (export "m" (memory $m)))`,
+			[]types.Export{
+				{Name: "f", Kind: 0x00, Index: 1}, {Name: "imported", Kind: 0x00, Index: 0},
+				{Name: "g", Kind: 0x03, Index: 1}, {Name: "h", Kind: 0x03, Index: 0},
+				{Name: "by index", Kind: 0x00, Index: 1}, {Name: "m", Kind: 0x02, Index: 0},
+			},
+		},
+		{
+			"escaped name",
+			`(module (func (export "a\tb\u{1F600}")))`,
+			[]types.Export{{Name: "a\tb\U0001F600", Kind: 0x00, Index: 0}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := built(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.Exports, test.want) {
+				t.Errorf("got %+v\nwant %+v", m.Exports, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildExportErrors(t *testing.T) {
+	tests := []struct {
+		name, input, err string
+	}{
+		{"duplicate inline", `(module (func (export "a")) (func (export "a")))`, "1:43: duplicate export \"a\""},
+		{"duplicate top-level", `(module (func $f) (export "a" (func $f)) (export "a" (func $f)))`, "duplicate export \"a\""},
+		{"duplicate of another kind", `(module (memory (export "a") 1) (func (export "a")))`, "duplicate export \"a\""},
+		{"duplicate escaped", `(module (func (export "a")) (func (export "\61")))`, "duplicate export \"\\61\""},
+		{"unknown id", `(module (export "a" (func $missing)))`, "$missing"},
+		{"index out of range", `(module (func) (export "a" (func 1)))`, "export"},
+		{"unknown kind", `(module (func) (export "a" (type 0)))`, "expected (func index)"},
+		{"name without quotes", `(module (export a (func 0)))`, "unknown keyword \"a\""},
+		{"missing target", `(module (export "a"))`, "expected (export \"name\" (kind index))"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := built(test.input)
+			if err == nil {
+				// the indices are checked by the validator
+				err = Validate(m)
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v, want an error with %q", err, test.err)
+			}
+		})
+	}
+}
+
+// The names are written without their quotes
+func TestAssembleExportSection(t *testing.T) {
+	binary := assembled(t, `(module (func (export "run")) (memory (export "mem") 1))`)
+	section := []byte{0x07, 0x0d, 0x02, 0x03, 'r', 'u', 'n', 0x00, 0x00, 0x03, 'm', 'e', 'm', 0x02, 0x00}
+	if !bytes.Contains(binary, section) {
+		t.Errorf("the export section %x is not in %x", section, binary)
+	}
+}
@@ -1,11 +1,9 @@
 package compiler
 
 import (
-	"log"
 	"luna/defaults"
 	"luna/texts"
 	"luna/types"
-	"strconv"
 )
 
 // A WebAssembly module is organized into sections
@@ -82,30 +80,42 @@ import (
 type sectionData []interface{}
 type Module []interface{}
 
-// Recursively flatten nested arrays/slices
+// Bytes returns the binary of the module
+func (m Module) Bytes() []byte {
+	bytes := make([]byte, len(m))
+	for i, b := range m {
+		bytes[i] = byte(b.(int))
+	}
+	return bytes
+}
+
+// Flatten nested arrays/slices
 // Tried to emulate Javascript's Array.prototype.flat()
+// A stack is used instead of recursion, so big function bodies don't grow the call stack
 func flatten(input sectionData) sectionData {
 	output := sectionData{}
-	recursively(0, input, &output)
-	return output
-}
+	stack := []sectionData{input}
 
-func recursively(index int, input sectionData, output *sectionData) {
-	if index >= len(input) {
-		return
-	}
-	value, ok := input[index].(sectionData)
-	if ok {
-		recursively(0, value, output)
-	} else {
-		*output = append((*output), input[index])
-	}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if len(top) == 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		stack[len(stack)-1] = top[1:]
 
-	recursively(index+1, input, output)
+		if nested, ok := top[0].(sectionData); ok {
+			stack = append(stack, nested)
+			continue
+		}
+		output = append(output, top[0])
+	}
+	return output
 }
 
+// A section is its id followed by the size (in bytes) of its content
 func createSection(secType interface{}, data sectionData) sectionData {
-	encodeData := encodeVector(data)
+	encodeData := encodeVector(flatten(data))
 
 	section := sectionData{}
 	section = append(section, secType)
@@ -114,12 +124,13 @@ func createSection(secType interface{}, data sectionData) sectionData {
 }
 
 // Encode vectors
-func encodeVector(data sectionData) []interface{} {
-	encoded := EncodeUnsignedLEB128(uint(len(data)))
+// The length is the number of elements: every nested sectionData counts as one element
+func encodeVector(data sectionData) sectionData {
+	encoded := EncodeUnsignedLEB128(uint64(len(data)))
 	newEncode := sectionData{}
 
 	for _, v := range encoded {
-		newEncode = append(newEncode, interface{}(v))
+		newEncode = append(newEncode, interface{}(int(v)))
 	}
 	vector := sectionData{}
 
@@ -129,191 +140,620 @@ func encodeVector(data sectionData) []interface{} {
 }
 
 func omologateEncoded(num uint) sectionData {
+	return omologateEncoded64(uint64(num))
+}
+
+// Memory64 addresses, offsets and limits do not fit in 32 bits
+func omologateEncoded64(num uint64) sectionData {
 	encodedLocalZero := EncodeUnsignedLEB128(num)
 	tmp := sectionData{}
 	for _, v := range encodedLocalZero {
+		tmp = append(tmp, interface{}(int(v)))
+	}
+	return tmp
+}
+
+func omologateSigned(num int64) sectionData {
+	encoded := EncodeSignedLEB128(num)
+	tmp := sectionData{}
+	for _, v := range encoded {
 		tmp = append(tmp, interface{}(v))
 	}
 	return tmp
 }
 
 // So let's start building our compiler
-func Compile(ast []types.AstNode) Module {
+// The AST becomes a types.Module (see Build) that is validated and then assembled into the binary
+func Compile(ast []types.AstNode) (Module, error) {
+	return CompileWithOptions(ast, Options{})
+}
 
-	var module = Module{}
+func CompileWithOptions(ast []types.AstNode, options Options) (Module, error) {
+	module, err := BuildWithOptions(ast, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := Validate(module); err != nil {
+		return nil, err
+	}
+	if options.EliminateDeadCode {
+		EliminateDeadCode(module)
+	}
+	if options.Optimize {
+		Optimize(module)
+	}
+	return Assemble(module), nil
+}
+
+// Assemble encodes a module into the binary format
+// Sections are emitted in the order required by the specification and empty sections are omitted
+// See https://webassembly.github.io/spec/core/binary/modules.html#binary-module
+func Assemble(m *types.Module) Module {
+	return assemble(m, nil)
+}
+
+// assemble encodes a module, or a relocatable object when o is not nil (see AssembleObject)
+func assemble(m *types.Module, o *object) Module {
 	// The final module array should resemble
 	// [
 	// 	MAGIC,
 	// 	VERSION,
 	//	SECTION_TYPE (1),
-	// 	FUNCTION_TYPE (0),
+	//	SECTION_IMPORT (2),
 	//	SECTION_FUNCTION (3),
+	//	SECTION_TABLE (4),
+	//	SECTION_MEMORY (5),
+	//	SECTION_TAG (13),
+	//	SECTION_GLOBAL (6),
 	// 	SECTION_EXPORT (7),
+	//	SECTION_START (8),
+	//	SECTION_ELEM (9),
+	//	SECTION_DATA_COUNT (12),
 	// 	SECTION_CODE (10),
-	// 	FUNCTION_BODY (0),
+	//	SECTION_DATA (11),
 	// ]
+	var module = Module{}
 
-	var SECTION_TYPE = sectionData{}
-	var SECTION_FUNCTION = sectionData{}
-	var SECTION_EXPORT = sectionData{}
-	var SECTION_CODE = sectionData{}
-
-	functionType := sectionData{}
-	exportData := sectionData{}
-	functionBody := sectionData{}
-	code := sectionData{}
-
-	for index, node := range ast {
-		switch node.Type {
-		case texts.ModuleStatement:
-			// MAGIC and VERSION don't change until a newer version of WebAssembly gets released
-			module = append(module, defaults.MAGIC...)
-			module = append(module, defaults.VERSION...)
-
-			// if the module is empty return
-			if node.Expression.Value == nil {
-				return module
-			}
+	// MAGIC and VERSION don't change until a newer version of WebAssembly gets released
+	module = append(module, defaults.MAGIC...)
+	module = append(module, defaults.VERSION...)
 
-		case texts.FuncStatement:
-			// num of types (i32, f32, i64, f64) inside the function
-			functionType = append(functionType, sectionData{0x01}...)
+	// The relocations point to a section by its position
+	sections := 0
+	addSection := func(name string, entries sectionData) {
+		if len(entries) == 0 {
+			return
+		}
+		module = append(module, createSection(defaults.Section[name], encodeVector(entries))...)
+		sections++
+	}
+
+	// Type Section
+	// The type section has the id 1. It decodes into a vector of function types that represent the  component of a module.
+	// Function types classify the signature of functions, mapping a vector of parameters to a vector of results.
+	// See https://webassembly.github.io/spec/core/binary/modules.html#type-section
+	//
+	// With the GC proposal the vector is made of recursive groups: 0x4e followed by the vector of its types,
+	// a group of a single type is written without it (so the MVP function types are still the same bytes)
+	// See https://webassembly.github.io/gc/core/binary/modules.html#type-section
+	SECTION_TYPE := sectionData{}
+	for i := 0; i < len(m.Types); {
+		rec := m.Types[i].Rec
+		if rec == 1 {
+			SECTION_TYPE = append(SECTION_TYPE, encodeTypeDef(m.Types[i]))
+			i++
+			continue
+		}
+		group := sectionData{}
+		for _, typeDef := range m.Types[i : i+rec] {
+			group = append(group, encodeTypeDef(typeDef))
+		}
+		SECTION_TYPE = append(SECTION_TYPE, sectionData{types.RecType, encodeVector(group)})
+		i += rec
+	}
+	addSection("type", SECTION_TYPE)
+
+	// Import Section
+	// Every import is the name of a module, the name of the item and what the item is:
+	// 0x00 a function (its type index), 0x01 a table, 0x02 a memory, 0x03 a global or 0x04 a tag
+	// the imports of each kind take the first indices of their index space
+	// See https://webassembly.github.io/spec/core/binary/modules.html#import-section
+	SECTION_IMPORT := sectionData{}
+	addImport := func(imported *types.Import, kind string, description ...interface{}) {
+		SECTION_IMPORT = append(SECTION_IMPORT, sectionData{
+			encodeVector(encodeString(imported.Module)),
+			encodeVector(encodeString(imported.Name)),
+			defaults.ExportSection[kind],
+			sectionData(description),
+		})
+	}
+	for _, fn := range m.Funcs {
+		if fn.Import != nil {
+			addImport(fn.Import, "func", omologateEncoded(uint(fn.Type)))
+		}
+	}
+	for _, table := range m.Tables {
+		if table.Import != nil {
+			addImport(table.Import, "table", encodeValueType(table.ElemType), encodeLimits(table.Limits))
+		}
+	}
+	for _, memory := range m.Memories {
+		if memory.Import != nil {
+			addImport(memory.Import, "mem", encodeLimits(memory.Limits))
+		}
+	}
+	for _, global := range m.Globals {
+		if global.Import != nil {
+			addImport(global.Import, "global", encodeValueType(global.Type), encodeMutability(global.Mutable))
+		}
+	}
+	for _, tag := range m.Tags {
+		if tag.Import != nil {
+			addImport(tag.Import, "tag", 0x00, omologateEncoded(uint(tag.Type)))
+		}
+	}
+	addSection("import", SECTION_IMPORT)
 
-			// Function types classify the signature of functions, mapping a vector of parameters to a vector of results.
-			functionType = append(functionType, sectionData{types.FuncType}...)
+	// Func Section
+	// The function section has the id 3. It decodes into a vector of type indices that represent the type fields
+	// of the functions in the funcs component of a module.
+	// See https://webassembly.github.io/spec/core/binary/modules.html#function-section
+	SECTION_FUNCTION := sectionData{}
+	for _, fn := range m.Funcs {
+		if fn.Import == nil {
+			SECTION_FUNCTION = append(SECTION_FUNCTION, omologateEncoded(uint(fn.Type)))
+		}
+	}
+	addSection("func", SECTION_FUNCTION)
+
+	// Table Section
+	// See https://webassembly.github.io/spec/core/binary/modules.html#table-section
+	SECTION_TABLE := sectionData{}
+	for _, table := range m.Tables {
+		if table.Import != nil {
+			continue
+		}
+		SECTION_TABLE = append(SECTION_TABLE, sectionData{encodeValueType(table.ElemType), encodeLimits(table.Limits)})
+	}
+	addSection("table", SECTION_TABLE)
+
+	// Memory Section
+	// See https://webassembly.github.io/spec/core/binary/modules.html#memory-section
+	SECTION_MEMORY := sectionData{}
+	for _, memory := range m.Memories {
+		if memory.Import == nil {
+			SECTION_MEMORY = append(SECTION_MEMORY, encodeLimits(memory.Limits))
+		}
+	}
+	addSection("memory", SECTION_MEMORY)
+
+	// Tag Section
+	// A tag is an attribute (0x00, an exception) and the index of its type
+	// See https://webassembly.github.io/exception-handling/core/binary/modules.html#tag-section
+	SECTION_TAG := sectionData{}
+	for _, tag := range m.Tags {
+		if tag.Import == nil {
+			SECTION_TAG = append(SECTION_TAG, sectionData{0x00, omologateEncoded(uint(tag.Type))})
+		}
+	}
+	addSection("tag", SECTION_TAG)
+
+	// Global Section
+	// A global is its type, its mutability (0x00 const, 0x01 var) and the expression that initializes it
+	// See https://webassembly.github.io/spec/core/binary/modules.html#global-section
+	SECTION_GLOBAL := sectionData{}
+	for _, global := range m.Globals {
+		if global.Import == nil {
+			SECTION_GLOBAL = append(SECTION_GLOBAL, sectionData{encodeValueType(global.Type), encodeMutability(global.Mutable), encodeExpression(global.Init)})
+		}
+	}
+	addSection("global", SECTION_GLOBAL)
 
-		case texts.ParamStatement:
-			paramsAlreadyAdded := false
+	// Export Section
+	// The export section has the id 7.
+	// It decodes into a vector of exports that represent the  component of a module.
+	// Every export is a name, the kind of the export and the index of what is exported
+	// See https://webassembly.github.io/spec/core/binary/modules.html#export-section
+	// Objects have no exports, their symbols are exported by the linker (see object.symbolTable)
+	SECTION_EXPORT := sectionData{}
+	for _, export := range m.Exports {
+		if o != nil {
+			break
+		}
+		SECTION_EXPORT = append(SECTION_EXPORT, sectionData{
+			encodeVector(encodeString(export.Name)),
+			export.Kind,
+			omologateEncoded(uint(export.Index)),
+		})
+	}
+	addSection("export", SECTION_EXPORT)
+
+	// Start Section
+	// Just the index of the start function, it is not a vector
+	// See https://webassembly.github.io/spec/core/binary/modules.html#start-section
+	// the start function of an object is an init function
+	if m.Start != nil && o == nil {
+		module = append(module, createSection(defaults.Section["start"], omologateEncoded(uint(*m.Start)))...)
+		sections++
+	}
 
-			value, ok := node.Expression.Value.(string)
-			if !ok {
-				log.Fatal("not a string")
+	// Element Section
+	// Element segments initialize the tables with references
+	// the first byte is a bit field that tells how the segment is encoded
+	// - bit 0: passive or declarative (otherwise active)
+	// - bit 1: active with a table index (otherwise table 0), or declarative (otherwise passive)
+	// - bit 2: the elements are expressions (otherwise function indices)
+	// so 0x00 is an active segment for table 0 with function indices, 0x03 is declarative...
+	// See https://webassembly.github.io/spec/core/binary/modules.html#element-section
+	SECTION_ELEM := sectionData{}
+	for _, elem := range m.Elems {
+		flags := 0
+		elements := sectionData{}
+		// Function indices have an element kind (0x00 for funcref), expressions have a reference type
+		kind := interface{}(0x00)
+
+		if elem.Exprs != nil {
+			flags |= 0x04
+			kind = encodeValueType(elem.Type)
+			for _, expression := range elem.Exprs {
+				elements = append(elements, encodeExpression(expression))
 			}
-			params := sectionData{types.ValType[value]}
-			// Params
-			// Get num of params dynamically
-			for idx, _node := range ast[index+1:] {
-				nextNode := ast[index+(idx+1)]
-
-				if (_node.Type != texts.ParamStatement) && (nextNode.Type != texts.TypeNum32) {
-					// All the parameters were parsed already
-					if idx == 0 {
-						paramsAlreadyAdded = true
-					}
-					break
-				}
+		} else {
+			for _, index := range elem.Funcs {
+				elements = append(elements, omologateEncoded(uint(index)))
+			}
+		}
 
-				params = append(params, sectionData{types.ValType[value]})
+		switch elem.Mode {
+		case types.SegmentPassive:
+			flags |= 0x01
+		case types.SegmentDeclarative:
+			flags |= 0x03
+		default:
+			// Table 0 with funcref elements has a shorter form (without table and element kind)
+			if elem.Table != 0 || elem.Type != types.ValueType(types.RefType["funcref"].(int)) {
+				flags |= 0x02
 			}
+		}
 
-			if paramsAlreadyAdded {
-				continue
+		segment := sectionData{flags}
+		if elem.Mode == types.SegmentActive {
+			if flags&0x02 != 0 {
+				segment = append(segment, omologateEncoded(uint(elem.Table)))
 			}
+			segment = append(segment, encodeExpression(elem.Offset))
+		}
+		if flags&0x03 != 0 {
+			segment = append(segment, kind)
+		}
+		segment = append(segment, encodeVector(elements))
+		SECTION_ELEM = append(SECTION_ELEM, segment)
+	}
+	addSection("elem", SECTION_ELEM)
+
+	// Data Count Section
+	// It is not a vector, just the number of data segments
+	// See https://webassembly.github.io/spec/core/binary/modules.html#data-count-section
+	if len(m.Datas) > 0 {
+		module = append(module, createSection(defaults.Section["datacount"], omologateEncoded(uint(len(m.Datas))))...)
+		sections++
+	}
+
+	// Code section
+	// The code section has the id 10. It decodes into a vector of code entries that are pairs of value type vectors and expressions.
+	// Every entry is prefixed by its size in bytes
+	// See https://webassembly.github.io/spec/core/binary/modules.html#code-section
+	SECTION_CODE := sectionData{}
+	for _, fn := range m.Funcs {
+		if fn.Import != nil || o != nil {
+			continue
+		}
+		functionBodyData := sectionData{encodeLocals(fn.Locals), encodeExpression(fn.Body)}
+		SECTION_CODE = append(SECTION_CODE, encodeVector(flatten(functionBodyData)))
+	}
+	addSection("code", SECTION_CODE)
+	// The code of an object has padded indices, and the relocations that point to them
+	if o != nil {
+		if code := o.code(); code != nil {
+			o.codeSection = sections
+			module = append(module, createSection(defaults.Section["code"], code)...)
+			sections++
+		}
+	}
 
-			functionType = append(functionType, encodeVector(params)...)
+	// Data Section
+	// Data segments initialize the memory with bytes
+	// - 0x00 active (memory 0): offset expression, bytes
+	// - 0x01 passive: bytes
+	// - 0x02 active: memory index, offset expression, bytes
+	// See https://webassembly.github.io/spec/core/binary/modules.html#data-section
+	SECTION_DATA := sectionData{}
+	for _, data := range m.Datas {
+		bytes := encodeVector(encodeString(string(data.Bytes)))
+
+		switch {
+		case data.Mode == types.SegmentPassive:
+			SECTION_DATA = append(SECTION_DATA, sectionData{0x01, bytes})
+		case data.Memory == 0:
+			SECTION_DATA = append(SECTION_DATA, sectionData{0x00, encodeExpression(data.Offset), bytes})
+		default:
+			SECTION_DATA = append(SECTION_DATA, sectionData{0x02, omologateEncoded(uint(data.Memory)), encodeExpression(data.Offset), bytes})
+		}
+	}
+	addSection("data", SECTION_DATA)
 
-		case texts.ResultStatement:
-			value, ok := node.Expression.Value.(string)
-			if !ok {
-				log.Fatal("not a string")
-			}
-			// Result
-			// Currently WebAssembly supports only one returned result
-			functionType = append(functionType, encodeVector(sectionData{
-				types.ValType[value],
-			})...)
-
-		// Instructions
-		// https://webassembly.github.io/spec/core/binary/instructions.html
-		case texts.GetLocalInstruction:
-			var localIndex uint
-			value, ok := node.Expression.Value.(string)
-			if !ok {
-				log.Fatal("Not string")
-			}
+	if o != nil {
+		module = append(module, o.customSections()...)
+	}
+	return module
+}
 
-			v, _ := strconv.Atoi(value)
-			localIndex = uint(v)
+// A type of the type section
+// - a function: 0x60 params results
+// - a struct: 0x5f and the vector of its fields, an array: 0x5e and its field (a field is its type and its mutability)
+// a type that can be extended (or that extends another one) is 0x50, 0x4f if final, followed by the vector of its supertypes
+// See https://webassembly.github.io/gc/core/binary/types.html#composite-types
+func encodeTypeDef(typeDef types.TypeDef) sectionData {
+	composite := sectionData{typeDef.Kind}
+	switch typeDef.Kind {
+	case types.FuncType:
+		composite = append(composite, encodeVector(encodeValueTypes(typeDef.Params)), encodeVector(encodeValueTypes(typeDef.Results)))
+	case types.StructType:
+		fields := sectionData{}
+		for _, field := range typeDef.Fields {
+			fields = append(fields, sectionData{encodeValueType(field.Type), encodeMutability(field.Mutable)})
+		}
+		composite = append(composite, encodeVector(fields))
+	case types.ArrayType:
+		composite = append(composite, encodeValueType(typeDef.Fields[0].Type), encodeMutability(typeDef.Fields[0].Mutable))
+	}
 
-			code = append(code, sectionData{node.MapTo}...)
-			code = append(code, omologateEncoded(localIndex)...)
+	if typeDef.Final && len(typeDef.Supers) == 0 {
+		return composite
+	}
+	sub := types.SubType
+	if typeDef.Final {
+		sub = types.SubFinalType
+	}
+	supers := sectionData{}
+	for _, super := range typeDef.Supers {
+		supers = append(supers, omologateEncoded(uint(super)))
+	}
+	return sectionData{sub, encodeVector(supers), composite}
+}
 
-		// Export section
-		case texts.ExportStatement:
-			value, ok := node.Expression.Value.(string)
-			if !ok {
-				log.Fatal("not a string")
-			}
+func encodeValueTypes(values []types.ValueType) sectionData {
+	encoded := sectionData{}
+	for _, value := range values {
+		encoded = append(encoded, encodeValueType(value))
+	}
+	return encoded
+}
 
-			// Let's build export section
-			encodedString := encodeString(value)
-
-			// number of exports
-			// We only have one export so the number is one
-			exportData = append(exportData, sectionData{0x01}...)
-			exportData = append(exportData, encodeVector(encodedString)...)
-			exportData = append(exportData, sectionData{defaults.ExportSection["func"]}...)
-			// Export type index
-			// We only have one exported function so the index is 0
-			exportData = append(exportData, sectionData{0x00}...)
-
-		// Remember the concept of Stack Machine
-		case texts.FuncInstruction:
-			code = append(code, sectionData{node.MapTo}...)
-
-			// Put all the section code together
-			functionBodyData := sectionData{}
-
-			// Locals declaration count
-			// See https://webassembly.github.io/spec/core/binary/modules.html#code-section:~:text=Local%20declarations
-			functionBodyData = append(functionBodyData, sectionData{0x00}...)
-			functionBodyData = append(functionBodyData, code...)
-			functionBodyData = append(functionBodyData, sectionData{defaults.Opcodes["end"]})
-
-			// Number of functions
-			functionBody = append(functionBody, sectionData{0x01})
-			functionBody = append(functionBody, encodeVector(functionBodyData)...)
-
-		// Internal instructions (e.g. i32.const)
-		case texts.InternalInstruction:
-			var localIndex uint
-			value, ok := node.Expression.Value.(string)
-			if !ok {
-				log.Fatal("Not string")
-			}
+// Value types are a single byte, like the nullable references to an abstract heap type (funcref is 0x70)
+// the other references are 0x63 (ref null) or 0x64 (ref) followed by the heap type
+// See https://webassembly.github.io/gc/core/binary/types.html#reference-types
+func encodeValueType(value types.ValueType) sectionData {
+	if _, concrete := value.TypeIndex(); !value.IsRef() || (value.Nullable() && !concrete) {
+		return sectionData{int(value)}
+	}
+	prefix := types.RefPrefix
+	if value.Nullable() {
+		prefix = types.RefNullPrefix
+	}
+	return sectionData{prefix, encodeHeapType(value.Heap())}
+}
 
-			v, _ := strconv.Atoi(value)
-			localIndex = uint(v)
+// Abstract heap types are their byte, the types of the module are their index as a signed 33 bit integer
+func encodeHeapType(heap int) sectionData {
+	if index, concrete := types.ValueType(heap).TypeIndex(); concrete {
+		return omologateSigned(int64(index))
+	}
+	return sectionData{heap}
+}
 
-			code = append(code, sectionData{node.MapTo}...)
-			code = append(code, omologateEncoded(localIndex)...)
+func encodeMutability(mutable bool) int {
+	if mutable {
+		return 0x01
+	}
+	return 0x00
+}
+
+// Limits: 0x00 min or 0x01 min max
+// See https://webassembly.github.io/spec/core/binary/types.html#limits
+func encodeLimits(limits types.Limits) sectionData {
+	flags := 0x00
+	if limits.HasMax {
+		flags |= 0x01
+	}
+	// Shared memories are 0x03 (they always have a maximum)
+	// See https://webassembly.github.io/threads/core/binary/types.html#limits
+	if limits.Shared {
+		flags |= 0x02
+	}
+	// Memories with 64 bit addresses are 0x04 (0x05 with a maximum, 0x07 if shared)
+	// See https://github.com/WebAssembly/memory64/blob/main/proposals/memory64/Overview.md#binary-format
+	if limits.Is64 {
+		flags |= 0x04
+	}
+
+	encoded := sectionData{flags, omologateEncoded64(limits.Min)}
+	if limits.HasMax {
+		encoded = append(encoded, omologateEncoded64(limits.Max))
+	}
+	return encoded
+}
+
+// Locals declaration
+// Consecutive locals of the same type are compressed into a single (count, type) entry
+// See https://webassembly.github.io/spec/core/binary/modules.html#code-section:~:text=Local%20declarations
+func encodeLocals(locals []types.ValueType) sectionData {
+	groups := sectionData{}
+	for i := 0; i < len(locals); {
+		count := 1
+		for i+count < len(locals) && locals[i+count] == locals[i] {
+			count++
 		}
+		groups = append(groups, sectionData{omologateEncoded(uint(count)), encodeValueType(locals[i])})
+		i += count
+	}
+	return encodeVector(groups)
+}
 
+// An expression is a sequence of instructions terminated by end
+// See https://webassembly.github.io/spec/core/binary/instructions.html#expressions
+func encodeExpression(instructions []types.Instruction) sectionData {
+	expression := sectionData{}
+	for _, instruction := range instructions {
+		expression = append(expression, encodeInstruction(instruction))
 	}
+	return append(expression, defaults.Opcodes["end"])
+}
 
-	// Type Section
-	// The type section has the id 1. It decodes into a vector of function types that represent the  component of a module.
-	// See https://webassembly.github.io/spec/core/binary/modules.html#type-section
-	SECTION_TYPE = createSection(defaults.Section["type"], functionType)
-	// Func Section
-	// The function section has the id 3. It decodes into a vector of type indices that represent the type fields
-	// of the functions in the funcs component of a module.
-	// See https://webassembly.github.io/spec/core/binary/modules.html#function-section
-	SECTION_FUNCTION = createSection(defaults.Section["func"], encodeVector(sectionData{0x00}))
-	// Code section
-	// The code section has the id 10. It decodes into a vector of code entries that are pairs of value type vectors and expressions.
-	// See https://webassembly.github.io/spec/core/binary/modules.html#code-section
-	SECTION_CODE = createSection(defaults.Section["code"], functionBody)
-	// Export Section
-	// The export section has the id 7.
-	// It decodes into a vector of exports that represent the  component of a module.
-	// See https://webassembly.github.io/spec/core/binary/modules.html#export-section
-	SECTION_EXPORT = createSection(defaults.Section["export"], exportData)
+// Instructions
+// The opcode followed by its immediates
+// See https://webassembly.github.io/spec/core/binary/instructions.html
+func encodeInstruction(instruction types.Instruction) sectionData {
+	return encodeInstructionWith(instruction, encodeIndex)
+}
 
-	module = append(module, SECTION_TYPE...)
-	module = append(module, SECTION_FUNCTION...)
-	module = append(module, SECTION_EXPORT...)
-	module = append(module, SECTION_CODE...)
+// Indices are unsigned LEB128, the index of a block type is signed (a positive 33 bit integer)
+// relocatable objects encode them differently (see object.index)
+func encodeIndex(kind string, index uint32) sectionData {
+	if kind == texts.BlockType {
+		return omologateSigned(int64(index))
+	}
+	return omologateEncoded(uint(index))
+}
 
-	return module
+func encodeInstructionWith(instruction types.Instruction, encodeIndex func(kind string, index uint32) sectionData) sectionData {
+	encoded := encodeOpcode(instruction.Name)
+
+	// select with types has its own opcode, followed by the vector of types
+	if instruction.Name == "select" {
+		values := instruction.Immediates[0].([]types.ValueType)
+		if len(values) == 0 {
+			return encoded
+		}
+		return sectionData{defaults.TypedSelect, encodeVector(encodeValueTypes(values))}
+	}
+
+	// br_on_cast $label rt1 rt2
+	if instruction.Name == "br_on_cast" || instruction.Name == "br_on_cast_fail" {
+		flags := 0
+		for i, refType := range instruction.Immediates[1:] {
+			if refType.(types.ValueType).Nullable() {
+				flags |= 1 << i
+			}
+		}
+		encoded = append(encoded, flags)
+	}
+
+	for i, kind := range defaults.Immediates[instruction.Name] {
+		immediate := instruction.Immediates[i]
+
+		switch kind {
+		case texts.LabelIdx, texts.FuncIdx, texts.LocalIdx, texts.TypeIdx, texts.TableIdx, texts.MemIdx, texts.DataIdx, texts.ElemIdx, texts.TagIdx, texts.GlobalIdx, texts.FieldIdx, texts.Count:
+			encoded = append(encoded, encodeIndex(kind, immediate.(uint32)))
+
+		// The vector of the labels, then the default one
+		// See https://webassembly.github.io/spec/core/binary/instructions.html#control-instructions
+		case texts.Labels:
+			labels := immediate.([]uint32)
+			targets := sectionData{}
+			for _, label := range labels[:len(labels)-1] {
+				targets = append(targets, encodeIndex(texts.LabelIdx, label))
+			}
+			encoded = append(encoded, encodeVector(targets), encodeIndex(texts.LabelIdx, labels[len(labels)-1]))
+
+		// Empty block types are 0x40, a single result is its value type
+		// otherwise the type index is encoded as a (positive) signed 33 bit integer
+		case texts.BlockType:
+			blockType := immediate.(types.BlockType)
+			switch {
+			case blockType.HasIndex:
+				encoded = append(encoded, encodeIndex(texts.BlockType, blockType.Index))
+			case len(blockType.Results) == 1:
+				encoded = append(encoded, encodeValueType(blockType.Results[0]))
+			default:
+				encoded = append(encoded, 0x40)
+			}
+
+		case texts.HeapType:
+			encoded = append(encoded, encodeHeapType(immediate.(types.ValueType).Heap()))
+
+		// ref.test and ref.cast have the heap type, they are the next opcode when the reference is nullable
+		// br_on_cast has a byte of flags instead (bit 0 the first type is nullable, bit 1 the second one)
+		// See https://webassembly.github.io/gc/core/binary/instructions.html#reference-instructions
+		case texts.RefType:
+			refType := immediate.(types.ValueType)
+			if i == 0 && refType.Nullable() {
+				encoded = sectionData{defaults.PrefixGC, omologateEncoded(uint(defaults.PrefixedOpcodes[instruction.Name][1] + 1))}
+			}
+			encoded = append(encoded, encodeHeapType(refType.Heap()))
+
+		// A vector of handlers: the kind (0x00 catch, 0x01 catch_ref, 0x02 catch_all, 0x03 catch_all_ref)
+		// the tag (not for catch_all) and the label
+		// See https://webassembly.github.io/exception-handling/core/binary/instructions.html#control-instructions
+		case texts.Catches:
+			handlers := sectionData{}
+			for _, handler := range immediate.([]types.Catch) {
+				encodedHandler := sectionData{handler.Kind}
+				if handler.Kind == types.CatchTag || handler.Kind == types.CatchTagRef {
+					encodedHandler = append(encodedHandler, encodeIndex(texts.TagIdx, handler.Tag))
+				}
+				handlers = append(handlers, append(encodedHandler, encodeIndex(texts.LabelIdx, handler.Label)))
+			}
+			encoded = append(encoded, encodeVector(handlers))
+
+		// The alignment (exponent) and the offset
+		// with multiple memories bit 6 of the alignment says that the memory index follows it
+		// See https://webassembly.github.io/multi-memory/core/binary/instructions.html#memory-instructions
+		case texts.MemArg:
+			memArg := immediate.(types.MemArg)
+			if memArg.Memory == 0 {
+				encoded = append(encoded, omologateEncoded(uint(memArg.Align)), omologateEncoded64(memArg.Offset))
+				break
+			}
+			encoded = append(encoded, omologateEncoded(uint(memArg.Align|0x40)), omologateEncoded(uint(memArg.Memory)), omologateEncoded64(memArg.Offset))
+
+		// Integer constants are always encoded as signed LEB128
+		// See https://webassembly.github.io/spec/core/binary/instructions.html#numeric-instructions
+		case texts.ConstI32:
+			encoded = append(encoded, omologateSigned(int64(immediate.(int32))))
+		case texts.ConstI64:
+			encoded = append(encoded, omologateSigned(immediate.(int64)))
+
+		// Floats are their IEEE 754 bits in little endian
+		case texts.ConstF32:
+			bits := immediate.(uint32)
+			encoded = append(encoded, int(bits&0xff), int(bits>>8&0xff), int(bits>>16&0xff), int(bits>>24))
+		case texts.ConstF64:
+			bits := immediate.(uint64)
+			for i := 0; i < 8; i++ {
+				encoded = append(encoded, int(bits>>(8*i)&0xff))
+			}
+
+		// Lanes are a single byte, not LEB128
+		// See https://webassembly.github.io/spec/core/binary/instructions.html#vector-instructions
+		case texts.LaneIdx:
+			encoded = append(encoded, int(immediate.(uint32)))
+		case texts.Reserved:
+			encoded = append(encoded, 0x00)
+		case texts.V128Const, texts.Shuffle:
+			for _, b := range immediate.([16]byte) {
+				encoded = append(encoded, int(b))
+			}
+		}
+	}
+
+	return encoded
+}
+
+// A single byte or a prefix followed by the opcode as u32
+func encodeOpcode(name string) sectionData {
+	if prefixed, ok := defaults.PrefixedOpcodes[name]; ok {
+		return sectionData{prefixed[0], omologateEncoded(uint(prefixed[1]))}
+	}
+	return sectionData{defaults.Opcodes[name]}
 }
@@ -0,0 +1,368 @@
+package compiler
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// functionBodies splits the code section of a binary into the bodies of its functions (locals and instructions) in hex
+func functionBodies(t *testing.T, binary []byte) []string {
+	t.Helper()
+	sections, err := splitSections(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := []string{}
+	for _, section := range sections {
+		if section.id != 0x0a {
+			continue
+		}
+		r := &reader{bytes: section.content}
+		for count := r.u32(); count > 0; count-- {
+			bodies = append(bodies, hex.EncodeToString(r.bytesN(int(r.u32()))))
+		}
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+	}
+	return bodies
+}
+
+// sectionHex is the content of a section in hex
+func sectionHex(t *testing.T, binary []byte, id int) string {
+	t.Helper()
+	sections, err := splitSections(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range sections {
+		if section.id == id {
+			return hex.EncodeToString(section.content)
+		}
+	}
+	return ""
+}
+
+// A module and the bytes it is encoded to: the content of some sections and the body of its last function,
+// the modules are checked against node (or the reference interpreter for the proposals node does not know yet)
+type encoderTest struct {
+	name, input string
+	sections    map[int]string
+	body        string
+}
+
+func runEncoderTests(t *testing.T, tests []encoderTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binary := assembled(t, test.input)
+			for id, want := range test.sections {
+				if got := sectionHex(t, binary, id); got != want {
+					t.Errorf("section %d:\n got %s\nwant %s", id, got, want)
+				}
+			}
+			if test.body == "" {
+				return
+			}
+			bodies := functionBodies(t, binary)
+			if got := bodies[len(bodies)-1]; got != test.body {
+				t.Errorf("body:\n got %s\nwant %s", got, test.body)
+			}
+		})
+	}
+}
+
+func TestEncodeMultiValue(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"results and block types",
+			`(module
+			  (func $pair (result i32 i32) (i32.const 1) (i32.const 2))
+			  (func (result i32)
+			    (call $pair)
+			    (block (param i32 i32) (result i32) (i32.add))
+			    (i32.const 3)
+			    (if (param i32) (result i32) (then (i32.const 1) (i32.add)) (else (i32.const 2) (i32.sub)))
+			    (loop (param i32) (result i32))))`,
+			// []->[i32 i32], []->[i32], [i32 i32]->[i32], [i32]->[i32]
+			map[int]string{0x01: "04" + "6000027f7f" + "6000017f" + "60027f7f017f" + "60017f017f"},
+			// the blocks with params use the index of their type
+			"00" + "1000" + "0202" + "6a0b" + "4103" + "0403" + "41016a" + "05" + "41026b" + "0b" + "0303" + "0b" + "0b",
+		},
+		{
+			// a single result is still written as a value type
+			"single result",
+			`(module (func (result i32) (block (result i32) (i32.const 1))))`,
+			nil,
+			"00" + "027f" + "4101" + "0b" + "0b",
+		},
+	})
+}
+
+func TestEncodeBulkMemory(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"passive segments and the 0xfc instructions",
+			`(module
+			  (memory 1)
+			  (table 2 funcref)
+			  (data $d "hi")
+			  (elem $e func $f)
+			  (func $f
+			    (memory.init $d (i32.const 0) (i32.const 0) (i32.const 2))
+			    (data.drop $d)
+			    (memory.copy (i32.const 8) (i32.const 0) (i32.const 2))
+			    (memory.fill (i32.const 16) (i32.const 255) (i32.const 4))
+			    (table.init $e (i32.const 0) (i32.const 0) (i32.const 1))
+			    (elem.drop $e)
+			    (table.copy (i32.const 1) (i32.const 0) (i32.const 1))))`,
+			map[int]string{
+				// a passive element segment of function indices (flags 1, elemkind 0x00)
+				0x09: "01" + "01" + "00" + "0100",
+				// the data count comes before the code, memory.init and data.drop need it
+				0x0c: "01",
+				// a passive data segment (flags 1)
+				0x0b: "01" + "01" + "026869",
+			},
+			"00" +
+				"410041004102" + "fc08" + "00" + "00" + // memory.init data 0, memory 0
+				"fc09" + "00" + // data.drop 0
+				"410841004102" + "fc0a" + "00" + "00" + // memory.copy memory 0 to memory 0
+				"4110" + "41ff01" + "4104" + "fc0b" + "00" + // memory.fill memory 0
+				"410041004101" + "fc0c" + "00" + "00" + // table.init elem 0, table 0
+				"fc0d" + "00" + // elem.drop 0
+				"410141004101" + "fc0e" + "00" + "00" + // table.copy table 0 to table 0
+				"0b",
+		},
+	})
+}
+
+func TestEncodeReferenceTypes(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"tables and references",
+			`(module
+			  (table $t 1 funcref)
+			  (table $x 2 externref)
+			  (elem declare func $f)
+			  (func $f (param externref) (result i32)
+			    (table.set $t (i32.const 0) (ref.func $f))
+			    (drop (table.get $x (i32.const 1)))
+			    (drop (table.grow $x (local.get 0) (i32.const 1)))
+			    (table.fill $x (i32.const 0) (ref.null extern) (i32.const 1))
+			    (drop (select (result funcref) (ref.null func) (ref.func $f) (i32.const 1)))
+			    (i32.add (ref.is_null (local.get 0)) (table.size $t))))`,
+			map[int]string{
+				0x01: "01" + "60016f017f",        // (func (param externref) (result i32))
+				0x04: "02" + "700001" + "6f0002", // funcref 1, externref 2
+				// a declarative segment (flags 3) of function indices
+				0x09: "01" + "03" + "00" + "0100",
+			},
+			"00" +
+				"4100" + "d200" + "2600" + // table.set 0 (ref.func 0)
+				"4101" + "2501" + "1a" + // table.get 1
+				"2000" + "4101" + "fc0f01" + "1a" + // table.grow 1
+				"4100" + "d06f" + "4101" + "fc1101" + // table.fill 1 (ref.null extern)
+				"d070" + "d200" + "4101" + "1c01" + "70" + "1a" + // select (result funcref)
+				"2000" + "d1" + "fc1000" + "6a" + // ref.is_null, table.size 0
+				"0b",
+		},
+	})
+}
+
+func TestEncodeSIMD(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"v128 instructions",
+			`(module
+			  (memory 1)
+			  (func (param i32) (result i32)
+			    (v128.store offset=16 (local.get 0)
+			      (i32x4.add (v128.load (local.get 0)) (v128.const i32x4 1 2 3 -1)))
+			    (i8x16.shuffle 0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 31 (v128.load (i32.const 0)) (v128.load (i32.const 16)))
+			    (f32x4.splat (f32.const 1.5))
+			    (drop)
+			    (i32x4.extract_lane 3)))`,
+			nil,
+			"00" +
+				"2000" + "2000" + "fd00" + "0400" + // v128.load align=16 offset=0
+				"fd0c" + "01000000" + "02000000" + "03000000" + "ffffffff" + // v128.const i32x4 1 2 3 -1
+				"fdae01" + // i32x4.add, the opcodes are u32 after the prefix
+				"fd0b" + "0410" + // v128.store align=16 offset=16
+				"4100" + "fd000400" + "4110" + "fd000400" +
+				"fd0d" + "000102030405060708090a0b0c0d0e1f" + // i8x16.shuffle and its 16 lanes
+				"430000c03f" + "fd13" + "1a" + // f32x4.splat
+				"fd1b" + "03" + // i32x4.extract_lane 3
+				"0b",
+		},
+		{
+			"v128 type",
+			`(module (func (param v128) (result v128) (local.get 0)))`,
+			map[int]string{0x01: "01" + "60017b017b"},
+			"00" + "2000" + "0b",
+		},
+	})
+}
+
+func TestEncodeAtomics(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"shared memory and the 0xfe instructions",
+			`(module
+			  (memory 1 1 shared)
+			  (func (param i32) (result i32)
+			    (i32.atomic.store (i32.const 0) (local.get 0))
+			    (drop (i64.atomic.rmw.add offset=8 (i32.const 0) (i64.const 1)))
+			    (drop (i32.atomic.rmw8.cmpxchg_u (i32.const 4) (i32.const 0) (i32.const 1)))
+			    (drop (memory.atomic.notify (i32.const 0) (i32.const 1)))
+			    (atomic.fence)
+			    (i32.atomic.load (i32.const 0))))`,
+			// the limits flag 0x03: shared with a maximum
+			map[int]string{0x05: "01" + "03" + "0101"},
+			"00" +
+				"4100" + "2000" + "fe17" + "0200" + // i32.atomic.store, the alignment is always the natural one
+				"4100" + "4201" + "fe1f" + "0308" + "1a" + // i64.atomic.rmw.add offset=8
+				"4104" + "4100" + "4101" + "fe4a" + "0000" + "1a" + // i32.atomic.rmw8.cmpxchg_u
+				"4100" + "4101" + "fe00" + "0200" + "1a" + // memory.atomic.notify
+				"fe03" + "00" + // atomic.fence and its reserved byte
+				"4100" + "fe10" + "0200" + // i32.atomic.load
+				"0b",
+		},
+	})
+}
+
+func TestEncodeExceptions(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"tags, try_table and throw",
+			`(module
+			  (tag $e (param i32))
+			  (func (param i32) (result i32)
+			    (block $caught (result i32)
+			      (block $all
+			        (try_table (catch $e $caught) (catch_all $all)
+			          (throw $e (local.get 0))))
+			      (i32.const -1))))`,
+			map[int]string{
+				// the tag section (13) comes between the memories and the globals: attribute 0 (exception) and the type
+				0x0d: "01" + "00" + "00",
+			},
+			"00" +
+				"027f" + "0240" +
+				"1f" + "40" + "02" + "00" + "00" + "01" + "02" + "00" + // try_table: catch tag 0 label 1, catch_all label 0
+				"2000" + "0800" + "0b" + // throw 0
+				"0b" + "417f" + "0b" + "0b",
+		},
+		{
+			"exnref and catch_all_ref",
+			`(module
+			  (tag $e)
+			  (func (result exnref)
+			    (block $h (result exnref)
+			      (try_table (catch_all_ref $h) (throw $e))
+			      (unreachable))))`,
+			map[int]string{0x01: "02" + "600000" + "60000169"},
+			"00" + "0269" + "1f" + "40" + "01" + "03" + "00" + "0800" + "0b" + "00" + "0b" + "0b", // catch_all_ref label 0
+		},
+		{
+			"throw_ref",
+			`(module (func (param exnref) (throw_ref (local.get 0))))`,
+			map[int]string{0x01: "01" + "60016900"},
+			"00" + "2000" + "0a" + "0b",
+		},
+	})
+}
+
+func TestEncodeMemories(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"memory64 and multiple memories",
+			`(module
+			  (memory $a 1)
+			  (memory $b i64 1 2)
+			  (data (memory $b) (i64.const 8) "x")
+			  (func (result i32)
+			    (i32.store $b (i64.const 0) (i32.load $a offset=4 (i32.const 0)))
+			    (memory.copy $a $b (i32.const 0) (i64.const 0) (i32.const 1))
+			    (drop (memory.grow $b (i64.const 1)))
+			    (drop (memory.size $b))
+			    (i32.load8_u $b offset=0x1_0000_0000 (i64.const 0))))`,
+			map[int]string{
+				// the limits flag 0x04 is a 64 bit memory (0x05 with a maximum)
+				0x05: "02" + "0001" + "050102",
+				// an active segment of another memory (flags 2)
+				0x0b: "01" + "02" + "01" + "42080b" + "0178",
+			},
+			"00" +
+				"4200" + "4100" + "28" + "0204" + // i32.load of the memory 0: align and offset
+				"36" + "42" + "01" + "00" + // i32.store of the memory 1: the bit 6 of the alignment says that the memory index follows
+				"4100" + "4200" + "4101" + "fc0a" + "0001" + // memory.copy to the memory 0 from the memory 1
+				"4201" + "4001" + "1a" + "3f01" + "1a" + // memory.grow 1, memory.size 1
+				"4200" + "2d" + "40" + "01" + "8080808010" + // the offset is a u64
+				"0b",
+		},
+	})
+}
+
+func TestEncodeExtendedConst(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"initializers",
+			`(module
+			  (import "env" "base" (global $base i32))
+			  (memory 1)
+			  (global $end i32 (i32.add (global.get $base) (i32.const 16)))
+			  (global $wide i64 (i64.mul (i64.const 3) (i64.sub (i64.const 10) (i64.const 2))))
+			  (data (i32.sub (global.get $base) (i32.const 4)) "x"))`,
+			map[int]string{
+				0x06: "02" +
+					"7f00" + "2300" + "4110" + "6a" + "0b" + // (i32.add (global.get $base) (i32.const 16))
+					"7e00" + "4203" + "420a" + "4202" + "7d" + "7e" + "0b", // the folded operands come first
+				0x0b: "01" + "00" + "2300" + "4104" + "6b" + "0b" + "0178",
+			},
+			"",
+		},
+	})
+}
+
+func TestEncodeGC(t *testing.T) {
+	runEncoderTests(t, []encoderTest{
+		{
+			"recursive types, structs and arrays",
+			`(module
+			  (rec
+			    (type $list (sub (struct (field $head i32) (field $tail (ref null $list)))))
+			    (type $bytes (array (mut i8))))
+			  (type $point (sub final (struct (field $x (mut f64)) (field $y f64))))
+			  (func (param $l (ref null $list)) (result i32)
+			    (struct.get $list $head (ref.as_non_null (local.get $l)))
+			    (drop (struct.new $point (f64.const 1) (f64.const 2)))
+			    (drop (array.new $bytes (i32.const 7) (i32.const 3)))
+			    (i31.get_s (ref.i31 (i32.const 1)))
+			    (i32.add)))`,
+			map[int]string{
+				0x01: "03" +
+					"4e" + "02" + // a recursive group of two types
+					"50" + "00" + "5f" + "02" + "7f00" + "630000" + // sub without supertypes: struct i32, (ref null 0)
+					"5e" + "7801" + // array (mut i8)
+					"5f" + "02" + "7c01" + "7c00" + // a final type without supertypes is written without sub
+					"60" + "01" + "6300" + "01" + "7f", // (func (param (ref null 0)) (result i32))
+			},
+			"00" +
+				"2000" + "d4" + "fb02" + "0000" + // ref.as_non_null, struct.get 0 0
+				"44000000000000f03f" + "440000000000000040" + "fb00" + "02" + "1a" + // struct.new 2
+				"4107" + "4103" + "fb06" + "01" + "1a" + // array.new 1
+				"4101" + "fb1c" + "fb1d" + "6a" + // ref.i31, i31.get_s
+				"0b",
+		},
+		{
+			"subtypes and casts",
+			`(module
+			  (type $a (sub (struct (field i32))))
+			  (type $b (sub $a (struct (field i32) (field i64))))
+			  (func (param anyref) (result i32) (ref.test (ref $a) (local.get 0))))`,
+			map[int]string{0x01: "03" + "50005f017f00" + "5001005f027f007e00" + "60016e017f"},
+			"00" + "2000" + "fb14" + "00" + "0b", // ref.test (ref 0)
+		},
+	})
+}
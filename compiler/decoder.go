@@ -0,0 +1,650 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/texts"
+	"luna/types"
+	"math"
+	"unicode/utf8"
+)
+
+// Decoder
+// The other way around: a binary module (e.g. built by another toolchain) becomes a types.Module,
+// so it can be validated, linked or rewritten like the modules built from the text format.
+// Only what Luna can assemble can be decoded, an unknown opcode (or section) is an error.
+// Custom sections (names, producers, debug info) are skipped.
+// See https://webassembly.github.io/spec/core/binary/modules.html
+
+// Opcodes by their bytes: the single byte ones and the prefixed ones ({prefix, opcode})
+var (
+	opcodeNames   = map[int]string{}
+	prefixedNames = map[[2]int]string{}
+)
+
+func init() {
+	for name, opcode := range defaults.Opcodes {
+		opcodeNames[opcode.(int)] = name
+	}
+	for name, opcode := range defaults.PrefixedOpcodes {
+		prefixedNames[opcode] = name
+	}
+}
+
+// Decode reads a binary module, the result is not validated (see Validate)
+func Decode(binary []byte) (*types.Module, error) {
+	r := &reader{bytes: binary}
+	for _, b := range append(append([]interface{}{}, defaults.MAGIC...), defaults.VERSION...) {
+		if int(r.byte()) != b.(int) {
+			return nil, fmt.Errorf("not a WebAssembly module (bad magic number or version)")
+		}
+	}
+
+	m := &types.Module{}
+	// The types of the functions defined in the module, their code comes later
+	funcTypes := []uint32{}
+
+	for r.err == nil && r.pos < len(r.bytes) {
+		id := int(r.byte())
+		size := int(r.u32())
+		if r.err != nil {
+			break
+		}
+		if r.pos+size > len(r.bytes) {
+			r.fail("section %d: unexpected end", id)
+			break
+		}
+		section := &reader{bytes: r.bytes[:r.pos+size], pos: r.pos}
+		r.pos += size
+
+		switch id {
+		case defaults.Section["custom"]:
+			section.name()
+			section.pos = len(section.bytes)
+		case defaults.Section["type"]:
+			section.typeSection(m)
+		case defaults.Section["import"]:
+			section.importSection(m)
+		case defaults.Section["func"]:
+			section.vector(func() { funcTypes = append(funcTypes, section.u32()) })
+		case defaults.Section["table"]:
+			section.vector(func() {
+				m.Tables = append(m.Tables, types.Table{ElemType: section.valueType(), Limits: section.limits()})
+			})
+		case defaults.Section["memory"]:
+			section.vector(func() { m.Memories = append(m.Memories, types.Memory{Limits: section.limits()}) })
+		case defaults.Section["tag"]:
+			section.vector(func() {
+				section.expect(0x00, "tag attribute")
+				m.Tags = append(m.Tags, types.Tag{Type: section.u32()})
+			})
+		case defaults.Section["global"]:
+			section.vector(func() {
+				global := types.Global{Type: section.valueType(), Mutable: section.mutability()}
+				global.Init = section.expression(m)
+				m.Globals = append(m.Globals, global)
+			})
+		case defaults.Section["export"]:
+			section.vector(func() {
+				m.Exports = append(m.Exports, types.Export{Name: section.name(), Kind: int(section.byte()), Index: section.u32()})
+			})
+		case defaults.Section["start"]:
+			start := section.u32()
+			m.Start = &start
+		case defaults.Section["elem"]:
+			section.vector(func() { m.Elems = append(m.Elems, section.elem(m)) })
+		case defaults.Section["datacount"]:
+			section.u32()
+		case defaults.Section["code"]:
+			section.codeSection(m, funcTypes)
+		case defaults.Section["data"]:
+			section.vector(func() { m.Datas = append(m.Datas, section.data(m)) })
+		default:
+			r.fail("unknown section %d", id)
+		}
+
+		if r.err == nil && section.err != nil {
+			r.err = section.err
+		}
+		if r.err == nil && section.pos != len(section.bytes) {
+			r.fail("section %d: size mismatch", id)
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	defined := 0
+	for _, fn := range m.Funcs {
+		if fn.Import == nil {
+			defined++
+		}
+	}
+	if defined != len(funcTypes) {
+		return nil, fmt.Errorf("function and code section have inconsistent lengths")
+	}
+	return m, nil
+}
+
+// reader reads the bytes one after the other
+// the first error is kept and the reads that follow it return zeros, so it is checked once at the end
+type reader struct {
+	bytes []byte
+	pos   int
+	err   error
+}
+
+func (r *reader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("offset 0x%x: %s", r.pos, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.bytes) {
+		r.fail("unexpected end")
+		return 0
+	}
+	b := r.bytes[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *reader) peek() byte {
+	if r.err != nil || r.pos >= len(r.bytes) {
+		return 0
+	}
+	return r.bytes[r.pos]
+}
+
+func (r *reader) expect(b byte, what string) {
+	if got := r.byte(); got != b && r.err == nil {
+		r.fail("expected %s 0x%02x, got 0x%02x", what, b, got)
+	}
+}
+
+func (r *reader) bytesN(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.bytes) {
+		r.fail("unexpected end")
+		return nil
+	}
+	bytes := r.bytes[r.pos : r.pos+n]
+	r.pos += n
+	return bytes
+}
+
+// Unsigned LEB128, at most ceil(bits / 7) bytes
+// See https://webassembly.github.io/spec/core/binary/values.html#integers
+func (r *reader) unsigned(bits uint) uint64 {
+	result := uint64(0)
+	for shift := uint(0); ; shift += 7 {
+		if shift >= bits+7 {
+			r.fail("integer representation too long")
+			return 0
+		}
+		b := r.byte()
+		result |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			if bits < 64 && result>>bits != 0 {
+				r.fail("integer too large")
+			}
+			return result
+		}
+	}
+}
+
+func (r *reader) signed(bits uint) int64 {
+	result := int64(0)
+	shift := uint(0)
+	for {
+		if shift >= bits+7 {
+			r.fail("integer representation too long")
+			return 0
+		}
+		b := r.byte()
+		result |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result
+		}
+	}
+}
+
+func (r *reader) u32() uint32 {
+	return uint32(r.unsigned(32))
+}
+
+// A vector is its length followed by its elements
+func (r *reader) vector(element func()) {
+	count := r.u32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		element()
+	}
+}
+
+// Names must be valid UTF-8
+// See https://webassembly.github.io/spec/core/binary/values.html#names
+func (r *reader) name() string {
+	name := r.bytesN(int(r.u32()))
+	if !utf8.Valid(name) {
+		r.fail("name is not valid UTF-8")
+	}
+	return string(name)
+}
+
+func (r *reader) mutability() bool {
+	switch r.byte() {
+	case 0x00:
+		return false
+	case 0x01:
+		return true
+	}
+	r.fail("malformed mutability")
+	return false
+}
+
+// Value types are a single byte, or 0x63 (ref null) and 0x64 (ref) followed by a heap type
+// See https://webassembly.github.io/gc/core/binary/types.html#value-types
+func (r *reader) valueType() types.ValueType {
+	b := r.byte()
+	switch {
+	case b == types.RefNullPrefix:
+		return types.Ref(r.heapType(), true)
+	case b == types.RefPrefix:
+		return types.Ref(r.heapType(), false)
+	case isValueTypeByte(b):
+		return types.ValueType(b)
+	}
+	r.fail("malformed value type 0x%02x", b)
+	return 0
+}
+
+func isValueTypeByte(b byte) bool {
+	for _, value := range types.ValType {
+		if value.(int) == int(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// Abstract heap types are a single byte (a negative signed 33 bit integer), the types of the module are their index
+func (r *reader) heapType() int {
+	for _, heap := range types.HeapType {
+		if heap.(int) == int(r.peek()) {
+			return int(r.byte())
+		}
+	}
+	index := r.signed(33)
+	if index < 0 || index > math.MaxUint32 {
+		r.fail("malformed heap type")
+		return 0
+	}
+	return types.ConcreteHeap(uint32(index))
+}
+
+// Field types can be packed (i8 and i16)
+func (r *reader) fieldType() types.ValueType {
+	if b := r.peek(); b == types.I8 || b == types.I16 {
+		return types.ValueType(r.byte())
+	}
+	return r.valueType()
+}
+
+func (r *reader) limits() types.Limits {
+	flags := r.byte()
+	if flags&^0x07 != 0 {
+		r.fail("malformed limits flags 0x%02x", flags)
+	}
+	limits := types.Limits{HasMax: flags&0x01 != 0, Shared: flags&0x02 != 0, Is64: flags&0x04 != 0}
+	bits := uint(32)
+	if limits.Is64 {
+		bits = 64
+	}
+	limits.Min = r.unsigned(bits)
+	if limits.HasMax {
+		limits.Max = r.unsigned(bits)
+	}
+	return limits
+}
+
+// The type section is a vector of recursive groups, a group of a single type has no 0x4e
+func (r *reader) typeSection(m *types.Module) {
+	r.vector(func() {
+		if r.peek() != types.RecType {
+			typeDef := r.subType()
+			typeDef.Rec = 1
+			m.Types = append(m.Types, typeDef)
+			return
+		}
+		r.byte()
+		first := len(m.Types)
+		r.vector(func() { m.Types = append(m.Types, r.subType()) })
+		if len(m.Types) > first {
+			m.Types[first].Rec = len(m.Types) - first
+		}
+	})
+}
+
+// 0x50 (or 0x4f if final) and the supertypes, then the composite type
+// a composite type alone is final and has no supertype
+func (r *reader) subType() types.TypeDef {
+	typeDef := types.TypeDef{Final: true}
+	if b := r.peek(); b == types.SubType || b == types.SubFinalType {
+		r.byte()
+		typeDef.Final = b == types.SubFinalType
+		typeDef.Supers = []uint32{}
+		r.vector(func() { typeDef.Supers = append(typeDef.Supers, r.u32()) })
+	}
+
+	typeDef.Kind = int(r.byte())
+	switch typeDef.Kind {
+	case types.FuncType:
+		typeDef.Params = []types.ValueType{}
+		r.vector(func() { typeDef.Params = append(typeDef.Params, r.valueType()) })
+		typeDef.Results = []types.ValueType{}
+		r.vector(func() { typeDef.Results = append(typeDef.Results, r.valueType()) })
+	case types.StructType:
+		typeDef.Fields = []types.Field{}
+		r.vector(func() {
+			typeDef.Fields = append(typeDef.Fields, types.Field{Type: r.fieldType(), Mutable: r.mutability()})
+		})
+	case types.ArrayType:
+		typeDef.Fields = []types.Field{{Type: r.fieldType(), Mutable: r.mutability()}}
+	default:
+		r.fail("malformed type 0x%02x", typeDef.Kind)
+	}
+	return typeDef
+}
+
+// Imports take the first indices of their index space, so they are added before the definitions
+func (r *reader) importSection(m *types.Module) {
+	r.vector(func() {
+		imported := &types.Import{Module: r.name(), Name: r.name()}
+		switch kind := int(r.byte()); kind {
+		case defaults.ExportSection["func"]:
+			m.Funcs = append(m.Funcs, types.Func{Type: r.u32(), Import: imported})
+		case defaults.ExportSection["table"]:
+			m.Tables = append(m.Tables, types.Table{ElemType: r.valueType(), Limits: r.limits(), Import: imported})
+		case defaults.ExportSection["mem"]:
+			m.Memories = append(m.Memories, types.Memory{Limits: r.limits(), Import: imported})
+		case defaults.ExportSection["global"]:
+			m.Globals = append(m.Globals, types.Global{Type: r.valueType(), Mutable: r.mutability(), Import: imported})
+		case defaults.ExportSection["tag"]:
+			r.expect(0x00, "tag attribute")
+			m.Tags = append(m.Tags, types.Tag{Type: r.u32(), Import: imported})
+		default:
+			r.fail("malformed import kind 0x%02x", kind)
+		}
+	})
+}
+
+// Every entry of the code section is its size, the locals and the body
+func (r *reader) codeSection(m *types.Module, funcTypes []uint32) {
+	index := 0
+	r.vector(func() {
+		if index >= len(funcTypes) {
+			r.fail("function and code section have inconsistent lengths")
+			return
+		}
+		size := int(r.u32())
+		if r.err != nil || r.pos+size > len(r.bytes) {
+			r.fail("unexpected end of the code section")
+			return
+		}
+		code := &reader{bytes: r.bytes[:r.pos+size], pos: r.pos}
+		r.pos += size
+
+		fn := types.Func{Type: funcTypes[index], Locals: []types.ValueType{}}
+		code.vector(func() {
+			count := code.u32()
+			value := code.valueType()
+			if uint64(len(fn.Locals))+uint64(count) > math.MaxUint32 {
+				code.fail("too many locals")
+				return
+			}
+			for i := uint32(0); i < count; i++ {
+				fn.Locals = append(fn.Locals, value)
+			}
+		})
+		fn.Body = code.expression(m)
+		if code.err == nil && code.pos != len(code.bytes) {
+			code.fail("function %d: size mismatch", index)
+		}
+		if code.err != nil {
+			r.err = code.err
+		}
+		m.Funcs = append(m.Funcs, fn)
+		index++
+	})
+}
+
+// The flags of the element segments (see Assemble)
+// See https://webassembly.github.io/spec/core/binary/modules.html#element-section
+func (r *reader) elem(m *types.Module) types.Elem {
+	flags := r.u32()
+	if flags > 7 {
+		r.fail("malformed element segment flags %d", flags)
+		return types.Elem{}
+	}
+	elem := types.Elem{Mode: types.SegmentActive, Type: types.ValueType(types.RefType["funcref"].(int))}
+	switch {
+	case flags&0x01 == 0:
+		if flags&0x02 != 0 {
+			elem.Table = r.u32()
+		}
+		elem.Offset = r.expression(m)
+	case flags&0x02 == 0:
+		elem.Mode = types.SegmentPassive
+	default:
+		elem.Mode = types.SegmentDeclarative
+	}
+
+	// the element kind (0x00 funcref) or the reference type, the short form of table 0 has none
+	hasKind := flags&0x03 != 0
+	if flags&0x04 != 0 {
+		if hasKind {
+			elem.Type = r.valueType()
+		}
+		elem.Exprs = [][]types.Instruction{}
+		r.vector(func() { elem.Exprs = append(elem.Exprs, r.expression(m)) })
+		return elem
+	}
+	if hasKind {
+		r.expect(0x00, "element kind")
+	}
+	elem.Funcs = []uint32{}
+	r.vector(func() { elem.Funcs = append(elem.Funcs, r.u32()) })
+	return elem
+}
+
+func (r *reader) data(m *types.Module) types.Data {
+	data := types.Data{Mode: types.SegmentActive}
+	switch flags := r.u32(); flags {
+	case 0x00:
+		data.Offset = r.expression(m)
+	case 0x01:
+		data.Mode = types.SegmentPassive
+	case 0x02:
+		data.Memory = r.u32()
+		data.Offset = r.expression(m)
+	default:
+		r.fail("malformed data segment flags %d", flags)
+	}
+	data.Bytes = append([]byte{}, r.bytesN(int(r.u32()))...)
+	return data
+}
+
+// An expression is a sequence of instructions terminated by end
+// the ends of the blocks inside it are instructions too (the bodies are flat, see types.Func)
+func (r *reader) expression(m *types.Module) []types.Instruction {
+	instructions := []types.Instruction{}
+	depth := 0
+	for r.err == nil {
+		instruction := r.instruction(m)
+		switch instruction.Name {
+		case "block", "loop", "if", "try", "try_table":
+			depth++
+		case "end", "delegate":
+			if depth == 0 && instruction.Name == "end" {
+				return instructions
+			}
+			depth--
+		}
+		instructions = append(instructions, instruction)
+	}
+	return nil
+}
+
+// The opcode and its immediates, in the order of defaults.Immediates (see encodeInstruction)
+func (r *reader) instruction(m *types.Module) types.Instruction {
+	start := r.pos
+	opcode := int(r.byte())
+	name, ok := opcodeNames[opcode]
+	nullable := false
+
+	switch opcode {
+	case defaults.PrefixMisc, defaults.PrefixSIMD, defaults.PrefixAtomic, defaults.PrefixGC:
+		prefixed := int(r.u32())
+		name, ok = prefixedNames[[2]int{opcode, prefixed}]
+		// ref.test (ref null ht) and ref.cast (ref null ht) are the opcode that follows the non-nullable one
+		if !ok && opcode == defaults.PrefixGC {
+			name, ok = prefixedNames[[2]int{opcode, prefixed - 1}]
+			nullable = ok && (name == "ref.test" || name == "ref.cast")
+			ok = nullable
+		}
+	case defaults.TypedSelect:
+		values := []types.ValueType{}
+		r.vector(func() { values = append(values, r.valueType()) })
+		return types.Instruction{Name: "select", Immediates: []interface{}{values}}
+	}
+	if r.err != nil {
+		return types.Instruction{}
+	}
+	if !ok {
+		r.pos = start
+		r.fail("unknown opcode 0x%02x", opcode)
+		return types.Instruction{}
+	}
+
+	instruction := types.Instruction{Name: name, Immediates: []interface{}{}}
+	// br_on_cast has a byte of flags: bit 0 the first type is nullable, bit 1 the second one
+	var castFlags byte
+	if name == "br_on_cast" || name == "br_on_cast_fail" {
+		castFlags = r.byte()
+	}
+
+	for i, kind := range defaults.Immediates[name] {
+		var immediate interface{}
+		switch kind {
+		case texts.LabelIdx, texts.FuncIdx, texts.LocalIdx, texts.TypeIdx, texts.TableIdx, texts.MemIdx, texts.DataIdx, texts.ElemIdx, texts.TagIdx, texts.GlobalIdx, texts.FieldIdx, texts.Count:
+			immediate = r.u32()
+
+		case texts.Labels:
+			labels := []uint32{}
+			r.vector(func() { labels = append(labels, r.u32()) })
+			immediate = append(labels, r.u32())
+
+		case texts.BlockType:
+			immediate = r.blockType(m)
+
+		case texts.HeapType:
+			immediate = types.ValueType(r.heapType())
+
+		case texts.RefType:
+			if name == "br_on_cast" || name == "br_on_cast_fail" {
+				nullable = castFlags&(1<<(i-1)) != 0
+			}
+			immediate = types.Ref(r.heapType(), nullable)
+
+		case texts.Catches:
+			catches := []types.Catch{}
+			r.vector(func() {
+				handler := types.Catch{Kind: int(r.byte())}
+				if handler.Kind > types.CatchAllRef {
+					r.fail("malformed catch kind %d", handler.Kind)
+				}
+				if handler.Kind == types.CatchTag || handler.Kind == types.CatchTagRef {
+					handler.Tag = r.u32()
+				}
+				handler.Label = r.u32()
+				catches = append(catches, handler)
+			})
+			immediate = catches
+
+		// bit 6 of the alignment: the memory index follows it
+		case texts.MemArg:
+			memArg := types.MemArg{Align: r.u32()}
+			if memArg.Align&0x40 != 0 {
+				memArg.Align &^= 0x40
+				memArg.Memory = r.u32()
+			}
+			memArg.Offset = r.unsigned(64)
+			immediate = memArg
+
+		case texts.SelectType:
+			immediate = []types.ValueType{}
+
+		case texts.ConstI32:
+			immediate = int32(r.signed(32))
+		case texts.ConstI64:
+			immediate = r.signed(64)
+		case texts.ConstF32:
+			bits := r.bytesN(4)
+			value := uint32(0)
+			for i := len(bits) - 1; i >= 0; i-- {
+				value = value<<8 | uint32(bits[i])
+			}
+			immediate = value
+		case texts.ConstF64:
+			bits := r.bytesN(8)
+			value := uint64(0)
+			for i := len(bits) - 1; i >= 0; i-- {
+				value = value<<8 | uint64(bits[i])
+			}
+			immediate = value
+
+		case texts.LaneIdx:
+			immediate = uint32(r.byte())
+		case texts.Reserved:
+			r.expect(0x00, "reserved byte")
+			immediate = uint32(0)
+		case texts.V128Const, texts.Shuffle:
+			var bytes [16]byte
+			copy(bytes[:], r.bytesN(16))
+			immediate = bytes
+		}
+		instruction.Immediates = append(instruction.Immediates, immediate)
+	}
+	return instruction
+}
+
+// 0x40 (empty), a value type (a single result) or the index of a function type
+// See https://webassembly.github.io/spec/core/binary/instructions.html#binary-blocktype
+func (r *reader) blockType(m *types.Module) types.BlockType {
+	b := r.peek()
+	switch {
+	case b == 0x40:
+		r.byte()
+		return types.BlockType{}
+	case b >= 0x40 && b < 0x80:
+		return types.BlockType{Results: []types.ValueType{r.valueType()}}
+	}
+
+	index := r.signed(33)
+	if index < 0 || index >= int64(len(m.Types)) || m.Types[index].Kind != types.FuncType {
+		r.fail("unknown block type %d", index)
+		return types.BlockType{}
+	}
+	funcType := m.Types[index]
+	return types.BlockType{Params: funcType.Params, Results: funcType.Results, Index: uint32(index), HasIndex: true}
+}
@@ -0,0 +1,99 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"luna/defaults"
+	"luna/types"
+	"strings"
+	"testing"
+)
+
+// A module like the ones of LLVM, not built by Luna: the size of the function body is padded to 5 bytes
+// and a producers section follows the code
+//
+//	(func (export "lt") (param i32) (result i32)
+//	  block
+//	    local.get 0
+//	    br_table 0 0
+//	  end
+//	  local.get 0
+//	  i32.const 10
+//	  i32.lt_s)
+var foreignModule = "0061736d01000000" +
+	"01060160017f017f" + // type section: (func (param i32) (result i32))
+	"03020100" + // function section
+	"070601026c740000" + // export section: "lt" func 0
+	"0a1601" + "9080808000" + "00024020000e0100000b2000410a480b" + // code section, the body size is padded
+	"000b0970726f647563657273" + "00" // custom section "producers"
+
+func TestDecodeForeignModule(t *testing.T) {
+	binary, _ := hex.DecodeString(foreignModule)
+	m, err := Decode(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(m); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "block local.get 0 br_table end local.get 0 i32.const 10 i32.lt_s"
+	if got := instructionsText(m.Funcs[0].Body); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if labels := m.Funcs[0].Body[2].Immediates[0].([]uint32); len(labels) != 2 || labels[0] != 0 || labels[1] != 0 {
+		t.Errorf("br_table labels: got %v, want [0 0]", labels)
+	}
+	if len(m.Exports) != 1 || m.Exports[0].Name != "lt" {
+		t.Errorf("exports: got %v", m.Exports)
+	}
+
+	// Luna writes the canonical encoding: the same module without the padding (and the custom section)
+	canonical, _ := hex.DecodeString("0061736d01000000" + "01060160017f017f" + "03020100" + "070601026c740000" +
+		"0a1201" + "10" + "00024020000e0100000b2000410a480b")
+	if got := Assemble(m).Bytes(); !bytes.Equal(got, canonical) {
+		t.Errorf("assembled:\n got %x\nwant %x", got, canonical)
+	}
+}
+
+// Every numeric instruction is encoded and decoded back to itself
+func TestDecodeNumericInstructions(t *testing.T) {
+	for name, opcode := range defaults.Opcodes {
+		prefix := strings.SplitN(name, ".", 2)[0]
+		if prefix != "i32" && prefix != "i64" && prefix != "f32" && prefix != "f64" {
+			continue
+		}
+		if len(defaults.Immediates[name]) > 0 {
+			continue
+		}
+		encoded := Module(flatten(encodeInstruction(types.Instruction{Name: name}))).Bytes()
+		if len(encoded) != 1 || int(encoded[0]) != opcode.(int) {
+			t.Errorf("%s: encoded as %x, want %02x", name, encoded, opcode)
+			continue
+		}
+		r := &reader{bytes: encoded}
+		if decoded := r.instruction(&types.Module{}); r.err != nil || decoded.Name != name {
+			t.Errorf("%s: decoded as %q (%v)", name, decoded.Name, r.err)
+		}
+	}
+}
+
+// The core instructions that were missing: every comparison and operation of the MVP is known
+func TestMVPNumericOpcodes(t *testing.T) {
+	tests := map[string]int{
+		"i32.lt_s": 0x48, "i32.ge_u": 0x4f, "i64.eqz": 0x50, "i64.ge_u": 0x5a, "f32.ge": 0x60, "f64.ge": 0x66,
+		"i32.clz": 0x67, "i32.rotr": 0x78, "i64.clz": 0x79, "i64.rotr": 0x8a,
+		"f32.abs": 0x8b, "f32.copysign": 0x98, "f64.abs": 0x99, "f64.copysign": 0xa6,
+		"br_table": 0x0e,
+	}
+	for name, opcode := range tests {
+		if got, ok := defaults.Opcodes[name]; !ok || got.(int) != opcode {
+			t.Errorf("%s: got %v, want 0x%02x", name, got, opcode)
+		}
+	}
+	for opcode := 0x45; opcode <= 0xc4; opcode++ {
+		if _, ok := opcodeNames[opcode]; !ok {
+			t.Errorf("opcode 0x%02x is unknown", opcode)
+		}
+	}
+}
@@ -2,12 +2,13 @@ package compiler
 
 // According to WebAssembly specification (https://webassembly.github.io/spec/core/_download/WebAssembly.pdf)
 // strings are encoded using UTF-8 encoding
-// Go uses it by default
+// Go uses it by default, so we only need to emit the bytes (not the runes!)
+// otherwise the length of the vector would count the characters and not the bytes
 func encodeString(str string) []interface{} {
 	encodedString := []interface{}{}
 
-	for _, v := range str {
-		encodedString = append(encodedString, interface{}(rune(v)))
+	for i := 0; i < len(str); i++ {
+		encodedString = append(encodedString, interface{}(int(str[i])))
 	}
 
 	return encodedString
@@ -19,8 +20,8 @@ func encodeString(str string) []interface{} {
 
 // Implementation for Unsigned integers
 // https://en.wikipedia.org/wiki/LEB128#Encode_unsigned_integer
-func EncodeUnsignedLEB128(number uint) []uint {
-	buff := []uint{}
+func EncodeUnsignedLEB128(number uint64) []uint64 {
+	buff := []uint64{}
 
 	// Do while emulation
 	for n := true; n; n = number != 0 {
@@ -38,12 +39,11 @@ func EncodeUnsignedLEB128(number uint) []uint {
 
 // Implementation for the signed integers
 // See javascript implementation https://en.wikipedia.org/wiki/LEB128#JavaScript_code
-func EncodeSignedLEB128(number int) []int {
-	number |= 0
+func EncodeSignedLEB128(number int64) []int {
 	buff := []int{}
 
 	for {
-		_byte := number & 0x7f
+		_byte := int(number & 0x7f)
 		number >>= 7
 		if (number == 0 && (_byte&0x40) == 0) || (number == -1 && (_byte&0x40) != 0) {
 			buff = append(buff, _byte)
@@ -52,3 +52,14 @@ func EncodeSignedLEB128(number int) []int {
 		buff = append(buff, _byte|0x80)
 	}
 }
+
+// Padded unsigned LEB128: always 5 bytes (the most a u32 can take), so the value can be patched
+// by a linker without moving what follows it, e.g. 3 is 0x83 0x80 0x80 0x80 0x00
+// See https://github.com/WebAssembly/tool-conventions/blob/main/Linking.md#relocation-sections
+func EncodePaddedLEB128(number uint32) []uint64 {
+	buff := []uint64{}
+	for i := 0; i < 4; i++ {
+		buff = append(buff, uint64(number>>(7*i)&0x7f|0x80))
+	}
+	return append(buff, uint64(number>>28))
+}
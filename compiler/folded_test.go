@@ -0,0 +1,155 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Samples in the folded form, like the ones found online (MDN, the specification, wasm-by-example...)
+// every one is compiled to the same binary as its flat version
+var foldedSamples = []struct {
+	name, folded, flat string
+}{
+	{
+		"factorial",
+		`(module
+		  (func $fac (export "fac") (param f64) (result f64)
+		    (if (result f64) (f64.lt (local.get 0) (f64.const 1))
+		      (then (f64.const 1))
+		      (else (f64.mul (local.get 0) (call $fac (f64.sub (local.get 0) (f64.const 1))))))))`,
+		`(module
+		  (func $fac (export "fac") (param f64) (result f64)
+		    local.get 0 f64.const 1 f64.lt
+		    if (result f64)
+		      f64.const 1
+		    else
+		      local.get 0 local.get 0 f64.const 1 f64.sub call $fac f64.mul
+		    end))`,
+	},
+	{
+		"fibonacci",
+		`(module
+		  (func $fib (export "fib") (param $n i32) (result i32)
+		    (if (result i32) (i32.lt_s (local.get $n) (i32.const 2))
+		      (then (local.get $n))
+		      (else (i32.add (call $fib (i32.sub (local.get $n) (i32.const 1)))
+		                     (call $fib (i32.sub (local.get $n) (i32.const 2))))))))`,
+		`(module
+		  (func $fib (export "fib") (param $n i32) (result i32)
+		    local.get $n i32.const 2 i32.lt_s
+		    if (result i32)
+		      local.get $n
+		    else
+		      local.get $n i32.const 1 i32.sub call $fib
+		      local.get $n i32.const 2 i32.sub call $fib
+		      i32.add
+		    end))`,
+	},
+	{
+		"loop with a counter",
+		`(module
+		  (func (export "sum") (param $n i32) (result i32) (local $i i32) (local $sum i32)
+		    (block $done
+		      (loop $next
+		        (br_if $done (i32.ge_u (local.get $i) (local.get $n)))
+		        (local.set $sum (i32.add (local.get $sum) (local.get $i)))
+		        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+		        (br $next)))
+		    (local.get $sum)))`,
+		`(module
+		  (func (export "sum") (param $n i32) (result i32) (local $i i32) (local $sum i32)
+		    block $done
+		      loop $next
+		        local.get $i local.get $n i32.ge_u br_if $done
+		        local.get $sum local.get $i i32.add local.set $sum
+		        local.get $i i32.const 1 i32.add local.set $i
+		        br $next
+		      end
+		    end
+		    local.get $sum))`,
+	},
+	{
+		"switch with br_table",
+		`(module
+		  (func (export "switch") (param $x i32) (result i32)
+		    (block $default
+		      (block $one
+		        (block $zero
+		          (br_table $zero $one $default (local.get $x)))
+		        (return (i32.const 100)))
+		      (return (i32.const 101)))
+		    (i32.const -1)))`,
+		`(module
+		  (func (export "switch") (param $x i32) (result i32)
+		    block $default
+		      block $one
+		        block $zero
+		          local.get $x
+		          br_table $zero $one $default
+		        end
+		        i32.const 100 return
+		      end
+		      i32.const 101 return
+		    end
+		    i32.const -1))`,
+	},
+	{
+		"memory",
+		`(module
+		  (memory (export "memory") 1)
+		  (func (export "swap") (param $a i32) (param $b i32) (local $t i32)
+		    (local.set $t (i32.load (local.get $a)))
+		    (i32.store (local.get $a) (i32.load (local.get $b)))
+		    (i32.store (local.get $b) (local.get $t))))`,
+		`(module
+		  (memory (export "memory") 1)
+		  (func (export "swap") (param $a i32) (param $b i32) (local $t i32)
+		    local.get $a i32.load local.set $t
+		    local.get $a local.get $b i32.load i32.store
+		    local.get $b local.get $t i32.store))`,
+	},
+	{
+		"bits and floats",
+		`(module
+		  (func (export "hypot") (param f64 f64) (result f64)
+		    (f64.sqrt (f64.add (f64.mul (local.get 0) (local.get 0)) (f64.mul (local.get 1) (local.get 1)))))
+		  (func (export "mix") (param i64) (result i64)
+		    (i64.or (i64.shl (local.get 0) (i64.const 4)) (i64.rotr (i64.popcnt (local.get 0)) (i64.const 1)))))`,
+		`(module
+		  (func (export "hypot") (param f64 f64) (result f64)
+		    local.get 0 local.get 0 f64.mul local.get 1 local.get 1 f64.mul f64.add f64.sqrt)
+		  (func (export "mix") (param i64) (result i64)
+		    local.get 0 i64.const 4 i64.shl local.get 0 i64.popcnt i64.const 1 i64.rotr i64.or))`,
+	},
+}
+
+func TestFoldedSamples(t *testing.T) {
+	for _, sample := range foldedSamples {
+		t.Run(sample.name, func(t *testing.T) {
+			folded := assembled(t, sample.folded)
+			flat := assembled(t, sample.flat)
+			if !bytes.Equal(folded, flat) {
+				t.Errorf("folded and flat differ:\nfolded %x\n  flat %x", folded, flat)
+			}
+		})
+	}
+}
+
+// The binary of the fibonacci sample, checked against node
+func TestFoldedGolden(t *testing.T) {
+	want := "0061736d01000000" +
+		"0106" + "0160017f017f" + // (func (param i32) (result i32))
+		"0302" + "0100" +
+		"0707" + "010366696200" + "00" + // (export "fib" (func 0))
+		"0a1e" + "011c" + "00" +
+		"2000" + "4102" + "48" + // local.get 0 i32.const 2 i32.lt_s
+		"047f" + "2000" + // if (result i32) local.get 0
+		"05" + "2000" + "4101" + "6b" + "1000" + // else local.get 0 i32.const 1 i32.sub call 0
+		"2000" + "4102" + "6b" + "1000" + "6a" + // local.get 0 i32.const 2 i32.sub call 0 i32.add
+		"0b" + "0b" // end end
+	got := hex.EncodeToString(assembled(t, foldedSamples[1].folded))
+	if got != want {
+		t.Errorf("fibonacci:\n got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,582 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/types"
+)
+
+// Garbage collection
+// The types of the module are not only functions: structs and arrays are allocated by the engine
+// and referenced with typed references, e.g. (ref $point) or (ref null $list).
+// References have subtypes: (ref $point) can be used where a (ref null $point), a structref
+// or an anyref is expected, and a type can extend another one with (sub $super ...).
+// See https://webassembly.github.io/gc/core/valid/index.html
+
+// Abstract heap types
+var (
+	heapAny      = types.HeapType["any"].(int)
+	heapEq       = types.HeapType["eq"].(int)
+	heapI31      = types.HeapType["i31"].(int)
+	heapStruct   = types.HeapType["struct"].(int)
+	heapArray    = types.HeapType["array"].(int)
+	heapNone     = types.HeapType["none"].(int)
+	heapFunc     = types.HeapType["func"].(int)
+	heapNoFunc   = types.HeapType["nofunc"].(int)
+	heapExtern   = types.HeapType["extern"].(int)
+	heapNoExtern = types.HeapType["noextern"].(int)
+	heapExn      = types.HeapType["exn"].(int)
+	heapNoExn    = types.HeapType["noexn"].(int)
+)
+
+// The abstract heap types form four hierarchies, each one with a top and a bottom type:
+//
+//	any > eq > i31, struct, array > none   (struct and array types are below struct and array)
+//	func > nofunc                         (function types are below func)
+//	extern > noextern
+//	exn > noexn
+//
+// See https://webassembly.github.io/gc/core/valid/matching.html#heap-types
+var abstractSupers = map[int]int{
+	heapEq:     heapAny,
+	heapI31:    heapEq,
+	heapStruct: heapEq,
+	heapArray:  heapEq,
+}
+
+var bottoms = map[int]int{
+	heapNone:     heapAny,
+	heapNoFunc:   heapFunc,
+	heapNoExtern: heapExtern,
+	heapNoExn:    heapExn,
+}
+
+// The abstract heap type of the types of the module
+var compositeHeaps = map[int]int{
+	types.FuncType:   heapFunc,
+	types.StructType: heapStruct,
+	types.ArrayType:  heapArray,
+}
+
+// The types of the type section
+// - references can only point to the types before them or to the ones of their recursive group
+// - a type can only extend a type that comes before it and that is not final
+// - the subtype must be compatible with the supertype: a struct can add fields but not change the ones it inherits
+// See https://webassembly.github.io/gc/core/valid/types.html#defined-types
+func (v *validator) validateTypes() error {
+	v.groups = make([]int, len(v.module.Types))
+	for i := 0; i < len(v.module.Types); {
+		rec := v.module.Types[i].Rec
+		if rec == 0 {
+			return fmt.Errorf("type %d: outside of a recursive group", i)
+		}
+		for j := i; j < i+rec && j < len(v.module.Types); j++ {
+			v.groups[j] = i
+		}
+		i += rec
+	}
+
+	for i, typeDef := range v.module.Types {
+		end := v.groups[i] + v.module.Types[v.groups[i]].Rec
+		for _, value := range typeValues(typeDef) {
+			if index, concrete := value.TypeIndex(); concrete && int(index) >= end {
+				return fmt.Errorf("type %d: unknown type %d", i, index)
+			}
+		}
+		if len(typeDef.Supers) > 1 {
+			return fmt.Errorf("type %d: a type can extend only one type", i)
+		}
+		for _, super := range typeDef.Supers {
+			if int(super) >= i {
+				return fmt.Errorf("type %d: supertype %d must be defined before", i, super)
+			}
+		}
+	}
+
+	for i, typeDef := range v.module.Types {
+		for _, super := range typeDef.Supers {
+			if v.module.Types[super].Final {
+				return fmt.Errorf("type %d: can not extend the final type %d", i, super)
+			}
+			if !v.extends(typeDef, v.module.Types[super]) {
+				return fmt.Errorf("type %d: type mismatch: it does not match its supertype %d", i, super)
+			}
+		}
+	}
+	return nil
+}
+
+// The value types used by a type: params and results, or the types of the fields
+func typeValues(typeDef types.TypeDef) []types.ValueType {
+	values := append(append([]types.ValueType{}, typeDef.Params...), typeDef.Results...)
+	for _, field := range typeDef.Fields {
+		values = append(values, field.Type)
+	}
+	return values
+}
+
+// A function can take more generic params and return more specific results,
+// a struct can add fields after the ones of its supertype,
+// immutable fields can be more specific, mutable ones must be the same
+// See https://webassembly.github.io/gc/core/valid/matching.html#composite-types
+func (v *validator) extends(sub, super types.TypeDef) bool {
+	if sub.Kind != super.Kind {
+		return false
+	}
+
+	switch sub.Kind {
+	case types.FuncType:
+		if len(sub.Params) != len(super.Params) || len(sub.Results) != len(super.Results) {
+			return false
+		}
+		for i := range sub.Params {
+			if !v.matches(super.Params[i], sub.Params[i]) {
+				return false
+			}
+		}
+		for i := range sub.Results {
+			if !v.matches(sub.Results[i], super.Results[i]) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		if len(sub.Fields) < len(super.Fields) || (sub.Kind == types.ArrayType && len(sub.Fields) != 1) {
+			return false
+		}
+		for i, field := range super.Fields {
+			if sub.Fields[i].Mutable != field.Mutable || !v.matches(sub.Fields[i].Type, field.Type) {
+				return false
+			}
+			if field.Mutable && !v.matches(field.Type, sub.Fields[i].Type) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// matches tells if a value of the type actual can be used where the type expected is expected
+// See https://webassembly.github.io/gc/core/valid/matching.html#reference-types
+func (v *validator) matches(actual, expected types.ValueType) bool {
+	if actual == expected || actual == unknown || expected == unknown {
+		return true
+	}
+	if !actual.IsRef() || !expected.IsRef() {
+		return false
+	}
+	if actual.Nullable() && !expected.Nullable() {
+		return false
+	}
+	return v.heapMatches(actual.Heap(), expected.Heap())
+}
+
+func (v *validator) heapMatches(actual, expected int) bool {
+	if actual == expected {
+		return true
+	}
+	if top, ok := bottoms[actual]; ok {
+		return v.top(expected) == top
+	}
+
+	index, concrete := types.ValueType(actual).TypeIndex()
+	if !concrete {
+		super, ok := abstractSupers[actual]
+		return ok && v.heapMatches(super, expected)
+	}
+	if int(index) >= len(v.module.Types) {
+		return false
+	}
+
+	// Equivalent types are the same type, even if they are defined twice
+	if expectedIndex, ok := types.ValueType(expected).TypeIndex(); ok && v.sameType(index, expectedIndex) {
+		return true
+	}
+	typeDef := v.module.Types[index]
+	for _, super := range typeDef.Supers {
+		if v.heapMatches(types.ConcreteHeap(super), expected) {
+			return true
+		}
+	}
+	return v.heapMatches(compositeHeaps[typeDef.Kind], expected)
+}
+
+// The top of the hierarchy of a heap type (any, func, extern or exn)
+func (v *validator) top(heap int) int {
+	if top, ok := bottoms[heap]; ok {
+		return top
+	}
+	if index, concrete := types.ValueType(heap).TypeIndex(); concrete {
+		if int(index) >= len(v.module.Types) {
+			return 0
+		}
+		return v.top(compositeHeaps[v.module.Types[index].Kind])
+	}
+	if super, ok := abstractSupers[heap]; ok {
+		return v.top(super)
+	}
+	return heap
+}
+
+// Types are structural: two types are the same if their recursive groups are the same,
+// the types of its own group are referenced by their position in the group
+// e.g. two (type $point (struct (field i32 i32))) are the same type
+// See https://webassembly.github.io/gc/core/valid/conventions.html#rolling-and-unrolling
+func (v *validator) sameType(a, b uint32) bool {
+	if a == b {
+		return true
+	}
+	if len(v.groups) != len(v.module.Types) || int(a) >= len(v.groups) || int(b) >= len(v.groups) {
+		return false
+	}
+	groupA, groupB := v.groups[a], v.groups[b]
+	rec := v.module.Types[groupA].Rec
+	if rec != v.module.Types[groupB].Rec || int(a)-groupA != int(b)-groupB {
+		return false
+	}
+
+	sameValue := func(x, y types.ValueType) bool {
+		indexX, concreteX := x.TypeIndex()
+		indexY, concreteY := y.TypeIndex()
+		if !concreteX || !concreteY {
+			return x == y
+		}
+		if x.Nullable() != y.Nullable() {
+			return false
+		}
+		insideX, insideY := int(indexX) >= groupA && int(indexX) < groupA+rec, int(indexY) >= groupB && int(indexY) < groupB+rec
+		if insideX || insideY {
+			return insideX && insideY && int(indexX)-groupA == int(indexY)-groupB
+		}
+		return v.sameType(indexX, indexY)
+	}
+
+	for i := 0; i < rec; i++ {
+		x, y := v.module.Types[groupA+i], v.module.Types[groupB+i]
+		if x.Kind != y.Kind || x.Final != y.Final || len(x.Supers) != len(y.Supers) || len(x.Params) != len(y.Params) || len(x.Results) != len(y.Results) || len(x.Fields) != len(y.Fields) {
+			return false
+		}
+		for j := range x.Supers {
+			if !sameValue(types.Ref(types.ConcreteHeap(x.Supers[j]), true), types.Ref(types.ConcreteHeap(y.Supers[j]), true)) {
+				return false
+			}
+		}
+		for j, value := range typeValues(x) {
+			if !sameValue(value, typeValues(y)[j]) {
+				return false
+			}
+		}
+		for j := range x.Fields {
+			if x.Fields[j].Mutable != y.Fields[j].Mutable {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// A reference to a type of the module must point to a type that exists
+func (v *validator) validValueType(value types.ValueType) error {
+	if index, concrete := value.TypeIndex(); concrete && int(index) >= len(v.module.Types) {
+		return fmt.Errorf("unknown type %d", index)
+	}
+	return nil
+}
+
+// Locals must have a default value (0 or null) unless they are set before they are read
+// See https://webassembly.github.io/gc/core/valid/types.html#defaultable-types
+func defaultable(value types.ValueType) bool {
+	return !value.IsRef() || value.Nullable()
+}
+
+func (v *validator) funcType(index uint32) (types.FunctionType, error) {
+	if int(index) >= len(v.module.Types) {
+		return types.FunctionType{}, fmt.Errorf("unknown type %d", index)
+	}
+	if v.module.Types[index].Kind != types.FuncType {
+		return types.FunctionType{}, fmt.Errorf("type %d is not a function type", index)
+	}
+	return v.module.Types[index].FunctionType, nil
+}
+
+func (v *validator) compositeType(index uint32, kind int) (types.TypeDef, error) {
+	if int(index) >= len(v.module.Types) {
+		return types.TypeDef{}, fmt.Errorf("unknown type %d", index)
+	}
+	typeDef := v.module.Types[index]
+	if typeDef.Kind != kind {
+		return typeDef, fmt.Errorf("type %d is not a%s type", index, map[int]string{types.StructType: " struct", types.ArrayType: "n array"}[kind])
+	}
+	return typeDef, nil
+}
+
+// Struct, array, i31 and cast instructions
+// See https://webassembly.github.io/gc/core/valid/instructions.html#aggregate-reference-instructions
+func (v *validator) validateGC(instruction types.Instruction) (bool, error) {
+	i32 := v.i32()
+	name := instruction.Name
+
+	// The struct or the array type, and a nullable reference to it
+	var typeDef types.TypeDef
+	var self, element types.ValueType
+	var err error
+	switch name {
+	case "struct.new", "struct.new_default", "struct.get", "struct.get_s", "struct.get_u", "struct.set":
+		typeDef, err = v.compositeType(instruction.Immediates[0].(uint32), types.StructType)
+	case "array.new", "array.new_default", "array.new_fixed", "array.new_data", "array.new_elem", "array.get", "array.get_s", "array.get_u",
+		"array.set", "array.fill", "array.copy", "array.init_data", "array.init_elem":
+		typeDef, err = v.compositeType(instruction.Immediates[0].(uint32), types.ArrayType)
+		if err == nil {
+			element = typeDef.Fields[0].Type
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+	if typeDef.Kind != 0 {
+		self = types.Ref(types.ConcreteHeap(instruction.Immediates[0].(uint32)), true)
+	}
+
+	switch name {
+	case "struct.new":
+		params := []types.ValueType{}
+		for _, field := range typeDef.Fields {
+			params = append(params, field.Type.Unpacked())
+		}
+		return true, v.applyType(types.FunctionType{Params: params, Results: []types.ValueType{self | types.NonNull}})
+
+	case "struct.new_default", "array.new_default":
+		for _, field := range typeDef.Fields {
+			if !defaultable(field.Type) {
+				return true, fmt.Errorf("%s needs fields with a default value, %s has none", name, typeName(field.Type))
+			}
+		}
+		params := []types.ValueType{}
+		if name == "array.new_default" {
+			params = append(params, i32)
+		}
+		return true, v.applyType(types.FunctionType{Params: params, Results: []types.ValueType{self | types.NonNull}})
+
+	// Packed fields are read with _s or _u (sign or zero extended), the others without
+	case "struct.get", "struct.get_s", "struct.get_u", "struct.set":
+		index := instruction.Immediates[1].(uint32)
+		if int(index) >= len(typeDef.Fields) {
+			return true, fmt.Errorf("unknown field %d", index)
+		}
+		field := typeDef.Fields[index]
+		if err := v.packed(name, field.Type); err != nil {
+			return true, err
+		}
+		if name == "struct.set" {
+			if !field.Mutable {
+				return true, fmt.Errorf("field %d is immutable", index)
+			}
+			return true, v.applyType(types.FunctionType{Params: []types.ValueType{self, field.Type.Unpacked()}})
+		}
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{self}, Results: []types.ValueType{field.Type.Unpacked()}})
+
+	case "array.new":
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{element.Unpacked(), i32}, Results: []types.ValueType{self | types.NonNull}})
+
+	case "array.new_fixed":
+		params := make([]types.ValueType, instruction.Immediates[1].(uint32))
+		for i := range params {
+			params[i] = element.Unpacked()
+		}
+		return true, v.applyType(types.FunctionType{Params: params, Results: []types.ValueType{self | types.NonNull}})
+
+	// The bytes of a data segment can only be numbers, the references of an elem segment must match
+	case "array.new_data", "array.new_elem", "array.init_data", "array.init_elem":
+		if err := v.segmentElements(name, instruction.Immediates[1].(uint32), element); err != nil {
+			return true, err
+		}
+		if name == "array.new_data" || name == "array.new_elem" {
+			return true, v.applyType(types.FunctionType{Params: []types.ValueType{i32, i32}, Results: []types.ValueType{self | types.NonNull}})
+		}
+		if !typeDef.Fields[0].Mutable {
+			return true, fmt.Errorf("array %d is immutable", instruction.Immediates[0])
+		}
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{self, i32, i32, i32}})
+
+	case "array.get", "array.get_s", "array.get_u":
+		if err := v.packed(name, element); err != nil {
+			return true, err
+		}
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{self, i32}, Results: []types.ValueType{element.Unpacked()}})
+
+	case "array.set", "array.fill":
+		if !typeDef.Fields[0].Mutable {
+			return true, fmt.Errorf("array %d is immutable", instruction.Immediates[0])
+		}
+		if name == "array.set" {
+			return true, v.applyType(types.FunctionType{Params: []types.ValueType{self, i32, element.Unpacked()}})
+		}
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{self, i32, element.Unpacked(), i32}})
+
+	// array.copy $destination $source
+	case "array.copy":
+		source, err := v.compositeType(instruction.Immediates[1].(uint32), types.ArrayType)
+		if err != nil {
+			return true, err
+		}
+		if !typeDef.Fields[0].Mutable {
+			return true, fmt.Errorf("array %d is immutable", instruction.Immediates[0])
+		}
+		if !v.matches(source.Fields[0].Type, element) {
+			return true, fmt.Errorf("type mismatch: can not copy %s into %s", typeName(source.Fields[0].Type), typeName(element))
+		}
+		sourceRef := types.Ref(types.ConcreteHeap(instruction.Immediates[1].(uint32)), true)
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{self, i32, sourceRef, i32, i32}})
+
+	case "array.len":
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{types.Ref(heapArray, true)}, Results: []types.ValueType{i32}})
+
+	// A reference can be tested (or cast) only against a type of its own hierarchy
+	case "ref.test", "ref.cast":
+		target := instruction.Immediates[0].(types.ValueType)
+		if err := v.validValueType(target); err != nil {
+			return true, err
+		}
+		value, err := v.popRef()
+		if err != nil {
+			return true, err
+		}
+		if value != unknown && v.top(value.Heap()) != v.top(target.Heap()) {
+			return true, fmt.Errorf("type mismatch: can not cast %s to %s", typeName(value), typeName(target))
+		}
+		if name == "ref.test" {
+			v.pushVals([]types.ValueType{i32})
+		} else {
+			v.pushVals([]types.ValueType{target})
+		}
+		return true, nil
+
+	// br_on_cast branches with the cast reference, br_on_cast_fail with the original one
+	// what is left on the stack is the other one (without null if the null went to the branch)
+	case "br_on_cast", "br_on_cast_fail":
+		from, to := instruction.Immediates[1].(types.ValueType), instruction.Immediates[2].(types.ValueType)
+		for _, value := range []types.ValueType{from, to} {
+			if err := v.validValueType(value); err != nil {
+				return true, err
+			}
+		}
+		if !v.matches(to, from) {
+			return true, fmt.Errorf("type mismatch: %s is not a subtype of %s", typeName(to), typeName(from))
+		}
+		labels, err := v.labelTypes(instruction.Immediates[0].(uint32))
+		if err != nil {
+			return true, err
+		}
+		if len(labels) == 0 {
+			return true, fmt.Errorf("type mismatch: the label of %s must take a reference", name)
+		}
+		rest := types.Ref(from.Heap(), from.Nullable() && !to.Nullable())
+		branch, remaining := to, rest
+		if name == "br_on_cast_fail" {
+			branch, remaining = rest, to
+		}
+		if !v.matches(branch, labels[len(labels)-1]) {
+			return true, fmt.Errorf("type mismatch: the label expects %s, found %s", typeName(labels[len(labels)-1]), typeName(branch))
+		}
+		if err := v.popExpect(from); err != nil {
+			return true, err
+		}
+		if err := v.popVals(labels[:len(labels)-1]); err != nil {
+			return true, err
+		}
+		v.pushVals(labels[:len(labels)-1])
+		v.pushVals([]types.ValueType{remaining})
+		return true, nil
+
+	// externref <-> anyref, null stays null
+	case "any.convert_extern", "extern.convert_any":
+		from, to := heapExtern, heapAny
+		if name == "extern.convert_any" {
+			from, to = heapAny, heapExtern
+		}
+		value, err := v.popVal()
+		if err != nil {
+			return true, err
+		}
+		if !v.matches(value, types.Ref(from, true)) {
+			return true, fmt.Errorf("type mismatch: expected %s, found %s", typeName(types.Ref(from, true)), typeName(value))
+		}
+		v.pushVals([]types.ValueType{types.Ref(to, value == unknown || value.Nullable())})
+		return true, nil
+
+	case "ref.i31":
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{i32}, Results: []types.ValueType{types.Ref(heapI31, false)}})
+
+	case "i31.get_s", "i31.get_u":
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{types.Ref(heapI31, true)}, Results: []types.ValueType{i32}})
+
+	case "ref.eq":
+		eqref := types.Ref(heapEq, true)
+		return true, v.applyType(types.FunctionType{Params: []types.ValueType{eqref, eqref}, Results: []types.ValueType{i32}})
+
+	// traps if the reference is null
+	case "ref.as_non_null":
+		value, err := v.popRef()
+		if err != nil {
+			return true, err
+		}
+		if value != unknown {
+			value |= types.NonNull
+		}
+		v.pushVals([]types.ValueType{value})
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// struct.get_s and the others read packed fields (i8 and i16), struct.get reads the other ones
+func (v *validator) packed(name string, value types.ValueType) error {
+	isPacked := value != value.Unpacked()
+	signed := name[len(name)-2:] == "_s" || name[len(name)-2:] == "_u"
+	if isPacked && !signed {
+		return fmt.Errorf("field of packed type %s needs %s_s or %s_u", typeName(value), name, name)
+	}
+	if !isPacked && signed {
+		return fmt.Errorf("%s needs a field of packed type (i8 or i16), found %s", name, typeName(value))
+	}
+	return nil
+}
+
+func (v *validator) segmentElements(name string, segment uint32, element types.ValueType) error {
+	if name == "array.new_data" || name == "array.init_data" {
+		if element.IsRef() {
+			return fmt.Errorf("type mismatch: %s needs an array of numbers, found %s", name, typeName(element))
+		}
+		return nil
+	}
+	if elemType := v.module.Elems[segment].Type; !v.matches(elemType, element) {
+		return fmt.Errorf("type mismatch: elements of %s, array of %s", typeName(elemType), typeName(element))
+	}
+	return nil
+}
+
+// popRef pops any reference
+func (v *validator) popRef() (types.ValueType, error) {
+	value, err := v.popVal()
+	if err != nil {
+		return 0, err
+	}
+	if !isReference(value) {
+		return 0, fmt.Errorf("type mismatch: expected a reference, found %s", typeName(value))
+	}
+	return value, nil
+}
+
+// heapName formats a heap type: func, any... or the index of a type of the module
+func heapName(heap int) string {
+	if index, concrete := types.ValueType(heap).TypeIndex(); concrete {
+		return fmt.Sprint(index)
+	}
+	for name, value := range types.HeapType {
+		if value.(int) == heap {
+			return name
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,774 @@
+package compiler
+
+import (
+	"luna/defaults"
+	"luna/texts"
+	"luna/types"
+	"strings"
+)
+
+// Instructions
+// See https://webassembly.github.io/spec/core/text/instructions.html
+//
+// In the flat form an instruction is followed by its immediates
+//
+//	local.get $a
+//	i32.const 42
+//	block $exit (result i32) ... end
+//
+// Which immediates (and in which order) is described by defaults.Immediates
+
+// What the instructions of a function can reference
+type context struct {
+	// Params and locals by their $id
+	locals map[string]uint32
+	// The blocks that are open, the innermost is the last
+	labels []label
+}
+
+type label struct {
+	name string
+	node types.AstNode
+}
+
+// parseBody parses the instructions of a function (or of a constant expression)
+// all the blocks opened inside must be closed by an end
+func (b *builder) parseBody(nodes []types.AstNode, ctx *context) ([]types.Instruction, error) {
+	body, err := b.parseInstructions(nodes, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ctx.labels) > 0 {
+		open := ctx.labels[len(ctx.labels)-1].node
+		return nil, nodeError(open, "%s without end", open.Value)
+	}
+	return body, nil
+}
+
+func (b *builder) parseInstructions(nodes []types.AstNode, ctx *context) ([]types.Instruction, error) {
+	instructions := []types.Instruction{}
+
+	for i := 0; i < len(nodes); {
+		if nodes[i].Type == texts.ListNode {
+			folded, err := b.parseFolded(nodes[i], ctx)
+			if err != nil {
+				return nil, err
+			}
+			instructions = append(instructions, folded...)
+			i++
+			continue
+		}
+
+		instruction, consumed, err := b.parseInstruction(nodes[i:], ctx)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+		i += consumed
+	}
+
+	return instructions, nil
+}
+
+// Folded instructions are written between parens and they contain their operands
+//
+//	(i32.add (local.get 0) (i32.const 1))
+//
+// the operands are executed first, so it is the same as the flat
+//
+//	local.get 0
+//	i32.const 1
+//	i32.add
+//
+// Blocks contain their instructions and the end is implicit
+//
+//	(block $label (result i32) instructions*)
+//	(loop $label (result i32) instructions*)
+//	(if $label (result i32) condition* (then instructions*) (else instructions*)?)
+//
+// See https://webassembly.github.io/spec/core/text/instructions.html#folded-instructions
+func (b *builder) parseFolded(list types.AstNode, ctx *context) ([]types.Instruction, error) {
+	if len(list.Children) == 0 {
+		return nil, nodeError(list, "unexpected (), an instruction was expected")
+	}
+
+	switch list.Children[0].Value {
+	case "block", "loop", "try_table":
+		instruction, consumed, err := b.parseInstruction(list.Children, ctx)
+		if err != nil {
+			return nil, err
+		}
+		body, err := b.parseBlock(list.Children[consumed:], ctx)
+		if err != nil {
+			return nil, err
+		}
+		instructions := append([]types.Instruction{instruction}, body...)
+		return append(instructions, b.closeBlock(ctx)), nil
+
+	case "if":
+		return b.parseFoldedIf(list, ctx)
+
+	case "try":
+		return b.parseFoldedTry(list, ctx)
+
+	case "then", "else", "end", "do":
+		return nil, nodeError(list, "unexpected (%s ...), an instruction was expected", list.Children[0].Value)
+	}
+
+	instruction, consumed, err := b.parseInstruction(list.Children, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The operands come before the instruction
+	instructions := []types.Instruction{}
+	for _, operand := range list.Children[consumed:] {
+		if operand.Type != texts.ListNode {
+			return nil, nodeError(operand, "unexpected %s, a folded instruction was expected", describe(operand))
+		}
+		folded, err := b.parseFolded(operand, ctx)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, folded...)
+	}
+
+	return append(instructions, instruction), nil
+}
+
+// (if $label? blocktype condition* (then instructions*) (else instructions*)?)
+// becomes condition* if $label? blocktype instructions* else instructions* end
+func (b *builder) parseFoldedIf(list types.AstNode, ctx *context) ([]types.Instruction, error) {
+	instruction, consumed, err := b.parseInstruction(list.Children, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The condition is outside of the if, so it can not see its label
+	ifLabel := ctx.labels[len(ctx.labels)-1]
+	ctx.labels = ctx.labels[:len(ctx.labels)-1]
+
+	rest := list.Children[consumed:]
+	instructions := []types.Instruction{}
+	for len(rest) > 0 && keyword(rest[0]) != "then" {
+		if rest[0].Type != texts.ListNode {
+			return nil, nodeError(rest[0], "unexpected %s, a folded instruction was expected", describe(rest[0]))
+		}
+		folded, err := b.parseFolded(rest[0], ctx)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, folded...)
+		rest = rest[1:]
+	}
+	ctx.labels = append(ctx.labels, ifLabel)
+	instructions = append(instructions, instruction)
+
+	if len(rest) == 0 {
+		return nil, nodeError(list, "expected (then ...)")
+	}
+	then, err := b.parseBlock(rest[0].Children[1:], ctx)
+	if err != nil {
+		return nil, err
+	}
+	instructions = append(instructions, then...)
+	rest = rest[1:]
+
+	if len(rest) > 0 && keyword(rest[0]) == "else" {
+		otherwise, err := b.parseBlock(rest[0].Children[1:], ctx)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, types.Instruction{Name: "else", Immediates: []interface{}{}})
+		instructions = append(instructions, otherwise...)
+		rest = rest[1:]
+	}
+
+	if len(rest) > 0 {
+		return nil, nodeError(rest[0], "unexpected %s after the branches of the if", describe(rest[0]))
+	}
+
+	return append(instructions, b.closeBlock(ctx)), nil
+}
+
+// Legacy exception handling
+// (try $label? blocktype (do instructions*) (catch $tag instructions*)* (catch_all instructions*)?)
+// becomes try $label? blocktype instructions* catch $tag instructions* ... catch_all instructions* end
+// (try $label? blocktype (do instructions*) (delegate $label))
+// becomes try $label? blocktype instructions* delegate $label
+func (b *builder) parseFoldedTry(list types.AstNode, ctx *context) ([]types.Instruction, error) {
+	instruction, consumed, err := b.parseInstruction(list.Children, ctx)
+	if err != nil {
+		return nil, err
+	}
+	instructions := []types.Instruction{instruction}
+
+	rest := list.Children[consumed:]
+	if len(rest) == 0 || keyword(rest[0]) != "do" {
+		return nil, nodeError(list, "expected (do ...)")
+	}
+	body, err := b.parseBlock(rest[0].Children[1:], ctx)
+	if err != nil {
+		return nil, err
+	}
+	instructions = append(instructions, body...)
+	rest = rest[1:]
+
+	if len(rest) == 1 && keyword(rest[0]) == "delegate" {
+		delegate, _, err := b.parseInstruction(rest[0].Children, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest[0].Children) != 2 {
+			return nil, nodeError(rest[0], "expected (delegate label)")
+		}
+		return append(instructions, delegate), nil
+	}
+
+	for len(rest) > 0 && (keyword(rest[0]) == "catch" || keyword(rest[0]) == "catch_all") {
+		handler, consumed, err := b.parseInstruction(rest[0].Children, ctx)
+		if err != nil {
+			return nil, err
+		}
+		body, err := b.parseBlock(rest[0].Children[consumed:], ctx)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(append(instructions, handler), body...)
+		rest = rest[1:]
+	}
+
+	if len(rest) > 0 {
+		return nil, nodeError(rest[0], "unexpected %s after the handlers of the try", describe(rest[0]))
+	}
+
+	return append(instructions, b.closeBlock(ctx)), nil
+}
+
+// parseBlock parses the instructions inside a folded block
+// they can be flat or folded, but the blocks they open must be closed inside
+func (b *builder) parseBlock(nodes []types.AstNode, ctx *context) ([]types.Instruction, error) {
+	depth := len(ctx.labels)
+	body, err := b.parseInstructions(nodes, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ctx.labels) != depth {
+		open := ctx.labels[len(ctx.labels)-1].node
+		return nil, nodeError(open, "%s without end", open.Value)
+	}
+	return body, nil
+}
+
+// closeBlock is the implicit end of a folded block
+func (b *builder) closeBlock(ctx *context) types.Instruction {
+	ctx.labels = ctx.labels[:len(ctx.labels)-1]
+	return types.Instruction{Name: "end", Immediates: []interface{}{}}
+}
+
+// parseInstruction reads an instruction and its immediates
+// and returns how many nodes it consumed
+func (b *builder) parseInstruction(nodes []types.AstNode, ctx *context) (types.Instruction, int, error) {
+	node := nodes[0]
+	if node.Type != texts.TypeInstruction {
+		return types.Instruction{}, 0, nodeError(node, "unexpected %s, an instruction was expected", describe(node))
+	}
+
+	name := node.Value
+	if alias, ok := defaults.Aliases[name]; ok {
+		name = alias
+	}
+
+	instruction := types.Instruction{Name: name, Immediates: []interface{}{}}
+	c := &cursor{nodes: nodes, pos: 1}
+
+	if defaults.Legacy[name] && !b.options.LegacyExceptions {
+		return instruction, 0, nodeError(node, "%s is a legacy exception handling instruction, use try_table or enable the legacy instructions", name)
+	}
+
+	// catch and catch_all start a handler of the innermost try
+	if name == "catch" || name == "catch_all" {
+		if len(ctx.labels) == 0 || ctx.labels[len(ctx.labels)-1].node.Value != "try" {
+			return instruction, 0, nodeError(node, "%s without try", name)
+		}
+	}
+
+	// delegate closes a try (like end) and forwards its exceptions to a label outside of it
+	if name == "delegate" {
+		if len(ctx.labels) == 0 || ctx.labels[len(ctx.labels)-1].node.Value != "try" {
+			return instruction, 0, nodeError(node, "delegate without try")
+		}
+		ctx.labels = ctx.labels[:len(ctx.labels)-1]
+	}
+
+	// else splits an if in two, it can repeat the label of the if
+	if name == "else" {
+		if len(ctx.labels) == 0 || ctx.labels[len(ctx.labels)-1].node.Value != "if" {
+			return instruction, 0, nodeError(node, "else without if")
+		}
+		open := ctx.labels[len(ctx.labels)-1]
+
+		if id := c.peek(); id != nil && id.Type == texts.Id {
+			if id.Value != open.name {
+				return instruction, 0, nodeError(*id, "mismatching label %s", id.Value)
+			}
+			c.next()
+		}
+		return instruction, c.pos, nil
+	}
+
+	// end closes the innermost block, it can repeat its label
+	if name == "end" {
+		if len(ctx.labels) == 0 {
+			return instruction, 0, nodeError(node, "end without a block")
+		}
+		open := ctx.labels[len(ctx.labels)-1]
+		ctx.labels = ctx.labels[:len(ctx.labels)-1]
+
+		if id := c.peek(); id != nil && id.Type == texts.Id {
+			if id.Value != open.name {
+				return instruction, 0, nodeError(*id, "mismatching label %s", id.Value)
+			}
+			c.next()
+		}
+		return instruction, c.pos, nil
+	}
+
+	// call_indirect $table? typeuse (and return_call_indirect)
+	// the table is optional (0 by default) and is written before the type
+	// See https://webassembly.github.io/spec/core/text/instructions.html#control-instructions
+	if name == "call_indirect" || name == "return_call_indirect" {
+		table := uint32(0)
+		if next := c.peek(); next != nil && (next.Type == texts.Id || next.Type == texts.Number) {
+			index, err := b.resolve(*c.next(), tableSpace)
+			if err != nil {
+				return instruction, 0, err
+			}
+			table = index
+		}
+
+		typeIndex, _, err := b.typeUse(c, nil)
+		if err != nil {
+			return instruction, 0, err
+		}
+		instruction.Immediates = append(instruction.Immediates, typeIndex, table)
+		return instruction, c.pos, nil
+	}
+
+	// table.init $table? $elem and table.copy ($destination $source)?
+	// memory.init $memory? $data and memory.copy ($destination $source)?
+	// the tables (and memories) are optional (0 by default) and are written first
+	// See https://webassembly.github.io/spec/core/text/instructions.html#table-instructions
+	if name == "table.init" || name == "table.copy" || name == "memory.init" || name == "memory.copy" {
+		space, segments, segment := tableSpace, elemSpace, texts.ElemIdx
+		if strings.HasPrefix(name, "memory.") {
+			space, segments, segment = memorySpace, dataSpace, texts.DataIdx
+		}
+
+		indices := []interface{}{uint32(0), uint32(0)}
+		written := 1
+		if strings.HasSuffix(name, ".copy") {
+			written = 2
+		}
+		if countIndices(c) >= 2 {
+			for i := range indices[:written] {
+				index, err := b.resolve(*c.next(), space)
+				if err != nil {
+					return instruction, 0, err
+				}
+				indices[i] = index
+			}
+		}
+
+		if written == 2 {
+			instruction.Immediates = append(instruction.Immediates, indices[0], indices[1])
+			return instruction, c.pos, nil
+		}
+
+		next := c.next()
+		if next == nil || next.Type == texts.ListNode {
+			return instruction, 0, nodeError(node, "missing %s of %s", segment, node.Value)
+		}
+		index, err := b.resolve(*next, segments)
+		if err != nil {
+			return instruction, 0, err
+		}
+		instruction.Immediates = append(instruction.Immediates, index, indices[0])
+		return instruction, c.pos, nil
+	}
+
+	for _, kind := range defaults.Immediates[name] {
+		immediate, err := b.parseImmediate(kind, c, node, ctx)
+		// Fields are named in their struct type, the type comes right before them (struct.get $point $x)
+		if kind == texts.FieldIdx && err == nil {
+			immediate, err = b.fieldIndex(instruction.Immediates[len(instruction.Immediates)-1].(uint32), immediate.(types.AstNode))
+		}
+		if err != nil {
+			return instruction, 0, err
+		}
+		instruction.Immediates = append(instruction.Immediates, immediate)
+	}
+
+	return instruction, c.pos, nil
+}
+
+func (b *builder) parseImmediate(kind string, c *cursor, instruction types.AstNode, ctx *context) (interface{}, error) {
+	switch kind {
+	// block $label? blocktype
+	// the block type is a type use: (type $t)? (param ...)* (result ...)*
+	// See https://webassembly.github.io/spec/core/text/instructions.html#control-instructions
+	case texts.BlockType:
+		ctx.labels = append(ctx.labels, label{name: c.id(), node: instruction})
+
+		index, funcType, explicit, err := b.optionalTypeUse(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		blockType := types.BlockType{Params: funcType.Params, Results: funcType.Results, Index: index, HasIndex: explicit}
+
+		// Multiple values need a function type
+		if !explicit && (len(funcType.Params) > 0 || len(funcType.Results) > 1) {
+			blockType.Index = b.typeIndex(funcType)
+			blockType.HasIndex = true
+		}
+		return blockType, nil
+
+	// br_table $label+: the last label is the default one
+	// See https://webassembly.github.io/spec/core/text/instructions.html#control-instructions
+	case texts.Labels:
+		labels := []uint32{}
+		for countIndices(c) > 0 {
+			index, err := b.labelIndex(*c.next(), ctx.labels)
+			if err != nil {
+				return nil, err
+			}
+			labels = append(labels, index)
+		}
+		if len(labels) == 0 {
+			return nil, nodeError(instruction, "missing %s of %s", kind, instruction.Value)
+		}
+		return labels, nil
+
+	// memidx? memarg: $memory? offset=n? align=n?
+	// the lane of v128.load8_lane (and the others) is an index too, so the memory is there only if both are
+	// See https://webassembly.github.io/spec/core/text/instructions.html#memory-instructions
+	case texts.MemArg:
+		memory := uint32(0)
+		written := 1
+		if kinds := defaults.Immediates[instruction.Value]; kinds[len(kinds)-1] == texts.LaneIdx {
+			written = 2
+		}
+		if countIndices(c) >= written {
+			index, err := b.resolve(*c.next(), memorySpace)
+			if err != nil {
+				return nil, err
+			}
+			memory = index
+		}
+		memArg, err := parseMemArg(c, instruction)
+		memArg.Memory = memory
+		return memArg, err
+
+	// Memory indices are optional (0 by default)
+	case texts.MemIdx:
+		if countIndices(c) == 0 {
+			return uint32(0), nil
+		}
+		return b.resolve(*c.next(), memorySpace)
+
+	case texts.Reserved:
+		return uint32(0), nil
+
+	// Table indices are optional (0 by default)
+	case texts.TableIdx:
+		if countIndices(c) == 0 {
+			return uint32(0), nil
+		}
+		return b.resolve(*c.next(), tableSpace)
+
+	// (catch $tag $label) (catch_ref $tag $label) (catch_all $label) (catch_all_ref $label)
+	// the labels are outside of the try_table, its own label was already pushed by the block type
+	// See https://webassembly.github.io/exception-handling/core/text/instructions.html#control-instructions
+	case texts.Catches:
+		catches := []types.Catch{}
+		outside := ctx.labels[:len(ctx.labels)-1]
+		for c.isList("catch", "catch_ref", "catch_all", "catch_all_ref") {
+			list := c.next()
+			handler := types.Catch{Kind: catchKinds[keyword(*list)]}
+
+			arguments := list.Children[1:]
+			expected := 2
+			if handler.Kind == types.CatchAll || handler.Kind == types.CatchAllRef {
+				expected = 1
+			}
+			if len(arguments) != expected {
+				return nil, nodeError(*list, "expected (%s %s)", keyword(*list), map[int]string{1: "label", 2: "tag label"}[expected])
+			}
+			if expected == 2 {
+				tag, err := b.resolve(arguments[0], tagSpace)
+				if err != nil {
+					return nil, err
+				}
+				handler.Tag = tag
+			}
+			index, err := b.labelIndex(arguments[expected-1], outside)
+			if err != nil {
+				return nil, err
+			}
+			handler.Label = index
+			catches = append(catches, handler)
+		}
+		return catches, nil
+
+	// select (result t)*
+	// See https://webassembly.github.io/spec/core/text/instructions.html#parametric-instructions
+	case texts.SelectType:
+		values := []types.ValueType{}
+		for c.isList("result") {
+			results, err := b.valueTypes(*c.next(), nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, results...)
+		}
+		return values, nil
+
+	// v128.const shape lanes+
+	// See https://webassembly.github.io/spec/core/text/instructions.html#vector-instructions
+	case texts.V128Const:
+		return parseV128(c, instruction)
+
+	// i8x16.shuffle takes 16 lanes out of the 32 of its operands
+	case texts.Shuffle:
+		var lanes [16]byte
+		for i := range lanes {
+			node := c.next()
+			if node == nil || node.Type == texts.ListNode {
+				return nil, nodeError(instruction, "%s expects 16 lane indices", instruction.Value)
+			}
+			value, err := parseUnsigned(node.Value, 8)
+			if err != nil {
+				return nil, nodeError(*node, "%v", err)
+			}
+			lanes[i] = byte(value)
+		}
+		return lanes, nil
+	}
+
+	// ref.test (ref null $t), ref.cast i31ref
+	// See https://webassembly.github.io/gc/core/text/instructions.html#reference-instructions
+	if kind == texts.RefType {
+		node := c.next()
+		if node == nil {
+			return nil, nodeError(instruction, "missing %s of %s", kind, instruction.Value)
+		}
+		return b.refType(*node)
+	}
+
+	node := c.next()
+	if node == nil || node.Type == texts.ListNode {
+		return nil, nodeError(instruction, "missing %s of %s", kind, instruction.Value)
+	}
+
+	switch kind {
+	case texts.LabelIdx:
+		return b.labelIndex(*node, ctx.labels)
+
+	case texts.TagIdx:
+		return b.resolve(*node, tagSpace)
+
+	case texts.FuncIdx:
+		return b.resolve(*node, funcSpace)
+
+	case texts.GlobalIdx:
+		return b.resolve(*node, globalSpace)
+
+	case texts.DataIdx:
+		return b.resolve(*node, dataSpace)
+
+	case texts.TypeIdx:
+		return b.resolve(*node, typeSpace)
+
+	// resolved by parseInstruction, it needs the struct type
+	case texts.FieldIdx:
+		return *node, nil
+
+	// array.new_fixed $t 3
+	case texts.Count:
+		value, err := parseUnsigned(node.Value, 32)
+		if err != nil {
+			return nil, nodeError(*node, "%v", err)
+		}
+		return uint32(value), nil
+
+	// ref.null func, ref.null extern, ref.null $t
+	case texts.HeapType:
+		heapType, err := b.heapType(*node)
+		return types.ValueType(heapType), err
+
+	case texts.ElemIdx:
+		return b.resolve(*node, elemSpace)
+
+	case texts.LocalIdx:
+		if node.Type == texts.Id {
+			index, ok := ctx.locals[node.Value]
+			if !ok {
+				return nil, nodeError(*node, "unknown local %s", node.Value)
+			}
+			return index, nil
+		}
+		return b.resolve(*node, "local")
+
+	case texts.ConstI32:
+		value, err := parseInteger(node.Value, 32)
+		if err != nil {
+			return nil, nodeError(*node, "%v", err)
+		}
+		return int32(value), nil
+
+	case texts.ConstI64:
+		value, err := parseInteger(node.Value, 64)
+		if err != nil {
+			return nil, nodeError(*node, "%v", err)
+		}
+		return value, nil
+
+	case texts.ConstF32:
+		value, err := parseFloat(node.Value, 32)
+		if err != nil {
+			return nil, nodeError(*node, "%v", err)
+		}
+		return uint32(value), nil
+
+	case texts.ConstF64:
+		value, err := parseFloat(node.Value, 64)
+		if err != nil {
+			return nil, nodeError(*node, "%v", err)
+		}
+		return value, nil
+
+	// The lane is checked against the shape by the validator
+	case texts.LaneIdx:
+		value, err := parseUnsigned(node.Value, 8)
+		if err != nil {
+			return nil, nodeError(*node, "%v", err)
+		}
+		return uint32(value), nil
+	}
+
+	return nil, nodeError(instruction, "unknown immediate %s", kind)
+}
+
+var catchKinds = map[string]int{
+	"catch":         types.CatchTag,
+	"catch_ref":     types.CatchTagRef,
+	"catch_all":     types.CatchAll,
+	"catch_all_ref": types.CatchAllRef,
+}
+
+// Labels are referenced by their depth: 0 is the innermost block
+func (b *builder) labelIndex(node types.AstNode, labels []label) (uint32, error) {
+	if node.Type == texts.Id {
+		for i := len(labels) - 1; i >= 0; i-- {
+			if labels[i].name == node.Value {
+				return uint32(len(labels) - 1 - i), nil
+			}
+		}
+		return 0, nodeError(node, "unknown label %s", node.Value)
+	}
+	return b.resolve(node, "label")
+}
+
+// A vector constant is written as its shape followed by the value of each lane
+// e.g. v128.const i32x4 1 2 3 4 or v128.const f64x2 1.5 -inf
+// All of them are 16 bytes in little endian (the first lane comes first)
+func parseV128(c *cursor, instruction types.AstNode) ([16]byte, error) {
+	var bytes [16]byte
+
+	shape := c.next()
+	if shape == nil || shape.Type != texts.TypeToken || defaults.Shapes[shape.Value] == 0 {
+		return bytes, nodeError(instruction, "%s expects a shape (i8x16, i16x8, i32x4, i64x2, f32x4 or f64x2)", instruction.Value)
+	}
+	lanes := defaults.Shapes[shape.Value]
+	size := 16 / lanes
+
+	for lane := 0; lane < lanes; lane++ {
+		node := c.next()
+		if node == nil || node.Type == texts.ListNode {
+			return bytes, nodeError(*shape, "%s expects %d lanes", shape.Value, lanes)
+		}
+
+		var value uint64
+		var err error
+		if shape.Value[0] == 'f' {
+			value, err = parseFloat(node.Value, size*8)
+		} else {
+			var signed int64
+			signed, err = parseInteger(node.Value, size*8)
+			value = uint64(signed)
+		}
+		if err != nil {
+			return bytes, nodeError(*node, "%v", err)
+		}
+
+		for i := 0; i < size; i++ {
+			bytes[lane*size+i] = byte(value >> (8 * i))
+		}
+	}
+	return bytes, nil
+}
+
+// The alignment is written in bytes but encoded as an exponent (align=4 is 2)
+// and it can not be bigger than the natural alignment of the instruction
+func parseMemArg(c *cursor, instruction types.AstNode) (types.MemArg, error) {
+	natural := defaults.Alignment[instruction.Value]
+	memArg := types.MemArg{Align: natural}
+
+	for _, key := range []string{"offset=", "align="} {
+		node := c.peek()
+		if node == nil || node.Type != texts.TypeToken || len(node.Value) <= len(key) || node.Value[:len(key)] != key {
+			continue
+		}
+		c.next()
+
+		// The offset can be 64 bits, the validator checks it against the memory
+		value, err := parseUnsigned(node.Value[len(key):], 64)
+		if err != nil {
+			return memArg, nodeError(*node, "%v", err)
+		}
+
+		if key == "offset=" {
+			memArg.Offset = value
+			continue
+		}
+
+		// Must be a power of two
+		if value == 0 || value&(value-1) != 0 {
+			return memArg, nodeError(*node, "alignment must be a power of two")
+		}
+		exponent := uint32(0)
+		for value > 1 {
+			value >>= 1
+			exponent++
+		}
+		if exponent > natural {
+			return memArg, nodeError(*node, "alignment must not be larger than natural")
+		}
+		memArg.Align = exponent
+	}
+
+	return memArg, nil
+}
+
+// countIndices counts the indices ($ids or numbers) that follow
+func countIndices(c *cursor) int {
+	count := 0
+	for _, node := range c.nodes[c.pos:] {
+		if node.Type != texts.Id && node.Type != texts.Number {
+			break
+		}
+		count++
+	}
+	return count
+}
@@ -0,0 +1,499 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/types"
+	"strings"
+)
+
+// Linker
+// A program can be split in several modules that import what they need from each other,
+// e.g. (import "math" "sqrt" (func ...)) in main.wat and (export "sqrt" (func $sqrt)) in math.wat.
+// Link merges them into a single module:
+// - an import exported by another module (by the name of that module and the name of the export)
+//   becomes the function (table, memory, global or tag) it points to
+// - the index spaces are put one after the other and renumbered,
+//   identical types (and recursive groups) are kept once
+// - the imports that no module exports stay imports, the same import in two modules is imported once
+// - the exports of every module are kept and their start functions are called in the order of the modules
+//
+// Data and element segments are copied as they are: like when the modules are instantiated one by one,
+// two segments written at the same address of a shared memory overwrite each other.
+
+// LinkInput is a module and the name the other modules import it with
+type LinkInput struct {
+	Name   string
+	Module *types.Module
+}
+
+// The index spaces that can be imported and exported (the keys of defaults.ExportSection)
+var linkKinds = []string{"func", "table", "mem", "global", "tag"}
+
+// Something of an index space: the module it comes from (its position in the inputs) and its index there
+type linkRef struct {
+	module int
+	index  uint32
+}
+
+type linker struct {
+	inputs []LinkInput
+	byName map[string]int
+	// the exports of every module by their name
+	exports []map[string]types.Export
+	// where every module is moved in the merged index spaces
+	maps   []remapper
+	merged *types.Module
+}
+
+// Link merges (valid) modules into one, the result should be validated
+func Link(inputs []LinkInput) (*types.Module, error) {
+	l := &linker{inputs: inputs, byName: map[string]int{}, merged: &types.Module{}}
+	for i, input := range inputs {
+		if _, ok := l.byName[input.Name]; ok {
+			return nil, fmt.Errorf("duplicate module name %q", input.Name)
+		}
+		l.byName[input.Name] = i
+		exports := map[string]types.Export{}
+		for _, export := range input.Module.Exports {
+			exports[export.Name] = export
+		}
+		l.exports = append(l.exports, exports)
+		l.maps = append(l.maps, remapper{})
+	}
+
+	l.linkTypes()
+	sources := map[string][]linkRef{}
+	for _, kind := range linkKinds {
+		kindSources, err := l.linkSpace(kind)
+		if err != nil {
+			return nil, err
+		}
+		sources[kind] = kindSources
+	}
+	l.linkSegments()
+
+	m := l.merged
+	for _, source := range sources["func"] {
+		r := l.maps[source.module]
+		fn := l.inputs[source.module].Module.Funcs[source.index]
+		fn.Type = r.types[fn.Type]
+		fn.Locals = r.values(fn.Locals)
+		fn.Body = r.instructions(fn.Body)
+		m.Funcs = append(m.Funcs, fn)
+	}
+	for _, source := range sources["table"] {
+		table := l.inputs[source.module].Module.Tables[source.index]
+		table.ElemType = l.maps[source.module].value(table.ElemType)
+		m.Tables = append(m.Tables, table)
+	}
+	for _, source := range sources["mem"] {
+		m.Memories = append(m.Memories, l.inputs[source.module].Module.Memories[source.index])
+	}
+	for _, source := range sources["global"] {
+		r := l.maps[source.module]
+		global := l.inputs[source.module].Module.Globals[source.index]
+		global.Type = r.value(global.Type)
+		global.Init = r.instructions(global.Init)
+		m.Globals = append(m.Globals, global)
+	}
+	for _, source := range sources["tag"] {
+		tag := l.inputs[source.module].Module.Tags[source.index]
+		tag.Type = l.maps[source.module].types[tag.Type]
+		m.Tags = append(m.Tags, tag)
+	}
+
+	if err := l.linkExports(); err != nil {
+		return nil, err
+	}
+	l.linkStart()
+	return m, nil
+}
+
+// linkTypes merges the type sections, a recursive group is kept once
+func (l *linker) linkTypes() {
+	groups := map[string]uint32{}
+	for i, input := range l.inputs {
+		typeMap := map[uint32]uint32{}
+		l.maps[i].types = typeMap
+
+		typeDefs := input.Module.Types
+		for start := 0; start < len(typeDefs); start += typeDefs[start].Rec {
+			group := typeDefs[start : start+typeDefs[start].Rec]
+			key := groupKey(group, uint32(start), typeMap)
+			first, ok := groups[key]
+			if !ok {
+				first = uint32(len(l.merged.Types))
+				groups[key] = first
+			}
+			for j := range group {
+				typeMap[uint32(start+j)] = first + uint32(j)
+			}
+			if !ok {
+				for _, typeDef := range group {
+					l.merged.Types = append(l.merged.Types, l.maps[i].typeDef(typeDef))
+				}
+			}
+		}
+	}
+}
+
+// groupKey is the same for identical recursive groups:
+// the types inside the group are referenced by their position in it, the other ones by their merged index
+// See https://webassembly.github.io/gc/core/valid/conventions.html#rolling-and-unrolling
+func groupKey(group []types.TypeDef, start uint32, typeMap map[uint32]uint32) string {
+	index := func(index uint32) string {
+		if index >= start && index < start+uint32(len(group)) {
+			return fmt.Sprintf("rec.%d", index-start)
+		}
+		return fmt.Sprint(typeMap[index])
+	}
+	value := func(value types.ValueType) string {
+		if typeIndex, concrete := value.TypeIndex(); concrete {
+			return fmt.Sprintf("(ref %t %s)", value.Nullable(), index(typeIndex))
+		}
+		return fmt.Sprint(int(value))
+	}
+
+	key := strings.Builder{}
+	for _, typeDef := range group {
+		fmt.Fprintf(&key, "(%d %t", typeDef.Kind, typeDef.Final)
+		for _, super := range typeDef.Supers {
+			fmt.Fprintf(&key, " super %s", index(super))
+		}
+		for _, param := range typeDef.Params {
+			fmt.Fprintf(&key, " param %s", value(param))
+		}
+		for _, result := range typeDef.Results {
+			fmt.Fprintf(&key, " result %s", value(result))
+		}
+		for _, field := range typeDef.Fields {
+			fmt.Fprintf(&key, " field %s %t", value(field.Type), field.Mutable)
+		}
+		key.WriteString(")")
+	}
+	return key.String()
+}
+
+// linkSpace merges an index space and returns where every merged item comes from:
+// first the imports that stay imports, then the definitions of every module
+func (l *linker) linkSpace(kind string) ([]linkRef, error) {
+	targets := make([][]linkRef, len(l.inputs))
+	for i, input := range l.inputs {
+		for j := 0; j < spaceLen(input.Module, kind); j++ {
+			target, err := l.resolve(kind, linkRef{i, uint32(j)})
+			if err != nil {
+				return nil, err
+			}
+			targets[i] = append(targets[i], target)
+		}
+	}
+
+	sources := []linkRef{}
+	indices := map[linkRef]uint32{}
+	imports := map[string]uint32{}
+	for i, input := range l.inputs {
+		for j, target := range targets[i] {
+			imported := importOf(input.Module, kind, uint32(j))
+			if imported == nil || target != (linkRef{i, uint32(j)}) {
+				continue
+			}
+			key := fmt.Sprintf("%q %q %s", imported.Module, imported.Name, l.describe(kind, target))
+			if index, ok := imports[key]; ok {
+				indices[target] = index
+				continue
+			}
+			imports[key] = uint32(len(sources))
+			indices[target] = uint32(len(sources))
+			sources = append(sources, target)
+		}
+	}
+	for i, input := range l.inputs {
+		for j := 0; j < spaceLen(input.Module, kind); j++ {
+			if importOf(input.Module, kind, uint32(j)) == nil {
+				indices[linkRef{i, uint32(j)}] = uint32(len(sources))
+				sources = append(sources, linkRef{i, uint32(j)})
+			}
+		}
+	}
+
+	for i, input := range l.inputs {
+		space := map[uint32]uint32{}
+		for j, target := range targets[i] {
+			space[uint32(j)] = indices[target]
+			if from := (linkRef{i, uint32(j)}); target != from && !l.matches(kind, target, from) {
+				imported := importOf(input.Module, kind, uint32(j))
+				return nil, fmt.Errorf("%s: import %s.%s: incompatible import type, %s %s is %s, expected %s",
+					input.Name, imported.Module, imported.Name, kindName(kind), imported.Name, l.describe(kind, target), l.describe(kind, from))
+			}
+		}
+		l.maps[i].setSpace(kind, space)
+	}
+	return sources, nil
+}
+
+// resolve follows an import to what it points to, through the modules that import it themselves
+// it stops at the definition, or at an import from a module that is not linked
+func (l *linker) resolve(kind string, ref linkRef) (linkRef, error) {
+	visited := map[linkRef]bool{}
+	for {
+		imported := importOf(l.inputs[ref.module].Module, kind, ref.index)
+		if imported == nil {
+			return ref, nil
+		}
+		target, ok := l.byName[imported.Module]
+		if !ok {
+			return ref, nil
+		}
+		if visited[ref] {
+			return ref, fmt.Errorf("%s: import %s.%s: the import is exported by itself (import cycle)", l.inputs[ref.module].Name, imported.Module, imported.Name)
+		}
+		visited[ref] = true
+
+		export, ok := l.exports[target][imported.Name]
+		if !ok || export.Kind != defaults.ExportSection[kind] {
+			return ref, fmt.Errorf("%s: import %s.%s: unknown import, %s has no %s export named %q",
+				l.inputs[ref.module].Name, imported.Module, imported.Name, imported.Module, kindName(kind), imported.Name)
+		}
+		ref = linkRef{target, export.Index}
+	}
+}
+
+// describe writes the type of an import (or of what it points to) with the merged type indices
+func (l *linker) describe(kind string, ref linkRef) string {
+	m, r := l.inputs[ref.module].Module, l.maps[ref.module]
+	switch kind {
+	case "func":
+		return l.funcTypeText(r.types[m.Funcs[ref.index].Type])
+	case "table":
+		table := m.Tables[ref.index]
+		return fmt.Sprintf("%s %s", typeName(r.value(table.ElemType)), limitsText(table.Limits))
+	case "mem":
+		return limitsText(m.Memories[ref.index].Limits)
+	case "global":
+		global := m.Globals[ref.index]
+		if global.Mutable {
+			return fmt.Sprintf("(mut %s)", typeName(r.value(global.Type)))
+		}
+		return typeName(r.value(global.Type))
+	case "tag":
+		return l.funcTypeText(r.types[m.Tags[ref.index].Type])
+	}
+	return ""
+}
+
+// e.g. (type 1) [i32 i32] -> [i32]
+func (l *linker) funcTypeText(index uint32) string {
+	typeDef := l.merged.Types[index]
+	return fmt.Sprintf("(type %d) [%s] -> [%s]", index, typeNames(typeDef.Params), typeNames(typeDef.Results))
+}
+
+// An import links only to something of the same type,
+// tables and memories can be bigger than the import asks (their limits are within the ones of the import)
+// See https://webassembly.github.io/spec/core/valid/types.html#import-subtyping
+func (l *linker) matches(kind string, actual, expected linkRef) bool {
+	switch kind {
+	case "table":
+		a, e := l.inputs[actual.module].Module.Tables[actual.index], l.inputs[expected.module].Module.Tables[expected.index]
+		return l.maps[actual.module].value(a.ElemType) == l.maps[expected.module].value(e.ElemType) && limitsMatch(a.Limits, e.Limits)
+	case "mem":
+		return limitsMatch(l.inputs[actual.module].Module.Memories[actual.index].Limits, l.inputs[expected.module].Module.Memories[expected.index].Limits)
+	}
+	return l.describe(kind, actual) == l.describe(kind, expected)
+}
+
+func limitsMatch(actual, expected types.Limits) bool {
+	if actual.Shared != expected.Shared || actual.Is64 != expected.Is64 || actual.Min < expected.Min {
+		return false
+	}
+	return !expected.HasMax || (actual.HasMax && actual.Max <= expected.Max)
+}
+
+func limitsText(limits types.Limits) string {
+	text := fmt.Sprint(limits.Min)
+	if limits.HasMax {
+		text += fmt.Sprintf(" %d", limits.Max)
+	}
+	if limits.Is64 {
+		text = "i64 " + text
+	}
+	if limits.Shared {
+		text += " shared"
+	}
+	return text
+}
+
+// linkSegments puts the element and the data segments of the modules one after the other
+func (l *linker) linkSegments() {
+	m := l.merged
+	for i, input := range l.inputs {
+		r := &l.maps[i]
+		r.elems = map[uint32]uint32{}
+		for j := range input.Module.Elems {
+			r.elems[uint32(j)] = uint32(len(m.Elems) + j)
+		}
+		r.datas = map[uint32]uint32{}
+		for j := range input.Module.Datas {
+			r.datas[uint32(j)] = uint32(len(m.Datas) + j)
+		}
+
+		for _, elem := range input.Module.Elems {
+			elem.Table = r.tables[elem.Table]
+			elem.Offset = r.instructions(elem.Offset)
+			elem.Type = r.value(elem.Type)
+			funcs := []uint32{}
+			for _, index := range elem.Funcs {
+				funcs = append(funcs, r.funcs[index])
+			}
+			if elem.Funcs != nil {
+				elem.Funcs = funcs
+			}
+			if elem.Exprs != nil {
+				exprs := [][]types.Instruction{}
+				for _, expression := range elem.Exprs {
+					exprs = append(exprs, r.instructions(expression))
+				}
+				elem.Exprs = exprs
+			}
+			m.Elems = append(m.Elems, elem)
+		}
+		for _, data := range input.Module.Datas {
+			data.Memory = r.memories[data.Memory]
+			data.Offset = r.instructions(data.Offset)
+			m.Datas = append(m.Datas, data)
+		}
+	}
+}
+
+// linkExports keeps the exports of every module
+// two modules can export the same name only if it is the same thing (e.g. a memory they share)
+func (l *linker) linkExports() error {
+	exported := map[string]int{}
+	for i, input := range l.inputs {
+		for _, export := range input.Module.Exports {
+			for _, kind := range linkKinds {
+				if export.Kind == defaults.ExportSection[kind] {
+					export.Index = remap(l.maps[i].space(kind), export.Index)
+				}
+			}
+			if j, ok := exported[export.Name]; ok {
+				if previous := l.merged.Exports[j]; previous.Kind != export.Kind || previous.Index != export.Index {
+					return fmt.Errorf("%s: duplicate export %q, it is already exported by another module", input.Name, export.Name)
+				}
+				continue
+			}
+			exported[export.Name] = len(l.merged.Exports)
+			l.merged.Exports = append(l.merged.Exports, export)
+		}
+	}
+	return nil
+}
+
+// linkStart calls the start functions of the modules in their order
+// with more than one, a new function calls them one after the other
+func (l *linker) linkStart() {
+	starts := []uint32{}
+	for i, input := range l.inputs {
+		if input.Module.Start != nil {
+			starts = append(starts, l.maps[i].funcs[*input.Module.Start])
+		}
+	}
+	switch len(starts) {
+	case 0:
+		return
+	case 1:
+		l.merged.Start = &starts[0]
+		return
+	}
+
+	m := l.merged
+	start := types.Func{Type: emptyFuncType(m), Locals: []types.ValueType{}, Body: []types.Instruction{}}
+	for _, index := range starts {
+		start.Body = append(start.Body, types.Instruction{Name: "call", Immediates: []interface{}{index}})
+	}
+	index := uint32(len(m.Funcs))
+	m.Funcs = append(m.Funcs, start)
+	m.Start = &index
+}
+
+// emptyFuncType is the index of the type [] -> [], it is added if the module does not have it
+func emptyFuncType(m *types.Module) uint32 {
+	for i, typeDef := range m.Types {
+		if typeDef.Kind == types.FuncType && typeDef.Rec == 1 && typeDef.Final && len(typeDef.Supers) == 0 && len(typeDef.Params) == 0 && len(typeDef.Results) == 0 {
+			return uint32(i)
+		}
+	}
+	m.Types = append(m.Types, types.TypeDef{Kind: types.FuncType, FunctionType: types.FunctionType{Params: []types.ValueType{}, Results: []types.ValueType{}}, Final: true, Rec: 1})
+	return uint32(len(m.Types) - 1)
+}
+
+func spaceLen(m *types.Module, kind string) int {
+	switch kind {
+	case "func":
+		return len(m.Funcs)
+	case "table":
+		return len(m.Tables)
+	case "mem":
+		return len(m.Memories)
+	case "global":
+		return len(m.Globals)
+	case "tag":
+		return len(m.Tags)
+	}
+	return 0
+}
+
+func importOf(m *types.Module, kind string, index uint32) *types.Import {
+	switch kind {
+	case "func":
+		return m.Funcs[index].Import
+	case "table":
+		return m.Tables[index].Import
+	case "mem":
+		return m.Memories[index].Import
+	case "global":
+		return m.Globals[index].Import
+	case "tag":
+		return m.Tags[index].Import
+	}
+	return nil
+}
+
+// The name of an index space in the text format
+func kindName(kind string) string {
+	if kind == "mem" {
+		return "memory"
+	}
+	return kind
+}
+
+func (r remapper) space(kind string) map[uint32]uint32 {
+	switch kind {
+	case "func":
+		return r.funcs
+	case "table":
+		return r.tables
+	case "mem":
+		return r.memories
+	case "global":
+		return r.globals
+	case "tag":
+		return r.tags
+	}
+	return nil
+}
+
+func (r *remapper) setSpace(kind string, space map[uint32]uint32) {
+	switch kind {
+	case "func":
+		r.funcs = space
+	case "table":
+		r.tables = space
+	case "mem":
+		r.memories = space
+	case "global":
+		r.globals = space
+	case "tag":
+		r.tags = space
+	}
+}
@@ -0,0 +1,179 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Integer literals
+// See https://webassembly.github.io/spec/core/text/values.html#integers
+//
+// An integer can be written
+// - in decimal 255 or hexadecimal 0xff
+// - with underscores between the digits to make it readable 1_000_000
+// - with a sign +1, -1
+//
+// Instructions like i32.const do not care about the signedness, they accept both
+// signed and unsigned values as long as they fit in the number of bits:
+// for i32 from -2^31 to 2^32-1. Unsigned values bigger than 2^31-1 are the same bits
+// of a negative number (two's complement) so 0xffffffff and -1 are the same i32.
+// See https://webassembly.github.io/spec/core/text/values.html#text-int
+
+var errNotInteger = errors.New("not an integer")
+
+// Split a literal into sign, digits (without underscores) and base
+func splitInteger(literal string) (bool, string, int, error) {
+	negative := false
+	switch {
+	case strings.HasPrefix(literal, "-"):
+		negative = true
+		literal = literal[1:]
+	case strings.HasPrefix(literal, "+"):
+		literal = literal[1:]
+	}
+
+	base := 10
+	if strings.HasPrefix(literal, "0x") {
+		base = 16
+		literal = literal[2:]
+	}
+
+	// Underscores can only separate digits
+	if literal == "" || strings.HasPrefix(literal, "_") || strings.HasSuffix(literal, "_") || strings.Contains(literal, "__") {
+		return false, "", 0, errNotInteger
+	}
+
+	return negative, strings.ReplaceAll(literal, "_", ""), base, nil
+}
+
+// parseUnsigned parses an unsigned integer (uN) e.g. an index
+func parseUnsigned(literal string, bits int) (uint64, error) {
+	if strings.HasPrefix(literal, "+") || strings.HasPrefix(literal, "-") {
+		return 0, fmt.Errorf("%s: unsigned integer expected", literal)
+	}
+
+	_, digits, base, err := splitInteger(literal)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", literal, err)
+	}
+
+	value, err := strconv.ParseUint(digits, base, bits)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("%s: integer out of range for u%d", literal, bits)
+		}
+		return 0, fmt.Errorf("%s: %v", literal, errNotInteger)
+	}
+	return value, nil
+}
+
+// parseInteger parses an integer (iN) of the given bits
+// and returns its signed value (the one encoded in the binary)
+func parseInteger(literal string, bits int) (int64, error) {
+	negative, digits, base, err := splitInteger(literal)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", literal, err)
+	}
+
+	magnitude, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("%s: integer out of range for i%d", literal, bits)
+		}
+		return 0, fmt.Errorf("%s: %v", literal, errNotInteger)
+	}
+
+	// -2^(N-1) <= value <= 2^N - 1
+	if negative && magnitude > uint64(1)<<(bits-1) {
+		return 0, fmt.Errorf("%s: integer out of range for i%d", literal, bits)
+	}
+	if !negative && bits < 64 && magnitude > uint64(1)<<bits-1 {
+		return 0, fmt.Errorf("%s: integer out of range for i%d", literal, bits)
+	}
+
+	value := int64(magnitude)
+	if negative {
+		value = -value
+	}
+
+	// Reinterpret the unsigned values as signed (two's complement)
+	if bits == 32 {
+		return int64(int32(uint32(value))), nil
+	}
+	return value, nil
+}
+
+// Float literals
+// See https://webassembly.github.io/spec/core/text/values.html#floating-point
+//
+// A float can be written
+// - in decimal 1.5, 1e10, 1.5e-3 or hexadecimal 0x1.8p3
+// - as inf, -inf, nan or nan:0x200000 (a NaN with a specific payload)
+//
+// Floats are encoded with their IEEE 754 bits (little endian)
+// See https://webassembly.github.io/spec/core/binary/values.html#floating-point
+
+// IEEE 754 layout of the floats
+var floatLayouts = map[int]struct {
+	sign, infinity, quiet uint64
+	payload               uint
+}{
+	32: {sign: 1 << 31, infinity: 0x7f800000, quiet: 0x400000, payload: 23},
+	64: {sign: 1 << 63, infinity: 0x7ff0000000000000, quiet: 0x8000000000000, payload: 52},
+}
+
+// parseFloat returns the bits of an f32 or f64 literal
+func parseFloat(literal string, bits int) (uint64, error) {
+	layout := floatLayouts[bits]
+	negative := strings.HasPrefix(literal, "-")
+	sign := uint64(0)
+	if negative {
+		sign = layout.sign
+	}
+	unsigned := strings.TrimLeft(literal, "+-")
+
+	switch {
+	case unsigned == "inf":
+		return sign | layout.infinity, nil
+	case unsigned == "nan":
+		// canonical NaN
+		return sign | layout.infinity | layout.quiet, nil
+	case strings.HasPrefix(unsigned, "nan:0x"):
+		_, digits, _, err := splitInteger(unsigned[4:])
+		if err != nil {
+			return 0, fmt.Errorf("%s: malformed NaN payload", literal)
+		}
+		payload, err := strconv.ParseUint(digits, 16, 64)
+		if err != nil || payload == 0 || payload >= 1<<layout.payload {
+			return 0, fmt.Errorf("%s: NaN payload out of range for f%d", literal, bits)
+		}
+		return sign | layout.infinity | payload, nil
+	}
+
+	// Underscores can only separate digits
+	if strings.Contains(literal, "__") || strings.Contains(literal, "_.") || strings.Contains(literal, "._") ||
+		strings.HasSuffix(literal, "_") {
+		return 0, fmt.Errorf("%s: not a float", literal)
+	}
+	clean := strings.ReplaceAll(literal, "_", "")
+
+	// Go requires an exponent for hexadecimal floats
+	if strings.HasPrefix(unsigned, "0x") && !strings.ContainsAny(clean, "pP") {
+		clean += "p0"
+	}
+
+	value, err := strconv.ParseFloat(clean, bits)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("%s: float out of range for f%d", literal, bits)
+		}
+		return 0, fmt.Errorf("%s: not a float", literal)
+	}
+	if bits == 32 {
+		return uint64(math.Float32bits(float32(value))), nil
+	}
+	return math.Float64bits(value), nil
+}
@@ -0,0 +1,128 @@
+package compiler
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInteger(t *testing.T) {
+	tests := []struct {
+		literal string
+		bits    int
+		want    int64
+	}{
+		{"0", 32, 0},
+		{"-2147483648", 32, math.MinInt32},
+		{"2147483647", 32, math.MaxInt32},
+		// unsigned values are the same bits of a negative number
+		{"4294967295", 32, -1},
+		{"2147483648", 32, math.MinInt32},
+		{"0xffffffff", 32, -1},
+		{"0x7FFF_FFFF", 32, math.MaxInt32},
+		{"-0x80000000", 32, math.MinInt32},
+		{"+42", 32, 42},
+		{"1_000_000", 32, 1000000},
+		{"0x1_0", 32, 16},
+		{"-9223372036854775808", 64, math.MinInt64},
+		{"9223372036854775807", 64, math.MaxInt64},
+		{"18446744073709551615", 64, -1},
+		{"0xffff_ffff_ffff_ffff", 64, -1},
+	}
+	for _, test := range tests {
+		got, err := parseInteger(test.literal, test.bits)
+		if err != nil || got != test.want {
+			t.Errorf("i%d %s: got %d (%v), want %d", test.bits, test.literal, got, err, test.want)
+		}
+	}
+}
+
+func TestParseIntegerErrors(t *testing.T) {
+	tests := []struct {
+		literal string
+		bits    int
+		err     string
+	}{
+		{"4294967296", 32, "out of range for i32"},
+		{"-2147483649", 32, "out of range for i32"},
+		{"0x1_0000_0000", 32, "out of range for i32"},
+		{"18446744073709551616", 64, "out of range for i64"},
+		{"-9223372036854775809", 64, "out of range for i64"},
+		{"_1", 32, "not an integer"},
+		{"1_", 32, "not an integer"},
+		{"1__0", 32, "not an integer"},
+		{"0x", 32, "not an integer"},
+		{"0x_1", 32, "not an integer"},
+		{"-", 32, "not an integer"},
+		{"1.5", 32, "not an integer"},
+		{"0xg", 32, "not an integer"},
+	}
+	for _, test := range tests {
+		if _, err := parseInteger(test.literal, test.bits); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("i%d %s: got %v, want %q", test.bits, test.literal, err, test.err)
+		}
+	}
+}
+
+func TestParseUnsigned(t *testing.T) {
+	if got, err := parseUnsigned("0xffff_ffff", 32); err != nil || got != math.MaxUint32 {
+		t.Errorf("got %d (%v), want %d", got, err, uint32(math.MaxUint32))
+	}
+	for _, literal := range []string{"-1", "+1", "4294967296"} {
+		if _, err := parseUnsigned(literal, 32); err == nil {
+			t.Errorf("u32 %s: expected an error", literal)
+		}
+	}
+}
+
+// The bytes of the signed LEB128 encoding, the sign bit (0x40) of the last byte matters
+// See https://webassembly.github.io/spec/core/binary/values.html#integers
+func TestEncodeSignedLEB128(t *testing.T) {
+	tests := []struct {
+		number int64
+		want   []int
+	}{
+		{0, []int{0x00}},
+		{-1, []int{0x7f}},
+		{63, []int{0x3f}},
+		// 64 has the sign bit set in the first byte, it takes two
+		{64, []int{0xc0, 0x00}},
+		{-64, []int{0x40}},
+		{-65, []int{0xbf, 0x7f}},
+		{127, []int{0xff, 0x00}},
+		{-128, []int{0x80, 0x7f}},
+		{math.MaxInt32, []int{0xff, 0xff, 0xff, 0xff, 0x07}},
+		{math.MinInt32, []int{0x80, 0x80, 0x80, 0x80, 0x78}},
+		{math.MaxInt64, []int{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{math.MinInt64, []int{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x7f}},
+	}
+	for _, test := range tests {
+		if got := EncodeSignedLEB128(test.number); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: got %x, want %x", test.number, got, test.want)
+		}
+	}
+}
+
+// The constants are encoded with their signed value
+func TestEncodeConstants(t *testing.T) {
+	tests := map[string][]byte{
+		"(i32.const 4294967295)":           {0x41, 0x7f},
+		"(i32.const -2147483648)":          {0x41, 0x80, 0x80, 0x80, 0x80, 0x78},
+		"(i32.const 0x40)":                 {0x41, 0xc0, 0x00},
+		"(i64.const -9223372036854775808)": {0x42, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x7f},
+		"(i64.const 1_000)":                {0x42, 0xe8, 0x07},
+	}
+	for constant, want := range tests {
+		result := "i32"
+		if strings.HasPrefix(constant, "(i64") {
+			result = "i64"
+		}
+		binary := assembled(t, "(module (func (result "+result+") "+constant+"))")
+		// the body ends with the constant and end
+		body := binary[len(binary)-len(want)-1 : len(binary)-1]
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("%s: got %x, want %x", constant, body, want)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/texts"
+	"luna/types"
+	"strings"
+)
+
+// Relocatable objects
+// The object files of LLVM (clang -c) are modules that wasm-ld links together: their indices are not final,
+// so every index used by the code is padded to 5 bytes and a relocation says what it points to.
+// Two custom sections are added after the data section:
+// - "linking": the symbol table (the functions, globals, tags, tables and data of the object),
+//   the segment info (the names of the data segments) and the init functions
+// - "reloc.CODE": where the indices of the code section are and the symbol (or type) they point to
+// See https://github.com/WebAssembly/tool-conventions/blob/main/Linking.md
+//
+// A module becomes an object like this:
+// - the imports are undefined symbols, the linker resolves them against the symbols of the other objects
+// - the exported functions, globals and tags are symbols exported by the linker (the export section is not emitted),
+//   the other ones are local symbols (named after their $id)
+// - the named data segments are local data symbols
+// - the start function is an init function (the linker calls it from __wasm_call_ctors)
+// - like in the objects of LLVM, the memory and the table are the ones of the linker:
+//   a memory (or a table) defined by the module is imported as env.__linear_memory (or env.__indirect_function_table)
+//
+// The text format has no symbolic addresses: the linker moves the data segments, but it can not know which
+// constants of the code (i32.const 16 i32.load) are their addresses (there would be an R_WASM_MEMORY_ADDR_* relocation).
+// So the code can not use a constant that points inside an active data segment, it would point somewhere else
+// once linked. Element segments can not be relocated either, tables are filled by the linker.
+
+// Relocation types
+// See https://github.com/WebAssembly/tool-conventions/blob/main/Linking.md#relocation-sections
+const (
+	relocFunctionIndexLEB = 0
+	relocTypeIndexLEB     = 6
+	relocGlobalIndexLEB   = 7
+	relocTagIndexLEB      = 10
+	relocTableNumberLEB   = 20
+)
+
+// The version of the linking section and its subsections
+// See https://github.com/WebAssembly/tool-conventions/blob/main/Linking.md#linking-metadata-section
+const (
+	linkingVersion     = 2
+	linkingSegmentInfo = 5
+	linkingInitFuncs   = 6
+	linkingSymbolTable = 8
+)
+
+// Symbol kinds and flags
+// See https://github.com/WebAssembly/tool-conventions/blob/main/Linking.md#symbol-table-subsection
+const (
+	symbolFunction = 0
+	symbolData     = 1
+	symbolGlobal   = 2
+	symbolTag      = 4
+	symbolTable    = 5
+
+	symbolBindingLocal = 0x02
+	symbolUndefined    = 0x10
+	symbolExported     = 0x20
+)
+
+// The priority of the init functions that do not have one (like the constructors of C)
+const defaultInitPriority = 65535
+
+// A relocation of the code section
+// its offset starts after the id and the size of the section, index is a symbol (or a type for relocTypeIndexLEB)
+type relocation struct {
+	Type   int
+	Offset uint32
+	Index  uint32
+	// the index written in the object, the linker replaces it
+	value uint32
+}
+
+type object struct {
+	m *types.Module
+	// the symbol of every function, global, tag and table (by the kinds of defaults.ExportSection)
+	symbols     map[string]map[uint32]uint32
+	relocations []relocation
+	// the position of the code section, the relocations point to it
+	codeSection int
+}
+
+// AssembleObject encodes a (valid) module as a relocatable object, that can be linked with wasm-ld
+func AssembleObject(m *types.Module) (Module, error) {
+	if len(m.Elems) > 0 {
+		return nil, fmt.Errorf("element segments can not be relocated, relocatable objects can not have them")
+	}
+	if err := dataAddresses(m); err != nil {
+		return nil, err
+	}
+	m = linkerMemory(m)
+	o := &object{m: m, symbols: map[string]map[uint32]uint32{}}
+	symbol := uint32(0)
+	for _, kind := range []string{"func", "global", "tag", "table"} {
+		o.symbols[kind] = map[uint32]uint32{}
+		for i := 0; i < spaceLen(m, kind); i++ {
+			o.symbols[kind][uint32(i)] = symbol
+			symbol++
+		}
+	}
+	return assemble(m, o), nil
+}
+
+// dataAddresses rejects the constants of the code that point inside an active data segment (at a constant offset):
+// they are most likely its address, and nothing would relocate them
+func dataAddresses(m *types.Module) error {
+	for i, data := range m.Datas {
+		if data.Mode != types.SegmentActive || len(data.Offset) != 1 || len(data.Bytes) == 0 {
+			continue
+		}
+		var start int64
+		switch offset := data.Offset[0]; offset.Name {
+		case "i32.const":
+			start = int64(uint32(offset.Immediates[0].(int32)))
+		case "i64.const":
+			start = offset.Immediates[0].(int64)
+		default:
+			continue
+		}
+		end := start + int64(len(data.Bytes))
+
+		for index, fn := range m.Funcs {
+			for _, instruction := range fn.Body {
+				var address int64
+				switch instruction.Name {
+				case "i32.const":
+					address = int64(uint32(instruction.Immediates[0].(int32)))
+				case "i64.const":
+					address = instruction.Immediates[0].(int64)
+				default:
+					continue
+				}
+				if address >= start && address < end {
+					return fmt.Errorf("func %s: %s %d is an address of the data segment %s, constant addresses can not be relocated",
+						symbolName("func", index, fn.Name), instruction.Name, address, symbolName("data", i, data.Name))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// linkerMemory imports the first memory and the first table, when the module defines them
+// (they are the first ones, the imports come before the definitions)
+func linkerMemory(m *types.Module) *types.Module {
+	object := *m
+	if len(m.Memories) > 0 && m.Memories[0].Import == nil {
+		object.Memories = append([]types.Memory{}, m.Memories...)
+		object.Memories[0].Import = &types.Import{Module: "env", Name: "__linear_memory"}
+	}
+	if len(m.Tables) > 0 && m.Tables[0].Import == nil {
+		object.Tables = append([]types.Table{}, m.Tables...)
+		object.Tables[0].Import = &types.Import{Module: "env", Name: "__indirect_function_table"}
+	}
+	return &object
+}
+
+// index pads the indices that point to a symbol (or a type), the other ones are encoded as usual
+func (o *object) index(kind string, index uint32) sectionData {
+	switch kind {
+	case texts.FuncIdx:
+		return sectionData{relocation{Type: relocFunctionIndexLEB, Index: o.symbols["func"][index], value: index}}
+	case texts.GlobalIdx:
+		return sectionData{relocation{Type: relocGlobalIndexLEB, Index: o.symbols["global"][index], value: index}}
+	case texts.TagIdx:
+		return sectionData{relocation{Type: relocTagIndexLEB, Index: o.symbols["tag"][index], value: index}}
+	case texts.TableIdx:
+		return sectionData{relocation{Type: relocTableNumberLEB, Index: o.symbols["table"][index], value: index}}
+	case texts.TypeIdx, texts.BlockType:
+		return sectionData{relocation{Type: relocTypeIndexLEB, Index: index, value: index}}
+	}
+	return encodeIndex(kind, index)
+}
+
+// code is the content of the code section (nil without functions), it records the relocations
+// their offsets start after the id and the size of the section
+func (o *object) code() sectionData {
+	bodies := []sectionData{}
+	for _, fn := range o.m.Funcs {
+		if fn.Import != nil {
+			continue
+		}
+		body := sectionData{encodeLocals(fn.Locals)}
+		for _, instruction := range fn.Body {
+			body = append(body, encodeInstructionWith(instruction, o.index))
+		}
+		bodies = append(bodies, flatten(append(body, defaults.Opcodes["end"])))
+	}
+	if len(bodies) == 0 {
+		return nil
+	}
+
+	content := omologateEncoded(uint(len(bodies)))
+	for _, body := range bodies {
+		// the padded indices are 5 bytes, so the size of the body is known before they are written
+		size := len(body)
+		for _, b := range body {
+			if _, ok := b.(relocation); ok {
+				size += 4
+			}
+		}
+		content = append(content, omologateEncoded(uint(size))...)
+
+		for _, b := range body {
+			r, ok := b.(relocation)
+			if !ok {
+				content = append(content, b)
+				continue
+			}
+			r.Offset = uint32(len(content))
+			o.relocations = append(o.relocations, r)
+			for _, padded := range EncodePaddedLEB128(r.value) {
+				content = append(content, int(padded))
+			}
+		}
+	}
+	return content
+}
+
+// customSections are the linking section and the relocations of the code
+func (o *object) customSections() sectionData {
+	linking := sectionData{encodeVector(encodeString("linking")), omologateEncoded(linkingVersion)}
+	addSubsection := func(id int, entries sectionData) {
+		if len(entries) > 0 {
+			linking = append(linking, id, encodeVector(flatten(encodeVector(entries))))
+		}
+	}
+	addSubsection(linkingSymbolTable, o.symbolTable())
+	addSubsection(linkingSegmentInfo, o.segmentInfo())
+	if o.m.Start != nil {
+		addSubsection(linkingInitFuncs, sectionData{sectionData{omologateEncoded(defaultInitPriority), omologateEncoded(uint(o.symbols["func"][*o.m.Start]))}})
+	}
+	sections := createSection(defaults.Section["custom"], linking)
+
+	if len(o.relocations) > 0 {
+		entries := sectionData{}
+		for _, r := range o.relocations {
+			entries = append(entries, sectionData{r.Type, omologateEncoded(uint(r.Offset)), omologateEncoded(uint(r.Index))})
+		}
+		reloc := sectionData{encodeVector(encodeString("reloc.CODE")), omologateEncoded(uint(o.codeSection)), encodeVector(entries)}
+		sections = append(sections, createSection(defaults.Section["custom"], reloc)...)
+	}
+	return sections
+}
+
+// symbolTable has a symbol for every function, global, tag and table (in this order) and for the named data segments
+// - imports are undefined, their name is the one of the import
+// - exports are exported by the linker with their export name
+// - the other ones are local, named after their $id (or their kind and index)
+func (o *object) symbolTable() sectionData {
+	m := o.m
+	kinds := map[string]int{"func": symbolFunction, "global": symbolGlobal, "tag": symbolTag, "table": symbolTable}
+	exported := map[string]map[uint32]string{}
+	for _, export := range m.Exports {
+		for kind := range kinds {
+			if export.Kind != defaults.ExportSection[kind] {
+				continue
+			}
+			if exported[kind] == nil {
+				exported[kind] = map[uint32]string{}
+			}
+			if _, ok := exported[kind][export.Index]; !ok {
+				exported[kind][export.Index] = export.Name
+			}
+		}
+	}
+
+	symbols := sectionData{}
+	for _, kind := range []string{"func", "global", "tag", "table"} {
+		for i := 0; i < spaceLen(m, kind); i++ {
+			if importOf(m, kind, uint32(i)) != nil {
+				symbols = append(symbols, sectionData{kinds[kind], symbolUndefined, omologateEncoded(uint(i))})
+				continue
+			}
+
+			flags, name := symbolBindingLocal, symbolName(kind, i, itemName(m, kind, i))
+			if export, ok := exported[kind][uint32(i)]; ok {
+				flags, name = symbolExported, export
+			}
+			symbols = append(symbols, sectionData{kinds[kind], flags, omologateEncoded(uint(i)), encodeVector(encodeString(name))})
+		}
+	}
+
+	// a data symbol is the whole segment: offset 0 and its size, it is local like the functions that are not exported
+	for i, data := range m.Datas {
+		if data.Name != "" {
+			symbols = append(symbols, sectionData{
+				symbolData, symbolBindingLocal,
+				encodeVector(encodeString(strings.TrimPrefix(data.Name, "$"))),
+				omologateEncoded(uint(i)), 0x00, omologateEncoded(uint(len(data.Bytes))),
+			})
+		}
+	}
+	return symbols
+}
+
+// segmentInfo names the data segments (.data.$id), they are aligned to 1 byte
+func (o *object) segmentInfo() sectionData {
+	segments := sectionData{}
+	for i, data := range o.m.Datas {
+		name := ".data." + symbolName("data", i, data.Name)
+		segments = append(segments, sectionData{encodeVector(encodeString(name)), 0x00, 0x00})
+	}
+	return segments
+}
+
+func itemName(m *types.Module, kind string, index int) string {
+	switch kind {
+	case "func":
+		return m.Funcs[index].Name
+	case "global":
+		return m.Globals[index].Name
+	case "tag":
+		return m.Tags[index].Name
+	case "table":
+		return m.Tables[index].Name
+	}
+	return ""
+}
+
+// The $id without the $, e.g. $add is add, or the kind and the index (func3)
+func symbolName(kind string, index int, name string) string {
+	if name != "" {
+		return strings.TrimPrefix(name, "$")
+	}
+	return fmt.Sprintf("%s%d", kind, index)
+}
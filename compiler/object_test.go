@@ -0,0 +1,126 @@
+package compiler
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func assembledObject(input string) ([]byte, error) {
+	m, err := built(input)
+	if err == nil {
+		err = Validate(m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	object, err := AssembleObject(m)
+	if err != nil {
+		return nil, err
+	}
+	return object.Bytes(), nil
+}
+
+// customSectionHex is the content of a custom section (after its name) in hex
+func customSectionHex(t *testing.T, binary []byte, name string) string {
+	t.Helper()
+	sections, err := splitSections(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range sections {
+		if section.id == 0 && section.name == name {
+			r := &reader{bytes: section.content}
+			r.name()
+			return hex.EncodeToString(section.content[r.pos:])
+		}
+	}
+	return ""
+}
+
+// The sections of an object, laid out as in the tool conventions
+func TestAssembleObject(t *testing.T) {
+	object, err := assembledObject(`(module
+	  (import "env" "log" (func $log (param i32)))
+	  (memory 1)
+	  (global $count (mut i32) (i32.const 0))
+	  (data $greeting (i32.const 100) "hi")
+	  (func $tick
+	    (global.set $count (i32.add (global.get $count) (i32.const 1)))
+	    (call $log (global.get $count)))
+	  (func (export "run") (call $tick))
+	  (start $tick))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the indices of the code are padded to 5 bytes
+	code := "02" +
+		"1d" + "00" + "23" + "8080808000" + "4101" + "6a" + "24" + "8080808000" + "23" + "8080808000" + "10" + "8080808000" + "0b" +
+		"08" + "00" + "10" + "8180808000" + "0b"
+	if got := sectionHex(t, object, 0x0a); got != code {
+		t.Errorf("code:\n got %s\nwant %s", got, code)
+	}
+	// the memory is the one of the linker, there is no export and no start section
+	if got := sectionHex(t, object, 0x02); !strings.Contains(got, hex.EncodeToString([]byte("__linear_memory"))) {
+		t.Errorf("imports: got %s, want env.__linear_memory", got)
+	}
+	for _, id := range []int{0x05, 0x07, 0x08} {
+		if got := sectionHex(t, object, id); got != "" {
+			t.Errorf("section %d: got %s, want none", id, got)
+		}
+	}
+
+	linking := "02" + // version
+		"08" + "2a" + "05" + // symbol table
+		"00" + "10" + "00" + // the import log: an undefined function
+		"00" + "02" + "01" + "04" + hex.EncodeToString([]byte("tick")) + // a local function
+		"00" + "20" + "02" + "03" + hex.EncodeToString([]byte("run")) + // an exported function
+		"02" + "02" + "00" + "05" + hex.EncodeToString([]byte("count")) + // a local global
+		"01" + "02" + "08" + hex.EncodeToString([]byte("greeting")) + "00" + "00" + "02" + // a local data symbol: segment 0, offset 0, size 2
+		"05" + "12" + "01" + "0e" + hex.EncodeToString([]byte(".data.greeting")) + "00" + "00" + // segment info: alignment and flags
+		"06" + "05" + "01" + "ffff03" + "01" // init functions: $tick with the default priority
+	if got := customSectionHex(t, object, "linking"); got != linking {
+		t.Errorf("linking:\n got %s\nwant %s", got, linking)
+	}
+
+	reloc := "05" + "05" + // the code section is the 6th, 5 relocations
+		"07" + "04" + "03" + // R_WASM_GLOBAL_INDEX_LEB of count
+		"07" + "0d" + "03" +
+		"07" + "13" + "03" +
+		"00" + "19" + "00" + // R_WASM_FUNCTION_INDEX_LEB of log
+		"00" + "22" + "01" // and of tick, in the second body
+	if got := customSectionHex(t, object, "reloc.CODE"); got != reloc {
+		t.Errorf("reloc.CODE:\n got %s\nwant %s", got, reloc)
+	}
+}
+
+// The linker moves the data, the constant addresses of the code would point somewhere else
+func TestAssembleObjectDataAddresses(t *testing.T) {
+	tests := []struct {
+		name, input, err string
+	}{
+		{"address of a segment", `(module (memory 1) (data $msg (i32.const 16) "hello")
+		  (func $f (result i32) (i32.load8_u (i32.const 16))))`, "func f: i32.const 16 is an address of the data segment msg"},
+		{"address inside a segment", `(module (memory 1) (data (i32.const 16) "hello")
+		  (func (result i32) (i32.load8_u (i32.const 20))))`, "func func0: i32.const 20 is an address of the data segment data0"},
+		{"address of a 64 bit memory", `(module (memory i64 1) (data (i64.const 8) "x")
+		  (func (result i32) (i32.load8_u (i64.const 8))))`, "i64.const 8 is an address"},
+
+		{"constants outside the segments", `(module (memory 1) (data (i32.const 16) "hello")
+		  (func (result i32) (i32.add (i32.const 15) (i32.const 21))))`, ""},
+		{"passive segments", `(module (memory 1) (data "hello") (func (result i32) (i32.const 0)))`, ""},
+		{"empty segments", `(module (memory 1) (data (i32.const 0)) (func (result i32) (i32.const 0)))`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := assembledObject(test.input)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("expected an object, got %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got %v, want an error with %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/types"
+	"math"
+	"strings"
+)
+
+// Optimizer
+// A peephole pass: it looks at the last few instructions of a function, one instruction at a time,
+// and replaces the patterns it knows with shorter ones that do the same thing
+// - constant arithmetic is computed at compile time: i32.const 2 i32.const 3 i32.add is i32.const 5
+// - a local read and thrown away does nothing: local.get $x drop
+// - a local set and read right after is local.tee: local.set $x local.get $x is local.tee $x
+// The patterns never span a block, a branch or a call, so they can not change what the function does.
+//
+// Integers wrap around like they do at runtime (i32.const 0x7fffffff i32.const 1 i32.add is i32.const -2147483648)
+// and divisions that would trap (by zero, or -2^31 / -1) are left alone, so they still trap when they run.
+// Floats are not folded: the NaN bits an engine produces are not deterministic.
+
+// Optimization is a change made by the optimizer, it is reported to explain what happened to the code
+type Optimization struct {
+	// The function that changed (its $id or its index)
+	Func   string
+	Before []types.Instruction
+	After  []types.Instruction
+}
+
+func (o Optimization) String() string {
+	after := instructionsText(o.After)
+	if after == "" {
+		after = "(nothing)"
+	}
+	return fmt.Sprintf("func %s: %s => %s", o.Func, instructionsText(o.Before), after)
+}
+
+// Optimize rewrites the bodies of the functions of a (valid) module and returns what it changed
+func Optimize(m *types.Module) []Optimization {
+	optimizations := []Optimization{}
+	for i := range m.Funcs {
+		fn := &m.Funcs[i]
+		if fn.Import != nil {
+			continue
+		}
+
+		body := []types.Instruction{}
+		for _, instruction := range fn.Body {
+			body = append(body, instruction)
+			// a rewrite can make another one possible, e.g. 2 3 i32.add 4 i32.mul is folded twice
+			for {
+				size, replacement, ok := peephole(body)
+				if !ok {
+					break
+				}
+				before := append([]types.Instruction{}, body[len(body)-size:]...)
+				body = append(body[:len(body)-size], replacement...)
+				optimizations = append(optimizations, Optimization{Func: displayName(i, fn.Name), Before: before, After: replacement})
+			}
+		}
+		fn.Body = body
+	}
+	return optimizations
+}
+
+// peephole matches the end of the body against the patterns,
+// it returns how many instructions to replace and what to replace them with
+// (a rewrite can empty the body, e.g. local.get 0 drop at its beginning, then nothing matches)
+func peephole(body []types.Instruction) (int, []types.Instruction, bool) {
+	if len(body) == 0 {
+		return 0, nil, false
+	}
+	last := body[len(body)-1]
+
+	if len(body) >= 2 {
+		previous := body[len(body)-2]
+		switch {
+		case last.Name == "drop" && previous.Name == "local.get":
+			return 2, []types.Instruction{}, true
+
+		case last.Name == "local.get" && previous.Name == "local.set" && last.Immediates[0] == previous.Immediates[0]:
+			return 2, []types.Instruction{{Name: "local.tee", Immediates: previous.Immediates}}, true
+
+		// the value is set and thrown away, that's just local.set
+		case last.Name == "drop" && previous.Name == "local.tee":
+			return 2, []types.Instruction{{Name: "local.set", Immediates: previous.Immediates}}, true
+		}
+
+		if fold, ok := unaryFolds[last.Name]; ok {
+			if value, ok := constant(previous); ok {
+				return 2, []types.Instruction{fold(value)}, true
+			}
+		}
+	}
+
+	if len(body) >= 3 {
+		if fold, ok := binaryFolds[last.Name]; ok {
+			a, okA := constant(body[len(body)-3])
+			b, okB := constant(body[len(body)-2])
+			if okA && okB {
+				if folded, ok := fold(a, b); ok {
+					return 3, []types.Instruction{folded}, true
+				}
+			}
+		}
+	}
+
+	return 0, nil, false
+}
+
+// The value of i32.const and i64.const (i32 are kept as int32 so they wrap around at 32 bits)
+func constant(instruction types.Instruction) (interface{}, bool) {
+	if instruction.Name != "i32.const" && instruction.Name != "i64.const" {
+		return nil, false
+	}
+	return instruction.Immediates[0], true
+}
+
+func i32Const(value int32) types.Instruction {
+	return types.Instruction{Name: "i32.const", Immediates: []interface{}{value}}
+}
+
+func i64Const(value int64) types.Instruction {
+	return types.Instruction{Name: "i64.const", Immediates: []interface{}{value}}
+}
+
+func boolConst(value bool) types.Instruction {
+	if value {
+		return i32Const(1)
+	}
+	return i32Const(0)
+}
+
+// Binary operations, they fold only if both operands are constants of their type
+// See https://webassembly.github.io/spec/core/exec/numerics.html#integer-operations
+var binaryFolds = map[string]func(a, b interface{}) (types.Instruction, bool){
+	"i32.add": i32Fold(func(a, b int32) (int32, bool) { return a + b, true }),
+	"i32.sub": i32Fold(func(a, b int32) (int32, bool) { return a - b, true }),
+	"i32.mul": i32Fold(func(a, b int32) (int32, bool) { return a * b, true }),
+	"i32.and": i32Fold(func(a, b int32) (int32, bool) { return a & b, true }),
+	// traps when dividing by zero and when the result does not fit (-2^31 / -1)
+	"i32.div_s": i32Fold(func(a, b int32) (int32, bool) {
+		if b == 0 || (a == math.MinInt32 && b == -1) {
+			return 0, false
+		}
+		return a / b, true
+	}),
+	"i32.eq": func(a, b interface{}) (types.Instruction, bool) {
+		x, okX := a.(int32)
+		y, okY := b.(int32)
+		return boolConst(x == y), okX && okY
+	},
+	"i64.add": i64Fold(func(a, b int64) int64 { return a + b }),
+	"i64.sub": i64Fold(func(a, b int64) int64 { return a - b }),
+	"i64.mul": i64Fold(func(a, b int64) int64 { return a * b }),
+}
+
+// Go integers wrap around like the WebAssembly ones (two's complement)
+func i32Fold(operation func(a, b int32) (int32, bool)) func(a, b interface{}) (types.Instruction, bool) {
+	return func(a, b interface{}) (types.Instruction, bool) {
+		x, okX := a.(int32)
+		y, okY := b.(int32)
+		if !okX || !okY {
+			return types.Instruction{}, false
+		}
+		result, ok := operation(x, y)
+		return i32Const(result), ok
+	}
+}
+
+func i64Fold(operation func(a, b int64) int64) func(a, b interface{}) (types.Instruction, bool) {
+	return func(a, b interface{}) (types.Instruction, bool) {
+		x, okX := a.(int64)
+		y, okY := b.(int64)
+		if !okX || !okY {
+			return types.Instruction{}, false
+		}
+		return i64Const(operation(x, y)), true
+	}
+}
+
+// Unary operations and integer conversions
+// the operand type is checked, so a (valid) module never gets here with the wrong constant
+var unaryFolds = map[string]func(value interface{}) types.Instruction{
+	"i32.eqz":          func(value interface{}) types.Instruction { return boolConst(value == int32(0)) },
+	"i32.wrap_i64":     func(value interface{}) types.Instruction { return i32Const(int32(value.(int64))) },
+	"i64.extend_i32_s": func(value interface{}) types.Instruction { return i64Const(int64(value.(int32))) },
+	"i64.extend_i32_u": func(value interface{}) types.Instruction { return i64Const(int64(uint32(value.(int32)))) },
+	"i32.extend8_s":    func(value interface{}) types.Instruction { return i32Const(int32(int8(value.(int32)))) },
+	"i32.extend16_s":   func(value interface{}) types.Instruction { return i32Const(int32(int16(value.(int32)))) },
+	"i64.extend8_s":    func(value interface{}) types.Instruction { return i64Const(int64(int8(value.(int64)))) },
+	"i64.extend16_s":   func(value interface{}) types.Instruction { return i64Const(int64(int16(value.(int64)))) },
+	"i64.extend32_s":   func(value interface{}) types.Instruction { return i64Const(int64(int32(value.(int64)))) },
+}
+
+// instructionsText writes instructions in the (flat) text format, e.g. "i32.const 2 i32.const 3 i32.add"
+// only the immediates the optimizer works with are written (constants and local indices)
+func instructionsText(instructions []types.Instruction) string {
+	texts := []string{}
+	for _, instruction := range instructions {
+		text := instruction.Name
+		for _, immediate := range instruction.Immediates {
+			switch immediate.(type) {
+			case int32, int64, uint32:
+				text += fmt.Sprintf(" %d", immediate)
+			}
+		}
+		texts = append(texts, text)
+	}
+	return strings.Join(texts, " ")
+}
@@ -0,0 +1,67 @@
+package compiler
+
+import (
+	"testing"
+)
+
+// optimized builds a module with a single function, optimizes it and returns its body as text
+func optimized(t *testing.T, fn string) string {
+	t.Helper()
+	ast, err := Parser(Tokenize("(module " + fn + ")"))
+	if err != nil {
+		t.Fatalf("%s: %v", fn, err)
+	}
+	m, err := BuildWithOptions(ast, Options{})
+	if err == nil {
+		err = Validate(m)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", fn, err)
+	}
+	Optimize(m)
+	if err := Validate(m); err != nil {
+		t.Fatalf("%s: optimized module is not valid: %v", fn, err)
+	}
+	return instructionsText(m.Funcs[0].Body)
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name, fn, want string
+	}{
+		{"local.get drop", "(func (param i32) local.get 0 drop)", ""},
+		{"local.get drop twice", "(func (param i32) local.get 0 drop local.get 0 drop)", ""},
+		{"local.get drop then code", "(func (param i32) (result i32) local.get 0 drop i32.const 1)", "i32.const 1"},
+		{"local.set local.get", "(func (param i32) (result i32) i32.const 1 local.set 0 local.get 0)", "i32.const 1 local.tee 0"},
+		{"local.tee drop", "(func (param i32) i32.const 1 local.tee 0 drop)", "i32.const 1 local.set 0"},
+		{"i32.add", "(func (result i32) i32.const 2 i32.const 3 i32.add)", "i32.const 5"},
+		{"i32.add wraps", "(func (result i32) i32.const 0x7fffffff i32.const 1 i32.add)", "i32.const -2147483648"},
+		{"i32.sub", "(func (result i32) i32.const 2 i32.const 3 i32.sub)", "i32.const -1"},
+		{"i32.mul", "(func (result i32) i32.const 2 i32.const 3 i32.add i32.const 4 i32.mul)", "i32.const 20"},
+		{"i32.and", "(func (result i32) i32.const 6 i32.const 3 i32.and)", "i32.const 2"},
+		{"i32.div_s", "(func (result i32) i32.const 7 i32.const -2 i32.div_s)", "i32.const -3"},
+		{"i32.div_s by zero", "(func (result i32) i32.const 7 i32.const 0 i32.div_s)", "i32.const 7 i32.const 0 i32.div_s"},
+		{"i32.div_s overflow", "(func (result i32) i32.const -2147483648 i32.const -1 i32.div_s)", "i32.const -2147483648 i32.const -1 i32.div_s"},
+		{"i32.eq", "(func (result i32) i32.const 3 i32.const 3 i32.eq)", "i32.const 1"},
+		{"i64.add", "(func (result i64) i64.const 2 i64.const 3 i64.add)", "i64.const 5"},
+		{"i64.sub", "(func (result i64) i64.const 2 i64.const 3 i64.sub)", "i64.const -1"},
+		{"i64.mul", "(func (result i64) i64.const 2 i64.const 3 i64.mul)", "i64.const 6"},
+		{"i32.eqz", "(func (result i32) i32.const 0 i32.eqz)", "i32.const 1"},
+		{"i32.wrap_i64", "(func (result i32) i64.const 0x100000001 i32.wrap_i64)", "i32.const 1"},
+		{"i64.extend_i32_s", "(func (result i64) i32.const -1 i64.extend_i32_s)", "i64.const -1"},
+		{"i64.extend_i32_u", "(func (result i64) i32.const -1 i64.extend_i32_u)", "i64.const 4294967295"},
+		{"i32.extend8_s", "(func (result i32) i32.const 0xff i32.extend8_s)", "i32.const -1"},
+		{"i32.extend16_s", "(func (result i32) i32.const 0xffff i32.extend16_s)", "i32.const -1"},
+		{"i64.extend8_s", "(func (result i64) i64.const 0x80 i64.extend8_s)", "i64.const -128"},
+		{"i64.extend16_s", "(func (result i64) i64.const 0x8000 i64.extend16_s)", "i64.const -32768"},
+		{"i64.extend32_s", "(func (result i64) i64.const 0x80000000 i64.extend32_s)", "i64.const -2147483648"},
+		{"not across a call", "(func $f (result i32) i32.const 2 call $f i32.add)", "i32.const 2 call 0 i32.add"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := optimized(t, test.fn); got != test.want {
+				t.Errorf("%s\n got: %q\nwant: %q", test.fn, got, test.want)
+			}
+		})
+	}
+}
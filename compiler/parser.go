@@ -1,11 +1,11 @@
 package compiler
 
 import (
-	"log"
-	"luna/defaults"
+	"errors"
+	"fmt"
 	"luna/texts"
 	"luna/types"
-	"strconv"
+	"strings"
 )
 
 // Parsing guarantees that the input program is syntactically correct,
@@ -13,7 +13,7 @@ import (
 // but it doesn’t guarantee a successful execution
 // Runtime errors may still be present
 
-// This parser is a Go implementation of the Chasm parser
+// This parser is inspired by the Chasm parser
 // See https://blog.scottlogic.com/2019/05/17/webassembly-compiler.html#the-parser
 
 // Building an iterator emulator
@@ -40,200 +40,118 @@ func (i *iteratorEmulator) next(arr []types.Token) iteratorEmulatorStruct {
 }
 
 // The parse receives the array of Tokens and creates an AST (abstract syntax tree)
-// This AST creation is very basic but useful to learn the concept.
 // See - https://en.wikipedia.org/wiki/Abstract_syntax_tree
-func Parser(tokens []types.Token) []types.AstNode {
+//
+// The text format is made of S-expressions so the AST is quite simple:
+// every paren opens a list, that goes on until the matching paren closes it.
+//
+//	(module (func (export "add") local.get 0))
+//
+// becomes
+//
+//	list
+//	├── module
+//	└── list
+//	    ├── func
+//	    ├── list
+//	    │   ├── export
+//	    │   └── "add"
+//	    ├── local.get
+//	    └── 0
+//
+// Giving a meaning to the lists (a function, an export...) is the job of the compiler.
+func Parser(tokens []types.Token) ([]types.AstNode, error) {
+	// The tokenizer does not skip what it does not understand, it leaves error tokens
+	if err := tokenErrors(tokens); err != nil {
+		return nil, err
+	}
+
 	if len(tokens) == 0 {
-		log.Fatal("No token to parse")
+		return nil, errors.New("no token to parse")
 	}
 
 	nodes := []types.AstNode{}
-	index := 0
 	// iterator
 	iterator := iteratorEmulator(0)
 
-	currentToken := iterator.next(tokens)
+	for int(iterator) < len(tokens) {
+		currentToken := iterator.next(tokens)
 
-	// If the module is empty return the Ast with only the module
-	if currentToken.done {
-		nodes = append(nodes, types.AstNode{
-			Type:       texts.ModuleStatement,
-			Expression: types.ExpressionNode{},
-		})
-		return nodes
-	}
-
-	nextToken := iterator.next(tokens)
+		switch currentToken.token.Type {
+		case texts.LeftParen:
+			list, err := parseList(currentToken.token, tokens, &iterator)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, list)
 
-	eatToken := func(tokenVal string) {
-		isValid, _ := strconv.ParseBool(tokenVal)
-		if isValid && tokenVal != currentToken.token.Value {
-			log.Fatal(`Unexpected token`)
-		}
+		case texts.RightParen:
+			return nil, positionError(currentToken.token, "unexpected closing paren")
 
-		currentToken = nextToken
-		if currentToken.done {
-			return
+		default:
+			nodes = append(nodes, parseAtom(currentToken.token))
 		}
-		nextToken = iterator.next(tokens)
-	}
-
-	for index < len(tokens) {
-		nodes = append(nodes, parseStatement(&currentToken, eatToken, &index))
-		index++
 	}
-
-	return nodes
+	return nodes, nil
 }
 
-func parseStatement(currentToken *iteratorEmulatorStruct, eatToken func(val string), index *int) types.AstNode {
-	if currentToken.token.Type == texts.TypeToken {
-		// We stat parsing the tokens of "type" tokens
-		switch currentToken.token.Value {
-		case "module":
-			eatToken("module")
-			return types.AstNode{
-				Type: texts.ModuleStatement,
-				// Check if the module is empty by inspecting the next node
-				Expression: parseExpression(currentToken, eatToken, index),
-			}
-
-		case "func":
-			eatToken("func")
+// parseList collects the nodes until the closing paren
+func parseList(open types.Token, tokens []types.Token, iterator *iteratorEmulator) (types.AstNode, error) {
+	list := types.AstNode{
+		Type:     texts.ListNode,
+		Children: []types.AstNode{},
+		Line:     open.Line,
+		Column:   open.Column,
+	}
 
-			return types.AstNode{
-				Type:       texts.FuncStatement,
-				Expression: types.ExpressionNode{},
-			}
-		case "export":
-			eatToken("export")
+	for {
+		// The tokens ended before the closing paren
+		if int(*iterator) >= len(tokens) {
+			return list, positionError(open, "unclosed paren")
+		}
+		currentToken := iterator.next(tokens)
 
-			return types.AstNode{
-				Type:       texts.ExportStatement,
-				Expression: parseExpression(currentToken, eatToken, index),
-			}
-		case "result":
-			eatToken("result")
+		switch currentToken.token.Type {
+		case texts.RightParen:
+			return list, nil
 
-			return types.AstNode{
-				Type:       texts.ResultStatement,
-				Expression: parseExpression(currentToken, eatToken, index),
+		case texts.LeftParen:
+			child, err := parseList(currentToken.token, tokens, iterator)
+			if err != nil {
+				return list, err
 			}
-		case "param":
-			eatToken("param")
+			list.Children = append(list.Children, child)
 
-			return types.AstNode{
-				Type:       texts.ParamStatement,
-				Expression: parseExpression(currentToken, eatToken, index),
-			}
-		}
-	}
-
-	// We parse the instructions
-	// Instructions are usually tied to the token that comes after them
-	// so we inspect the token that comes after the instruction and eventually tie them together
-	if currentToken.token.Type == texts.TypeInstruction {
-		switch currentToken.token.Value {
-		case "local.get":
-			eatToken("local.get")
-			return types.AstNode{
-				Type:       texts.GetLocalInstruction,
-				Expression: parseExpression(currentToken, eatToken, index),
-				MapTo:      defaults.Opcodes["get_local"],
-			}
-		case "i32.add":
-			eatToken("i32.add")
-			return types.AstNode{
-				Type:       texts.FuncInstruction,
-				Expression: types.ExpressionNode{},
-				MapTo:      defaults.Opcodes["i32_add"],
-			}
-		case "i32.sub":
-			eatToken("i32.sub")
-			return types.AstNode{
-				Type:       texts.FuncInstruction,
-				Expression: types.ExpressionNode{},
-				MapTo:      defaults.Opcodes["i32_sub"],
-			}
-		case "i32.mul":
-			eatToken("i32.mul")
-			return types.AstNode{
-				Type:       texts.FuncInstruction,
-				Expression: types.ExpressionNode{},
-				MapTo:      defaults.Opcodes["i32_mul"],
-			}
-		case "i32.div":
-			eatToken("i32.div")
-			return types.AstNode{
-				Type:       texts.FuncInstruction,
-				Expression: types.ExpressionNode{},
-				MapTo:      defaults.Opcodes["i32_div"],
-			}
-		case "i32.const":
-			eatToken("i32.const")
-			return types.AstNode{
-				Type:       texts.InternalInstruction,
-				Expression: parseExpression(currentToken, eatToken, index),
-				MapTo:      defaults.Opcodes["i32_const"],
-			}
+		default:
+			list.Children = append(list.Children, parseAtom(currentToken.token))
 		}
 	}
+}
 
-	if currentToken.token.Type == texts.TypeNum {
-		switch currentToken.token.Value {
-		case "i32":
-			eatToken("i32")
-			return types.AstNode{
-				Type:       texts.TypeNum32,
-				Expression: types.ExpressionNode{},
-				MapTo:      types.ValType["i32"],
-			}
-		}
+func parseAtom(token types.Token) types.AstNode {
+	return types.AstNode{
+		Type:   token.Type,
+		Value:  token.Value,
+		Line:   token.Line,
+		Column: token.Column,
 	}
-
-	return types.AstNode{}
 }
 
-// This is used to inspect the NEXT token and eventually
-// tie it with the current token
-func parseExpression(currentToken *iteratorEmulatorStruct, eatToken func(val string), index *int) types.ExpressionNode {
-	switch currentToken.token.Type {
-	case "number":
-		log := types.ExpressionNode{
-			Type:  texts.NumberLiteral,
-			Value: currentToken.token.Value,
-		}
-		eatToken("number")
-		*index++
-
-		return log
-
-	case "literal":
-		log := types.ExpressionNode{
-			Type:  texts.TypeLiteral,
-			Value: currentToken.token.Value,
-		}
-		eatToken("literal")
-		*index++
-
-		return log
-
-	case "typeNum":
-		log := types.ExpressionNode{
-			Type:  texts.TypeNum32,
-			Value: currentToken.token.Value,
-		}
-		eatToken("typeNum")
-		*index++
-
-		return log
+func positionError(token types.Token, message string) error {
+	return fmt.Errorf("%d:%d: %s", token.Line, token.Column, message)
+}
 
-	// Make node aware of which node is coming after
-	default:
-		log := types.ExpressionNode{
-			Value: currentToken.token.Value,
+// Collect all the errors of the tokenizer
+func tokenErrors(tokens []types.Token) error {
+	messages := []string{}
+	for _, token := range tokens {
+		if token.Type == texts.TypeError {
+			messages = append(messages, fmt.Sprintf("%d:%d: %s %q", token.Line, token.Column, token.Error, token.Value))
 		}
+	}
 
-		return log
+	if len(messages) == 0 {
+		return nil
 	}
+	return errors.New(strings.Join(messages, "\n"))
 }
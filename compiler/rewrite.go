@@ -0,0 +1,492 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rewriting binaries
+// A compiled module can be changed without its source:
+// - custom sections (names, producers, debug info...) can be removed
+// - exports can be renamed, added and removed
+// - functions can be reordered (e.g. the ones that run first at the beginning, so they are compiled first)
+//
+// The sections that do not change are copied byte by byte, the ones that change are encoded again with their new size.
+// Reordering the functions changes their indices: the module is decoded, renumbered and assembled again.
+// The name section is renumbered too, the other custom sections that refer to functions or to code offsets
+// (reloc.*, linking, debug info...) would be wrong, so they are removed.
+// See https://webassembly.github.io/spec/core/binary/modules.html#sections
+
+// Rewrite is what RewriteBinary changes, in this order
+type Rewrite struct {
+	// Custom sections to remove by their name ("name", "producers"...),
+	// a name that ends with * is a prefix (".debug_*"), "*" removes all of them
+	Strip []string
+	// Exports to rename (one after the other, so a -> b then b -> c renames a to c), to remove and to add
+	Rename []ExportRename
+	Remove []string
+	Add    []types.Export
+	// Functions in their new order, by index, by export name or by name (from the name section)
+	// the functions that are not in the list come after them, in their order. Imported functions can not move
+	Order []string
+}
+
+// ExportRename renames the export Old to New
+type ExportRename struct {
+	Old, New string
+}
+
+// Rewritten is the new binary and the custom sections it does not have anymore
+type Rewritten struct {
+	Binary  []byte
+	Removed []string
+}
+
+// The custom sections that are kept when the functions are reordered (the name section is renumbered)
+var reorderSafe = map[string]bool{
+	"name":            true,
+	"producers":       true,
+	"target_features": true,
+}
+
+// A section as it is in the binary, custom sections have their name
+type rawSection struct {
+	id      int
+	name    string
+	content []byte
+}
+
+// RewriteBinary rewrites a binary module,
+// reordering decodes the module: one that can not be decoded is rejected before anything else is done
+func RewriteBinary(binary []byte, rewrite Rewrite) (Rewritten, error) {
+	rewritten := Rewritten{Removed: []string{}}
+	if len(rewrite.Order) > 0 {
+		if _, err := Decode(binary); err != nil {
+			return rewritten, fmt.Errorf("the functions can not be reordered, the module can not be decoded: %v", err)
+		}
+	}
+	sections, err := splitSections(binary)
+	if err != nil {
+		return rewritten, err
+	}
+
+	kept := []rawSection{}
+	for _, section := range sections {
+		if section.id == defaults.Section["custom"] && stripped(section.name, rewrite.Strip) {
+			rewritten.Removed = append(rewritten.Removed, section.name)
+			continue
+		}
+		kept = append(kept, section)
+	}
+	sections = kept
+
+	if len(rewrite.Rename) > 0 || len(rewrite.Remove) > 0 || len(rewrite.Add) > 0 {
+		sections, err = rewriteExports(sections, rewrite)
+		if err != nil {
+			return rewritten, err
+		}
+	}
+
+	if len(rewrite.Order) > 0 {
+		var removed []string
+		sections, removed, err = reorderFunctions(sections, rewrite.Order)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten.Removed = append(rewritten.Removed, removed...)
+	}
+
+	rewritten.Binary = joinSections(sections)
+	return rewritten, nil
+}
+
+func stripped(name string, strip []string) bool {
+	for _, pattern := range strip {
+		if pattern == name || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSections cuts a binary module into its sections
+func splitSections(binary []byte) ([]rawSection, error) {
+	r := &reader{bytes: binary}
+	for _, b := range append(append([]interface{}{}, defaults.MAGIC...), defaults.VERSION...) {
+		if int(r.byte()) != b.(int) {
+			return nil, fmt.Errorf("not a WebAssembly module (bad magic number or version)")
+		}
+	}
+
+	sections := []rawSection{}
+	for r.err == nil && r.pos < len(r.bytes) {
+		id := int(r.byte())
+		content := r.bytesN(int(r.u32()))
+		section := rawSection{id: id, content: content}
+		if id == defaults.Section["custom"] {
+			section.name = (&reader{bytes: content}).name()
+		}
+		sections = append(sections, section)
+	}
+	return sections, r.err
+}
+
+// joinSections writes the sections again, every one with the size of its content
+func joinSections(sections []rawSection) []byte {
+	binary := Module(append(append(sectionData{}, defaults.MAGIC...), defaults.VERSION...)).Bytes()
+	for _, section := range sections {
+		binary = append(binary, byte(section.id))
+		for _, b := range EncodeUnsignedLEB128(uint64(len(section.content))) {
+			binary = append(binary, byte(b))
+		}
+		binary = append(binary, section.content...)
+	}
+	return binary
+}
+
+// Exports
+// The export section is decoded, changed and encoded again, the other sections do not change
+func rewriteExports(sections []rawSection, rewrite Rewrite) ([]rawSection, error) {
+	exportID := defaults.Section["export"].(int)
+	exports := []types.Export{}
+	position := -1
+	for i, section := range sections {
+		if section.id == exportID {
+			position = i
+			r := &reader{bytes: section.content}
+			r.vector(func() {
+				exports = append(exports, types.Export{Name: r.name(), Kind: int(r.byte()), Index: r.u32()})
+			})
+			if r.err != nil {
+				return nil, r.err
+			}
+		}
+	}
+
+	find := func(name string) int {
+		for i, export := range exports {
+			if export.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, rename := range rewrite.Rename {
+		i := find(rename.Old)
+		if i < 0 {
+			return nil, fmt.Errorf("rename: unknown export %q", rename.Old)
+		}
+		exports[i].Name = rename.New
+	}
+	for _, name := range rewrite.Remove {
+		i := find(name)
+		if i < 0 {
+			return nil, fmt.Errorf("remove: unknown export %q", name)
+		}
+		exports = append(exports[:i], exports[i+1:]...)
+	}
+
+	counts, err := spaceCounts(sections)
+	if err != nil {
+		return nil, err
+	}
+	for _, export := range rewrite.Add {
+		for _, kind := range linkKinds {
+			if export.Kind == defaults.ExportSection[kind] && int(export.Index) >= counts[kind] {
+				return nil, fmt.Errorf("export %q: unknown %s %d", export.Name, kindName(kind), export.Index)
+			}
+		}
+		exports = append(exports, export)
+	}
+
+	names := map[string]bool{}
+	for _, export := range exports {
+		if names[export.Name] {
+			return nil, fmt.Errorf("duplicate export name %q", export.Name)
+		}
+		names[export.Name] = true
+	}
+
+	entries := sectionData{}
+	for _, export := range exports {
+		entries = append(entries, sectionData{encodeVector(encodeString(export.Name)), export.Kind, omologateEncoded(uint(export.Index))})
+	}
+	section := rawSection{id: exportID, content: Module(flatten(encodeVector(entries))).Bytes()}
+
+	switch {
+	case len(exports) == 0 && position >= 0:
+		return append(sections[:position:position], sections[position+1:]...), nil
+	case len(exports) == 0:
+		return sections, nil
+	case position >= 0:
+		sections[position] = section
+		return sections, nil
+	}
+	// a new export section goes before the first section that comes after it
+	for i, other := range sections {
+		if other.id != defaults.Section["custom"] && sectionOrder(other.id) > sectionOrder(exportID) {
+			return append(sections[:i:i], append([]rawSection{section}, sections[i:]...)...), nil
+		}
+	}
+	return append(sections, section), nil
+}
+
+// The order of the sections, the tags come between the memories and the globals (see Assemble)
+func sectionOrder(id int) int {
+	for i, name := range []string{"type", "import", "func", "table", "memory", "tag", "global", "export", "start", "elem", "datacount", "code", "data"} {
+		if defaults.Section[name] == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// spaceCounts is the size of every index space (by the kinds of defaults.ExportSection)
+// the imports come first, then the definitions of their sections
+func spaceCounts(sections []rawSection) (map[string]int, error) {
+	imports := &types.Module{}
+	counts := map[string]int{}
+	definitions := map[string]string{"func": "func", "table": "table", "memory": "mem", "global": "global", "tag": "tag"}
+	for _, section := range sections {
+		r := &reader{bytes: section.content}
+		if section.id == defaults.Section["import"] {
+			r.importSection(imports)
+		}
+		for name, kind := range definitions {
+			if section.id == defaults.Section[name] {
+				counts[kind] += int(r.u32())
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	for _, kind := range linkKinds {
+		counts[kind] += spaceLen(imports, kind)
+	}
+	return counts, nil
+}
+
+// Reordering
+// The functions move to their new index: every call, ref.func, element, export and the start function follow them
+func reorderFunctions(sections []rawSection, order []string) ([]rawSection, []string, error) {
+	m, err := Decode(joinSections(sections))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := map[string]uint32{}
+	for _, export := range m.Exports {
+		if export.Kind == defaults.ExportSection["func"] {
+			names[export.Name] = export.Index
+		}
+	}
+	for _, section := range sections {
+		if section.name == "name" {
+			for index, name := range functionNames(section.content) {
+				names[name] = index
+				names["$"+name] = index
+			}
+		}
+	}
+
+	// the imports keep their indices, the functions of the profile come first, then the other ones
+	imported := 0
+	for _, fn := range m.Funcs {
+		if fn.Import != nil {
+			imported++
+		}
+	}
+	newIndex := map[uint32]uint32{}
+	moved := []uint32{}
+	for _, name := range order {
+		index, ok := names[name]
+		if number, err := strconv.ParseUint(name, 10, 32); err == nil {
+			index, ok = uint32(number), true
+		}
+		switch {
+		case !ok || int(index) >= len(m.Funcs):
+			return nil, nil, fmt.Errorf("order: unknown function %s", name)
+		case int(index) < imported:
+			return nil, nil, fmt.Errorf("order: function %s is imported, it can not move", name)
+		}
+		if _, ok := newIndex[index]; !ok {
+			newIndex[index] = uint32(imported + len(moved))
+			moved = append(moved, index)
+		}
+	}
+	for i := range m.Funcs {
+		if _, ok := newIndex[uint32(i)]; !ok {
+			if i < imported {
+				newIndex[uint32(i)] = uint32(i)
+				continue
+			}
+			newIndex[uint32(i)] = uint32(imported + len(moved))
+			moved = append(moved, uint32(i))
+		}
+	}
+	renumberFunctions(m, newIndex)
+
+	// the custom sections go back after the section they followed
+	reordered, err := splitSections(Assemble(m).Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	removed := []string{}
+	previous := -1
+	customs := map[int][]rawSection{}
+	for _, section := range sections {
+		if section.id != defaults.Section["custom"] {
+			previous = section.id
+			continue
+		}
+		if !reorderSafe[section.name] {
+			removed = append(removed, section.name)
+			continue
+		}
+		if section.name == "name" {
+			section.content = renumberNames(section.content, newIndex)
+		}
+		customs[previous] = append(customs[previous], section)
+	}
+
+	result := append([]rawSection{}, customs[-1]...)
+	for _, section := range reordered {
+		result = append(result, section)
+		result = append(result, customs[section.id]...)
+		delete(customs, section.id)
+	}
+	for _, id := range sortedKeys(customs) {
+		if id >= 0 {
+			result = append(result, customs[id]...)
+		}
+	}
+	return result, removed, nil
+}
+
+func sortedKeys(customs map[int][]rawSection) []int {
+	keys := []int{}
+	for id := range customs {
+		keys = append(keys, id)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// renumberFunctions moves every function to its new index
+func renumberFunctions(m *types.Module, newIndex map[uint32]uint32) {
+	r := remapper{funcs: newIndex}
+	funcs := make([]types.Func, len(m.Funcs))
+	for i, fn := range m.Funcs {
+		fn.Body = r.instructions(fn.Body)
+		funcs[newIndex[uint32(i)]] = fn
+	}
+	m.Funcs = funcs
+
+	for i := range m.Globals {
+		m.Globals[i].Init = r.instructions(m.Globals[i].Init)
+	}
+	for i, elem := range m.Elems {
+		for j, index := range elem.Funcs {
+			elem.Funcs[j] = newIndex[index]
+		}
+		for j, expression := range elem.Exprs {
+			elem.Exprs[j] = r.instructions(expression)
+		}
+		m.Elems[i].Offset = r.instructions(elem.Offset)
+	}
+	for i, data := range m.Datas {
+		m.Datas[i].Offset = r.instructions(data.Offset)
+	}
+	for i, export := range m.Exports {
+		if export.Kind == defaults.ExportSection["func"] {
+			m.Exports[i].Index = newIndex[export.Index]
+		}
+	}
+	if m.Start != nil {
+		start := newIndex[*m.Start]
+		m.Start = &start
+	}
+}
+
+// The name section
+// Its subsections are an id, a size and their content:
+// 1 the names of the functions (index, name), 2 the names of the locals and 3 of the labels (by function)
+// See https://webassembly.github.io/spec/core/appendix/custom.html#name-section
+// See https://github.com/WebAssembly/extended-name-section/blob/main/proposals/extended-name-section/Overview.md
+const (
+	functionNamesSubsection = 1
+	localNamesSubsection    = 2
+	labelNamesSubsection    = 3
+)
+
+func functionNames(content []byte) map[uint32]string {
+	names := map[uint32]string{}
+	r := &reader{bytes: content}
+	r.name()
+	for r.err == nil && r.pos < len(r.bytes) {
+		id := r.byte()
+		subsection := &reader{bytes: r.bytesN(int(r.u32()))}
+		if id == functionNamesSubsection {
+			subsection.vector(func() {
+				index := subsection.u32()
+				names[index] = subsection.name()
+			})
+		}
+	}
+	return names
+}
+
+// renumberNames moves the names of the functions (and of their locals and labels) to their new index
+// the entries are sorted by index, like the specification requires
+func renumberNames(content []byte, newIndex map[uint32]uint32) []byte {
+	r := &reader{bytes: content}
+	renumbered := Module(flatten(encodeVector(encodeString(r.name())))).Bytes()
+	for r.err == nil && r.pos < len(r.bytes) {
+		id := r.byte()
+		payload := r.bytesN(int(r.u32()))
+
+		if id == functionNamesSubsection || id == localNamesSubsection || id == labelNamesSubsection {
+			// every entry is the function index followed by the name (or the map of names), copied as it is
+			subsection := &reader{bytes: payload}
+			type entry struct {
+				index uint32
+				bytes []byte
+			}
+			entries := []entry{}
+			subsection.vector(func() {
+				index := subsection.u32()
+				start := subsection.pos
+				if id == functionNamesSubsection {
+					subsection.name()
+				} else {
+					subsection.vector(func() {
+						subsection.u32()
+						subsection.name()
+					})
+				}
+				entries = append(entries, entry{newIndex[index], subsection.bytes[start:subsection.pos]})
+			})
+			if subsection.err == nil {
+				sort.SliceStable(entries, func(i, j int) bool { return entries[i].index < entries[j].index })
+				encoded := omologateEncoded(uint(len(entries)))
+				for _, e := range entries {
+					encoded = append(encoded, omologateEncoded(uint(e.index))...)
+					for _, b := range e.bytes {
+						encoded = append(encoded, int(b))
+					}
+				}
+				payload = Module(encoded).Bytes()
+			}
+		}
+
+		renumbered = append(renumbered, id)
+		renumbered = append(renumbered, Module(omologateEncoded(uint(len(payload)))).Bytes()...)
+		renumbered = append(renumbered, payload...)
+	}
+	return renumbered
+}
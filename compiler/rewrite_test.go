@@ -0,0 +1,279 @@
+package compiler
+
+import (
+	"bytes"
+	"luna/types"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assembled(t *testing.T, input string) []byte {
+	t.Helper()
+	ast, err := Parser(Tokenize(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildWithOptions(ast, Options{})
+	if err == nil {
+		err = Validate(m)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Assemble(m).Bytes()
+}
+
+func exportNames(t *testing.T, binary []byte) []string {
+	t.Helper()
+	m, err := Decode(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, export := range m.Exports {
+		names = append(names, export.Name)
+	}
+	return names
+}
+
+// The renames are applied in their order, every time
+func TestRewriteChainedRenames(t *testing.T) {
+	binary := assembled(t, `(module (func (export "run")) (func (export "other")))`)
+	renames := []ExportRename{{Old: "run", New: "a"}, {Old: "a", New: "b"}}
+	for i := 0; i < 20; i++ {
+		rewritten, err := RewriteBinary(binary, Rewrite{Rename: renames})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := exportNames(t, rewritten.Binary); len(names) != 2 || names[0] != "b" || names[1] != "other" {
+			t.Fatalf("got exports %v, want [b other]", names)
+		}
+	}
+
+	if _, err := RewriteBinary(binary, Rewrite{Rename: []ExportRename{{Old: "a", New: "b"}, {Old: "run", New: "a"}}}); err == nil {
+		t.Error("renaming a before run is renamed to a: expected an unknown export error")
+	}
+	if _, err := RewriteBinary(binary, Rewrite{Rename: []ExportRename{{Old: "run", New: "other"}}}); err == nil {
+		t.Error("renaming run to other: expected a duplicate export error")
+	}
+}
+
+// withCustomSections appends custom sections (name: content) to a binary
+func withCustomSections(binary []byte, sections ...string) []byte {
+	binary = append([]byte{}, binary...)
+	for i := 0; i < len(sections); i += 2 {
+		content := append(Module(flatten(encodeVector(encodeString(sections[i])))).Bytes(), sections[i+1]...)
+		binary = append(binary, 0x00)
+		binary = append(binary, Module(omologateEncoded(uint(len(content)))).Bytes()...)
+		binary = append(binary, content...)
+	}
+	return binary
+}
+
+func customSectionNames(t *testing.T, binary []byte) []string {
+	t.Helper()
+	sections, err := splitSections(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, section := range sections {
+		if section.id == 0 {
+			names = append(names, section.name)
+		}
+	}
+	return names
+}
+
+func TestRewriteStrip(t *testing.T) {
+	module := assembled(t, `(module (func (export "run")))`)
+	binary := withCustomSections(module, "name", "\x00\x01m", "producers", "\x00", ".debug_info", "abc", ".debug_line", "def")
+
+	tests := []struct {
+		strip []string
+		kept  []string
+	}{
+		{[]string{"name"}, []string{"producers", ".debug_info", ".debug_line"}},
+		{[]string{".debug_*"}, []string{"name", "producers"}},
+		{[]string{"producers", ".debug_info"}, []string{"name", ".debug_line"}},
+		{[]string{"*"}, []string{}},
+		{[]string{"unknown"}, []string{"name", "producers", ".debug_info", ".debug_line"}},
+	}
+	for _, test := range tests {
+		rewritten, err := RewriteBinary(binary, Rewrite{Strip: test.strip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := customSectionNames(t, rewritten.Binary); !reflect.DeepEqual(got, test.kept) {
+			t.Errorf("strip %v: got %v, want %v", test.strip, got, test.kept)
+		}
+		if len(rewritten.Removed)+len(test.kept) != 4 {
+			t.Errorf("strip %v: removed %v", test.strip, rewritten.Removed)
+		}
+		// the other sections are copied as they are
+		if _, err := Decode(rewritten.Binary); err != nil {
+			t.Errorf("strip %v: %v", test.strip, err)
+		}
+	}
+
+	rewritten, _ := RewriteBinary(binary, Rewrite{Strip: []string{"*"}})
+	if !bytes.Equal(rewritten.Binary, module) {
+		t.Errorf("without its custom sections the module is not the same:\n got %x\nwant %x", rewritten.Binary, module)
+	}
+}
+
+func TestRewriteExports(t *testing.T) {
+	binary := assembled(t, `(module
+	  (memory (export "memory") 1)
+	  (global $g i32 (i32.const 1))
+	  (func (export "a")) (func (export "b")) (func))`)
+
+	rewritten, err := RewriteBinary(binary, Rewrite{Remove: []string{"a", "memory"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := exportNames(t, rewritten.Binary); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("remove: got %v, want [b]", names)
+	}
+
+	// without exports the export section is removed, adding one creates it again
+	rewritten, err = RewriteBinary(binary, Rewrite{Remove: []string{"a", "b", "memory"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := exportNames(t, rewritten.Binary); len(names) != 0 {
+		t.Errorf("remove all: got %v", names)
+	}
+	rewritten, err = RewriteBinary(rewritten.Binary, Rewrite{Add: []types.Export{{Name: "c", Kind: 0, Index: 2}, {Name: "g", Kind: 3, Index: 0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(rewritten.Binary)
+	if err == nil {
+		err = Validate(m)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Exports) != 2 || m.Exports[0].Name != "c" || m.Exports[0].Index != 2 || m.Exports[1].Name != "g" {
+		t.Errorf("add: got %+v", m.Exports)
+	}
+
+	for _, rewrite := range []Rewrite{
+		{Remove: []string{"unknown"}},
+		{Add: []types.Export{{Name: "x", Kind: 0, Index: 3}}},
+		{Add: []types.Export{{Name: "x", Kind: 2, Index: 1}}},
+		{Add: []types.Export{{Name: "a", Kind: 0, Index: 2}}},
+	} {
+		if _, err := RewriteBinary(binary, rewrite); err == nil {
+			t.Errorf("%+v: expected an error", rewrite)
+		}
+	}
+}
+
+// Every function has its own constant, so it can be found wherever it moves
+func TestRewriteOrder(t *testing.T) {
+	binary := assembled(t, `(module
+	  (import "env" "log" (func $log (param i32)))
+	  (table 2 funcref)
+	  (elem (i32.const 0) $a $c)
+	  (elem declare func $b)
+	  (func $a (result i32) (i32.const 10))
+	  (func $b (result i32) (i32.add (call $a) (i32.const 20)))
+	  (func $c (export "c") (result i32) (drop (ref.func $b)) (i32.add (call $b) (i32.const 30)))
+	  (func $init (call $log (i32.const 40)))
+	  (start $init))`)
+	// the name section: names of the functions 1 ($a) and 3 ($c)
+	binary = withCustomSections(binary, "name", "\x01\x07\x02\x01\x01a\x03\x01c", "reloc.CODE", "\x00")
+
+	// by index, by export name and by name (the name section)
+	rewritten, err := RewriteBinary(binary, Rewrite{Order: []string{"4", "c", "$a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(rewritten.Binary)
+	if err == nil {
+		err = Validate(m)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new index of every function, by its constant
+	index := map[int32]uint32{}
+	for i, fn := range m.Funcs {
+		for _, instruction := range fn.Body {
+			if instruction.Name == "i32.const" {
+				index[instruction.Immediates[0].(int32)] = uint32(i)
+			}
+		}
+	}
+	init, c, b, a := index[40], index[30], index[20], index[10]
+	if init != 1 || c != 2 || a != 3 || b != 4 {
+		t.Fatalf("order: $init %d $c %d $a %d $b %d, want 1 2 3 4", init, c, a, b)
+	}
+	if m.Funcs[0].Import == nil {
+		t.Error("the import must stay the function 0")
+	}
+
+	calls := func(fn uint32) []uint32 {
+		called := []uint32{}
+		for _, instruction := range m.Funcs[fn].Body {
+			if instruction.Name == "call" || instruction.Name == "ref.func" {
+				called = append(called, instruction.Immediates[0].(uint32))
+			}
+		}
+		return called
+	}
+	if got := calls(b); !reflect.DeepEqual(got, []uint32{a}) {
+		t.Errorf("$b calls %v, want [%d]", got, a)
+	}
+	if got := calls(c); !reflect.DeepEqual(got, []uint32{b, b}) {
+		t.Errorf("$c calls %v, want [%d %d]", got, b, b)
+	}
+	if got := calls(init); !reflect.DeepEqual(got, []uint32{0}) {
+		t.Errorf("$init calls %v, want [0]", got)
+	}
+	if got := m.Elems[0].Funcs; !reflect.DeepEqual(got, []uint32{a, c}) {
+		t.Errorf("elements: got %v, want [%d %d]", got, a, c)
+	}
+	if m.Exports[0].Index != c {
+		t.Errorf("export c: got %d, want %d", m.Exports[0].Index, c)
+	}
+	if m.Start == nil || *m.Start != init {
+		t.Errorf("start: got %v, want %d", m.Start, init)
+	}
+
+	// the name section follows the functions, reloc.CODE would point to the old code
+	if !reflect.DeepEqual(rewritten.Removed, []string{"reloc.CODE"}) {
+		t.Errorf("removed: got %v, want [reloc.CODE]", rewritten.Removed)
+	}
+	sections, _ := splitSections(rewritten.Binary)
+	names := map[uint32]string{}
+	for _, section := range sections {
+		if section.name == "name" {
+			names = functionNames(section.content)
+		}
+	}
+	if !reflect.DeepEqual(names, map[uint32]string{a: "a", c: "c"}) {
+		t.Errorf("names: got %v", names)
+	}
+
+	for _, order := range [][]string{{"0"}, {"9"}, {"unknown"}} {
+		if _, err := RewriteBinary(binary, Rewrite{Order: order}); err == nil {
+			t.Errorf("order %v: expected an error", order)
+		}
+	}
+}
+
+// A module that can not be decoded is rejected before it is rewritten
+func TestRewriteOrderUndecodable(t *testing.T) {
+	binary := assembled(t, `(module (func (export "run")))`)
+	// an unknown opcode (0xff) in the body
+	binary[len(binary)-2] = 0xff
+	_, err := RewriteBinary(binary, Rewrite{Order: []string{"0"}, Strip: []string{"*"}})
+	if err == nil || !strings.Contains(err.Error(), "can not be decoded") {
+		t.Errorf("got %v, want a decoding error", err)
+	}
+}
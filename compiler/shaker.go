@@ -0,0 +1,486 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/texts"
+	"luna/types"
+	"strings"
+)
+
+// Dead code elimination (tree shaking)
+// Code generated from templates is full of helpers that nobody calls.
+// Starting from what the host can reach (the exports, the start function and the tables, through the element segments)
+// we follow every call, ref.func and global.get/global.set: what is never reached is removed
+// and the indices of what is left are renumbered.
+// Imports are kept, they are part of what the module asks to the host.
+//
+// Inside a function the instructions after unreachable, br, br_table, return (or throw...) can never run,
+// they are removed until the end of their block.
+
+// DeadCode is what the elimination removed
+type DeadCode struct {
+	Funcs   []string
+	Globals []string
+	Types   []string
+	// Instructions that could never run
+	Instructions int
+}
+
+func (d DeadCode) String() string {
+	lines := []string{}
+	for _, name := range d.Funcs {
+		lines = append(lines, "removed func "+name)
+	}
+	for _, name := range d.Globals {
+		lines = append(lines, "removed global "+name)
+	}
+	for _, name := range d.Types {
+		lines = append(lines, "removed type "+name)
+	}
+	lines = append(lines, fmt.Sprintf("removed %d unreachable instructions", d.Instructions))
+	return strings.Join(lines, "\n")
+}
+
+// Instructions that never fall through to the next one
+var terminators = map[string]bool{
+	"unreachable":          true,
+	"br":                   true,
+	"br_table":             true,
+	"return":               true,
+	"return_call":          true,
+	"return_call_indirect": true,
+	"throw":                true,
+	"throw_ref":            true,
+	"rethrow":              true,
+}
+
+// EliminateDeadCode removes from a (valid) module the code that can never run
+func EliminateDeadCode(m *types.Module) DeadCode {
+	dead := DeadCode{Funcs: []string{}, Globals: []string{}, Types: []string{}}
+	for i := range m.Funcs {
+		body, removed := removeUnreachable(m.Funcs[i].Body)
+		m.Funcs[i].Body = body
+		dead.Instructions += removed
+	}
+
+	funcs, globals := reachable(m)
+	typesUsed := usedTypes(m, funcs, globals)
+
+	funcMap := renumber(len(m.Funcs), funcs)
+	globalMap := renumber(len(m.Globals), globals)
+	typeMap := renumber(len(m.Types), typesUsed)
+	r := remapper{funcs: funcMap, globals: globalMap, types: typeMap}
+
+	for i, fn := range m.Funcs {
+		if !funcs[uint32(i)] {
+			dead.Funcs = append(dead.Funcs, displayName(i, fn.Name))
+		}
+	}
+	for i, global := range m.Globals {
+		if !globals[uint32(i)] {
+			dead.Globals = append(dead.Globals, displayName(i, global.Name))
+		}
+	}
+	for i := range m.Types {
+		if !typesUsed[uint32(i)] {
+			dead.Types = append(dead.Types, fmt.Sprint(i))
+		}
+	}
+
+	r.module(m, funcs, globals, typesUsed)
+	return dead
+}
+
+// removeUnreachable drops the instructions between a terminator and the end (or else, catch...) of its block
+func removeUnreachable(body []types.Instruction) ([]types.Instruction, int) {
+	kept := []types.Instruction{}
+	removed := 0
+	for i := 0; i < len(body); i++ {
+		kept = append(kept, body[i])
+		if !terminators[body[i].Name] {
+			continue
+		}
+
+		depth := 0
+		for i+1 < len(body) {
+			next := body[i+1].Name
+			if depth == 0 && (next == "end" || next == "else" || next == "catch" || next == "catch_all" || next == "delegate") {
+				break
+			}
+			switch next {
+			case "block", "loop", "if", "try", "try_table":
+				depth++
+			case "end", "delegate":
+				depth--
+			}
+			removed++
+			i++
+		}
+	}
+	return kept, removed
+}
+
+// reachable follows the references from the roots to the functions and the globals
+func reachable(m *types.Module) (map[uint32]bool, map[uint32]bool) {
+	funcs, globals := map[uint32]bool{}, map[uint32]bool{}
+
+	for i, fn := range m.Funcs {
+		if fn.Import != nil {
+			funcs[uint32(i)] = true
+		}
+	}
+	for i, global := range m.Globals {
+		if global.Import != nil {
+			globals[uint32(i)] = true
+		}
+	}
+	for _, export := range m.Exports {
+		switch export.Kind {
+		case defaults.ExportSection["func"]:
+			funcs[export.Index] = true
+		case defaults.ExportSection["global"]:
+			globals[export.Index] = true
+		}
+	}
+	if m.Start != nil {
+		funcs[*m.Start] = true
+	}
+
+	// the instructions of the segments always run (or can be reached through a table)
+	visit := func(instructions []types.Instruction) {
+		forEachIndex(instructions, func(kind string, index uint32) {
+			switch kind {
+			case texts.FuncIdx:
+				funcs[index] = true
+			case texts.GlobalIdx:
+				globals[index] = true
+			}
+		})
+	}
+	for _, elem := range m.Elems {
+		for _, index := range elem.Funcs {
+			funcs[index] = true
+		}
+		for _, expression := range elem.Exprs {
+			visit(expression)
+		}
+		visit(elem.Offset)
+	}
+	for _, data := range m.Datas {
+		visit(data.Offset)
+	}
+
+	// a function (or a global) reached can reach others, until nothing new is found
+	for visited := 0; visited != len(funcs)+len(globals); {
+		visited = len(funcs) + len(globals)
+		for i, fn := range m.Funcs {
+			if funcs[uint32(i)] {
+				visit(fn.Body)
+			}
+		}
+		for i, global := range m.Globals {
+			if globals[uint32(i)] {
+				visit(global.Init)
+			}
+		}
+	}
+	return funcs, globals
+}
+
+// usedTypes are the types referenced by what is left
+// a type of a recursive group keeps the whole group (the group is a single type definition)
+func usedTypes(m *types.Module, funcs, globals map[uint32]bool) map[uint32]bool {
+	used := map[uint32]bool{}
+	useValue := func(value types.ValueType) {
+		if index, concrete := value.TypeIndex(); concrete {
+			used[index] = true
+		}
+	}
+	useValues := func(values []types.ValueType) {
+		for _, value := range values {
+			useValue(value)
+		}
+	}
+	useInstructions := func(instructions []types.Instruction) {
+		forEachIndex(instructions, func(kind string, index uint32) {
+			if kind == texts.TypeIdx {
+				used[index] = true
+			}
+		})
+		forEachValue(instructions, useValue)
+	}
+
+	for i, fn := range m.Funcs {
+		if funcs[uint32(i)] {
+			used[fn.Type] = true
+			useValues(fn.Locals)
+			useInstructions(fn.Body)
+		}
+	}
+	for i, global := range m.Globals {
+		if globals[uint32(i)] {
+			useValue(global.Type)
+			useInstructions(global.Init)
+		}
+	}
+	for _, table := range m.Tables {
+		useValue(table.ElemType)
+	}
+	for _, tag := range m.Tags {
+		used[tag.Type] = true
+	}
+	for _, elem := range m.Elems {
+		useValue(elem.Type)
+		for _, expression := range elem.Exprs {
+			useInstructions(expression)
+		}
+		useInstructions(elem.Offset)
+	}
+	for _, data := range m.Datas {
+		useInstructions(data.Offset)
+	}
+
+	for found := -1; found != len(used); {
+		found = len(used)
+		for group := 0; group < len(m.Types) && m.Types[group].Rec > 0; group += m.Types[group].Rec {
+			members := m.Types[group : group+m.Types[group].Rec]
+			for i := range members {
+				if !used[uint32(group+i)] {
+					continue
+				}
+				for j, member := range members {
+					used[uint32(group+j)] = true
+					useValues(typeValues(member))
+					for _, super := range member.Supers {
+						used[super] = true
+					}
+				}
+				break
+			}
+		}
+	}
+	return used
+}
+
+// renumber gives the next index to everything that is kept
+func renumber(count int, kept map[uint32]bool) map[uint32]uint32 {
+	indices := map[uint32]uint32{}
+	next := uint32(0)
+	for i := 0; i < count; i++ {
+		if kept[uint32(i)] {
+			indices[uint32(i)] = next
+			next++
+		}
+	}
+	return indices
+}
+
+// forEachIndex visits the function, global and type indices of the instructions
+func forEachIndex(instructions []types.Instruction, visit func(kind string, index uint32)) {
+	for _, instruction := range instructions {
+		for i, kind := range defaults.Immediates[instruction.Name] {
+			switch kind {
+			case texts.FuncIdx, texts.GlobalIdx, texts.TypeIdx:
+				visit(kind, instruction.Immediates[i].(uint32))
+			case texts.BlockType:
+				if blockType := instruction.Immediates[i].(types.BlockType); blockType.HasIndex {
+					visit(texts.TypeIdx, blockType.Index)
+				}
+			}
+		}
+	}
+}
+
+// forEachValue visits the value types of the instructions (block types, select, ref.null, ref.cast...)
+func forEachValue(instructions []types.Instruction, visit func(value types.ValueType)) {
+	for _, instruction := range instructions {
+		for i, kind := range defaults.Immediates[instruction.Name] {
+			switch kind {
+			case texts.HeapType, texts.RefType:
+				visit(instruction.Immediates[i].(types.ValueType))
+			case texts.SelectType:
+				for _, value := range instruction.Immediates[i].([]types.ValueType) {
+					visit(value)
+				}
+			case texts.BlockType:
+				blockType := instruction.Immediates[i].(types.BlockType)
+				for _, value := range append(append([]types.ValueType{}, blockType.Params...), blockType.Results...) {
+					visit(value)
+				}
+			}
+		}
+	}
+}
+
+// remapper moves everything to its new index
+// an index space without a map (nil) keeps its indices
+type remapper struct {
+	funcs, globals, types                map[uint32]uint32
+	tables, memories, tags, elems, datas map[uint32]uint32
+}
+
+func remap(indices map[uint32]uint32, index uint32) uint32 {
+	if indices == nil {
+		return index
+	}
+	return indices[index]
+}
+
+func (r remapper) module(m *types.Module, funcs, globals, typesUsed map[uint32]bool) {
+	typeDefs := []types.TypeDef{}
+	for i, typeDef := range m.Types {
+		if typesUsed[uint32(i)] {
+			typeDefs = append(typeDefs, r.typeDef(typeDef))
+		}
+	}
+	m.Types = typeDefs
+
+	fns := []types.Func{}
+	for i, fn := range m.Funcs {
+		if funcs[uint32(i)] {
+			fn.Type = r.types[fn.Type]
+			fn.Locals = r.values(fn.Locals)
+			fn.Body = r.instructions(fn.Body)
+			fns = append(fns, fn)
+		}
+	}
+	m.Funcs = fns
+
+	kept := []types.Global{}
+	for i, global := range m.Globals {
+		if globals[uint32(i)] {
+			global.Type = r.value(global.Type)
+			global.Init = r.instructions(global.Init)
+			kept = append(kept, global)
+		}
+	}
+	m.Globals = kept
+
+	for i := range m.Tables {
+		m.Tables[i].ElemType = r.value(m.Tables[i].ElemType)
+	}
+	for i := range m.Tags {
+		m.Tags[i].Type = r.types[m.Tags[i].Type]
+	}
+	for i, export := range m.Exports {
+		switch export.Kind {
+		case defaults.ExportSection["func"]:
+			m.Exports[i].Index = r.funcs[export.Index]
+		case defaults.ExportSection["global"]:
+			m.Exports[i].Index = r.globals[export.Index]
+		}
+	}
+	if m.Start != nil {
+		start := r.funcs[*m.Start]
+		m.Start = &start
+	}
+	for i, elem := range m.Elems {
+		for j, index := range elem.Funcs {
+			elem.Funcs[j] = r.funcs[index]
+		}
+		for j, expression := range elem.Exprs {
+			elem.Exprs[j] = r.instructions(expression)
+		}
+		m.Elems[i].Type = r.value(elem.Type)
+		m.Elems[i].Offset = r.instructions(elem.Offset)
+	}
+	for i, data := range m.Datas {
+		m.Datas[i].Offset = r.instructions(data.Offset)
+	}
+}
+
+func (r remapper) typeDef(typeDef types.TypeDef) types.TypeDef {
+	typeDef.Params = r.values(typeDef.Params)
+	typeDef.Results = r.values(typeDef.Results)
+	fields := []types.Field{}
+	for _, field := range typeDef.Fields {
+		fields = append(fields, types.Field{Type: r.value(field.Type), Mutable: field.Mutable})
+	}
+	if typeDef.Fields != nil {
+		typeDef.Fields = fields
+	}
+	supers := []uint32{}
+	for _, super := range typeDef.Supers {
+		supers = append(supers, remap(r.types, super))
+	}
+	if typeDef.Supers != nil {
+		typeDef.Supers = supers
+	}
+	return typeDef
+}
+
+func (r remapper) value(value types.ValueType) types.ValueType {
+	if index, concrete := value.TypeIndex(); concrete {
+		return types.Ref(types.ConcreteHeap(remap(r.types, index)), value.Nullable())
+	}
+	return value
+}
+
+func (r remapper) values(values []types.ValueType) []types.ValueType {
+	if values == nil {
+		return nil
+	}
+	remapped := []types.ValueType{}
+	for _, value := range values {
+		remapped = append(remapped, r.value(value))
+	}
+	return remapped
+}
+
+func (r remapper) instructions(instructions []types.Instruction) []types.Instruction {
+	if instructions == nil {
+		return nil
+	}
+	remapped := []types.Instruction{}
+	for _, instruction := range instructions {
+		immediates := append([]interface{}{}, instruction.Immediates...)
+		for i, kind := range defaults.Immediates[instruction.Name] {
+			switch kind {
+			case texts.FuncIdx:
+				immediates[i] = remap(r.funcs, immediates[i].(uint32))
+			case texts.GlobalIdx:
+				immediates[i] = remap(r.globals, immediates[i].(uint32))
+			case texts.TypeIdx:
+				immediates[i] = remap(r.types, immediates[i].(uint32))
+			case texts.TableIdx:
+				immediates[i] = remap(r.tables, immediates[i].(uint32))
+			case texts.MemIdx:
+				immediates[i] = remap(r.memories, immediates[i].(uint32))
+			case texts.TagIdx:
+				immediates[i] = remap(r.tags, immediates[i].(uint32))
+			case texts.ElemIdx:
+				immediates[i] = remap(r.elems, immediates[i].(uint32))
+			case texts.DataIdx:
+				immediates[i] = remap(r.datas, immediates[i].(uint32))
+			case texts.MemArg:
+				memArg := immediates[i].(types.MemArg)
+				memArg.Memory = remap(r.memories, memArg.Memory)
+				immediates[i] = memArg
+			case texts.Catches:
+				catches := []types.Catch{}
+				for _, handler := range immediates[i].([]types.Catch) {
+					if handler.Kind == types.CatchTag || handler.Kind == types.CatchTagRef {
+						handler.Tag = remap(r.tags, handler.Tag)
+					}
+					catches = append(catches, handler)
+				}
+				immediates[i] = catches
+			case texts.HeapType, texts.RefType:
+				immediates[i] = r.value(immediates[i].(types.ValueType))
+			case texts.SelectType:
+				immediates[i] = r.values(immediates[i].([]types.ValueType))
+			case texts.BlockType:
+				blockType := immediates[i].(types.BlockType)
+				if blockType.HasIndex {
+					blockType.Index = remap(r.types, blockType.Index)
+				}
+				blockType.Params = r.values(blockType.Params)
+				blockType.Results = r.values(blockType.Results)
+				immediates[i] = blockType
+			}
+		}
+		remapped = append(remapped, types.Instruction{Name: instruction.Name, Immediates: immediates})
+	}
+	return remapped
+}
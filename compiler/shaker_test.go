@@ -0,0 +1,142 @@
+package compiler
+
+import (
+	"luna/types"
+	"reflect"
+	"testing"
+)
+
+// shaken is a module after the dead code elimination, it must still be valid
+func shaken(t *testing.T, input string) (*types.Module, DeadCode) {
+	t.Helper()
+	m, err := built(input)
+	if err == nil {
+		err = Validate(m)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := EliminateDeadCode(m)
+	if err := Validate(m); err != nil {
+		t.Fatalf("the module is not valid after the elimination: %v", err)
+	}
+	return m, dead
+}
+
+func funcNames(m *types.Module) []string {
+	names := []string{}
+	for _, fn := range m.Funcs {
+		names = append(names, fn.Name)
+	}
+	return names
+}
+
+func TestShakerReachability(t *testing.T) {
+	tests := []struct {
+		name, input string
+		kept        []string
+	}{
+		{"exports", `(module (func $a (export "a") (call $b)) (func $b) (func $c))`, []string{"$a", "$b"}},
+		{"start", `(module (func $init (call $b)) (func $b) (func $c) (start $init))`, []string{"$init", "$b"}},
+		{"elements", `(module (table 2 funcref) (elem (i32.const 0) $a $b) (func $a) (func $b (call $c)) (func $c) (func $d))`, []string{"$a", "$b", "$c"}},
+		{"ref.func", `(module (elem declare func $b)
+		  (func $a (export "a") (result funcref) (ref.func $b))
+		  (func $b (call $c)) (func $c) (func $d))`, []string{"$a", "$b", "$c"}},
+		{"call_indirect keeps the table", `(module (type $t (func)) (table 1 funcref) (elem (i32.const 0) $b)
+		  (func $a (export "a") (call_indirect (type $t) (i32.const 0))) (func $b) (func $c))`, []string{"$a", "$b"}},
+		{"imports are kept", `(module (import "env" "f" (func $f)) (func $a) (func $b (export "b")))`, []string{"$f", "$b"}},
+		{"a cycle nobody calls", `(module (func $a (call $b)) (func $b (call $a)) (func $c (export "c")))`, []string{"$c"}},
+		{"an exported global reaches a function", `(module (global (export "g") funcref (ref.func $a)) (func $a) (func $b))`, []string{"$a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, _ := shaken(t, test.input)
+			if got := funcNames(m); !reflect.DeepEqual(got, test.kept) {
+				t.Errorf("got %v, want %v", got, test.kept)
+			}
+		})
+	}
+}
+
+// What is left is renumbered: the calls, the globals, the types, the exports, the elements and the start
+func TestShakerRenumbering(t *testing.T) {
+	m, dead := shaken(t, `(module
+	  (type $unused (func (param f64)))
+	  (type $binary (func (param i32 i32) (result i32)))
+	  (type $void (func))
+	  (table 1 funcref)
+	  (global $unused i32 (i32.const 0))
+	  (global $counter (mut i32) (i32.const 0))
+	  (elem (i32.const 0) $add)
+	  (func $dead (param f64))
+	  (func $add (type $binary) (i32.add (local.get 0) (local.get 1)))
+	  (func $init (type $void) (global.set $counter (i32.const 1)))
+	  (func $run (export "run") (result i32)
+	    (call $add (global.get $counter) (i32.const 2))
+	    (call_indirect (type $binary) (i32.const 3) (i32.const 4) (i32.const 0))
+	    (i32.add))
+	  (start $init))`)
+
+	if !reflect.DeepEqual(dead.Funcs, []string{"$dead"}) || !reflect.DeepEqual(dead.Globals, []string{"$unused"}) || !reflect.DeepEqual(dead.Types, []string{"0"}) {
+		t.Errorf("removed %+v", dead)
+	}
+	if got := funcNames(m); !reflect.DeepEqual(got, []string{"$add", "$init", "$run"}) {
+		t.Fatalf("funcs: got %v", got)
+	}
+	if len(m.Globals) != 1 || m.Globals[0].Name != "$counter" {
+		t.Errorf("globals: got %+v", m.Globals)
+	}
+
+	// $binary is now the type 0, $void the type 1 and $counter the global 0
+	if m.Funcs[0].Type != 0 || m.Funcs[1].Type != 1 {
+		t.Errorf("types of the functions: got %d %d, want 0 1", m.Funcs[0].Type, m.Funcs[1].Type)
+	}
+	if got, want := instructionsText(m.Funcs[2].Body), "global.get 0 i32.const 2 call 0 i32.const 3 i32.const 4 i32.const 0 call_indirect 0 0 i32.add"; got != want {
+		t.Errorf("run:\n got %s\nwant %s", got, want)
+	}
+	if got, want := instructionsText(m.Funcs[1].Body), "i32.const 1 global.set 0"; got != want {
+		t.Errorf("init:\n got %s\nwant %s", got, want)
+	}
+	if m.Exports[0].Index != 2 {
+		t.Errorf("export run: got %d, want 2", m.Exports[0].Index)
+	}
+	if !reflect.DeepEqual(m.Elems[0].Funcs, []uint32{0}) {
+		t.Errorf("elements: got %v, want [0]", m.Elems[0].Funcs)
+	}
+	if m.Start == nil || *m.Start != 1 {
+		t.Errorf("start: got %v, want 1", m.Start)
+	}
+}
+
+// The instructions after a terminator are removed until the end of their block, nested blocks included
+func TestShakerUnreachableCode(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+		removed           int
+	}{
+		{"unreachable", `(module (func (export "f") unreachable i32.const 1 drop))`, "unreachable", 2},
+		{"return in a block", `(module (func (export "f") (result i32)
+		  block i32.const 1 return i32.const 2 drop end i32.const 3))`, "block i32.const 1 return end i32.const 3", 2},
+		{"br skips a nested block", `(module (func (export "f")
+		  block br 0 block nop loop nop end end nop end))`, "block br 0 end", 7},
+		{"br_table", `(module (func (export "f") (param i32)
+		  block local.get 0 br_table 0 0 local.get 0 drop end))`, "block local.get 0 br_table end", 2},
+		{"the else branch is kept", `(module (func (export "f") (param i32) (result i32)
+		  local.get 0 if (result i32) i32.const 1 return i32.const 2 drop unreachable else i32.const 3 end))`,
+			"local.get 0 if i32.const 1 return else i32.const 3 end", 3},
+		{"inside a loop inside an if", `(module (func (export "f") (param i32)
+		  local.get 0 if loop br 1 i32.const 1 drop end nop end))`, "local.get 0 if loop br 1 end nop end", 2},
+		{"nothing after the terminator", `(module (func (export "f") (result i32) i32.const 1 return))`, "i32.const 1 return", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, dead := shaken(t, test.input)
+			if got := instructionsText(m.Funcs[0].Body); got != test.want {
+				t.Errorf("got %s\nwant %s", got, test.want)
+			}
+			if dead.Instructions != test.removed {
+				t.Errorf("removed %d instructions, want %d", dead.Instructions, test.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"luna/defaults"
+	"sort"
+)
+
+// Size statistics
+// Where the bytes of a binary module go: the size of every section, of every function body
+// and how many times every opcode is used. They are computed from the binary itself
+// (what Assemble emits, or a .wasm built by another toolchain), so they are the real sizes.
+
+// Statistics of a binary module, sizes are in bytes
+type Statistics struct {
+	Size      int                  `json:"size"`
+	Sections  []SectionStatistics  `json:"sections"`
+	Functions []FunctionStatistics `json:"functions"`
+	// How many times every instruction is used by the function bodies (their final end included)
+	Opcodes map[string]int `json:"opcodes"`
+}
+
+// The size of a section includes its id and the size of its content
+type SectionStatistics struct {
+	ID int `json:"id"`
+	// The name of the section, or the name of a custom section
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	// The number of entries of the vector (functions, types...), 0 for the custom sections
+	Count int `json:"count"`
+}
+
+// The size of a function body includes its locals and the size that prefixes it in the code section
+type FunctionStatistics struct {
+	// Index in the function index space (after the imported functions)
+	Index        uint32 `json:"index"`
+	Name         string `json:"name,omitempty"`
+	Size         int    `json:"size"`
+	Instructions int    `json:"instructions"`
+}
+
+// The names of the sections by their id
+var sectionNames = map[int]string{}
+
+func init() {
+	for name, id := range defaults.Section {
+		sectionNames[id.(int)] = name
+	}
+}
+
+// Stats reads the sections and the function bodies of a binary module
+// the functions are named after their export (if any)
+func Stats(binary []byte) (Statistics, error) {
+	m, err := Decode(binary)
+	if err != nil {
+		return Statistics{}, err
+	}
+
+	stats := Statistics{Size: len(binary), Sections: []SectionStatistics{}, Functions: []FunctionStatistics{}, Opcodes: map[string]int{}}
+	imported := uint32(0)
+	for _, fn := range m.Funcs {
+		if fn.Import != nil {
+			imported++
+		}
+	}
+	names := map[uint32]string{}
+	for _, export := range m.Exports {
+		if _, ok := names[export.Index]; !ok && export.Kind == defaults.ExportSection["func"] {
+			names[export.Index] = export.Name
+		}
+	}
+
+	// Decode already checked the structure, the sections can be read without checking it again
+	r := &reader{bytes: binary, pos: len(defaults.MAGIC) + len(defaults.VERSION)}
+	for r.pos < len(r.bytes) {
+		start := r.pos
+		id := int(r.byte())
+		size := int(r.u32())
+		content := &reader{bytes: binary[:r.pos+size], pos: r.pos}
+		r.pos += size
+
+		section := SectionStatistics{ID: id, Name: sectionNames[id], Size: r.pos - start}
+		switch id {
+		case defaults.Section["custom"]:
+			section.Name = content.name()
+		case defaults.Section["start"], defaults.Section["datacount"]:
+		default:
+			section.Count = int(content.u32())
+		}
+
+		if id == defaults.Section["code"] {
+			for i := 0; i < section.Count; i++ {
+				bodyStart := content.pos
+				content.pos += int(content.u32())
+				index := imported + uint32(i)
+				stats.Functions = append(stats.Functions, FunctionStatistics{
+					Index:        index,
+					Name:         names[index],
+					Size:         content.pos - bodyStart,
+					Instructions: len(m.Funcs[index].Body) + 1,
+				})
+			}
+		}
+		stats.Sections = append(stats.Sections, section)
+	}
+
+	for _, fn := range m.Funcs {
+		if fn.Import != nil {
+			continue
+		}
+		for _, instruction := range fn.Body {
+			stats.Opcodes[instruction.Name]++
+		}
+		stats.Opcodes["end"]++
+	}
+	return stats, nil
+}
+
+// LargestFunctions are the functions sorted by size, the biggest first
+func (s Statistics) LargestFunctions() []FunctionStatistics {
+	functions := append([]FunctionStatistics{}, s.Functions...)
+	sort.SliceStable(functions, func(i, j int) bool {
+		return functions[i].Size > functions[j].Size
+	})
+	return functions
+}
+
+// OpcodeCount is how many times an opcode is used
+type OpcodeCount struct {
+	Name  string
+	Count int
+}
+
+// SortedOpcodes are the opcodes sorted by use, the most used first (then by name)
+func (s Statistics) SortedOpcodes() []OpcodeCount {
+	opcodes := []OpcodeCount{}
+	for name, count := range s.Opcodes {
+		opcodes = append(opcodes, OpcodeCount{Name: name, Count: count})
+	}
+	sort.Slice(opcodes, func(i, j int) bool {
+		if opcodes[i].Count != opcodes[j].Count {
+			return opcodes[i].Count > opcodes[j].Count
+		}
+		return opcodes[i].Name < opcodes[j].Name
+	})
+	return opcodes
+}
@@ -0,0 +1,80 @@
+package compiler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The sizes of the module built by another toolchain (see foreignModule)
+func TestStats(t *testing.T) {
+	binary, _ := hex.DecodeString(foreignModule)
+	stats, err := Stats(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Size != 65 {
+		t.Errorf("size: got %d, want 65", stats.Size)
+	}
+	sections := []SectionStatistics{
+		{ID: 1, Name: "type", Size: 8, Count: 1},
+		{ID: 3, Name: "func", Size: 4, Count: 1},
+		{ID: 7, Name: "export", Size: 8, Count: 1},
+		{ID: 10, Name: "code", Size: 24, Count: 1},
+		{ID: 0, Name: "producers", Size: 13},
+	}
+	if !reflect.DeepEqual(stats.Sections, sections) {
+		t.Errorf("sections:\n got %+v\nwant %+v", stats.Sections, sections)
+	}
+	total := 8
+	for _, section := range stats.Sections {
+		total += section.Size
+	}
+	if total != stats.Size {
+		t.Errorf("the header and the sections are %d bytes, the module %d", total, stats.Size)
+	}
+
+	// the padded size of the body (5 bytes), the locals (1) and the instructions (15)
+	functions := []FunctionStatistics{{Index: 0, Name: "lt", Size: 21, Instructions: 8}}
+	if !reflect.DeepEqual(stats.Functions, functions) {
+		t.Errorf("functions:\n got %+v\nwant %+v", stats.Functions, functions)
+	}
+
+	opcodes := []OpcodeCount{{"end", 2}, {"local.get", 2}, {"block", 1}, {"br_table", 1}, {"i32.const", 1}, {"i32.lt_s", 1}}
+	if got := stats.SortedOpcodes(); !reflect.DeepEqual(got, opcodes) {
+		t.Errorf("opcodes:\n got %v\nwant %v", got, opcodes)
+	}
+
+	encoded, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"size":65,"sections":[` +
+		`{"id":1,"name":"type","size":8,"count":1},{"id":3,"name":"func","size":4,"count":1},` +
+		`{"id":7,"name":"export","size":8,"count":1},{"id":10,"name":"code","size":24,"count":1},` +
+		`{"id":0,"name":"producers","size":13,"count":0}],` +
+		`"functions":[{"index":0,"name":"lt","size":21,"instructions":8}],` +
+		`"opcodes":{"block":1,"br_table":1,"end":2,"i32.const":1,"i32.lt_s":1,"local.get":2}}`
+	if string(encoded) != want {
+		t.Errorf("json:\n got %s\nwant %s", encoded, want)
+	}
+}
+
+func TestLargestFunctions(t *testing.T) {
+	stats, err := Stats(assembled(t, `(module
+	  (func $small)
+	  (func $big (result i32) (i32.add (i32.const 1) (i32.const 2)))
+	  (func $medium (result i32) (i32.const 1)))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []uint32{}
+	for _, function := range stats.LargestFunctions() {
+		order = append(order, function.Index)
+	}
+	if !reflect.DeepEqual(order, []uint32{1, 2, 0}) {
+		t.Errorf("got %v, want [1 2 0]", order)
+	}
+}
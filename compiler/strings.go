@@ -0,0 +1,102 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// String literals
+// See https://webassembly.github.io/spec/core/text/values.html#strings
+//
+// A string is a sequence of bytes between quotes, special characters are escaped with a backslash
+// - \t \n \r \" \' \\      tab, newline, carriage return, quote, apostrophe, backslash
+// - \hh                    any byte written as two hexadecimal digits (e.g. \00 \ff)
+// - \u{hhhh}               any unicode character (encoded as UTF-8)
+//
+// Strings can hold arbitrary bytes (e.g. the content of a data segment)
+// but names (e.g. export names) must be valid UTF-8
+// See https://webassembly.github.io/spec/core/text/values.html#names
+
+// decodeString turns a string literal (with its quotes) into the bytes it represents
+func decodeString(literal string) (string, error) {
+	if len(literal) < 2 || literal[0] != '"' || literal[len(literal)-1] != '"' {
+		return "", errors.New("malformed string")
+	}
+	literal = literal[1 : len(literal)-1]
+
+	var decoded strings.Builder
+	for i := 0; i < len(literal); i++ {
+		c := literal[i]
+
+		if c != '\\' {
+			if c < 0x20 || c == 0x7f || c == '"' {
+				return "", fmt.Errorf("malformed string: invalid character %q", c)
+			}
+			decoded.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(literal) {
+			return "", errors.New("malformed string: incomplete escape")
+		}
+
+		switch literal[i] {
+		case 't':
+			decoded.WriteByte('\t')
+		case 'n':
+			decoded.WriteByte('\n')
+		case 'r':
+			decoded.WriteByte('\r')
+		case '"', '\'', '\\':
+			decoded.WriteByte(literal[i])
+
+		// \u{hhhh} unicode character
+		case 'u':
+			end := strings.IndexByte(literal[i:], '}')
+			if !strings.HasPrefix(literal[i:], "u{") || end == -1 {
+				return "", errors.New("malformed string: invalid unicode escape")
+			}
+			digits := literal[i+2 : i+end]
+			if digits == "" || strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+				return "", errors.New("malformed string: invalid unicode escape")
+			}
+			code, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), 16, 32)
+			// Surrogates are not unicode scalar values
+			if err != nil || code >= 0x110000 || (code >= 0xd800 && code < 0xe000) {
+				return "", fmt.Errorf("malformed string: invalid unicode character \\u{%s}", digits)
+			}
+			decoded.WriteRune(rune(code))
+			i += end
+
+		// \hh any byte
+		default:
+			if i+1 >= len(literal) {
+				return "", fmt.Errorf("malformed string: unknown escape \\%c", literal[i])
+			}
+			b, err := strconv.ParseUint(literal[i:i+2], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("malformed string: unknown escape \\%c", literal[i])
+			}
+			decoded.WriteByte(byte(b))
+			i++
+		}
+	}
+
+	return decoded.String(), nil
+}
+
+// decodeName decodes a string that must be valid UTF-8
+func decodeName(literal string) (string, error) {
+	name, err := decodeString(literal)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%s: name is not valid UTF-8", literal)
+	}
+	return name, nil
+}
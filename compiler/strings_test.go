@@ -0,0 +1,91 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeString(t *testing.T) {
+	tests := map[string]string{
+		`""`:                      "",
+		`"abc"`:                   "abc",
+		`"a\tb\nc\rd"`:            "a\tb\nc\rd",
+		`"\"\'\\"`:                "\"'\\",
+		`"\00\ff\7F"`:             "\x00\xff\x7f",
+		`"\u{41}"`:                "A",
+		`"\u{e9}"`:                "é",
+		`"\u{1F600}"`:             "\U0001F600",
+		`"\u{10_FFFF}"`:           "\U0010FFFF",
+		`"\u{0}"`:                 "\x00",
+		`"ünïcode ∑"`:             "ünïcode ∑",
+		`"\e2\88\91 is \u{2211}"`: "∑ is ∑",
+	}
+	for literal, want := range tests {
+		if got, err := decodeString(literal); err != nil || got != want {
+			t.Errorf("%s: got %q (%v), want %q", literal, got, err, want)
+		}
+	}
+}
+
+func TestDecodeStringErrors(t *testing.T) {
+	tests := map[string]string{
+		`"\q"`:         "unknown escape \\q",
+		`"\a"`:         "unknown escape \\a",
+		`"\0"`:         "unknown escape \\0",
+		`"\0g"`:        "unknown escape \\0",
+		`"\`:           "malformed string",
+		`"\u41"`:       "invalid unicode escape",
+		`"\u{41"`:      "invalid unicode escape",
+		`"\u{}"`:       "invalid unicode escape",
+		`"\u{_41}"`:    "invalid unicode escape",
+		`"\u{110000}"`: "invalid unicode character",
+		`"\u{xyz}"`:    "invalid unicode character",
+		// unpaired surrogates are not characters
+		`"\u{D800}"`:         "invalid unicode character",
+		`"\u{dfff}"`:         "invalid unicode character",
+		`"\u{d83d}\u{de00}"`: "invalid unicode character",
+		"\"a\tb\"":           "invalid character",
+		"\"a\x7fb\"":         "invalid character",
+	}
+	for literal, want := range tests {
+		if _, err := decodeString(literal); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", literal, err, want)
+		}
+	}
+}
+
+// Strings can hold any byte, names must be valid UTF-8
+func TestDecodeName(t *testing.T) {
+	if got, err := decodeName(`"\e2\88\91"`); err != nil || got != "∑" {
+		t.Errorf("got %q (%v), want ∑", got, err)
+	}
+	for _, literal := range []string{`"\ff"`, `"\e2\88"`, `"a\80"`, `"\ed\a0\80"`} {
+		if _, err := decodeName(literal); err == nil || !strings.Contains(err.Error(), "not valid UTF-8") {
+			t.Errorf("%s: got %v, want an invalid UTF-8 error", literal, err)
+		}
+	}
+
+	for _, input := range []string{
+		`(module (func (export "\ff")))`,
+		`(module (import "\c0\80" "f" (func)))`,
+		`(module (import "env" "\80" (func)))`,
+	} {
+		if _, err := built(input); err == nil || !strings.Contains(err.Error(), "not valid UTF-8") {
+			t.Errorf("%s: got %v, want an invalid UTF-8 error", input, err)
+		}
+	}
+	// the data segments are bytes
+	if _, err := built(`(module (memory 1) (data (i32.const 0) "\ff\00"))`); err != nil {
+		t.Error(err)
+	}
+}
+
+// The decoder rejects the names that are not valid UTF-8 too
+func TestDecodeBinaryName(t *testing.T) {
+	binary := assembled(t, `(module (func (export "ab")))`)
+	i := strings.Index(string(binary), "ab")
+	binary[i] = 0xff
+	if _, err := Decode(binary); err == nil || !strings.Contains(err.Error(), "not valid UTF-8") {
+		t.Errorf("got %v, want an invalid UTF-8 error", err)
+	}
+}
@@ -2,10 +2,12 @@ package compiler
 
 import (
 	"errors"
+	"luna/defaults"
 	"luna/texts"
 	"luna/types"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 // Inside this wasm module there are two main things:
@@ -25,13 +27,78 @@ var tokens = []string{
 	"export",
 	"result",
 	"param",
+	"local",
+	"table",
+	"memory",
+	"global",
+	"mut",
+	"funcref",
+	"externref",
+	"extern",
+	"exnref",
+	"exn",
+	"import",
+	"tag",
+	// try_table handlers and the legacy (try (do ...) (catch ...))
+	"catch_ref",
+	"catch_all_ref",
+	"do",
+	"declare",
+	"item",
+	"type",
+	"then",
+	"data",
+	"elem",
+	"offset",
+	"start",
+	"shared",
+	// GC types e.g. (type $list (sub (struct (field $next (ref null $list)))))
+	"ref",
+	"null",
+	"struct",
+	"array",
+	"field",
+	"sub",
+	"final",
+	"rec",
+	"i8",
+	"i16",
+	"any",
+	"eq",
+	"i31",
+	"none",
+	"nofunc",
+	"noextern",
+	"noexn",
+	"anyref",
+	"eqref",
+	"i31ref",
+	"structref",
+	"arrayref",
+	"nullref",
+	"nullfuncref",
+	"nullexternref",
+	"nullexnref",
+	// Shapes of the vectors e.g. v128.const i32x4 1 2 3 4
+	"i8x16",
+	"i16x8",
+	"i32x4",
+	"i64x2",
+	"f32x4",
+	"f64x2",
+	// Memory arguments e.g. i32.store8 offset=4 align=1
+	"(?:offset|align)=(?:0x" + hexDigits + "|" + digits + ")",
 }
 
-// Hard coding identifiers for simplicity reasons (since the example won't change)
-// A better and more robust regex could be implemented
-var instructions = []string{
-	"local\\.get",
-	"i32\\.(add|sub|mul|div|const)",
+// Instructions are the ones Luna knows how to encode (see defaults.Opcodes)
+func matchInstruction(input string, index int) (types.Matcher, error) {
+	_, known := defaults.Opcodes[input[index:]]
+	_, prefixed := defaults.PrefixedOpcodes[input[index:]]
+	_, alias := defaults.Aliases[input[index:]]
+	if known || prefixed || alias {
+		return types.Matcher{Type: texts.TypeInstruction, Value: input[index:]}, nil
+	}
+	return types.Matcher{}, errors.New("no match found")
 }
 
 var numTypes = []string{
@@ -39,24 +106,53 @@ var numTypes = []string{
 	"i64",
 	"f32",
 	"f64",
+	"v128",
 }
 
-// We can hard hardcode a bunch of names for function export
-// so we do not need to change this everytime
-// or implement a simple regex to catch anything between quotes
-var literals = "\"([^\"]+)\""
+// The tokenizer goes through the input (string) and splits it into tokens
+// following the lexical format of the specification
+// See https://webassembly.github.io/spec/core/text/lexical.html
+//
+// A token is either a paren, a string or a run of "idchars" (letters, digits and a bunch of symbols).
+// The tokenizer always takes the longest possible run (maximal munch), so i32.addx is
+// one (unknown) token and not i32.add followed by x.
+// Whatever is not valid becomes an error token (with its position) instead of being skipped.
+
+// Characters allowed in keywords, ids and numbers
+// See https://webassembly.github.io/spec/core/text/values.html#text-idchar
+var idChars = "[0-9A-Za-z!#$%&'*+\\-./:<=>?@\\\\^_`|~]"
 
-// The tokenizer goes through the input (string) and gets all the matching patterns
-// that represent the tokens
+// Strings are enclosed in quotes, a backslash escapes the next character
+// See https://webassembly.github.io/spec/core/text/values.html#strings
+var literals = `"(?:[^"\\\n]|\\.)*"`
+
+// Numbers: decimal or hexadecimal, with an optional sign and optional underscores between digits
+// floats can have a fraction, an exponent or be inf and nan
+// See https://webassembly.github.io/spec/core/text/values.html#integers
+var digits = "[0-9](?:_?[0-9])*"
+var hexDigits = "[0-9a-fA-F](?:_?[0-9a-fA-F])*"
+var numbers = "[+-]?(?:" +
+	digits + "(?:\\.(?:" + digits + ")?)?(?:[eE][+-]?" + digits + ")?|" +
+	"0x" + hexDigits + "(?:\\.(?:" + hexDigits + ")?)?(?:[pP][+-]?" + digits + ")?|" +
+	"inf|nan(?::0x" + hexDigits + ")?)"
 
 // List of regex
-var tokensRegex = regexp.MustCompile("^(" + strings.Join(tokens, "|") + ")")
-var instructionRegex = regexp.MustCompile("^(" + strings.Join(instructions, "|") + ")")
-var typeNumRegex = regexp.MustCompile("^(" + strings.Join(numTypes, "|") + ")")
-var literalsRegex = regexp.MustCompile("^(" + literals + ")")
-var numberRegex = regexp.MustCompile("^[0-9]+")
+// Keywords are checked against the whole run of characters
+var tokensRegex = regexp.MustCompile("^(" + strings.Join(tokens, "|") + ")$")
+var typeNumRegex = regexp.MustCompile("^(" + strings.Join(numTypes, "|") + ")$")
+var idRegex = regexp.MustCompile("^\\$" + idChars + "+$")
+var numberRegex = regexp.MustCompile("^" + numbers + "$")
+var literalsRegex = regexp.MustCompile("^" + literals + "$")
+
+// A complete string at the beginning of the input
+var stringRegex = regexp.MustCompile("^" + literals)
 var whitespaceRegex = regexp.MustCompile(`^\s+`)
 
+// A run of idchars, strings and a few other characters that are not separated by whitespace
+// Anything longer than a single token (e.g. i32"x") is reserved and therefore an error
+// See https://webassembly.github.io/spec/core/text/lexical.html#tokens
+var reservedRegex = regexp.MustCompile("^(?:" + idChars + "|" + literals + "|[,\\[\\]{}])+")
+
 // Higher order function
 func matchChecker(rxp *regexp.Regexp, whichType string) func(string, int) (types.Matcher, error) {
 
@@ -75,45 +171,168 @@ func matchChecker(rxp *regexp.Regexp, whichType string) func(string, int) (types
 
 func Tokenize(input string) []types.Token {
 	tokens := []types.Token{}
-	matches := []types.Matcher{}
 	index := 0
+	line, lineStart := 1, 0
 
 	matchers := []func(string, int) (types.Matcher, error){
-		matchChecker(tokensRegex, texts.TypeToken),
-		matchChecker(instructionRegex, texts.TypeInstruction),
-		matchChecker(typeNumRegex, texts.TypeNum),
 		matchChecker(literalsRegex, texts.TypeLiteral),
+		matchChecker(idRegex, texts.Id),
 		matchChecker(numberRegex, texts.Number),
-		matchChecker(whitespaceRegex, texts.Whitespace),
+		matchChecker(tokensRegex, texts.TypeToken),
+		matchInstruction,
+		matchChecker(typeNumRegex, texts.TypeNum),
+	}
+
+	comments := []string{}
+
+	// Keep track of lines and columns for the error messages
+	advance := func(length int) {
+		for i := index; i < index+length; i++ {
+			if input[i] == '\n' {
+				line++
+				lineStart = i + 1
+			}
+		}
+		index += length
+	}
+
+	emit := func(token types.Token) {
+		token.Index = index
+		token.Line = line
+		token.Column = index - lineStart + 1
+
+		// Keep the comments as trivia of the token that follows them
+		if len(comments) > 0 {
+			token.Comments = comments
+			comments = []string{}
+		}
+		tokens = append(tokens, token)
+		advance(len(token.Value))
 	}
 
 	for index < len(input) {
+		if whitespace := whitespaceRegex.FindString(input[index:]); whitespace != "" {
+			advance(len(whitespace))
+			continue
+		}
+
+		// Comments are skipped before anything else
+		// otherwise a comment like ;; i32.add would be tokenized as code
+		if comment, err := matchComment(input, index); comment != "" {
+			if err != nil {
+				emit(types.Token{Type: texts.TypeError, Value: comment, Error: err.Error()})
+				continue
+			}
+			comments = append(comments, comment)
+			advance(len(comment))
+			continue
+		}
+
+		switch input[index] {
+		case '(':
+			emit(types.Token{Type: texts.LeftParen, Value: "("})
+			continue
+		case ')':
+			emit(types.Token{Type: texts.RightParen, Value: ")"})
+			continue
+		case '"':
+			if !stringRegex.MatchString(input[index:]) {
+				// The string never ends (strings can not span multiple lines)
+				end := strings.IndexByte(input[index:], '\n')
+				if end == -1 {
+					end = len(input) - index
+				}
+				emit(types.Token{Type: texts.TypeError, Value: input[index : index+end], Error: "unterminated string"})
+				continue
+			}
+		}
+
+		run := reservedRegex.FindString(input[index:])
+		if run == "" {
+			// Not even a valid character, take the whole (utf-8) character
+			_, size := utf8.DecodeRuneInString(input[index:])
+			emit(types.Token{Type: texts.TypeError, Value: input[index : index+size], Error: "unexpected character"})
+			continue
+		}
+
+		token := types.Token{Type: texts.TypeError, Value: run, Error: "unknown token"}
 		for _, m := range matchers {
-			matchFound, notFound := m(input, index)
+			match, notFound := m(run, 0)
 
 			// Prevent panic if no match is found
 			if notFound != nil {
 				continue
 			}
 
-			matches = append(matches, matchFound)
-		}
-		if len(matches) == 0 {
-			index++
-			continue
+			token.Type = match.Type
+			token.Error = ""
+			break
 		}
-		match := &types.Token{
-			Type:  matches[0].Type,
-			Value: matches[0].Value,
-			Index: index,
+
+		// Escapes must be valid too
+		if token.Type == texts.TypeLiteral {
+			if _, err := decodeString(run); err != nil {
+				token.Type = texts.TypeError
+				token.Error = err.Error()
+			}
 		}
 
-		if match.Type != "whitespace" {
-			tokens = append(tokens, *match)
+		if token.Type == texts.TypeError && token.Error == "unknown token" {
+			switch {
+			case strings.Contains(run, "\""):
+				token.Error = "missing whitespace between tokens"
+			case strings.ContainsAny(run, ",[]{}"):
+				token.Error = "unexpected character"
+			case strings.HasPrefix(run, "$"):
+				token.Error = "malformed id"
+			case run[0] >= '0' && run[0] <= '9', run[0] == '+', run[0] == '-':
+				token.Error = "malformed number"
+			case run[0] >= 'a' && run[0] <= 'z':
+				token.Error = "unknown keyword"
+			}
 		}
 
-		index += len(matches[0].Value)
-		matches = []types.Matcher{}
+		emit(token)
 	}
 	return tokens
 }
+
+// Comments
+// See https://webassembly.github.io/spec/core/text/lexical.html#comments
+//   - line comments start with ;; and go on until the end of the line
+//   - block comments are enclosed between (; and ;) and they can be nested
+//     (; this is (; a nested ;) comment ;)
+//
+// A regex can not count the nesting levels so we scan them by hand.
+// It returns the whole comment or an empty string if there is no comment at index
+func matchComment(input string, index int) (string, error) {
+	substr := input[index:]
+
+	if strings.HasPrefix(substr, ";;") {
+		end := strings.IndexByte(substr, '\n')
+		if end == -1 {
+			return substr, nil
+		}
+		return substr[:end], nil
+	}
+
+	if !strings.HasPrefix(substr, "(;") {
+		return "", nil
+	}
+
+	depth := 0
+	for i := 0; i < len(substr)-1; i++ {
+		switch substr[i : i+2] {
+		case "(;":
+			depth++
+			i++
+		case ";)":
+			depth--
+			i++
+			if depth == 0 {
+				return substr[:i+1], nil
+			}
+		}
+	}
+	return substr, errors.New("unterminated block comment")
+}
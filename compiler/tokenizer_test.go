@@ -0,0 +1,89 @@
+package compiler
+
+import (
+	"luna/texts"
+	"luna/types"
+	"reflect"
+	"testing"
+)
+
+// tokenTypes is the type and value of every token, e.g. leftParen ( or id $a
+func tokenTypes(tokens []types.Token) []string {
+	list := []string{}
+	for _, token := range tokens {
+		list = append(list, token.Type+" "+token.Value)
+	}
+	return list
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		// adjacent parens do not need whitespace
+		{"(module(func))", []string{"leftParen (", "token module", "leftParen (", "token func", "rightParen )", "rightParen )"}},
+		{"((()))", []string{"leftParen (", "leftParen (", "leftParen (", "rightParen )", "rightParen )", "rightParen )"}},
+		{`(export "a")`, []string{"leftParen (", "token export", "literal \"a\"", "rightParen )"}},
+		// ids can contain any idchar
+		{"$a $0 $a.b-c $!#%&'*+-./:<=>?@\\^_`|~", []string{"id $a", "id $0", "id $a.b-c", "id $!#%&'*+-./:<=>?@\\^_`|~"}},
+		{"($x)", []string{"leftParen (", "id $x", "rightParen )"}},
+		// numbers, keywords and instructions
+		{"1 -1 +1 0x1F 1_000 1.5e3 -inf nan:0x1", []string{"number 1", "number -1", "number +1", "number 0x1F", "number 1_000", "number 1.5e3", "number -inf", "number nan:0x1"}},
+		{"i32.add i32 offset=4 align=0x8", []string{"instruction i32.add", "typeNum i32", "token offset=4", "token align=0x8"}},
+		// comments are not tokens
+		{"(; a (; nested ;) comment ;) i32.add ;; end", []string{"instruction i32.add"}},
+	}
+	for _, test := range tests {
+		if got := tokenTypes(Tokenize(test.input)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %q\nwant %q", test.input, got, test.want)
+		}
+	}
+}
+
+// Reserved tokens (runs of idchars that are not a keyword, an id or a number) are errors, with their position
+func TestTokenizeErrors(t *testing.T) {
+	tests := []struct {
+		input        string
+		value, error string
+		line, column int
+	}{
+		{"0x", "0x", "malformed number", 1, 1},
+		{"1a", "1a", "malformed number", 1, 1},
+		{"(i32.const 1a)", "1a", "malformed number", 1, 12},
+		{"0x1g", "0x1g", "malformed number", 1, 1},
+		{"1__0", "1__0", "malformed number", 1, 1},
+		{"-", "-", "malformed number", 1, 1},
+		{"$", "$", "malformed id", 1, 1},
+		{"(func\n  $a\"b\")", "$a\"b\"", "missing whitespace between tokens", 2, 3},
+		{`(export"a")`, "export\"a\"", "missing whitespace between tokens", 1, 2},
+		{"i32.addx", "i32.addx", "unknown keyword", 1, 1},
+		{"(module)\n\n  (func {})", "{}", "unexpected character", 3, 9},
+		{"  ∑", "∑", "unexpected character", 1, 3},
+		{"(data \"abc", "\"abc", "unterminated string", 1, 7},
+		{"(data \"\\q\")", "\"\\q\"", "", 1, 7},
+		{"(; never closed", "(; never closed", "", 1, 1},
+	}
+	for _, test := range tests {
+		var token *types.Token
+		for _, current := range Tokenize(test.input) {
+			if current.Type == texts.TypeError {
+				token = &current
+				break
+			}
+		}
+		if token == nil {
+			t.Errorf("%q: no error token", test.input)
+			continue
+		}
+		if token.Value != test.value || token.Line != test.line || token.Column != test.column {
+			t.Errorf("%q: got %q at %d:%d, want %q at %d:%d", test.input, token.Value, token.Line, token.Column, test.value, test.line, test.column)
+		}
+		if test.error != "" && token.Error != test.error {
+			t.Errorf("%q: got %q, want %q", test.input, token.Error, test.error)
+		}
+		if token.Error == "" {
+			t.Errorf("%q: the error token has no error", test.input)
+		}
+	}
+}
@@ -0,0 +1,1026 @@
+package compiler
+
+import (
+	"fmt"
+	"luna/defaults"
+	"luna/texts"
+	"luna/types"
+	"math"
+	"strings"
+)
+
+// Validation
+// A module can be well formed but still not make sense, e.g. i32.add with f32 operands,
+// a call to a function that does not exist or a function that leaves the wrong values on the stack.
+// The validator checks the module the same way the engines do before running it.
+// See https://webassembly.github.io/spec/core/valid/index.html
+//
+// Instructions are checked with the algorithm of the specification appendix:
+// a stack of operand types and a stack of the open blocks (control frames)
+// See https://webassembly.github.io/spec/core/appendix/algorithm.html
+
+// After unreachable, br or return the stack is polymorphic:
+// popping from it gives an unknown type that matches any type
+const unknown types.ValueType = 0
+
+type frame struct {
+	opcode string
+	// The types the block takes and the ones it leaves on the stack
+	start []types.ValueType
+	end   []types.ValueType
+	// The height of the operand stack when the block started
+	height      int
+	unreachable bool
+	// The number of locals set before the block (they are set only until its end)
+	sets int
+}
+
+type validator struct {
+	module *types.Module
+	// Functions that can be referenced by ref.func inside function bodies
+	refs map[uint32]bool
+	// Types of the params and the locals of the current function
+	locals []types.ValueType
+	vals   []types.ValueType
+	ctrls  []frame
+	// Locals without a default value can be read only after they are set
+	// See https://webassembly.github.io/gc/core/valid/instructions.html#local-instructions
+	inits []bool
+	sets  []uint32
+	// The first type of the recursive group of every type
+	groups []int
+}
+
+func Validate(m *types.Module) error {
+	v := &validator{module: m, refs: declaredRefs(m)}
+
+	if err := v.validateTypes(); err != nil {
+		return err
+	}
+
+	// Exceptions carry values but do not return any
+	// See https://webassembly.github.io/exception-handling/core/valid/types.html#tag-types
+	for i, tag := range m.Tags {
+		tagType, err := v.funcType(tag.Type)
+		if err != nil {
+			return fmt.Errorf("tag %s: %v", displayName(i, tag.Name), err)
+		}
+		if len(tagType.Results) > 0 {
+			return fmt.Errorf("tag %s: non-empty tag result type", displayName(i, tag.Name))
+		}
+	}
+
+	for i, fn := range m.Funcs {
+		if err := v.validateFunc(fn); err != nil {
+			return fmt.Errorf("func %s: %v", displayName(i, fn.Name), err)
+		}
+	}
+
+	for i, global := range m.Globals {
+		if err := v.validValueType(global.Type); err != nil {
+			return fmt.Errorf("global %s: %v", displayName(i, global.Name), err)
+		}
+		if global.Import != nil {
+			continue
+		}
+		// a global can only read the globals that come before it
+		if err := v.validateConstant(global.Init, global.Type, i); err != nil {
+			return fmt.Errorf("global %s: %v", displayName(i, global.Name), err)
+		}
+	}
+
+	for _, table := range m.Tables {
+		if table.Limits.HasMax && table.Limits.Max < table.Limits.Min {
+			return fmt.Errorf("table %s: size minimum must not be greater than maximum", table.Name)
+		}
+	}
+
+	// Memories are limited to 65536 pages (4GiB), the ones with 64 bit addresses to 2^48 pages
+	// See https://webassembly.github.io/spec/core/valid/types.html#memory-types
+	for i, memory := range m.Memories {
+		if pages, size := maxPages(memory.Limits); memory.Limits.Min > pages || (memory.Limits.HasMax && memory.Limits.Max > pages) {
+			return fmt.Errorf("memory %s: memory size must be at most %d pages (%s)", displayName(i, memory.Name), pages, size)
+		}
+		if memory.Limits.Shared && !memory.Limits.HasMax {
+			return fmt.Errorf("memory %s: shared memory must have maximum", displayName(i, memory.Name))
+		}
+	}
+
+	// The start function takes no arguments and returns nothing
+	// See https://webassembly.github.io/spec/core/valid/modules.html#start-function
+	if m.Start != nil {
+		if int(*m.Start) >= len(m.Funcs) {
+			return fmt.Errorf("start: unknown function %d", *m.Start)
+		}
+		if funcType := m.Types[m.Funcs[*m.Start].Type]; len(funcType.Params) > 0 || len(funcType.Results) > 0 {
+			return fmt.Errorf("start: the start function must have type [] -> []")
+		}
+	}
+
+	if err := v.validateSegments(); err != nil {
+		return err
+	}
+
+	return v.validateExports()
+}
+
+// Active segments are copied at an offset (an i32 constant expression, i64 for 64 bit memories)
+// into a table or a memory that must exist
+// See https://webassembly.github.io/spec/core/valid/modules.html#element-segments
+func (v *validator) validateSegments() error {
+	i32 := v.i32()
+
+	for i, elem := range v.module.Elems {
+		for _, index := range elem.Funcs {
+			if int(index) >= len(v.module.Funcs) {
+				return fmt.Errorf("elem %s: unknown function %d", displayName(i, elem.Name), index)
+			}
+		}
+		if elem.Funcs != nil && elem.Type != v.funcref() {
+			return fmt.Errorf("elem %s: type mismatch: function indices are funcref, not %s", displayName(i, elem.Name), typeName(elem.Type))
+		}
+		for _, expression := range elem.Exprs {
+			if err := v.validateConstant(expression, elem.Type, len(v.module.Globals)); err != nil {
+				return fmt.Errorf("elem %s: %v", displayName(i, elem.Name), err)
+			}
+		}
+
+		if elem.Mode != types.SegmentActive {
+			continue
+		}
+		if int(elem.Table) >= len(v.module.Tables) {
+			return fmt.Errorf("elem %s: unknown table %d", displayName(i, elem.Name), elem.Table)
+		}
+		if table := v.module.Tables[elem.Table]; !v.matches(elem.Type, table.ElemType) {
+			return fmt.Errorf("elem %s: type mismatch: table of %s, elements of %s", displayName(i, elem.Name), typeName(table.ElemType), typeName(elem.Type))
+		}
+		if err := v.validateConstant(elem.Offset, i32, len(v.module.Globals)); err != nil {
+			return fmt.Errorf("elem %s: %v", displayName(i, elem.Name), err)
+		}
+	}
+
+	for i, data := range v.module.Datas {
+		if data.Mode != types.SegmentActive {
+			continue
+		}
+		if int(data.Memory) >= len(v.module.Memories) {
+			return fmt.Errorf("data %s: unknown memory %d", displayName(i, data.Name), data.Memory)
+		}
+		if err := v.validateConstant(data.Offset, v.addressType(data.Memory), len(v.module.Globals)); err != nil {
+			return fmt.Errorf("data %s: %v", displayName(i, data.Name), err)
+		}
+	}
+	return nil
+}
+
+// Every export must reference something that exists
+func (v *validator) validateExports() error {
+	sizes := map[interface{}]int{
+		defaults.ExportSection["func"]:   len(v.module.Funcs),
+		defaults.ExportSection["table"]:  len(v.module.Tables),
+		defaults.ExportSection["mem"]:    len(v.module.Memories),
+		defaults.ExportSection["global"]: len(v.module.Globals),
+		defaults.ExportSection["tag"]:    len(v.module.Tags),
+	}
+
+	for _, export := range v.module.Exports {
+		if int(export.Index) >= sizes[export.Kind] {
+			return fmt.Errorf("export %q: unknown index %d", export.Name, export.Index)
+		}
+	}
+	return nil
+}
+
+// ref.func can only reference functions that are declared outside of the function bodies:
+// in element segments, in the initial value of globals or in the exports
+// See https://webassembly.github.io/spec/core/valid/modules.html#valid-module
+func declaredRefs(m *types.Module) map[uint32]bool {
+	refs := map[uint32]bool{}
+	addRefs := func(expression []types.Instruction) {
+		for _, instruction := range expression {
+			if instruction.Name == "ref.func" {
+				refs[instruction.Immediates[0].(uint32)] = true
+			}
+		}
+	}
+
+	for _, elem := range m.Elems {
+		for _, index := range elem.Funcs {
+			refs[index] = true
+		}
+		for _, expression := range elem.Exprs {
+			addRefs(expression)
+		}
+	}
+	for _, global := range m.Globals {
+		addRefs(global.Init)
+	}
+	for _, export := range m.Exports {
+		if export.Kind == defaults.ExportSection["func"] {
+			refs[export.Index] = true
+		}
+	}
+	return refs
+}
+
+func displayName(index int, name string) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprint(index)
+}
+
+func (v *validator) validateFunc(fn types.Func) error {
+	funcType, err := v.funcType(fn.Type)
+	if err != nil {
+		return err
+	}
+	if fn.Import != nil {
+		return nil
+	}
+
+	v.locals = append(append([]types.ValueType{}, funcType.Params...), fn.Locals...)
+	v.inits = make([]bool, len(v.locals))
+	for i, local := range v.locals {
+		if err := v.validValueType(local); err != nil {
+			return err
+		}
+		v.inits[i] = i < len(funcType.Params) || defaultable(local)
+	}
+	return v.validateBody(fn.Body, funcType.Results)
+}
+
+// Constant expressions can only contain constant instructions
+// and read the first globals (the ones already initialized), if they are immutable
+// See https://webassembly.github.io/spec/core/valid/instructions.html#constant-expressions
+func (v *validator) validateConstant(init []types.Instruction, valueType types.ValueType, globals int) error {
+	for _, instruction := range init {
+		if !defaults.Constants[instruction.Name] {
+			return fmt.Errorf("constant expression required, found %s", instruction.Name)
+		}
+		if instruction.Name != "global.get" {
+			continue
+		}
+		index := instruction.Immediates[0].(uint32)
+		if int(index) >= globals {
+			return fmt.Errorf("unknown global %d, constant expressions can only read the globals defined before", index)
+		}
+		if v.module.Globals[index].Mutable {
+			return fmt.Errorf("constant expression required, global %d is mutable", index)
+		}
+	}
+
+	v.locals = nil
+	v.inits = nil
+	return v.validateBody(init, []types.ValueType{valueType})
+}
+
+// The body of a function is an implicit block
+// that must leave exactly the results on the stack
+func (v *validator) validateBody(body []types.Instruction, results []types.ValueType) error {
+	v.vals = []types.ValueType{}
+	v.ctrls = []frame{}
+	v.sets = []uint32{}
+	v.pushCtrl("func", nil, results)
+
+	for i, instruction := range body {
+		if err := v.validateInstruction(instruction); err != nil {
+			return fmt.Errorf("instruction %d (%s): %v", i, instruction.Name, err)
+		}
+	}
+
+	if len(v.ctrls) != 1 {
+		return fmt.Errorf("%s without end", v.ctrls[len(v.ctrls)-1].opcode)
+	}
+	if _, err := v.popCtrl(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v *validator) validateInstruction(instruction types.Instruction) error {
+	name := instruction.Name
+
+	switch name {
+	case "nop":
+		return nil
+
+	case "unreachable":
+		v.setUnreachable()
+		return nil
+
+	case "block", "loop":
+		blockType := instruction.Immediates[0].(types.BlockType)
+		if err := v.popVals(blockType.Params); err != nil {
+			return err
+		}
+		v.pushCtrl(name, blockType.Params, blockType.Results)
+		return nil
+
+	case "if":
+		blockType := instruction.Immediates[0].(types.BlockType)
+		if err := v.popExpect(v.i32()); err != nil {
+			return err
+		}
+		if err := v.popVals(blockType.Params); err != nil {
+			return err
+		}
+		v.pushCtrl(name, blockType.Params, blockType.Results)
+		return nil
+
+	case "else":
+		f, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		if f.opcode != "if" {
+			return fmt.Errorf("else without if")
+		}
+		v.pushCtrl("else", f.start, f.end)
+		return nil
+
+	case "end":
+		if len(v.ctrls) == 1 {
+			return fmt.Errorf("end without a block")
+		}
+		f, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		// An if without else leaves its params untouched, so they must be its results
+		if f.opcode == "if" && !sameValueTypes(f.start, f.end) {
+			return fmt.Errorf("type mismatch: if without else must have the same params and results")
+		}
+		v.pushVals(f.end)
+		return nil
+
+	// Exception handling
+	// See https://webassembly.github.io/exception-handling/core/valid/instructions.html#control-instructions
+	case "throw":
+		tag, err := v.tagType(instruction.Immediates[0].(uint32))
+		if err != nil {
+			return err
+		}
+		if err := v.popVals(tag.Params); err != nil {
+			return err
+		}
+		v.setUnreachable()
+		return nil
+
+	case "throw_ref":
+		if err := v.popExpect(v.exnref()); err != nil {
+			return err
+		}
+		v.setUnreachable()
+		return nil
+
+	// The values a handler passes to its label must be the ones the label expects
+	case "try_table":
+		blockType := instruction.Immediates[0].(types.BlockType)
+		for _, handler := range instruction.Immediates[1].([]types.Catch) {
+			values := []types.ValueType{}
+			if handler.Kind == types.CatchTag || handler.Kind == types.CatchTagRef {
+				tag, err := v.tagType(handler.Tag)
+				if err != nil {
+					return err
+				}
+				values = append(values, tag.Params...)
+			}
+			if handler.Kind == types.CatchTagRef || handler.Kind == types.CatchAllRef {
+				values = append(values, v.exnref())
+			}
+			labels, err := v.labelTypes(handler.Label)
+			if err != nil {
+				return err
+			}
+			if !sameValueTypes(values, labels) {
+				return fmt.Errorf("type mismatch: the handler passes [%s] to a label of [%s]", typeNames(values), typeNames(labels))
+			}
+		}
+		if err := v.popVals(blockType.Params); err != nil {
+			return err
+		}
+		v.pushCtrl(name, blockType.Params, blockType.Results)
+		return nil
+
+	// Legacy exception handling
+	// try is a block, catch and catch_all close the previous part like else
+	// See https://github.com/WebAssembly/exception-handling/blob/main/proposals/exception-handling/legacy/Exceptions.md
+	case "try":
+		blockType := instruction.Immediates[0].(types.BlockType)
+		if err := v.popVals(blockType.Params); err != nil {
+			return err
+		}
+		v.pushCtrl(name, blockType.Params, blockType.Results)
+		return nil
+
+	case "catch", "catch_all":
+		f, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		if f.opcode != "try" && f.opcode != "catch" {
+			return fmt.Errorf("%s without try", name)
+		}
+		// The handler starts with the values of the exception
+		values := []types.ValueType{}
+		if name == "catch" {
+			tag, err := v.tagType(instruction.Immediates[0].(uint32))
+			if err != nil {
+				return err
+			}
+			values = tag.Params
+		}
+		v.pushCtrl(name, values, f.end)
+		return nil
+
+	case "delegate":
+		f, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		if f.opcode != "try" {
+			return fmt.Errorf("delegate without try")
+		}
+		if int(instruction.Immediates[0].(uint32)) >= len(v.ctrls) {
+			return fmt.Errorf("unknown label %d", instruction.Immediates[0])
+		}
+		v.pushVals(f.end)
+		return nil
+
+	// rethrow throws again the exception caught by a handler
+	case "rethrow":
+		depth := instruction.Immediates[0].(uint32)
+		if int(depth) >= len(v.ctrls) {
+			return fmt.Errorf("unknown label %d", depth)
+		}
+		if f := v.ctrls[len(v.ctrls)-1-int(depth)]; f.opcode != "catch" && f.opcode != "catch_all" {
+			return fmt.Errorf("rethrow must target a catch")
+		}
+		v.setUnreachable()
+		return nil
+
+	case "br":
+		labels, err := v.labelTypes(instruction.Immediates[0].(uint32))
+		if err != nil {
+			return err
+		}
+		if err := v.popVals(labels); err != nil {
+			return err
+		}
+		v.setUnreachable()
+		return nil
+
+	// every label must take as many values as the default one, the values on the stack must match all of them
+	// See https://webassembly.github.io/spec/core/valid/instructions.html#xref-syntax-instructions-syntax-instr-control-mathsf-br-table-l-ast-l-n
+	case "br_table":
+		targets := instruction.Immediates[0].([]uint32)
+		if err := v.popExpect(v.i32()); err != nil {
+			return err
+		}
+		fallback, err := v.labelTypes(targets[len(targets)-1])
+		if err != nil {
+			return err
+		}
+		for _, target := range targets[:len(targets)-1] {
+			labels, err := v.labelTypes(target)
+			if err != nil {
+				return err
+			}
+			if len(labels) != len(fallback) {
+				return fmt.Errorf("type mismatch: br_table label %d takes %d values, the default label takes %d", target, len(labels), len(fallback))
+			}
+			// the values are checked and put back (as they were, they can be unknown after unreachable)
+			popped := make([]types.ValueType, len(labels))
+			for i := len(labels) - 1; i >= 0; i-- {
+				value, err := v.popVal()
+				if err == nil && !v.matches(value, labels[i]) {
+					err = fmt.Errorf("type mismatch: expected %s, found %s", typeName(labels[i]), typeName(value))
+				}
+				if err != nil {
+					return err
+				}
+				popped[i] = value
+			}
+			v.pushVals(popped)
+		}
+		if err := v.popVals(fallback); err != nil {
+			return err
+		}
+		v.setUnreachable()
+		return nil
+
+	case "br_if":
+		labels, err := v.labelTypes(instruction.Immediates[0].(uint32))
+		if err != nil {
+			return err
+		}
+		if err := v.popExpect(v.i32()); err != nil {
+			return err
+		}
+		if err := v.popVals(labels); err != nil {
+			return err
+		}
+		v.pushVals(labels)
+		return nil
+
+	// return is a branch to the function block
+	case "return":
+		if err := v.popVals(v.ctrls[0].end); err != nil {
+			return err
+		}
+		v.setUnreachable()
+		return nil
+
+	case "call":
+		index := instruction.Immediates[0].(uint32)
+		if int(index) >= len(v.module.Funcs) {
+			return fmt.Errorf("unknown function %d", index)
+		}
+		return v.applyType(v.module.Types[v.module.Funcs[index].Type].FunctionType)
+
+	// A tail call returns what the callee returns,
+	// so its results must be the results of the caller
+	// See https://webassembly.github.io/tail-call/core/valid/instructions.html#control-instructions
+	case "return_call":
+		index := instruction.Immediates[0].(uint32)
+		if int(index) >= len(v.module.Funcs) {
+			return fmt.Errorf("unknown function %d", index)
+		}
+		return v.tailCall(v.module.Types[v.module.Funcs[index].Type].FunctionType)
+
+	case "call_indirect", "return_call_indirect":
+		typeIndex := instruction.Immediates[0].(uint32)
+		table := instruction.Immediates[1].(uint32)
+		if int(table) >= len(v.module.Tables) {
+			return fmt.Errorf("unknown table %d", table)
+		}
+		funcType, err := v.funcType(typeIndex)
+		if err != nil {
+			return err
+		}
+		if !v.matches(v.module.Tables[table].ElemType, v.funcref()) {
+			return fmt.Errorf("type mismatch: %s needs a table of funcref", name)
+		}
+		if err := v.popExpect(v.i32()); err != nil {
+			return err
+		}
+		if name == "return_call_indirect" {
+			return v.tailCall(funcType)
+		}
+		return v.applyType(funcType)
+
+	case "drop":
+		_, err := v.popVal()
+		return err
+
+	case "local.get":
+		index := instruction.Immediates[0].(uint32)
+		local, err := v.local(index)
+		if err != nil {
+			return err
+		}
+		if !v.inits[index] {
+			return fmt.Errorf("uninitialized local %d, %s has no default value", index, typeName(local))
+		}
+		v.pushVals([]types.ValueType{local})
+		return nil
+
+	// local.tee is local.set that leaves the value on the stack
+	case "local.set", "local.tee":
+		index := instruction.Immediates[0].(uint32)
+		local, err := v.local(index)
+		if err != nil {
+			return err
+		}
+		if !v.inits[index] {
+			v.inits[index] = true
+			v.sets = append(v.sets, index)
+		}
+		if name == "local.tee" {
+			return v.applyType(types.FunctionType{Params: []types.ValueType{local}, Results: []types.ValueType{local}})
+		}
+		return v.popExpect(local)
+
+	// See https://webassembly.github.io/spec/core/valid/instructions.html#variable-instructions
+	case "global.get":
+		global, err := v.global(instruction.Immediates[0].(uint32))
+		if err != nil {
+			return err
+		}
+		v.pushVals([]types.ValueType{global.Type})
+		return nil
+
+	case "global.set":
+		global, err := v.global(instruction.Immediates[0].(uint32))
+		if err != nil {
+			return err
+		}
+		if !global.Mutable {
+			return fmt.Errorf("global is immutable")
+		}
+		return v.popExpect(global.Type)
+	}
+
+	// Indices of segments, tables and memories must exist
+	for i, kind := range defaults.Immediates[name] {
+		switch kind {
+		case texts.MemArg:
+			memArg := instruction.Immediates[i].(types.MemArg)
+			if int(memArg.Memory) >= len(v.module.Memories) {
+				return fmt.Errorf("unknown memory %d", memArg.Memory)
+			}
+			if !v.module.Memories[memArg.Memory].Limits.Is64 && memArg.Offset > math.MaxUint32 {
+				return fmt.Errorf("offset %d out of range of a 32 bit memory", memArg.Offset)
+			}
+			// Atomics can not be misaligned
+			if defaults.PrefixedOpcodes[name][0] == defaults.PrefixAtomic && memArg.Align != defaults.Alignment[name] {
+				return fmt.Errorf("alignment of %s must be exactly %d", name, 1<<defaults.Alignment[name])
+			}
+		case texts.MemIdx:
+			if int(instruction.Immediates[i].(uint32)) >= len(v.module.Memories) {
+				return fmt.Errorf("unknown memory %d", instruction.Immediates[i])
+			}
+		case texts.TypeIdx:
+			if int(instruction.Immediates[i].(uint32)) >= len(v.module.Types) {
+				return fmt.Errorf("unknown type %d", instruction.Immediates[i])
+			}
+		case texts.TableIdx:
+			if int(instruction.Immediates[i].(uint32)) >= len(v.module.Tables) {
+				return fmt.Errorf("unknown table %d", instruction.Immediates[i])
+			}
+		case texts.DataIdx:
+			if int(instruction.Immediates[i].(uint32)) >= len(v.module.Datas) {
+				return fmt.Errorf("unknown data segment %d", instruction.Immediates[i])
+			}
+		case texts.ElemIdx:
+			if int(instruction.Immediates[i].(uint32)) >= len(v.module.Elems) {
+				return fmt.Errorf("unknown elem segment %d", instruction.Immediates[i])
+			}
+		case texts.LaneIdx:
+			if lanes := laneCount(name); int(instruction.Immediates[i].(uint32)) >= lanes {
+				return fmt.Errorf("invalid lane index %d, %s has %d lanes", instruction.Immediates[i], name, lanes)
+			}
+		// Lanes 0-15 are from the first operand, 16-31 from the second one
+		case texts.Shuffle:
+			for _, lane := range instruction.Immediates[i].([16]byte) {
+				if lane >= 32 {
+					return fmt.Errorf("invalid lane index %d, %s picks from 32 lanes", lane, name)
+				}
+			}
+		}
+	}
+
+	if ok, err := v.validateGC(instruction); ok {
+		return err
+	}
+
+	switch name {
+	// select picks one of two values of the same type,
+	// without a type annotation they must be numbers
+	// See https://webassembly.github.io/spec/core/valid/instructions.html#parametric-instructions
+	case "select":
+		if err := v.popExpect(v.i32()); err != nil {
+			return err
+		}
+		if values := instruction.Immediates[0].([]types.ValueType); len(values) > 0 {
+			if len(values) != 1 {
+				return fmt.Errorf("invalid result arity of select")
+			}
+			return v.applyType(types.FunctionType{Params: []types.ValueType{values[0], values[0]}, Results: values})
+		}
+		first, err := v.popVal()
+		if err != nil {
+			return err
+		}
+		second, err := v.popVal()
+		if err != nil {
+			return err
+		}
+		if !isNumeric(first) || !isNumeric(second) {
+			return fmt.Errorf("type mismatch: select without a type needs numeric operands")
+		}
+		if first != second && first != unknown && second != unknown {
+			return fmt.Errorf("type mismatch: select operands %s and %s", typeName(second), typeName(first))
+		}
+		if first == unknown {
+			first = second
+		}
+		v.pushVals([]types.ValueType{first})
+		return nil
+
+	case "ref.null":
+		if err := v.validValueType(instruction.Immediates[0].(types.ValueType)); err != nil {
+			return err
+		}
+		v.pushVals([]types.ValueType{instruction.Immediates[0].(types.ValueType)})
+		return nil
+
+	case "ref.is_null":
+		value, err := v.popVal()
+		if err != nil {
+			return err
+		}
+		if !isReference(value) {
+			return fmt.Errorf("type mismatch: expected a reference, found %s", typeName(value))
+		}
+		v.pushVals([]types.ValueType{v.i32()})
+		return nil
+
+	case "ref.func":
+		index := instruction.Immediates[0].(uint32)
+		if int(index) >= len(v.module.Funcs) {
+			return fmt.Errorf("unknown function %d", index)
+		}
+		if !v.refs[index] {
+			return fmt.Errorf("undeclared function reference %d", index)
+		}
+		// a reference to the type of the function, it can be used where a funcref is expected
+		v.pushVals([]types.ValueType{types.Ref(types.ConcreteHeap(v.module.Funcs[index].Type), false)})
+		return nil
+
+	// Table instructions work with the type of the table
+	// See https://webassembly.github.io/spec/core/valid/instructions.html#table-instructions
+	case "table.get", "table.set", "table.grow", "table.size", "table.fill":
+		elemType := v.module.Tables[instruction.Immediates[0].(uint32)].ElemType
+		i32 := v.i32()
+		operands := map[string]types.FunctionType{
+			"table.get":  {Params: []types.ValueType{i32}, Results: []types.ValueType{elemType}},
+			"table.set":  {Params: []types.ValueType{i32, elemType}},
+			"table.grow": {Params: []types.ValueType{elemType, i32}, Results: []types.ValueType{i32}},
+			"table.size": {Results: []types.ValueType{i32}},
+			"table.fill": {Params: []types.ValueType{i32, elemType, i32}},
+		}
+		return v.applyType(operands[name])
+
+	case "table.init":
+		elem := v.module.Elems[instruction.Immediates[0].(uint32)]
+		table := v.module.Tables[instruction.Immediates[1].(uint32)]
+		if !v.matches(elem.Type, table.ElemType) {
+			return fmt.Errorf("type mismatch: table of %s, elements of %s", typeName(table.ElemType), typeName(elem.Type))
+		}
+
+	case "table.copy":
+		destination := v.module.Tables[instruction.Immediates[0].(uint32)]
+		source := v.module.Tables[instruction.Immediates[1].(uint32)]
+		if !v.matches(source.ElemType, destination.ElemType) {
+			return fmt.Errorf("type mismatch: can not copy %s into %s", typeName(source.ElemType), typeName(destination.ElemType))
+		}
+	}
+
+	operands, ok := defaults.Operands[name]
+	if !ok {
+		return fmt.Errorf("unknown instruction")
+	}
+	funcType := types.FunctionType{Params: valueTypes(operands[0]), Results: valueTypes(operands[1])}
+	v.addresses(instruction, funcType)
+	return v.applyType(funcType)
+}
+
+// The operands of the memory instructions are the ones of a 32 bit memory,
+// addresses (and sizes) are replaced by the index type of the memory they work on
+// See https://github.com/WebAssembly/memory64/blob/main/proposals/memory64/Overview.md#validation
+func (v *validator) addresses(instruction types.Instruction, funcType types.FunctionType) {
+	memory := func(i int) types.ValueType {
+		return v.addressType(instruction.Immediates[i].(uint32))
+	}
+
+	switch instruction.Name {
+	case "memory.size":
+		funcType.Results[0] = memory(0)
+	case "memory.grow":
+		funcType.Params[0] = memory(0)
+		funcType.Results[0] = memory(0)
+	// destination, value and size
+	case "memory.fill":
+		funcType.Params[0] = memory(0)
+		funcType.Params[2] = memory(0)
+	// the size is an i64 only if both memories are 64 bit
+	case "memory.copy":
+		funcType.Params[0] = memory(0)
+		funcType.Params[1] = memory(1)
+		if memory(0) == memory(1) {
+			funcType.Params[2] = memory(0)
+		}
+	// the source and the size are in the data segment
+	case "memory.init":
+		funcType.Params[0] = memory(1)
+	default:
+		// loads and stores (and atomics, SIMD...) take the address first
+		for i, kind := range defaults.Immediates[instruction.Name] {
+			if kind == texts.MemArg {
+				funcType.Params[0] = v.addressType(instruction.Immediates[i].(types.MemArg).Memory)
+			}
+		}
+	}
+}
+
+// applyType pops the params and pushes the results
+func (v *validator) applyType(funcType types.FunctionType) error {
+	if err := v.popVals(funcType.Params); err != nil {
+		return err
+	}
+	v.pushVals(funcType.Results)
+	return nil
+}
+
+func (v *validator) local(index uint32) (types.ValueType, error) {
+	if int(index) >= len(v.locals) {
+		return 0, fmt.Errorf("unknown local %d", index)
+	}
+	return v.locals[index], nil
+}
+
+func (v *validator) global(index uint32) (types.Global, error) {
+	if int(index) >= len(v.module.Globals) {
+		return types.Global{}, fmt.Errorf("unknown global %d", index)
+	}
+	return v.module.Globals[index], nil
+}
+
+// A tail call pops the arguments of the callee and never falls through
+func (v *validator) tailCall(callee types.FunctionType) error {
+	if !sameValueTypes(callee.Results, v.ctrls[0].end) {
+		return fmt.Errorf("type mismatch: the callee returns [%s] but the function returns [%s]", typeNames(callee.Results), typeNames(v.ctrls[0].end))
+	}
+	if err := v.popVals(callee.Params); err != nil {
+		return err
+	}
+	v.setUnreachable()
+	return nil
+}
+
+func (v *validator) tagType(index uint32) (types.FunctionType, error) {
+	if int(index) >= len(v.module.Tags) {
+		return types.FunctionType{}, fmt.Errorf("unknown tag %d", index)
+	}
+	return v.module.Types[v.module.Tags[index].Type].FunctionType, nil
+}
+
+// A branch to a loop goes back to its start (so it takes its params)
+// to any other block it goes to its end (so it takes its results)
+func (v *validator) labelTypes(depth uint32) ([]types.ValueType, error) {
+	if int(depth) >= len(v.ctrls) {
+		return nil, fmt.Errorf("unknown label %d", depth)
+	}
+	f := v.ctrls[len(v.ctrls)-1-int(depth)]
+	if f.opcode == "loop" {
+		return f.start, nil
+	}
+	return f.end, nil
+}
+
+func (v *validator) pushVals(values []types.ValueType) {
+	v.vals = append(v.vals, values...)
+}
+
+func (v *validator) popVal() (types.ValueType, error) {
+	f := v.ctrls[len(v.ctrls)-1]
+	if len(v.vals) == f.height {
+		if f.unreachable {
+			return unknown, nil
+		}
+		return 0, fmt.Errorf("type mismatch: not enough operands on the stack")
+	}
+	value := v.vals[len(v.vals)-1]
+	v.vals = v.vals[:len(v.vals)-1]
+	return value, nil
+}
+
+func (v *validator) popExpect(expected types.ValueType) error {
+	actual, err := v.popVal()
+	if err != nil {
+		return fmt.Errorf("type mismatch: expected %s but the stack is empty", typeName(expected))
+	}
+	if !v.matches(actual, expected) {
+		return fmt.Errorf("type mismatch: expected %s, found %s", typeName(expected), typeName(actual))
+	}
+	return nil
+}
+
+// Values are popped in reverse order (the last param is on top of the stack)
+func (v *validator) popVals(values []types.ValueType) error {
+	for i := len(values) - 1; i >= 0; i-- {
+		if err := v.popExpect(values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *validator) pushCtrl(opcode string, start, end []types.ValueType) {
+	v.ctrls = append(v.ctrls, frame{opcode: opcode, start: start, end: end, height: len(v.vals), sets: len(v.sets)})
+	v.pushVals(start)
+}
+
+// popCtrl closes a block, the stack must hold exactly its results
+func (v *validator) popCtrl() (frame, error) {
+	f := v.ctrls[len(v.ctrls)-1]
+	if err := v.popVals(f.end); err != nil {
+		return f, err
+	}
+	if len(v.vals) != f.height {
+		return f, fmt.Errorf("type mismatch: %d values remain on the stack at the end of the %s", len(v.vals)-f.height, f.opcode)
+	}
+	v.ctrls = v.ctrls[:len(v.ctrls)-1]
+	for _, index := range v.sets[f.sets:] {
+		v.inits[index] = false
+	}
+	v.sets = v.sets[:f.sets]
+	return f, nil
+}
+
+func (v *validator) setUnreachable() {
+	f := &v.ctrls[len(v.ctrls)-1]
+	v.vals = v.vals[:f.height]
+	f.unreachable = true
+}
+
+func (v *validator) i32() types.ValueType {
+	return types.ValueType(types.ValType["i32"].(int))
+}
+
+// The type of the addresses of a memory: i32, or i64 for 64 bit memories
+func (v *validator) addressType(memory uint32) types.ValueType {
+	if v.module.Memories[memory].Limits.Is64 {
+		return types.ValueType(types.ValType["i64"].(int))
+	}
+	return v.i32()
+}
+
+// The biggest memory: 4GiB of 32 bit addresses, 2^64 bytes (2^48 pages) for 64 bit ones
+func maxPages(limits types.Limits) (uint64, string) {
+	if limits.Is64 {
+		return 1 << 48, "16EiB"
+	}
+	return 65536, "4GiB"
+}
+
+func (v *validator) funcref() types.ValueType {
+	return types.ValueType(types.RefType["funcref"].(int))
+}
+
+func (v *validator) exnref() types.ValueType {
+	return types.ValueType(types.RefType["exnref"].(int))
+}
+
+// Lanes of the vector a SIMD instruction works on
+// i32x4.extract_lane has the shape in its name, v128.load16_lane loads one of 8 lanes (of 2 bytes)
+func laneCount(name string) int {
+	if shape := strings.Split(name, ".")[0]; defaults.Shapes[shape] > 0 {
+		return defaults.Shapes[shape]
+	}
+	return 16 >> defaults.Alignment[name]
+}
+
+func isNumeric(value types.ValueType) bool {
+	return value == unknown || !isReference(value)
+}
+
+func isReference(value types.ValueType) bool {
+	return value == unknown || value.IsRef()
+}
+
+// valueTypes turns "i32 i32" into value types
+func valueTypes(names string) []types.ValueType {
+	values := []types.ValueType{}
+	for _, name := range strings.Fields(names) {
+		values = append(values, types.ValueType(types.ValType[name].(int)))
+	}
+	return values
+}
+
+// typeNames turns value types into "i32 i32"
+func typeNames(values []types.ValueType) string {
+	names := []string{}
+	for _, value := range values {
+		names = append(names, typeName(value))
+	}
+	return strings.Join(names, " ")
+}
+
+func typeName(value types.ValueType) string {
+	for name, v := range types.ValType {
+		if v.(int) == int(value) {
+			return name
+		}
+	}
+	for name, v := range types.RefType {
+		if v.(int) == int(value) {
+			return name
+		}
+	}
+	for name, v := range types.PackedType {
+		if v.(int) == int(value) {
+			return name
+		}
+	}
+	// (ref null $t) and (ref ht) have no shorthand
+	if value.IsRef() {
+		if value.Nullable() {
+			return fmt.Sprintf("(ref null %s)", heapName(value.Heap()))
+		}
+		return fmt.Sprintf("(ref %s)", heapName(value.Heap()))
+	}
+	return "unknown"
+}
@@ -0,0 +1,261 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+// A module to validate, err is a part of the expected error (empty when the module is valid)
+type validatorTest struct {
+	name, input, err string
+}
+
+func runValidatorTests(t *testing.T, tests []validatorTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := built(test.input)
+			if err == nil {
+				err = Validate(m)
+			}
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("expected a valid module, got %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got %v, want an error with %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidateMultiValue(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"results", `(module (func (result i32 i64) (i32.const 1) (i64.const 2)))`, ""},
+		{"call", `(module
+		  (func $pair (result i32 i32) (i32.const 1) (i32.const 2))
+		  (func (result i32) (call $pair) (i32.add)))`, ""},
+		{"block params", `(module (func (result i32) (i32.const 1) (i32.const 2) (block (param i32 i32) (result i32) (i32.add))))`, ""},
+		{"if params", `(module (func (param i32) (result i32)
+		  (i32.const 1) (local.get 0) (if (param i32) (result i32) (then (i32.const 1) (i32.add)) (else (i32.const 2) (i32.sub)))))`, ""},
+		{"loop params", `(module (func (result i32) (i32.const 1) (loop (param i32) (result i32))))`, ""},
+		{"br to a loop takes its params", `(module (func (param i32) (i32.const 1) (loop (param i32) (br_if 0 (local.get 0)) (drop))))`, ""},
+		{"br with more values", `(module (func (result i32 i32) (block (result i32 i32) (i32.const 1) (i32.const 2) (br 0))))`, ""},
+
+		{"too few results", `(module (func (result i32 i64) (i64.const 2)))`, "type mismatch"},
+		{"results in the wrong order", `(module (func (result i32 i64) (i64.const 2) (i32.const 1)))`, "type mismatch: expected i64, found i32"},
+		{"missing block params", `(module (func (result i32) (i32.const 1) (block (param i32 i32) (result i32) (i32.add))))`, "type mismatch"},
+		{"block params of the wrong type", `(module (func (result i32) (f32.const 1) (block (param i32) (result i32))))`, "type mismatch: expected i32, found f32"},
+		{"extra values at the end of a block", `(module (func (block (result i32) (i32.const 1) (i32.const 2))))`, "values remain on the stack at the end of the block"},
+		{"if without else changes the types", `(module (func (result i64) (i32.const 1) (i32.const 0) (if (param i32) (result i64) (then (drop) (i64.const 1)))))`, "if without else must have the same params and results"},
+		{"br with too few values", `(module (func (result i32 i32) (block (result i32 i32) (i32.const 1) (br 0))))`, "type mismatch"},
+		{"br_table labels of different arity", `(module (func (result i32)
+		  (block (result i32) (block (result i32 i32) (i32.const 1) (i32.const 2) (i32.const 0) (br_table 0 1)) (drop))))`, "br_table label"},
+	})
+}
+
+func TestValidateBulkMemory(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"memory", `(module (memory 1) (data $d "hi")
+		  (func
+		    (memory.init $d (i32.const 0) (i32.const 0) (i32.const 2)) (data.drop $d)
+		    (memory.copy (i32.const 8) (i32.const 0) (i32.const 2))
+		    (memory.fill (i32.const 16) (i32.const 255) (i32.const 4))))`, ""},
+		{"table", `(module (table 2 funcref) (elem $e func $f)
+		  (func $f
+		    (table.init $e (i32.const 0) (i32.const 0) (i32.const 1)) (elem.drop $e)
+		    (table.copy (i32.const 1) (i32.const 0) (i32.const 1))))`, ""},
+		{"passive segments without a memory or a table", `(module (data "hi") (elem func $f) (func $f))`, ""},
+
+		{"memory.init without a memory", `(module (data $d "hi") (func (memory.init $d (i32.const 0) (i32.const 0) (i32.const 2))))`, "unknown memory 0"},
+		{"memory.fill without a memory", `(module (func (memory.fill (i32.const 0) (i32.const 0) (i32.const 0))))`, "unknown memory 0"},
+		{"unknown data segment", `(module (memory 1) (func (data.drop 0)))`, "unknown data"},
+		{"unknown elem segment", `(module (table 1 funcref) (func (elem.drop 0)))`, "unknown elem"},
+		{"memory.copy of an i64", `(module (memory 1) (func (memory.copy (i32.const 0) (i64.const 0) (i32.const 1))))`, "type mismatch: expected i32, found i64"},
+		{"memory.fill without the size", `(module (memory 1) (func (memory.fill (i32.const 0) (i32.const 0))))`, "type mismatch"},
+		{"table.init of another type", `(module (table 1 externref) (elem $e func $f) (func $f (table.init $e (i32.const 0) (i32.const 0) (i32.const 1))))`, "type mismatch"},
+	})
+}
+
+func TestValidateReferenceTypes(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"tables of references", `(module (table $t 1 funcref) (table $x 2 externref) (elem declare func $f)
+		  (func $f (param externref) (result i32)
+		    (table.set $t (i32.const 0) (ref.func $f))
+		    (drop (table.get $x (i32.const 1)))
+		    (drop (table.grow $x (local.get 0) (i32.const 1)))
+		    (table.fill $x (i32.const 0) (ref.null extern) (i32.const 1))
+		    (i32.add (ref.is_null (local.get 0)) (table.size $t))))`, ""},
+		{"typed select", `(module (func (result funcref) (select (result funcref) (ref.null func) (ref.null func) (i32.const 1))))`, ""},
+		{"ref.func of an exported function", `(module (func $f (export "f") (result funcref) (ref.func $f)))`, ""},
+		{"ref.func in a global", `(module (global funcref (ref.func $f)) (func $f))`, ""},
+
+		{"undeclared ref.func", `(module (func $f (result funcref) (ref.func $f)))`, "undeclared function reference 0"},
+		{"ref.func of an unknown function", `(module (func (result funcref) (ref.func 1)))`, "unknown function 1"},
+		{"externref in a funcref table", `(module (table 1 funcref) (func (param externref) (table.set (i32.const 0) (local.get 0))))`, "type mismatch: expected funcref, found externref"},
+		{"table.get of an unknown table", `(module (func (drop (table.get 0 (i32.const 0)))))`, "unknown table 0"},
+		{"ref.is_null of an i32", `(module (func (result i32) (ref.is_null (i32.const 0))))`, "expected a reference, found i32"},
+		{"select of references without a type", `(module (func (result funcref) (select (ref.null func) (ref.null func) (i32.const 1))))`, "select without a type needs numeric operands"},
+		{"table.copy between types", `(module (table 1 funcref) (table 1 externref) (func (table.copy 0 1 (i32.const 0) (i32.const 0) (i32.const 0))))`, "type mismatch"},
+		{"elements of another type", `(module (table 1 externref) (elem (i32.const 0) func $f) (func $f))`, "type mismatch: table of externref, elements of funcref"},
+	})
+}
+
+func TestValidateSIMD(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"lanes", `(module (func (result i32)
+		  (i32x4.extract_lane 3 (i32x4.add (v128.const i32x4 1 2 3 -1) (i32x4.splat (i32.const 1))))))`, ""},
+		{"shuffle", `(module (func (result v128)
+		  (i8x16.shuffle 0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 31 (v128.const i64x2 0 0) (v128.const f32x4 1 2 3 4))))`, ""},
+		{"memory", `(module (memory 1) (func (v128.store offset=16 align=8 (i32.const 0) (v128.load (i32.const 0)))))`, ""},
+		{"v128 locals and params", `(module (func (param v128) (result v128) (local v128) (v128.and (local.get 0) (local.get 1))))`, ""},
+
+		{"lane out of range", `(module (func (result i32) (i32x4.extract_lane 4 (v128.const i32x4 0 0 0 0))))`, "invalid lane index 4, i32x4.extract_lane has 4 lanes"},
+		{"shuffle lane out of range", `(module (func (result v128)
+		  (i8x16.shuffle 0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 32 (v128.const i64x2 0 0) (v128.const i64x2 0 0))))`, "invalid lane index 32"},
+		{"alignment too big", `(module (memory 1) (func (drop (v128.load align=32 (i32.const 0)))))`, "alignment"},
+		{"i32 instead of v128", `(module (func (result v128) (i32x4.add (v128.const i32x4 0 0 0 0) (i32.const 1))))`, "type mismatch: expected v128, found i32"},
+		{"v128 result of an i32 function", `(module (func (result i32) (v128.const i32x4 0 0 0 0)))`, "type mismatch: expected i32, found v128"},
+		{"v128.load without a memory", `(module (func (drop (v128.load (i32.const 0)))))`, "unknown memory 0"},
+		{"wrong number of lanes", `(module (func (drop (v128.const i32x4 1 2 3))))`, "i32x4"},
+		{"lane value out of range", `(module (func (drop (v128.const i8x16 256 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0))))`, "out of range"},
+	})
+}
+
+func TestValidateAtomics(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"shared memory", `(module (memory 1 1 shared)
+		  (func (result i32)
+		    (i32.atomic.store (i32.const 0) (i32.const 1))
+		    (drop (i64.atomic.rmw.add offset=8 (i32.const 0) (i64.const 1)))
+		    (drop (i32.atomic.rmw8.cmpxchg_u (i32.const 4) (i32.const 0) (i32.const 1)))
+		    (drop (memory.atomic.wait32 (i32.const 0) (i32.const 0) (i64.const -1)))
+		    (drop (memory.atomic.notify (i32.const 0) (i32.const 1)))
+		    (atomic.fence)
+		    (i32.atomic.load align=4 (i32.const 0))))`, ""},
+		// the atomic instructions can be used on unshared memories too
+		{"unshared memory", `(module (memory 1) (func (result i32) (i32.atomic.load (i32.const 0))))`, ""},
+		{"imported shared memory", `(module (import "env" "memory" (memory 1 2 shared)) (func (atomic.fence)))`, ""},
+
+		{"shared memory without maximum", `(module (memory 1 shared))`, "shared memory must have maximum"},
+		{"alignment smaller than the access", `(module (memory 1 1 shared) (func (result i32) (i32.atomic.load align=2 (i32.const 0))))`, "alignment of i32.atomic.load must be exactly 4"},
+		{"alignment bigger than the access", `(module (memory 1 1 shared) (func (result i32) (i32.atomic.load8_u align=2 (i32.const 0))))`, "alignment must not be larger than natural"},
+		{"without a memory", `(module (func (result i32) (i32.atomic.load (i32.const 0))))`, "unknown memory 0"},
+		{"i32 rmw of an i64", `(module (memory 1 1 shared) (func (result i32) (i32.atomic.rmw.add (i32.const 0) (i64.const 1))))`, "type mismatch: expected i32, found i64"},
+		{"wait32 timeout is an i64", `(module (memory 1 1 shared) (func (result i32) (memory.atomic.wait32 (i32.const 0) (i32.const 0) (i32.const 0))))`, "type mismatch: expected i64, found i32"},
+	})
+}
+
+func TestValidateExceptions(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"try_table", `(module (tag $e (param i32))
+		  (func (param i32) (result i32)
+		    (block $caught (result i32)
+		      (block $all
+		        (try_table (catch $e $caught) (catch_all $all)
+		          (throw $e (local.get 0))))
+		      (i32.const -1))))`, ""},
+		{"catch_ref and throw_ref", `(module (tag $e (param i32))
+		  (func (result i32)
+		    (block $h (result i32 exnref) (try_table (catch_ref $e $h) (nop)) (return (i32.const 0)))
+		    (throw_ref)))`, ""},
+		{"catch_all_ref", `(module (tag $e) (func (result exnref) (block $h (result exnref) (try_table (catch_all_ref $h) (throw $e)) (unreachable))))`, ""},
+		{"try_table with a result", `(module (func (result i32) (block $h (return (try_table (result i32) (catch_all $h) (i32.const 1)))) (i32.const 0)))`, ""},
+		{"imported and exported tags", `(module (import "env" "e" (tag $e (param i64))) (export "e" (tag $e)) (func (throw $e (i64.const 1))))`, ""},
+
+		{"catch_ref to a label without exnref", `(module (tag $e (param i32)) (func (block $h (result i32) (try_table (catch_ref $e $h) (nop)) (unreachable)) (drop)))`,
+			"type mismatch: the handler passes [i32 exnref] to a label of [i32]"},
+		{"catch to a label of another type", `(module (tag $e (param i32)) (func (block $h (result i64) (try_table (catch $e $h) (nop)) (unreachable)) (drop)))`,
+			"type mismatch: the handler passes [i32] to a label of [i64]"},
+		{"catch_all to a label with values", `(module (func (block $h (result i32) (try_table (catch_all $h) (nop)) (unreachable)) (drop)))`, "type mismatch"},
+		{"unknown label", `(module (func (try_table (catch_all 1) (nop))))`, "unknown label 1"},
+		{"unknown tag", `(module (func (throw 0)))`, "unknown tag 0"},
+		{"throw without its params", `(module (tag $e (param i32)) (func (throw $e)))`, "type mismatch"},
+		{"throw_ref of an i32", `(module (func (throw_ref (i32.const 0))))`, "type mismatch: expected exnref, found i32"},
+		{"tag with results", `(module (type $t (func (result i32))) (tag (type $t)))`, "non-empty tag result type"},
+	})
+}
+
+func TestValidateMemories(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"memory64", `(module (memory i64 1)
+		  (func (result i64)
+		    (i64.store offset=0x1_0000_0000 (i64.const 0) (i64.load (i64.const 8)))
+		    (memory.fill (i64.const 0) (i32.const 0) (i64.const 8))
+		    (drop (memory.grow (i64.const 1)))
+		    (memory.size)))`, ""},
+		{"multiple memories", `(module (memory $a 1) (memory $b i64 1 2) (data (memory $b) (i64.const 8) "x")
+		  (func (result i32)
+		    (i32.store $b (i64.const 0) (i32.load $a (i32.const 0)))
+		    (memory.copy $a $b (i32.const 0) (i64.const 0) (i32.const 1))
+		    (i32.load8_u $b (i64.const 0))))`, ""},
+		{"imported and defined memories", `(module (import "env" "memory" (memory 1)) (memory $own 1) (func (result i32) (i32.load $own (i32.const 0))))`, ""},
+
+		{"i32 address of a 64 bit memory", `(module (memory i64 1) (func (result i32) (i32.load (i32.const 0))))`, "type mismatch: expected i64, found i32"},
+		{"i64 address of a 32 bit memory", `(module (memory 1) (func (result i32) (i32.load (i64.const 0))))`, "type mismatch: expected i32, found i64"},
+		{"offset of a 32 bit memory", `(module (memory 1) (func (result i32) (i32.load offset=0x1_0000_0000 (i32.const 0))))`, "offset 4294967296 out of range of a 32 bit memory"},
+		{"unknown memory", `(module (memory 1) (func (result i32) (i32.load 1 (i32.const 0))))`, "unknown memory 1"},
+		{"copy size of a 64 bit and a 32 bit memory", `(module (memory $a 1) (memory $b i64 1)
+		  (func (memory.copy $a $b (i32.const 0) (i64.const 0) (i64.const 1))))`, "type mismatch: expected i32, found i64"},
+		{"data offset of a 64 bit memory", `(module (memory i64 1) (data (i32.const 0) "x"))`, "type mismatch"},
+		{"32 bit memory too big", `(module (memory 65537))`, "memory size must be at most 65536 pages"},
+	})
+}
+
+func TestValidateExtendedConst(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"arithmetic in the initializers", `(module (import "env" "base" (global $base i32)) (memory 1) (table 4 funcref)
+		  (global $end i32 (i32.add (global.get $base) (i32.const 16)))
+		  (global i64 (i64.mul (i64.const 3) (i64.sub (i64.const 10) (i64.const 2))))
+		  (data (i32.sub (global.get $base) (i32.const 4)) "x")
+		  (elem (i32.mul (global.get $base) (i32.const 0)) func $f)
+		  (func $f))`, ""},
+		{"the globals defined before", `(module (global $a i32 (i32.const 1)) (global i32 (i32.add (global.get $a) (global.get $a))))`, ""},
+
+		{"division", `(module (global i32 (i32.div_s (i32.const 1) (i32.const 1))))`, "constant expression required, found i32.div_s"},
+		{"f32.add", `(module (global f32 (f32.add (f32.const 1) (f32.const 1))))`, "constant expression required, found f32.add"},
+		{"a call", `(module (global i32 (call $f)) (func $f (result i32) (i32.const 1)))`, "constant expression required, found call"},
+		{"a mutable global", `(module (import "env" "g" (global $g (mut i32))) (global i32 (i32.add (global.get $g) (i32.const 1))))`, "global 0 is mutable"},
+		{"a global defined after", `(module (global $a i32 (global.get $b)) (global $b i32 (i32.const 1)))`, "constant expressions can only read the globals defined before"},
+		{"the wrong type", `(module (global i64 (i32.add (i32.const 1) (i32.const 1))))`, "type mismatch: expected i64, found i32"},
+		{"two values", `(module (global i32 (i32.const 1) (i32.const 2)))`, "type mismatch"},
+	})
+}
+
+func TestValidateGC(t *testing.T) {
+	runValidatorTests(t, []validatorTest{
+		{"structs, arrays and i31", `(module
+		  (rec
+		    (type $list (sub (struct (field $head i32) (field $tail (ref null $list)))))
+		    (type $bytes (array (mut i8))))
+		  (type $point (sub final (struct (field $x (mut f64)) (field $y f64))))
+		  (func (param $l (ref null $list)) (param $p (ref $point)) (result i32)
+		    (struct.set $point $x (local.get $p) (f64.const 3))
+		    (struct.get $list $head (ref.as_non_null (local.get $l)))
+		    (array.get_u $bytes (array.new $bytes (i32.const 7) (i32.const 3)) (i32.const 0))
+		    (i31.get_s (ref.i31 (i32.const 1)))
+		    (i32.add) (i32.add)))`, ""},
+		{"subtypes", `(module
+		  (type $a (sub (struct (field i32))))
+		  (type $b (sub $a (struct (field i32) (field i64))))
+		  (func (param (ref $b)) (result (ref $a)) (local.get 0))
+		  (func (param anyref) (result i32) (ref.test (ref $a) (local.get 0))))`, ""},
+		{"casts", `(module (type $a (struct))
+		  (func (param anyref) (result (ref null $a)) (ref.cast (ref null $a) (local.get 0))))`, ""},
+		{"br_on_cast", `(module (type $a (struct))
+		  (func (param anyref) (result anyref) (block $l (result (ref $a)) (return (br_on_cast $l anyref (ref $a) (local.get 0))))))`, ""},
+
+		{"set an immutable field", `(module (type $p (struct (field f64))) (func (param (ref $p)) (struct.set $p 0 (local.get 0) (f64.const 1))))`, "field 0 is immutable"},
+		{"set an immutable array", `(module (type $a (array i8)) (func (param (ref $a)) (array.set $a (local.get 0) (i32.const 0) (i32.const 1))))`, "array 0 is immutable"},
+		{"packed field without sign", `(module (type $a (array i8)) (func (param (ref $a)) (result i32) (array.get $a (local.get 0) (i32.const 0))))`, "field of packed type i8 needs array.get_s or array.get_u"},
+		{"unknown field", `(module (type $p (struct (field i32))) (func (param (ref $p)) (result i32) (struct.get $p 1 (local.get 0))))`, "unknown field 1"},
+		{"struct.new of a function type", `(module (type $f (func)) (func (drop (struct.new $f))))`, "type 0 is not a struct type"},
+		{"struct.new without a field", `(module (type $p (struct (field i32) (field i32))) (func (drop (struct.new $p (i32.const 1)))))`, "type mismatch"},
+		{"struct.new_default of a non-nullable reference", `(module (type $p (struct (field (ref $p)))) (func (drop (struct.new_default $p))))`, "needs fields with a default value"},
+		{"extend a final type", `(module (type $a (struct)) (type $b (sub $a (struct))))`, "type 1: can not extend the final type 0"},
+		{"extend with other fields", `(module (type $a (sub (struct (field i32)))) (type $b (sub $a (struct (field i64)))))`, "type 1: type mismatch: it does not match its supertype 0"},
+		{"supertype defined after", `(module (type $b (sub $a (struct))) (type $a (sub (struct))))`, "supertype 1 must be defined before"},
+		{"nullable reference as non-nullable", `(module (type $a (struct)) (func (param (ref null $a)) (result (ref $a)) (local.get 0)))`, "type mismatch"},
+		{"reference to an unrelated type", `(module (type $a (struct)) (type $b (array i8)) (func (param (ref $a)) (result (ref $b)) (local.get 0)))`, "type mismatch"},
+		{"i31 of an i64", `(module (func (result i31ref) (ref.i31 (i64.const 1))))`, "type mismatch: expected i32, found i64"},
+	})
+}
@@ -0,0 +1,106 @@
+package defaults
+
+import "luna/texts"
+
+// Threads
+// Memories can be shared between threads (e.g. web workers with a SharedArrayBuffer),
+// atomic instructions access them without data races. All of them are prefixed with 0xfe
+// See https://webassembly.github.io/threads/core/binary/instructions.html#atomic-memory-instructions
+const PrefixAtomic = 0xfe
+
+// Atomic memory instructions: name, opcode, operands, results and natural alignment
+// Unlike the other memory instructions, the alignment of atomics must be exactly the natural one
+// See https://webassembly.github.io/threads/core/valid/instructions.html#atomic-memory-instructions
+var atomicInstructions = []struct {
+	name      string
+	opcode    int
+	params    string
+	results   string
+	alignment uint32
+}{
+	// Wait for a notify (or a timeout in nanoseconds) and wake up the waiting threads
+	// See https://webassembly.github.io/threads/core/exec/instructions.html#exec-memory-atomic-wait
+	{"memory.atomic.notify", 0x00, "i32 i32", "i32", 2},
+	{"memory.atomic.wait32", 0x01, "i32 i32 i64", "i32", 2},
+	{"memory.atomic.wait64", 0x02, "i32 i64 i64", "i32", 3},
+	// Loads and stores
+	{"i32.atomic.load", 0x10, "i32", "i32", 2},
+	{"i64.atomic.load", 0x11, "i32", "i64", 3},
+	{"i32.atomic.load8_u", 0x12, "i32", "i32", 0},
+	{"i32.atomic.load16_u", 0x13, "i32", "i32", 1},
+	{"i64.atomic.load8_u", 0x14, "i32", "i64", 0},
+	{"i64.atomic.load16_u", 0x15, "i32", "i64", 1},
+	{"i64.atomic.load32_u", 0x16, "i32", "i64", 2},
+	{"i32.atomic.store", 0x17, "i32 i32", "", 2},
+	{"i64.atomic.store", 0x18, "i32 i64", "", 3},
+	{"i32.atomic.store8", 0x19, "i32 i32", "", 0},
+	{"i32.atomic.store16", 0x1a, "i32 i32", "", 1},
+	{"i64.atomic.store8", 0x1b, "i32 i64", "", 0},
+	{"i64.atomic.store16", 0x1c, "i32 i64", "", 1},
+	{"i64.atomic.store32", 0x1d, "i32 i64", "", 2},
+	// Read-modify-write: the value that was in memory is returned
+	{"i32.atomic.rmw.add", 0x1e, "i32 i32", "i32", 2},
+	{"i64.atomic.rmw.add", 0x1f, "i32 i64", "i64", 3},
+	{"i32.atomic.rmw8.add_u", 0x20, "i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.add_u", 0x21, "i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.add_u", 0x22, "i32 i64", "i64", 0},
+	{"i64.atomic.rmw16.add_u", 0x23, "i32 i64", "i64", 1},
+	{"i64.atomic.rmw32.add_u", 0x24, "i32 i64", "i64", 2},
+	{"i32.atomic.rmw.sub", 0x25, "i32 i32", "i32", 2},
+	{"i64.atomic.rmw.sub", 0x26, "i32 i64", "i64", 3},
+	{"i32.atomic.rmw8.sub_u", 0x27, "i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.sub_u", 0x28, "i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.sub_u", 0x29, "i32 i64", "i64", 0},
+	{"i64.atomic.rmw16.sub_u", 0x2a, "i32 i64", "i64", 1},
+	{"i64.atomic.rmw32.sub_u", 0x2b, "i32 i64", "i64", 2},
+	{"i32.atomic.rmw.and", 0x2c, "i32 i32", "i32", 2},
+	{"i64.atomic.rmw.and", 0x2d, "i32 i64", "i64", 3},
+	{"i32.atomic.rmw8.and_u", 0x2e, "i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.and_u", 0x2f, "i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.and_u", 0x30, "i32 i64", "i64", 0},
+	{"i64.atomic.rmw16.and_u", 0x31, "i32 i64", "i64", 1},
+	{"i64.atomic.rmw32.and_u", 0x32, "i32 i64", "i64", 2},
+	{"i32.atomic.rmw.or", 0x33, "i32 i32", "i32", 2},
+	{"i64.atomic.rmw.or", 0x34, "i32 i64", "i64", 3},
+	{"i32.atomic.rmw8.or_u", 0x35, "i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.or_u", 0x36, "i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.or_u", 0x37, "i32 i64", "i64", 0},
+	{"i64.atomic.rmw16.or_u", 0x38, "i32 i64", "i64", 1},
+	{"i64.atomic.rmw32.or_u", 0x39, "i32 i64", "i64", 2},
+	{"i32.atomic.rmw.xor", 0x3a, "i32 i32", "i32", 2},
+	{"i64.atomic.rmw.xor", 0x3b, "i32 i64", "i64", 3},
+	{"i32.atomic.rmw8.xor_u", 0x3c, "i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.xor_u", 0x3d, "i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.xor_u", 0x3e, "i32 i64", "i64", 0},
+	{"i64.atomic.rmw16.xor_u", 0x3f, "i32 i64", "i64", 1},
+	{"i64.atomic.rmw32.xor_u", 0x40, "i32 i64", "i64", 2},
+	{"i32.atomic.rmw.xchg", 0x41, "i32 i32", "i32", 2},
+	{"i64.atomic.rmw.xchg", 0x42, "i32 i64", "i64", 3},
+	{"i32.atomic.rmw8.xchg_u", 0x43, "i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.xchg_u", 0x44, "i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.xchg_u", 0x45, "i32 i64", "i64", 0},
+	{"i64.atomic.rmw16.xchg_u", 0x46, "i32 i64", "i64", 1},
+	{"i64.atomic.rmw32.xchg_u", 0x47, "i32 i64", "i64", 2},
+	// Compare and exchange: the new value is stored only if the old one is the expected one
+	{"i32.atomic.rmw.cmpxchg", 0x48, "i32 i32 i32", "i32", 2},
+	{"i64.atomic.rmw.cmpxchg", 0x49, "i32 i64 i64", "i64", 3},
+	{"i32.atomic.rmw8.cmpxchg_u", 0x4a, "i32 i32 i32", "i32", 0},
+	{"i32.atomic.rmw16.cmpxchg_u", 0x4b, "i32 i32 i32", "i32", 1},
+	{"i64.atomic.rmw8.cmpxchg_u", 0x4c, "i32 i64 i64", "i64", 0},
+	{"i64.atomic.rmw16.cmpxchg_u", 0x4d, "i32 i64 i64", "i64", 1},
+	{"i64.atomic.rmw32.cmpxchg_u", 0x4e, "i32 i64 i64", "i64", 2},
+}
+
+func init() {
+	for _, instruction := range atomicInstructions {
+		PrefixedOpcodes[instruction.name] = [2]int{PrefixAtomic, instruction.opcode}
+		Operands[instruction.name] = [2]string{instruction.params, instruction.results}
+		Immediates[instruction.name] = []string{texts.MemArg}
+		Alignment[instruction.name] = instruction.alignment
+	}
+
+	// atomic.fence does not access the memory, it is followed by a reserved 0x00 byte
+	PrefixedOpcodes["atomic.fence"] = [2]int{PrefixAtomic, 0x03}
+	Operands["atomic.fence"] = [2]string{"", ""}
+	Immediates["atomic.fence"] = []string{texts.Reserved}
+}
@@ -1,5 +1,7 @@
 package defaults
 
+import "luna/texts"
+
 // Module magic \asm and version
 // URL: https://webassembly.github.io/spec/core/binary/modules.html#binary-version
 var (
@@ -10,62 +12,366 @@ var (
 // Opcodes
 // URL on https://webassembly.github.io/spec/core/binary/instructions.html
 var (
-	// unreachable = 0x00
-	block       = 0x02
-	loop        = 0x03
-	br          = 0x0c
-	br_if       = 0x0d
-	end         = 0x0b
-	call        = 0x10
-	get_local   = 0x20
-	set_local   = 0x21
-	i32_store_8 = 0x3a
-	i32_const   = 0x41
-	f32_const   = 0x43
-	i32_eqz     = 0x45
-	i32_eq      = 0x46
-	f32_eq      = 0x5b
-	f32_lt      = 0x5d
-	f32_gt      = 0x5e
-	i32_and     = 0x71
-	i32_add     = 0x6a
-	i32_sub     = 0x6b
-	i32_mul     = 0x6c
-	i32_div     = 0x6d
-	f32_add     = 0x92
-	f32_sub     = 0x93
-	f32_mul     = 0x94
-	f32_div     = 0x95
+	unreachable   = 0x00
+	nop           = 0x01
+	block         = 0x02
+	loop          = 0x03
+	if_           = 0x04
+	else_         = 0x05
+	try           = 0x06
+	catch         = 0x07
+	throw         = 0x08
+	rethrow       = 0x09
+	throw_ref     = 0x0a
+	br            = 0x0c
+	br_if         = 0x0d
+	br_table      = 0x0e
+	end           = 0x0b
+	return_       = 0x0f
+	call          = 0x10
+	call_indirect = 0x11
+	delegate      = 0x18
+	catch_all     = 0x19
+	drop          = 0x1a
+	select_       = 0x1b
+	select_t      = 0x1c
+	try_table     = 0x1f
+	local_get     = 0x20
+	local_set     = 0x21
+	local_tee     = 0x22
+	global_get    = 0x23
+	global_set    = 0x24
+	table_get     = 0x25
+	table_set     = 0x26
+	i32_const     = 0x41
+	i64_const     = 0x42
+	f32_const     = 0x43
+	f64_const     = 0x44
+	// Conversions
+	i32_wrap_i64        = 0xa7
+	i32_trunc_f32_s     = 0xa8
+	i32_trunc_f32_u     = 0xa9
+	i32_trunc_f64_s     = 0xaa
+	i32_trunc_f64_u     = 0xab
+	i64_extend_i32_s    = 0xac
+	i64_extend_i32_u    = 0xad
+	i64_trunc_f32_s     = 0xae
+	i64_trunc_f32_u     = 0xaf
+	i64_trunc_f64_s     = 0xb0
+	i64_trunc_f64_u     = 0xb1
+	f32_convert_i32_s   = 0xb2
+	f32_convert_i32_u   = 0xb3
+	f32_convert_i64_s   = 0xb4
+	f32_convert_i64_u   = 0xb5
+	f32_demote_f64      = 0xb6
+	f64_convert_i32_s   = 0xb7
+	f64_convert_i32_u   = 0xb8
+	f64_convert_i64_s   = 0xb9
+	f64_convert_i64_u   = 0xba
+	f64_promote_f32     = 0xbb
+	i32_reinterpret_f32 = 0xbc
+	i64_reinterpret_f64 = 0xbd
+	f32_reinterpret_i32 = 0xbe
+	f64_reinterpret_i64 = 0xbf
+	// Sign extension: the low 8, 16 or 32 bits as a signed integer
+	i32_extend8_s  = 0xc0
+	i32_extend16_s = 0xc1
+	i64_extend8_s  = 0xc2
+	i64_extend16_s = 0xc3
+	i64_extend32_s = 0xc4
+	ref_null       = 0xd0
+	ref_is_null    = 0xd1
+	ref_func       = 0xd2
+
+	// Tail calls
+	// See https://webassembly.github.io/tail-call/core/binary/instructions.html#control-instructions
+	return_call          = 0x12
+	return_call_indirect = 0x13
 )
 
+// Opcodes by their name in the text format
 var Opcodes = map[string]interface{}{
-	"block":       block,
-	"loop":        loop,
-	"br":          br,
-	"br_if":       br_if,
-	"end":         end,
-	"call":        call,
-	"get_local":   get_local,
-	"set_local":   set_local,
-	"i32_store_8": i32_store_8,
-	"i32_const":   i32_const,
-	"f32_const":   f32_const,
-	"i32_eqz":     i32_eqz,
-	"i32_add":     i32_add,
-	"i32_sub":     i32_sub,
-	"i32_mul":     i32_mul,
-	"i32_div":     i32_div,
-	"i32_eq":      i32_eq,
-	"f32_eq":      f32_eq,
-	"f32_lt":      f32_lt,
-	"f32_gt":      f32_gt,
-	"i32_and":     i32_and,
-	"f32_add":     f32_add,
-	"f32_sub":     f32_sub,
-	"f32_mul":     f32_mul,
-	"f32_div":     f32_div,
+	"unreachable":   unreachable,
+	"nop":           nop,
+	"block":         block,
+	"loop":          loop,
+	"if":            if_,
+	"else":          else_,
+	"throw":         throw,
+	"throw_ref":     throw_ref,
+	"try_table":     try_table,
+	"try":           try,
+	"catch":         catch,
+	"catch_all":     catch_all,
+	"delegate":      delegate,
+	"rethrow":       rethrow,
+	"br":            br,
+	"br_if":         br_if,
+	"br_table":      br_table,
+	"end":           end,
+	"return":        return_,
+	"drop":          drop,
+	"select":        select_,
+	"call":          call,
+	"call_indirect": call_indirect,
+	"local.get":     local_get,
+	"local.set":     local_set,
+	"local.tee":     local_tee,
+	"global.get":    global_get,
+	"global.set":    global_set,
+	"table.get":     table_get,
+	"table.set":     table_set,
+	"i32.const":     i32_const,
+	"i64.const":     i64_const,
+	"f32.const":     f32_const,
+	"f64.const":     f64_const,
+	// Conversions
+	"i32.wrap_i64":        i32_wrap_i64,
+	"i32.trunc_f32_s":     i32_trunc_f32_s,
+	"i32.trunc_f32_u":     i32_trunc_f32_u,
+	"i32.trunc_f64_s":     i32_trunc_f64_s,
+	"i32.trunc_f64_u":     i32_trunc_f64_u,
+	"i64.extend_i32_s":    i64_extend_i32_s,
+	"i64.extend_i32_u":    i64_extend_i32_u,
+	"i64.trunc_f32_s":     i64_trunc_f32_s,
+	"i64.trunc_f32_u":     i64_trunc_f32_u,
+	"i64.trunc_f64_s":     i64_trunc_f64_s,
+	"i64.trunc_f64_u":     i64_trunc_f64_u,
+	"f32.convert_i32_s":   f32_convert_i32_s,
+	"f32.convert_i32_u":   f32_convert_i32_u,
+	"f32.convert_i64_s":   f32_convert_i64_s,
+	"f32.convert_i64_u":   f32_convert_i64_u,
+	"f32.demote_f64":      f32_demote_f64,
+	"f64.convert_i32_s":   f64_convert_i32_s,
+	"f64.convert_i32_u":   f64_convert_i32_u,
+	"f64.convert_i64_s":   f64_convert_i64_s,
+	"f64.convert_i64_u":   f64_convert_i64_u,
+	"f64.promote_f32":     f64_promote_f32,
+	"i32.reinterpret_f32": i32_reinterpret_f32,
+	"i64.reinterpret_f64": i64_reinterpret_f64,
+	"f32.reinterpret_i32": f32_reinterpret_i32,
+	"f64.reinterpret_i64": f64_reinterpret_i64,
+	// Sign extension
+	"i32.extend8_s":  i32_extend8_s,
+	"i32.extend16_s": i32_extend16_s,
+	"i64.extend8_s":  i64_extend8_s,
+	"i64.extend16_s": i64_extend16_s,
+	"i64.extend32_s": i64_extend32_s,
+	"ref.null":       ref_null,
+	"ref.is_null":    ref_is_null,
+	"ref.func":       ref_func,
+
+	// Tail calls: the caller frame is replaced by the callee, so the stack does not grow
+	"return_call":          return_call,
+	"return_call_indirect": return_call_indirect,
+}
+
+// select with a type (select (result t)) has its own opcode
+// See https://webassembly.github.io/spec/core/binary/instructions.html#parametric-instructions
+var TypedSelect = select_t
+
+// Prefixed opcodes
+// There is a limited number of single byte opcodes, so newer instructions are
+// a prefix byte followed by their own opcode (a u32 encoded as LEB128)
+// See https://webassembly.github.io/spec/core/binary/instructions.html
+const (
+	// Bulk memory, saturating truncation...
+	PrefixMisc = 0xfc
+)
+
+// Prefixed opcodes by their name in the text format: {prefix, opcode}
+var PrefixedOpcodes = map[string][2]int{
+	// Bulk memory
+	// See https://webassembly.github.io/spec/core/binary/instructions.html#memory-instructions
+	"memory.init": {PrefixMisc, 8},
+	"data.drop":   {PrefixMisc, 9},
+	"memory.copy": {PrefixMisc, 10},
+	"memory.fill": {PrefixMisc, 11},
+	"table.init":  {PrefixMisc, 12},
+	"elem.drop":   {PrefixMisc, 13},
+	"table.copy":  {PrefixMisc, 14},
+	// Tables
+	// See https://webassembly.github.io/spec/core/binary/instructions.html#table-instructions
+	"table.grow": {PrefixMisc, 15},
+	"table.size": {PrefixMisc, 16},
+	"table.fill": {PrefixMisc, 17},
+	// Saturating truncation: like trunc but out of range values are clamped (and NaN is 0) instead of trapping
+	// See https://webassembly.github.io/spec/core/exec/numerics.html#op-trunc-sat-u
+	"i32.trunc_sat_f32_s": {PrefixMisc, 0},
+	"i32.trunc_sat_f32_u": {PrefixMisc, 1},
+	"i32.trunc_sat_f64_s": {PrefixMisc, 2},
+	"i32.trunc_sat_f64_u": {PrefixMisc, 3},
+	"i64.trunc_sat_f32_s": {PrefixMisc, 4},
+	"i64.trunc_sat_f32_u": {PrefixMisc, 5},
+	"i64.trunc_sat_f64_s": {PrefixMisc, 6},
+	"i64.trunc_sat_f64_u": {PrefixMisc, 7},
+}
+
+// Legacy exception handling
+// The first version of the exception handling proposal, it is still emitted by some toolchains
+// but it was replaced by try_table and throw_ref. Luna only accepts it when asked (see compiler.Options)
+// See https://github.com/WebAssembly/exception-handling/blob/main/proposals/exception-handling/legacy/Exceptions.md
+var Legacy = map[string]bool{
+	"try":       true,
+	"catch":     true,
+	"catch_all": true,
+	"delegate":  true,
+	"rethrow":   true,
 }
 
+// Luna has always accepted a few names that are not in the specification
+var Aliases = map[string]string{
+	"i32.div": "i32.div_s",
+}
+
+// Immediates
+// Some instructions are followed by arguments (e.g. the index of local.get or the value of i32.const)
+// they are encoded right after the opcode, in this order.
+// Instructions that are not listed have no immediates.
+// See https://webassembly.github.io/spec/core/binary/instructions.html
+var Immediates = map[string][]string{
+	"block": {texts.BlockType},
+	"loop":  {texts.BlockType},
+	"if":    {texts.BlockType},
+	"br":    {texts.LabelIdx},
+	"br_if": {texts.LabelIdx},
+	// br_table $label* $default, encoded as the vector of the labels followed by the default one
+	"br_table": {texts.Labels},
+	"call":     {texts.FuncIdx},
+	"throw":    {texts.TagIdx},
+	// try_table $label? blocktype (catch $tag $label)*
+	"try_table": {texts.BlockType, texts.Catches},
+	"try":       {texts.BlockType},
+	"catch":     {texts.TagIdx},
+	"delegate":  {texts.LabelIdx},
+	"rethrow":   {texts.LabelIdx},
+	// in the text format the table comes first: call_indirect $table (type $t)
+	"call_indirect": {texts.TypeIdx, texts.TableIdx},
+	"return_call":   {texts.FuncIdx},
+	"local.get":     {texts.LocalIdx},
+	"local.set":     {texts.LocalIdx},
+	"local.tee":     {texts.LocalIdx},
+	"global.get":    {texts.GlobalIdx},
+	"global.set":    {texts.GlobalIdx},
+	// return_call_indirect $table? typeuse, like call_indirect
+	"return_call_indirect": {texts.TypeIdx, texts.TableIdx},
+	// in the text format the memory comes first: memory.init $memory? $data
+	"memory.init": {texts.DataIdx, texts.MemIdx},
+	"data.drop":   {texts.DataIdx},
+	// destination and source memories
+	"memory.copy": {texts.MemIdx, texts.MemIdx},
+	"memory.fill": {texts.MemIdx},
+	// in the text format the table comes first: table.init $table? $elem
+	"table.init": {texts.ElemIdx, texts.TableIdx},
+	"elem.drop":  {texts.ElemIdx},
+	// destination and source tables
+	"table.copy": {texts.TableIdx, texts.TableIdx},
+	// the table index is optional in the text format (0 by default)
+	"table.get":  {texts.TableIdx},
+	"table.set":  {texts.TableIdx},
+	"table.grow": {texts.TableIdx},
+	"table.size": {texts.TableIdx},
+	"table.fill": {texts.TableIdx},
+	// select (result t)? the type is optional
+	"select":    {texts.SelectType},
+	"ref.null":  {texts.HeapType},
+	"ref.func":  {texts.FuncIdx},
+	"i32.const": {texts.ConstI32},
+	"i64.const": {texts.ConstI64},
+	"f32.const": {texts.ConstF32},
+	"f64.const": {texts.ConstF64},
+}
+
+// Operands
+// The types an instruction pops from the stack and the types it pushes back
+// e.g. i32.add pops two i32 and pushes their sum (an i32)
+// Control instructions (block, br, call...) and the ones that depend on their immediates
+// (local.get, drop...) are checked by the validator itself
+// See https://webassembly.github.io/spec/core/valid/instructions.html
+var Operands = map[string][2]string{
+	"i32.const": {"", "i32"},
+	"i64.const": {"", "i64"},
+	"f32.const": {"", "f32"},
+	"f64.const": {"", "f64"},
+	// Conversions
+	// trunc traps when the float is NaN or does not fit in the integer, trunc_sat does not
+	// See https://webassembly.github.io/spec/core/valid/instructions.html#conversion-instructions
+	"i32.wrap_i64":        {"i64", "i32"},
+	"i32.trunc_f32_s":     {"f32", "i32"},
+	"i32.trunc_f32_u":     {"f32", "i32"},
+	"i32.trunc_f64_s":     {"f64", "i32"},
+	"i32.trunc_f64_u":     {"f64", "i32"},
+	"i64.extend_i32_s":    {"i32", "i64"},
+	"i64.extend_i32_u":    {"i32", "i64"},
+	"i64.trunc_f32_s":     {"f32", "i64"},
+	"i64.trunc_f32_u":     {"f32", "i64"},
+	"i64.trunc_f64_s":     {"f64", "i64"},
+	"i64.trunc_f64_u":     {"f64", "i64"},
+	"f32.convert_i32_s":   {"i32", "f32"},
+	"f32.convert_i32_u":   {"i32", "f32"},
+	"f32.convert_i64_s":   {"i64", "f32"},
+	"f32.convert_i64_u":   {"i64", "f32"},
+	"f32.demote_f64":      {"f64", "f32"},
+	"f64.convert_i32_s":   {"i32", "f64"},
+	"f64.convert_i32_u":   {"i32", "f64"},
+	"f64.convert_i64_s":   {"i64", "f64"},
+	"f64.convert_i64_u":   {"i64", "f64"},
+	"f64.promote_f32":     {"f32", "f64"},
+	"i32.reinterpret_f32": {"f32", "i32"},
+	"i64.reinterpret_f64": {"f64", "i64"},
+	"f32.reinterpret_i32": {"i32", "f32"},
+	"f64.reinterpret_i64": {"i64", "f64"},
+	"i32.extend8_s":       {"i32", "i32"},
+	"i32.extend16_s":      {"i32", "i32"},
+	"i64.extend8_s":       {"i64", "i64"},
+	"i64.extend16_s":      {"i64", "i64"},
+	"i64.extend32_s":      {"i64", "i64"},
+	"i32.trunc_sat_f32_s": {"f32", "i32"},
+	"i32.trunc_sat_f32_u": {"f32", "i32"},
+	"i32.trunc_sat_f64_s": {"f64", "i32"},
+	"i32.trunc_sat_f64_u": {"f64", "i32"},
+	"i64.trunc_sat_f32_s": {"f32", "i64"},
+	"i64.trunc_sat_f32_u": {"f32", "i64"},
+	"i64.trunc_sat_f64_s": {"f64", "i64"},
+	"i64.trunc_sat_f64_u": {"f64", "i64"},
+	// destination, source (or value) and size
+	"memory.init": {"i32 i32 i32", ""},
+	"memory.copy": {"i32 i32 i32", ""},
+	"memory.fill": {"i32 i32 i32", ""},
+	"table.init":  {"i32 i32 i32", ""},
+	"table.copy":  {"i32 i32 i32", ""},
+	"data.drop":   {"", ""},
+	"elem.drop":   {"", ""},
+}
+
+// Constant instructions
+// Only these can appear in constant expressions (e.g. the initial value of a global)
+// See https://webassembly.github.io/spec/core/valid/instructions.html#constant-expressions
+var Constants = map[string]bool{
+	"i32.const":  true,
+	"i64.const":  true,
+	"f32.const":  true,
+	"f64.const":  true,
+	"v128.const": true,
+	"ref.null":   true,
+	"ref.func":   true,
+	// Immutable globals (e.g. an imported __memory_base)
+	"global.get": true,
+	// Extended constant expressions: offsets can be computed, e.g. __memory_base + 16
+	// See https://github.com/WebAssembly/extended-const/blob/main/proposals/extended-const/Overview.md
+	"i32.add": true,
+	"i32.sub": true,
+	"i32.mul": true,
+	"i64.add": true,
+	"i64.sub": true,
+	"i64.mul": true,
+}
+
+// Natural alignment of the memory instructions, as an exponent (2 means 4 bytes)
+// it is the default alignment and the biggest one allowed
+// See https://webassembly.github.io/spec/core/valid/instructions.html#memory-instructions
+var Alignment = map[string]uint32{}
+
 // Section
 // See https://webassembly.github.io/spec/core/binary/modules.html#sections
 var Section = map[string]interface{}{
@@ -77,7 +383,16 @@ var Section = map[string]interface{}{
 	"memory": 0x05,
 	"global": 0x06,
 	"export": 0x07,
+	"start":  0x08,
+	"elem":   0x09,
 	"code":   0xa,
+	"data":   0x0b,
+	// The number of data segments, so that memory.init and data.drop
+	// can be validated before the data section (that comes after the code)
+	"datacount": 0x0c,
+	// The tags come between the memories and the globals
+	// See https://webassembly.github.io/exception-handling/core/binary/modules.html#tag-section
+	"tag": 0x0d,
 }
 
 // Export section
@@ -87,4 +402,5 @@ var ExportSection = map[string]interface{}{
 	"table":  0x01,
 	"mem":    0x02,
 	"global": 0x03,
+	"tag":    0x04,
 }
@@ -0,0 +1,73 @@
+package defaults
+
+import "luna/texts"
+
+// Garbage collection
+// Structs and arrays are allocated by the engine and referenced with typed references
+// e.g. (ref $point), i31 references are small integers that are not allocated at all.
+// Most of the instructions are prefixed with 0xfb
+// See https://webassembly.github.io/gc/core/binary/instructions.html#aggregate-reference-instructions
+const PrefixGC = 0xfb
+
+// Their operands depend on their type immediates (the fields of the struct, the element of the array...)
+// so they are checked by the validator itself
+var gcInstructions = []struct {
+	name       string
+	opcode     int
+	immediates []string
+}{
+	{"struct.new", 0, []string{texts.TypeIdx}},
+	{"struct.new_default", 1, []string{texts.TypeIdx}},
+	{"struct.get", 2, []string{texts.TypeIdx, texts.FieldIdx}},
+	// packed fields (i8, i16) are sign or zero extended
+	{"struct.get_s", 3, []string{texts.TypeIdx, texts.FieldIdx}},
+	{"struct.get_u", 4, []string{texts.TypeIdx, texts.FieldIdx}},
+	{"struct.set", 5, []string{texts.TypeIdx, texts.FieldIdx}},
+	{"array.new", 6, []string{texts.TypeIdx}},
+	{"array.new_default", 7, []string{texts.TypeIdx}},
+	{"array.new_fixed", 8, []string{texts.TypeIdx, texts.Count}},
+	{"array.new_data", 9, []string{texts.TypeIdx, texts.DataIdx}},
+	{"array.new_elem", 10, []string{texts.TypeIdx, texts.ElemIdx}},
+	{"array.get", 11, []string{texts.TypeIdx}},
+	{"array.get_s", 12, []string{texts.TypeIdx}},
+	{"array.get_u", 13, []string{texts.TypeIdx}},
+	{"array.set", 14, []string{texts.TypeIdx}},
+	{"array.len", 15, nil},
+	{"array.fill", 16, []string{texts.TypeIdx}},
+	// destination and source types
+	{"array.copy", 17, []string{texts.TypeIdx, texts.TypeIdx}},
+	{"array.init_data", 18, []string{texts.TypeIdx, texts.DataIdx}},
+	{"array.init_elem", 19, []string{texts.TypeIdx, texts.ElemIdx}},
+	// ref.test (ref null ht) and ref.cast (ref null ht) are the next opcodes (21 and 23)
+	{"ref.test", 20, []string{texts.RefType}},
+	{"ref.cast", 22, []string{texts.RefType}},
+	// br_on_cast $label (ref null? ht1) (ref null? ht2), a byte of flags says which ones are nullable
+	{"br_on_cast", 24, []string{texts.LabelIdx, texts.RefType, texts.RefType}},
+	{"br_on_cast_fail", 25, []string{texts.LabelIdx, texts.RefType, texts.RefType}},
+	// externref <-> anyref
+	{"any.convert_extern", 26, nil},
+	{"extern.convert_any", 27, nil},
+	{"ref.i31", 28, nil},
+	{"i31.get_s", 29, nil},
+	{"i31.get_u", 30, nil},
+}
+
+func init() {
+	for _, instruction := range gcInstructions {
+		PrefixedOpcodes[instruction.name] = [2]int{PrefixGC, instruction.opcode}
+		if instruction.immediates != nil {
+			Immediates[instruction.name] = instruction.immediates
+		}
+	}
+
+	// Not prefixed: references to eq types can be compared, and a nullable reference can be made non-nullable (or trap)
+	// See https://webassembly.github.io/gc/core/binary/instructions.html#reference-instructions
+	Opcodes["ref.eq"] = 0xd3
+	Opcodes["ref.as_non_null"] = 0xd4
+
+	// Allocating and converting are constant, e.g. (global $origin (ref $point) (struct.new_default $point))
+	// See https://webassembly.github.io/gc/core/valid/instructions.html#constant-expressions
+	for _, name := range []string{"struct.new", "struct.new_default", "array.new", "array.new_default", "array.new_fixed", "ref.i31", "any.convert_extern", "extern.convert_any"} {
+		Constants[name] = true
+	}
+}
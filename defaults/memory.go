@@ -0,0 +1,63 @@
+package defaults
+
+import "luna/texts"
+
+// Memory instructions
+// Loads and stores read and write the linear memory at an address (popped from the stack) plus a static offset.
+// The narrower ones (load8_s, store16...) read and write only the low bytes of the value
+// See https://webassembly.github.io/spec/core/binary/instructions.html#memory-instructions
+//
+// Memory64: the address is an i64 for the memories declared with (memory i64 ...),
+// the operands below are the ones of a 32 bit memory (the validator replaces the addresses)
+// See https://github.com/WebAssembly/memory64/blob/main/proposals/memory64/Overview.md
+
+// Loads and stores: name, opcode, operands, results and natural alignment
+var memoryInstructions = []struct {
+	name      string
+	opcode    int
+	params    string
+	results   string
+	alignment uint32
+}{
+	{"i32.load", 0x28, "i32", "i32", 2},
+	{"i64.load", 0x29, "i32", "i64", 3},
+	{"f32.load", 0x2a, "i32", "f32", 2},
+	{"f64.load", 0x2b, "i32", "f64", 3},
+	{"i32.load8_s", 0x2c, "i32", "i32", 0},
+	{"i32.load8_u", 0x2d, "i32", "i32", 0},
+	{"i32.load16_s", 0x2e, "i32", "i32", 1},
+	{"i32.load16_u", 0x2f, "i32", "i32", 1},
+	{"i64.load8_s", 0x30, "i32", "i64", 0},
+	{"i64.load8_u", 0x31, "i32", "i64", 0},
+	{"i64.load16_s", 0x32, "i32", "i64", 1},
+	{"i64.load16_u", 0x33, "i32", "i64", 1},
+	{"i64.load32_s", 0x34, "i32", "i64", 2},
+	{"i64.load32_u", 0x35, "i32", "i64", 2},
+	{"i32.store", 0x36, "i32 i32", "", 2},
+	{"i64.store", 0x37, "i32 i64", "", 3},
+	{"f32.store", 0x38, "i32 f32", "", 2},
+	{"f64.store", 0x39, "i32 f64", "", 3},
+	{"i32.store8", 0x3a, "i32 i32", "", 0},
+	{"i32.store16", 0x3b, "i32 i32", "", 1},
+	{"i64.store8", 0x3c, "i32 i64", "", 0},
+	{"i64.store16", 0x3d, "i32 i64", "", 1},
+	{"i64.store32", 0x3e, "i32 i64", "", 2},
+}
+
+func init() {
+	for _, instruction := range memoryInstructions {
+		Opcodes[instruction.name] = instruction.opcode
+		Operands[instruction.name] = [2]string{instruction.params, instruction.results}
+		Immediates[instruction.name] = []string{texts.MemArg}
+		Alignment[instruction.name] = instruction.alignment
+	}
+
+	// The size of a memory (in pages of 64KiB) and its growth, grow returns the old size (or -1)
+	// See https://webassembly.github.io/spec/core/exec/instructions.html#xref-syntax-instructions-syntax-instr-memory-mathsf-memory-grow
+	Opcodes["memory.size"] = 0x3f
+	Operands["memory.size"] = [2]string{"", "i32"}
+	Immediates["memory.size"] = []string{texts.MemIdx}
+	Opcodes["memory.grow"] = 0x40
+	Operands["memory.grow"] = [2]string{"i32", "i32"}
+	Immediates["memory.grow"] = []string{texts.MemIdx}
+}
@@ -0,0 +1,358 @@
+package defaults
+
+import "luna/texts"
+
+// Fixed-width SIMD
+// 128-bit vectors (v128) seen as lanes of the same type: 16 x i8, 8 x i16, 4 x i32, 2 x i64, 4 x f32 or 2 x f64.
+// All of them are prefixed with 0xfd
+// See https://webassembly.github.io/spec/core/binary/instructions.html#vector-instructions
+const PrefixSIMD = 0xfd
+
+// Lanes of each shape e.g. i32x4 has 4 lanes
+// See https://webassembly.github.io/spec/core/syntax/instructions.html#vector-instructions
+var Shapes = map[string]int{
+	"i8x16": 16,
+	"i16x8": 8,
+	"i32x4": 4,
+	"i64x2": 2,
+	"f32x4": 4,
+	"f64x2": 2,
+}
+
+// SIMD instructions: name, opcode, operands and results
+// The opcodes are not contiguous, the missing ones were dropped from the proposal
+var simdInstructions = []struct {
+	name    string
+	opcode  int
+	params  string
+	results string
+}{
+	// Memory
+	{"v128.load", 0, "i32", "v128"},
+	{"v128.load8x8_s", 1, "i32", "v128"},
+	{"v128.load8x8_u", 2, "i32", "v128"},
+	{"v128.load16x4_s", 3, "i32", "v128"},
+	{"v128.load16x4_u", 4, "i32", "v128"},
+	{"v128.load32x2_s", 5, "i32", "v128"},
+	{"v128.load32x2_u", 6, "i32", "v128"},
+	{"v128.load8_splat", 7, "i32", "v128"},
+	{"v128.load16_splat", 8, "i32", "v128"},
+	{"v128.load32_splat", 9, "i32", "v128"},
+	{"v128.load64_splat", 10, "i32", "v128"},
+	{"v128.store", 11, "i32 v128", ""},
+	// Constant and shuffles
+	{"v128.const", 12, "", "v128"},
+	{"i8x16.shuffle", 13, "v128 v128", "v128"},
+	{"i8x16.swizzle", 14, "v128 v128", "v128"},
+	// Lanes
+	{"i8x16.splat", 15, "i32", "v128"},
+	{"i16x8.splat", 16, "i32", "v128"},
+	{"i32x4.splat", 17, "i32", "v128"},
+	{"i64x2.splat", 18, "i64", "v128"},
+	{"f32x4.splat", 19, "f32", "v128"},
+	{"f64x2.splat", 20, "f64", "v128"},
+	{"i8x16.extract_lane_s", 21, "v128", "i32"},
+	{"i8x16.extract_lane_u", 22, "v128", "i32"},
+	{"i8x16.replace_lane", 23, "v128 i32", "v128"},
+	{"i16x8.extract_lane_s", 24, "v128", "i32"},
+	{"i16x8.extract_lane_u", 25, "v128", "i32"},
+	{"i16x8.replace_lane", 26, "v128 i32", "v128"},
+	{"i32x4.extract_lane", 27, "v128", "i32"},
+	{"i32x4.replace_lane", 28, "v128 i32", "v128"},
+	{"i64x2.extract_lane", 29, "v128", "i64"},
+	{"i64x2.replace_lane", 30, "v128 i64", "v128"},
+	{"f32x4.extract_lane", 31, "v128", "f32"},
+	{"f32x4.replace_lane", 32, "v128 f32", "v128"},
+	{"f64x2.extract_lane", 33, "v128", "f64"},
+	{"f64x2.replace_lane", 34, "v128 f64", "v128"},
+	// Comparisons
+	{"i8x16.eq", 35, "v128 v128", "v128"},
+	{"i8x16.ne", 36, "v128 v128", "v128"},
+	{"i8x16.lt_s", 37, "v128 v128", "v128"},
+	{"i8x16.lt_u", 38, "v128 v128", "v128"},
+	{"i8x16.gt_s", 39, "v128 v128", "v128"},
+	{"i8x16.gt_u", 40, "v128 v128", "v128"},
+	{"i8x16.le_s", 41, "v128 v128", "v128"},
+	{"i8x16.le_u", 42, "v128 v128", "v128"},
+	{"i8x16.ge_s", 43, "v128 v128", "v128"},
+	{"i8x16.ge_u", 44, "v128 v128", "v128"},
+	{"i16x8.eq", 45, "v128 v128", "v128"},
+	{"i16x8.ne", 46, "v128 v128", "v128"},
+	{"i16x8.lt_s", 47, "v128 v128", "v128"},
+	{"i16x8.lt_u", 48, "v128 v128", "v128"},
+	{"i16x8.gt_s", 49, "v128 v128", "v128"},
+	{"i16x8.gt_u", 50, "v128 v128", "v128"},
+	{"i16x8.le_s", 51, "v128 v128", "v128"},
+	{"i16x8.le_u", 52, "v128 v128", "v128"},
+	{"i16x8.ge_s", 53, "v128 v128", "v128"},
+	{"i16x8.ge_u", 54, "v128 v128", "v128"},
+	{"i32x4.eq", 55, "v128 v128", "v128"},
+	{"i32x4.ne", 56, "v128 v128", "v128"},
+	{"i32x4.lt_s", 57, "v128 v128", "v128"},
+	{"i32x4.lt_u", 58, "v128 v128", "v128"},
+	{"i32x4.gt_s", 59, "v128 v128", "v128"},
+	{"i32x4.gt_u", 60, "v128 v128", "v128"},
+	{"i32x4.le_s", 61, "v128 v128", "v128"},
+	{"i32x4.le_u", 62, "v128 v128", "v128"},
+	{"i32x4.ge_s", 63, "v128 v128", "v128"},
+	{"i32x4.ge_u", 64, "v128 v128", "v128"},
+	{"f32x4.eq", 65, "v128 v128", "v128"},
+	{"f32x4.ne", 66, "v128 v128", "v128"},
+	{"f32x4.lt", 67, "v128 v128", "v128"},
+	{"f32x4.gt", 68, "v128 v128", "v128"},
+	{"f32x4.le", 69, "v128 v128", "v128"},
+	{"f32x4.ge", 70, "v128 v128", "v128"},
+	{"f64x2.eq", 71, "v128 v128", "v128"},
+	{"f64x2.ne", 72, "v128 v128", "v128"},
+	{"f64x2.lt", 73, "v128 v128", "v128"},
+	{"f64x2.gt", 74, "v128 v128", "v128"},
+	{"f64x2.le", 75, "v128 v128", "v128"},
+	{"f64x2.ge", 76, "v128 v128", "v128"},
+	// Bitwise
+	{"v128.not", 77, "v128", "v128"},
+	{"v128.and", 78, "v128 v128", "v128"},
+	{"v128.andnot", 79, "v128 v128", "v128"},
+	{"v128.or", 80, "v128 v128", "v128"},
+	{"v128.xor", 81, "v128 v128", "v128"},
+	{"v128.bitselect", 82, "v128 v128 v128", "v128"},
+	{"v128.any_true", 83, "v128", "i32"},
+	// Memory lanes
+	{"v128.load8_lane", 84, "i32 v128", "v128"},
+	{"v128.load16_lane", 85, "i32 v128", "v128"},
+	{"v128.load32_lane", 86, "i32 v128", "v128"},
+	{"v128.load64_lane", 87, "i32 v128", "v128"},
+	{"v128.store8_lane", 88, "i32 v128", ""},
+	{"v128.store16_lane", 89, "i32 v128", ""},
+	{"v128.store32_lane", 90, "i32 v128", ""},
+	{"v128.store64_lane", 91, "i32 v128", ""},
+	{"v128.load32_zero", 92, "i32", "v128"},
+	{"v128.load64_zero", 93, "i32", "v128"},
+	// Arithmetic and conversions
+	{"f32x4.demote_f64x2_zero", 94, "v128", "v128"},
+	{"f64x2.promote_low_f32x4", 95, "v128", "v128"},
+	{"i8x16.abs", 96, "v128", "v128"},
+	{"i8x16.neg", 97, "v128", "v128"},
+	{"i8x16.popcnt", 98, "v128", "v128"},
+	{"i8x16.all_true", 99, "v128", "i32"},
+	{"i8x16.bitmask", 100, "v128", "i32"},
+	{"i8x16.narrow_i16x8_s", 101, "v128 v128", "v128"},
+	{"i8x16.narrow_i16x8_u", 102, "v128 v128", "v128"},
+	{"f32x4.ceil", 103, "v128", "v128"},
+	{"f32x4.floor", 104, "v128", "v128"},
+	{"f32x4.trunc", 105, "v128", "v128"},
+	{"f32x4.nearest", 106, "v128", "v128"},
+	{"i8x16.shl", 107, "v128 i32", "v128"},
+	{"i8x16.shr_s", 108, "v128 i32", "v128"},
+	{"i8x16.shr_u", 109, "v128 i32", "v128"},
+	{"i8x16.add", 110, "v128 v128", "v128"},
+	{"i8x16.add_sat_s", 111, "v128 v128", "v128"},
+	{"i8x16.add_sat_u", 112, "v128 v128", "v128"},
+	{"i8x16.sub", 113, "v128 v128", "v128"},
+	{"i8x16.sub_sat_s", 114, "v128 v128", "v128"},
+	{"i8x16.sub_sat_u", 115, "v128 v128", "v128"},
+	{"f64x2.ceil", 116, "v128", "v128"},
+	{"f64x2.floor", 117, "v128", "v128"},
+	{"i8x16.min_s", 118, "v128 v128", "v128"},
+	{"i8x16.min_u", 119, "v128 v128", "v128"},
+	{"i8x16.max_s", 120, "v128 v128", "v128"},
+	{"i8x16.max_u", 121, "v128 v128", "v128"},
+	{"f64x2.trunc", 122, "v128", "v128"},
+	{"i8x16.avgr_u", 123, "v128 v128", "v128"},
+	{"i16x8.extadd_pairwise_i8x16_s", 124, "v128", "v128"},
+	{"i16x8.extadd_pairwise_i8x16_u", 125, "v128", "v128"},
+	{"i32x4.extadd_pairwise_i16x8_s", 126, "v128", "v128"},
+	{"i32x4.extadd_pairwise_i16x8_u", 127, "v128", "v128"},
+	{"i16x8.abs", 128, "v128", "v128"},
+	{"i16x8.neg", 129, "v128", "v128"},
+	{"i16x8.q15mulr_sat_s", 130, "v128 v128", "v128"},
+	{"i16x8.all_true", 131, "v128", "i32"},
+	{"i16x8.bitmask", 132, "v128", "i32"},
+	{"i16x8.narrow_i32x4_s", 133, "v128 v128", "v128"},
+	{"i16x8.narrow_i32x4_u", 134, "v128 v128", "v128"},
+	{"i16x8.extend_low_i8x16_s", 135, "v128", "v128"},
+	{"i16x8.extend_high_i8x16_s", 136, "v128", "v128"},
+	{"i16x8.extend_low_i8x16_u", 137, "v128", "v128"},
+	{"i16x8.extend_high_i8x16_u", 138, "v128", "v128"},
+	{"i16x8.shl", 139, "v128 i32", "v128"},
+	{"i16x8.shr_s", 140, "v128 i32", "v128"},
+	{"i16x8.shr_u", 141, "v128 i32", "v128"},
+	{"i16x8.add", 142, "v128 v128", "v128"},
+	{"i16x8.add_sat_s", 143, "v128 v128", "v128"},
+	{"i16x8.add_sat_u", 144, "v128 v128", "v128"},
+	{"i16x8.sub", 145, "v128 v128", "v128"},
+	{"i16x8.sub_sat_s", 146, "v128 v128", "v128"},
+	{"i16x8.sub_sat_u", 147, "v128 v128", "v128"},
+	{"f64x2.nearest", 148, "v128", "v128"},
+	{"i16x8.mul", 149, "v128 v128", "v128"},
+	{"i16x8.min_s", 150, "v128 v128", "v128"},
+	{"i16x8.min_u", 151, "v128 v128", "v128"},
+	{"i16x8.max_s", 152, "v128 v128", "v128"},
+	{"i16x8.max_u", 153, "v128 v128", "v128"},
+	{"i16x8.avgr_u", 155, "v128 v128", "v128"},
+	{"i16x8.extmul_low_i8x16_s", 156, "v128 v128", "v128"},
+	{"i16x8.extmul_high_i8x16_s", 157, "v128 v128", "v128"},
+	{"i16x8.extmul_low_i8x16_u", 158, "v128 v128", "v128"},
+	{"i16x8.extmul_high_i8x16_u", 159, "v128 v128", "v128"},
+	{"i32x4.abs", 160, "v128", "v128"},
+	{"i32x4.neg", 161, "v128", "v128"},
+	{"i32x4.all_true", 163, "v128", "i32"},
+	{"i32x4.bitmask", 164, "v128", "i32"},
+	{"i32x4.extend_low_i16x8_s", 167, "v128", "v128"},
+	{"i32x4.extend_high_i16x8_s", 168, "v128", "v128"},
+	{"i32x4.extend_low_i16x8_u", 169, "v128", "v128"},
+	{"i32x4.extend_high_i16x8_u", 170, "v128", "v128"},
+	{"i32x4.shl", 171, "v128 i32", "v128"},
+	{"i32x4.shr_s", 172, "v128 i32", "v128"},
+	{"i32x4.shr_u", 173, "v128 i32", "v128"},
+	{"i32x4.add", 174, "v128 v128", "v128"},
+	{"i32x4.sub", 177, "v128 v128", "v128"},
+	{"i32x4.mul", 181, "v128 v128", "v128"},
+	{"i32x4.min_s", 182, "v128 v128", "v128"},
+	{"i32x4.min_u", 183, "v128 v128", "v128"},
+	{"i32x4.max_s", 184, "v128 v128", "v128"},
+	{"i32x4.max_u", 185, "v128 v128", "v128"},
+	{"i32x4.dot_i16x8_s", 186, "v128 v128", "v128"},
+	{"i32x4.extmul_low_i16x8_s", 188, "v128 v128", "v128"},
+	{"i32x4.extmul_high_i16x8_s", 189, "v128 v128", "v128"},
+	{"i32x4.extmul_low_i16x8_u", 190, "v128 v128", "v128"},
+	{"i32x4.extmul_high_i16x8_u", 191, "v128 v128", "v128"},
+	{"i64x2.abs", 192, "v128", "v128"},
+	{"i64x2.neg", 193, "v128", "v128"},
+	{"i64x2.all_true", 195, "v128", "i32"},
+	{"i64x2.bitmask", 196, "v128", "i32"},
+	{"i64x2.extend_low_i32x4_s", 199, "v128", "v128"},
+	{"i64x2.extend_high_i32x4_s", 200, "v128", "v128"},
+	{"i64x2.extend_low_i32x4_u", 201, "v128", "v128"},
+	{"i64x2.extend_high_i32x4_u", 202, "v128", "v128"},
+	{"i64x2.shl", 203, "v128 i32", "v128"},
+	{"i64x2.shr_s", 204, "v128 i32", "v128"},
+	{"i64x2.shr_u", 205, "v128 i32", "v128"},
+	{"i64x2.add", 206, "v128 v128", "v128"},
+	{"i64x2.sub", 209, "v128 v128", "v128"},
+	{"i64x2.mul", 213, "v128 v128", "v128"},
+	{"i64x2.eq", 214, "v128 v128", "v128"},
+	{"i64x2.ne", 215, "v128 v128", "v128"},
+	{"i64x2.lt_s", 216, "v128 v128", "v128"},
+	{"i64x2.gt_s", 217, "v128 v128", "v128"},
+	{"i64x2.le_s", 218, "v128 v128", "v128"},
+	{"i64x2.ge_s", 219, "v128 v128", "v128"},
+	{"i64x2.extmul_low_i32x4_s", 220, "v128 v128", "v128"},
+	{"i64x2.extmul_high_i32x4_s", 221, "v128 v128", "v128"},
+	{"i64x2.extmul_low_i32x4_u", 222, "v128 v128", "v128"},
+	{"i64x2.extmul_high_i32x4_u", 223, "v128 v128", "v128"},
+	{"f32x4.abs", 224, "v128", "v128"},
+	{"f32x4.neg", 225, "v128", "v128"},
+	{"f32x4.sqrt", 227, "v128", "v128"},
+	{"f32x4.add", 228, "v128 v128", "v128"},
+	{"f32x4.sub", 229, "v128 v128", "v128"},
+	{"f32x4.mul", 230, "v128 v128", "v128"},
+	{"f32x4.div", 231, "v128 v128", "v128"},
+	{"f32x4.min", 232, "v128 v128", "v128"},
+	{"f32x4.max", 233, "v128 v128", "v128"},
+	{"f32x4.pmin", 234, "v128 v128", "v128"},
+	{"f32x4.pmax", 235, "v128 v128", "v128"},
+	{"f64x2.abs", 236, "v128", "v128"},
+	{"f64x2.neg", 237, "v128", "v128"},
+	{"f64x2.sqrt", 239, "v128", "v128"},
+	{"f64x2.add", 240, "v128 v128", "v128"},
+	{"f64x2.sub", 241, "v128 v128", "v128"},
+	{"f64x2.mul", 242, "v128 v128", "v128"},
+	{"f64x2.div", 243, "v128 v128", "v128"},
+	{"f64x2.min", 244, "v128 v128", "v128"},
+	{"f64x2.max", 245, "v128 v128", "v128"},
+	{"f64x2.pmin", 246, "v128 v128", "v128"},
+	{"f64x2.pmax", 247, "v128 v128", "v128"},
+	{"i32x4.trunc_sat_f32x4_s", 248, "v128", "v128"},
+	{"i32x4.trunc_sat_f32x4_u", 249, "v128", "v128"},
+	{"f32x4.convert_i32x4_s", 250, "v128", "v128"},
+	{"f32x4.convert_i32x4_u", 251, "v128", "v128"},
+	{"i32x4.trunc_sat_f64x2_s_zero", 252, "v128", "v128"},
+	{"i32x4.trunc_sat_f64x2_u_zero", 253, "v128", "v128"},
+	{"f64x2.convert_low_i32x4_s", 254, "v128", "v128"},
+	{"f64x2.convert_low_i32x4_u", 255, "v128", "v128"},
+}
+
+// Immediates of the SIMD instructions
+// - the lane of extract_lane, replace_lane and the *_lane memory instructions
+// - the 16 bytes of v128.const
+// - the 16 lanes picked by i8x16.shuffle (from the 32 of its two operands)
+var simdImmediates = map[string][]string{
+	"v128.load":            {texts.MemArg},
+	"v128.load8x8_s":       {texts.MemArg},
+	"v128.load8x8_u":       {texts.MemArg},
+	"v128.load16x4_s":      {texts.MemArg},
+	"v128.load16x4_u":      {texts.MemArg},
+	"v128.load32x2_s":      {texts.MemArg},
+	"v128.load32x2_u":      {texts.MemArg},
+	"v128.load8_splat":     {texts.MemArg},
+	"v128.load16_splat":    {texts.MemArg},
+	"v128.load32_splat":    {texts.MemArg},
+	"v128.load64_splat":    {texts.MemArg},
+	"v128.store":           {texts.MemArg},
+	"v128.const":           {texts.V128Const},
+	"i8x16.shuffle":        {texts.Shuffle},
+	"i8x16.extract_lane_s": {texts.LaneIdx},
+	"i8x16.extract_lane_u": {texts.LaneIdx},
+	"i8x16.replace_lane":   {texts.LaneIdx},
+	"i16x8.extract_lane_s": {texts.LaneIdx},
+	"i16x8.extract_lane_u": {texts.LaneIdx},
+	"i16x8.replace_lane":   {texts.LaneIdx},
+	"i32x4.extract_lane":   {texts.LaneIdx},
+	"i32x4.replace_lane":   {texts.LaneIdx},
+	"i64x2.extract_lane":   {texts.LaneIdx},
+	"i64x2.replace_lane":   {texts.LaneIdx},
+	"f32x4.extract_lane":   {texts.LaneIdx},
+	"f32x4.replace_lane":   {texts.LaneIdx},
+	"f64x2.extract_lane":   {texts.LaneIdx},
+	"f64x2.replace_lane":   {texts.LaneIdx},
+	"v128.load8_lane":      {texts.MemArg, texts.LaneIdx},
+	"v128.load16_lane":     {texts.MemArg, texts.LaneIdx},
+	"v128.load32_lane":     {texts.MemArg, texts.LaneIdx},
+	"v128.load64_lane":     {texts.MemArg, texts.LaneIdx},
+	"v128.store8_lane":     {texts.MemArg, texts.LaneIdx},
+	"v128.store16_lane":    {texts.MemArg, texts.LaneIdx},
+	"v128.store32_lane":    {texts.MemArg, texts.LaneIdx},
+	"v128.store64_lane":    {texts.MemArg, texts.LaneIdx},
+	"v128.load32_zero":     {texts.MemArg},
+	"v128.load64_zero":     {texts.MemArg},
+}
+
+// Natural alignment of the SIMD memory instructions
+var simdAlignment = map[string]uint32{
+	"v128.load":         4,
+	"v128.load8x8_s":    3,
+	"v128.load8x8_u":    3,
+	"v128.load16x4_s":   3,
+	"v128.load16x4_u":   3,
+	"v128.load32x2_s":   3,
+	"v128.load32x2_u":   3,
+	"v128.load8_splat":  0,
+	"v128.load16_splat": 1,
+	"v128.load32_splat": 2,
+	"v128.load64_splat": 3,
+	"v128.store":        4,
+	"v128.load8_lane":   0,
+	"v128.load16_lane":  1,
+	"v128.load32_lane":  2,
+	"v128.load64_lane":  3,
+	"v128.store8_lane":  0,
+	"v128.store16_lane": 1,
+	"v128.store32_lane": 2,
+	"v128.store64_lane": 3,
+	"v128.load32_zero":  2,
+	"v128.load64_zero":  3,
+}
+
+// The SIMD instructions go in the same tables as the other ones
+func init() {
+	for _, instruction := range simdInstructions {
+		PrefixedOpcodes[instruction.name] = [2]int{PrefixSIMD, instruction.opcode}
+		Operands[instruction.name] = [2]string{instruction.params, instruction.results}
+	}
+	for name, immediates := range simdImmediates {
+		Immediates[name] = immediates
+	}
+	for name, alignment := range simdAlignment {
+		Alignment[name] = alignment
+	}
+}
@@ -0,0 +1,541 @@
+package formatter
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Converting between flat and folded instructions is always safe:
+// a folded instruction (op a b) is nothing more than a shortcut for a b op
+// See https://webassembly.github.io/spec/core/text/instructions.html#folded-instructions
+//
+// So flattening simply emits the operands first and then the operator (post-order).
+// Folding does the opposite, every instruction takes as operands the instructions right before it,
+// as long as each of them leaves exactly one value on the stack.
+// Knowing how many values an instruction pops and pushes (its arity) only makes the result nicer,
+// a wrong guess never changes the meaning of the program.
+
+func convert(root *node, fold bool) {
+	for _, item := range root.children {
+		switch item.head() {
+		case "module":
+			convert(item, fold)
+		case "func":
+			convertFunc(item, newModuleInfo(root), fold)
+		}
+	}
+}
+
+func convertFunc(fn *node, module *moduleInfo, fold bool) {
+	start := header(fn)
+	// Locals are declared before the instructions
+	for start < len(fn.children) && fn.children[start].head() == "local" {
+		start++
+	}
+
+	body := flatten(fn.children[start:])
+	if fold {
+		f := &folder{module: module, labels: []label{{results: signatureOf(fn, module).results}}}
+		body, _ = f.fold(body, 0)
+	}
+
+	fn.children = append(fn.children[:start:start], body...)
+}
+
+// Flatten
+
+func flatten(items []*node) []*node {
+	out := []*node{}
+	for _, item := range items {
+		out = append(out, flattenNode(item)...)
+	}
+	return out
+}
+
+func flattenNode(n *node) []*node {
+	if !n.isList || !isInstruction(n.head()) {
+		return []*node{n}
+	}
+
+	out := []*node{}
+	end := &node{text: "end"}
+	start := header(n)
+
+	switch n.head() {
+	// (block $label (result i32) instructions) -> block $label (result i32) instructions end
+	case "block", "loop", "try_table":
+		out = append(out, n.children[:start]...)
+		out = append(out, flatten(n.children[start:])...)
+		out = append(out, end)
+
+	// (if (result i32) condition (then instructions) (else instructions))
+	// -> condition if (result i32) instructions else instructions end
+	case "if":
+		clauses := []*node{}
+		for _, child := range n.children[start:] {
+			if child.head() == "then" || child.head() == "else" {
+				clauses = append(clauses, child)
+				continue
+			}
+			out = append(out, flattenNode(child)...)
+		}
+		out = append(out, n.children[:start]...)
+
+		for _, clause := range clauses {
+			if clause.head() == "else" {
+				out = append(out, &node{text: "else", leading: clause.leading})
+			}
+			out = append(out, flatten(clause.children[1:])...)
+		}
+		out = append(out, end)
+
+	// legacy exceptions (try (do instructions) (catch $tag instructions) (catch_all instructions))
+	case "try":
+		out = append(out, n.children[:start]...)
+		for _, clause := range n.children[start:] {
+			switch clause.head() {
+			case "do":
+				out = append(out, flatten(clause.children[1:])...)
+			case "catch", "catch_all":
+				out = append(out, clause.children[0])
+				clauseStart := header(clause)
+				out = append(out, clause.children[1:clauseStart]...)
+				out = append(out, flatten(clause.children[clauseStart:])...)
+			case "delegate":
+				// delegate replaces the end
+				out = append(out, clause.children...)
+				end = nil
+			}
+		}
+		if end != nil {
+			out = append(out, end)
+		}
+
+	// (i32.add (local.get 0) (local.get 1)) -> local.get 0 local.get 1 i32.add
+	default:
+		out = append(out, flatten(n.children[start:])...)
+		out = append(out, n.children[:start]...)
+	}
+
+	// Comments and empty lines go with the first (or last) emitted instruction
+	first := out[0]
+	first.leading = append(n.leading, first.leading...)
+	first.blank = first.blank || n.blank
+	last := out[len(out)-1]
+	last.leading = append(last.leading, n.inner...)
+	last.trailing = append(last.trailing, n.trailing...)
+
+	return out
+}
+
+// Fold
+
+type label struct {
+	name    string
+	results int
+}
+
+type folder struct {
+	module *moduleInfo
+	// labels of the enclosing blocks, the innermost is the last one
+	labels []label
+}
+
+// fold folds a flat sequence of instructions until it reaches the end of the current block
+// It returns the folded instructions and the position where it stopped
+func (f *folder) fold(items []*node, pos int) ([]*node, int) {
+	out := []*node{}
+	// values pushed by each folded instruction (-1 if unknown)
+	pushes := []int{}
+
+	for pos < len(items) {
+		item := items[pos]
+		if item.isList || !isInstruction(item.text) {
+			out = append(out, item)
+			pushes = append(pushes, -1)
+			pos++
+			continue
+		}
+
+		switch item.text {
+		case "end", "else", "catch", "catch_all", "delegate":
+			return out, pos
+		}
+
+		group := []*node{item}
+		for pos+1 < len(items) && isImmediate(items[pos+1]) {
+			pos++
+			group = append(group, items[pos])
+		}
+		pos++
+
+		folded := &node{isList: true, children: group, leading: item.leading, blank: item.blank}
+		item.leading = nil
+		item.blank = false
+
+		pops, results := 0, -1
+		switch item.text {
+		case "block", "loop", "try_table", "if", "try":
+			results = blockResults(group, f.module)
+			pos = f.foldBlock(folded, items, pos, results)
+			if item.text == "if" {
+				pops = 1
+			}
+		default:
+			pops, results = f.arity(group)
+		}
+
+		// Take the operands from the instructions right before
+		operands := 0
+		for operands < pops && operands < len(out) && pushes[len(out)-1-operands] == 1 {
+			operands++
+		}
+		if operands > 0 {
+			start := len(out) - operands
+			// operands go after the immediates (but before the then/else clauses)
+			children := append([]*node{}, folded.children[:len(group)]...)
+			children = append(children, out[start:]...)
+			children = append(children, folded.children[len(group):]...)
+			folded.children = children
+
+			out = out[:start]
+			pushes = pushes[:start]
+		}
+
+		out = append(out, folded)
+		pushes = append(pushes, results)
+	}
+
+	return out, pos
+}
+
+// foldBlock folds the body of a block, loop, if or try
+// and skips its end, it returns the position after the end
+func (f *folder) foldBlock(folded *node, items []*node, pos int, results int) int {
+	name := ""
+	if len(folded.children) > 1 && strings.HasPrefix(folded.children[1].text, "$") {
+		name = folded.children[1].text
+	}
+	f.labels = append(f.labels, label{name: name, results: results})
+	defer func() { f.labels = f.labels[:len(f.labels)-1] }()
+
+	keyword := folded.children[0].text
+	clause := &node{isList: true, children: []*node{{text: "then"}}}
+	if keyword == "try" {
+		clause.children[0].text = "do"
+	}
+
+	for {
+		body, next := f.fold(items, pos)
+		pos = next
+
+		if keyword == "block" || keyword == "loop" || keyword == "try_table" {
+			folded.children = append(folded.children, body...)
+		} else {
+			clause.children = append(clause.children, body...)
+			folded.children = append(folded.children, clause)
+		}
+
+		if pos >= len(items) {
+			return pos
+		}
+
+		// else, catch, catch_all start a new clause, end closes the block
+		closing := items[pos]
+		pos++
+		switch closing.text {
+		case "else", "catch", "catch_all":
+			clause = &node{isList: true, children: []*node{{text: closing.text}}, leading: closing.leading}
+			for pos < len(items) && isImmediate(items[pos]) {
+				clause.children = append(clause.children, items[pos])
+				pos++
+			}
+			continue
+		case "delegate":
+			delegate := &node{isList: true, children: []*node{closing}}
+			for pos < len(items) && isImmediate(items[pos]) {
+				delegate.children = append(delegate.children, items[pos])
+				pos++
+			}
+			folded.children = append(folded.children, delegate)
+			return pos
+		}
+
+		// end (and its optional label)
+		folded.inner = append(folded.inner, closing.leading...)
+		folded.trailing = append(folded.trailing, closing.trailing...)
+		for pos < len(items) && !items[pos].isList && strings.HasPrefix(items[pos].text, "$") {
+			folded.trailing = append(folded.trailing, items[pos].trailing...)
+			pos++
+		}
+		return pos
+	}
+}
+
+// Number of values a block leaves on the stack
+// -1 if it is unknown (e.g. the block has parameters)
+func blockResults(group []*node, module *moduleInfo) int {
+	sig := signature{}
+	for _, n := range group[1:] {
+		if n.isList {
+			sig = sig.add(n, module)
+		}
+	}
+	if sig.params != 0 {
+		return -1
+	}
+	return sig.results
+}
+
+// arity returns how many values an instruction pops and pushes
+// -1 pushes if it is unknown
+func (f *folder) arity(group []*node) (int, int) {
+	name := group[0].text
+	immediates := group[1:]
+
+	switch name {
+	case "nop", "unreachable", "atomic.fence", "data.drop", "elem.drop":
+		return 0, 0
+	case "drop", "local.set", "global.set":
+		return 1, 0
+	case "local.tee":
+		return 1, 1
+	case "select":
+		return 3, 1
+	case "local.get", "global.get", "memory.size", "table.size", "ref.null", "ref.func":
+		return 0, 1
+	case "memory.grow", "table.get", "ref.is_null", "ref.as_non_null", "ref.i31", "i31.get_s", "i31.get_u":
+		return 1, 1
+	case "table.set":
+		return 2, 0
+	case "table.grow", "ref.eq":
+		return 2, 1
+	case "memory.fill", "memory.copy", "memory.init", "table.fill", "table.copy", "table.init":
+		return 3, 0
+	case "return":
+		return f.labels[0].results, 0
+	case "br":
+		return f.labelResults(immediates), 0
+	case "br_if":
+		results := f.labelResults(immediates)
+		return results + 1, results
+	case "br_table":
+		// the default label is the last one, without labels the arity is unknown
+		if len(immediates) == 0 {
+			return 0, -1
+		}
+		return f.labelResults(immediates[len(immediates)-1:]) + 1, 0
+	case "call", "return_call":
+		if len(immediates) == 0 {
+			return 0, -1
+		}
+		sig, ok := f.module.funcs[immediates[0].text]
+		if !ok {
+			return 0, -1
+		}
+		if name == "return_call" {
+			return sig.params, 0
+		}
+		return sig.params, sig.results
+	case "call_indirect", "return_call_indirect":
+		sig := signature{}
+		for _, n := range immediates {
+			if n.isList {
+				sig = sig.add(n, f.module)
+			}
+		}
+		if name == "return_call_indirect" {
+			return sig.params + 1, 0
+		}
+		return sig.params + 1, sig.results
+	}
+
+	// Numeric instructions are named type.operation (e.g. i32.add)
+	dot := strings.Index(name, ".")
+	if dot == -1 {
+		return 0, -1
+	}
+	operation := name[dot+1:]
+
+	switch {
+	case operation == "const":
+		return 0, 1
+	case strings.Contains(operation, "load"):
+		if strings.HasSuffix(operation, "_lane") {
+			return 2, 1
+		}
+		return 1, 1
+	case strings.Contains(operation, "store"):
+		return 2, 0
+	case strings.Contains(operation, "cmpxchg"), strings.HasPrefix(operation, "atomic.wait"):
+		return 3, 1
+	case strings.HasPrefix(operation, "atomic.rmw"), operation == "atomic.notify":
+		return 2, 1
+	case operation == "bitselect":
+		return 3, 1
+	case strings.HasPrefix(operation, "replace_lane"), operation == "shuffle", operation == "swizzle":
+		return 2, 1
+	}
+
+	// Strip the signedness (e.g. div_s -> div)
+	operation = strings.TrimSuffix(strings.TrimSuffix(operation, "_s"), "_u")
+
+	switch operation {
+	case "add", "sub", "mul", "div", "rem", "and", "or", "xor", "andnot", "shl", "shr", "rotl", "rotr",
+		"min", "max", "pmin", "pmax", "copysign", "eq", "ne", "lt", "gt", "le", "ge",
+		"add_sat", "sub_sat", "avgr", "q15mulr_sat", "narrow_i16x8", "narrow_i32x4", "dot_i16x8":
+		return 2, 1
+	case "clz", "ctz", "popcnt", "abs", "neg", "sqrt", "ceil", "floor", "trunc", "nearest", "eqz",
+		"not", "any_true", "all_true", "bitmask", "splat", "extract_lane":
+		return 1, 1
+	}
+
+	// Conversions (e.g. i32.wrap_i64, f32.convert_i32_s, i32.extend8_s)
+	if strings.HasPrefix(operation, "wrap") || strings.HasPrefix(operation, "extend") ||
+		strings.HasPrefix(operation, "trunc") || strings.HasPrefix(operation, "convert") ||
+		strings.HasPrefix(operation, "demote") || strings.HasPrefix(operation, "promote") ||
+		strings.HasPrefix(operation, "reinterpret") {
+		return 1, 1
+	}
+
+	return 0, -1
+}
+
+// Results of the label a branch targets, by name ($label) or by depth (0 is the innermost)
+func (f *folder) labelResults(immediates []*node) int {
+	if len(immediates) == 0 || immediates[0].isList {
+		return 0
+	}
+	target := immediates[0].text
+
+	for i := len(f.labels) - 1; i >= 0; i-- {
+		depth := strconv.Itoa(len(f.labels) - 1 - i)
+		if target == depth || (target == f.labels[i].name && target != "") {
+			// loops branch to their beginning, that is another story,
+			// but an unknown arity is always safe
+			return max0(f.labels[i].results)
+		}
+	}
+	return 0
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Signatures of the functions and types of a module,
+// used to know the arity of calls
+
+type signature struct {
+	params  int
+	results int
+}
+
+// add counts the params and results of a (param ...), (result ...) or (type $t) list
+func (s signature) add(n *node, module *moduleInfo) signature {
+	switch n.head() {
+	case "param":
+		// (param $name i32) declares only one param
+		if len(n.children) > 1 && strings.HasPrefix(n.children[1].text, "$") {
+			s.params++
+		} else {
+			s.params += len(n.children) - 1
+		}
+	case "result":
+		s.results += len(n.children) - 1
+	case "type":
+		if len(n.children) > 1 {
+			if sig, ok := module.types[n.children[1].text]; ok {
+				s.params += sig.params
+				s.results += sig.results
+			}
+		}
+	}
+	return s
+}
+
+type moduleInfo struct {
+	types map[string]signature
+	funcs map[string]signature
+}
+
+func newModuleInfo(root *node) *moduleInfo {
+	module := &moduleInfo{types: map[string]signature{}, funcs: map[string]signature{}}
+	fields := root.children
+	if len(fields) == 1 && fields[0].head() == "module" {
+		fields = fields[0].children[1:]
+	}
+
+	types := 0
+	funcs := 0
+	for _, field := range fields {
+		switch field.head() {
+		case "type":
+			sig := signature{}
+			name := ""
+			for _, child := range field.children[1:] {
+				if child.head() == "func" {
+					sig = signatureOf(child, module)
+				} else if !child.isList {
+					name = child.text
+				}
+			}
+			module.types[strconv.Itoa(types)] = sig
+			if name != "" {
+				module.types[name] = sig
+			}
+			types++
+
+		case "import", "func":
+			fn := field
+			if field.head() == "import" {
+				fn = nil
+				for _, child := range field.children {
+					if child.head() == "func" {
+						fn = child
+					}
+				}
+				if fn == nil {
+					continue
+				}
+			}
+			sig := signatureOf(fn, module)
+			module.funcs[strconv.Itoa(funcs)] = sig
+			if len(fn.children) > 1 && strings.HasPrefix(fn.children[1].text, "$") {
+				module.funcs[fn.children[1].text] = sig
+			}
+			funcs++
+		}
+	}
+
+	return module
+}
+
+func signatureOf(fn *node, module *moduleInfo) signature {
+	sig := signature{}
+	typeUse := signature{}
+	hasInline := false
+
+	for _, child := range fn.children[1:] {
+		// The signature ends where the instructions begin,
+		// the (result ...) of a flat block (if (result i32) ...) is not a result of the function
+		if isInstruction(child.head()) || (!child.isList && isInstruction(child.text)) {
+			break
+		}
+		switch child.head() {
+		case "param", "result":
+			sig = sig.add(child, module)
+			hasInline = true
+		case "type":
+			typeUse = typeUse.add(child, module)
+		}
+	}
+
+	if hasInline {
+		return sig
+	}
+	return typeUse
+}
@@ -0,0 +1,309 @@
+package formatter
+
+import (
+	"errors"
+	"strings"
+)
+
+// Luna's formatter (lunafmt) re-emits WebAssembly Text Format in a canonical way:
+// - every module field on its own line
+// - one instruction per line, indented by nesting depth
+// - single spaces between the elements of a line
+// - comments are kept where they were (own line or end of line)
+// - at most one empty line between two elements
+//
+// Optionally it converts the instructions between the flat (stack machine) form
+//
+//	local.get 0
+//	local.get 1
+//	i32.add
+//
+// and the folded (S-expression) form
+//
+//	(i32.add
+//	  (local.get 0)
+//	  (local.get 1))
+//
+// See https://webassembly.github.io/spec/core/text/instructions.html#folded-instructions
+
+type Options struct {
+	// Indentation unit, two spaces if empty
+	Indent string
+	// Convert flat instructions into folded ones
+	Fold bool
+	// Convert folded instructions into flat ones
+	Flatten bool
+}
+
+func Format(input string, options Options) (string, error) {
+	if options.Fold && options.Flatten {
+		return "", errors.New("cannot fold and flatten at the same time")
+	}
+	if options.Indent == "" {
+		options.Indent = "  "
+	}
+
+	root, err := parse(input)
+	if err != nil {
+		return "", err
+	}
+
+	if options.Fold || options.Flatten {
+		convert(root, options.Fold)
+	}
+
+	p := &printer{}
+	p.printItems(root.children, 0, false)
+	for _, comment := range root.inner {
+		p.line(0, comment)
+	}
+
+	return p.String(options.Indent), nil
+}
+
+// Check reports whether the input is already formatted
+// (useful for pre-commit hooks)
+func Check(input string, options Options) (bool, error) {
+	formatted, err := Format(input, options)
+	if err != nil {
+		return false, err
+	}
+	return formatted == input, nil
+}
+
+type line struct {
+	indent   int
+	text     string
+	comments []string
+	// the line is an empty separator
+	empty bool
+}
+
+type printer struct {
+	lines []line
+}
+
+func (p *printer) line(indent int, text string, comments ...string) {
+	p.lines = append(p.lines, line{indent: indent, text: text, comments: comments})
+}
+
+func (p *printer) empty() {
+	if len(p.lines) > 0 && !p.lines[len(p.lines)-1].empty {
+		p.lines = append(p.lines, line{empty: true})
+	}
+}
+
+// Append text (e.g. a closing paren) to the last line printed
+func (p *printer) appendLast(text string, comments ...string) {
+	last := &p.lines[len(p.lines)-1]
+	last.text += text
+	last.comments = append(last.comments, comments...)
+}
+
+func (p *printer) String(indent string) string {
+	var builder strings.Builder
+
+	for _, l := range p.lines {
+		if !l.empty {
+			builder.WriteString(strings.Repeat(indent, l.indent))
+			builder.WriteString(l.text)
+			for _, comment := range l.comments {
+				builder.WriteString(" ")
+				builder.WriteString(comment)
+			}
+		}
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// printItems prints the elements of a module (or of a function body)
+// each one on its own line.
+// Flat instructions are grouped together with their immediates,
+// block instructions (block, loop, if...) indent what comes next until their end.
+func (p *printer) printItems(items []*node, depth int, isBody bool) {
+	level := depth
+
+	for i := 0; i < len(items); i++ {
+		item := items[i]
+
+		if item.blank && i > 0 {
+			p.empty()
+		}
+
+		if item.isList || !isBody || !isInstruction(item.text) {
+			p.printNode(item, level)
+			continue
+		}
+
+		// Flat instruction: the keyword and its immediates go on the same line
+		group := []*node{item}
+		for i+1 < len(items) && isImmediate(items[i+1]) {
+			i++
+			group = append(group, items[i])
+		}
+
+		indent := level
+		switch item.text {
+		case "block", "loop", "if", "try", "try_table":
+			level++
+		case "else", "catch", "catch_all":
+			if level > depth {
+				indent = level - 1
+			}
+		case "end", "delegate":
+			if level > depth {
+				level--
+			}
+			indent = level
+		}
+
+		texts := []string{}
+		comments := []string{}
+		for _, n := range group {
+			texts = append(texts, inline(n))
+			comments = append(comments, trailing(n)...)
+		}
+		p.comments(item.leading, indent)
+		p.line(indent, strings.Join(texts, " "), comments...)
+	}
+}
+
+func (p *printer) comments(comments []string, depth int) {
+	for _, comment := range comments {
+		p.line(depth, comment)
+	}
+}
+
+func (p *printer) printNode(n *node, depth int) {
+	p.comments(n.leading, depth)
+
+	if !n.isList {
+		p.line(depth, n.text, n.trailing...)
+		return
+	}
+
+	headerEnd := header(n)
+	if headerEnd == len(n.children) && !n.hasComments() {
+		p.line(depth, inline(n), trailing(n)...)
+		return
+	}
+
+	// The header (keyword, ids, inline exports, params...) is printed on the first line
+	texts := []string{}
+	comments := []string{}
+	for _, child := range n.children[:headerEnd] {
+		texts = append(texts, inline(child))
+		comments = append(comments, trailing(child)...)
+	}
+	p.line(depth, "("+strings.Join(texts, " "), comments...)
+
+	// the rest, one line each
+	p.printItems(n.children[headerEnd:], depth+1, true)
+
+	if len(n.inner) > 0 {
+		p.comments(n.inner, depth+1)
+		p.line(depth, ")", n.trailing...)
+		return
+	}
+	p.appendLast(")", n.trailing...)
+}
+
+// header returns the number of children of a list that stay on the first line
+func header(n *node) int {
+	hasBody := false
+	switch n.head() {
+	case "module", "func", "rec",
+		"block", "loop", "if", "then", "else", "try", "try_table", "do", "catch", "catch_all":
+		hasBody = true
+	default:
+		// Folded instructions keep their immediates on the first line,
+		// their operands go on the next ones
+		hasBody = isInstruction(n.head())
+	}
+
+	for i, child := range n.children {
+		if i == 0 {
+			continue
+		}
+		// (module $name? fields*) every field is on its own line, even (type ...) and (import ...)
+		// and so is every type of (rec ...)
+		if (n.head() == "module" || n.head() == "rec") && child.isList {
+			return i
+		}
+		if len(child.leading) > 0 {
+			return i
+		}
+		if !hasBody {
+			continue
+		}
+		if child.isList && !isHeaderList(child) {
+			return i
+		}
+		if !child.isList && isInstruction(child.text) {
+			return i
+		}
+	}
+	return len(n.children)
+}
+
+// Lists that annotate the list they belong to
+// e.g. (func (export "add") (param i32) (result i32))
+// or block types (block (result i32))
+func isHeaderList(n *node) bool {
+	switch n.head() {
+	case "export", "import", "type", "param", "result", "ref",
+		"catch", "catch_ref", "catch_all", "catch_all_ref":
+		return true
+	}
+	return false
+}
+
+func isImmediate(n *node) bool {
+	if len(n.leading) > 0 || n.blank {
+		return false
+	}
+	if n.isList {
+		return isHeaderList(n)
+	}
+	return !isInstruction(n.text)
+}
+
+func inline(n *node) string {
+	if !n.isList {
+		return n.text
+	}
+
+	texts := []string{}
+	for _, child := range n.children {
+		texts = append(texts, inline(child))
+	}
+	return "(" + strings.Join(texts, " ") + ")"
+}
+
+// trailing collects all the end of line comments of a node (and of its children)
+func trailing(n *node) []string {
+	comments := []string{}
+	for _, child := range n.children {
+		comments = append(comments, trailing(child)...)
+	}
+	return append(comments, n.trailing...)
+}
+
+// Instructions that are plain words, all the others have a dot (e.g. i32.add)
+var plainInstructions = map[string]bool{
+	"unreachable": true, "nop": true, "block": true, "loop": true, "if": true, "else": true, "end": true,
+	"br": true, "br_if": true, "br_table": true, "return": true, "call": true, "call_indirect": true,
+	"return_call": true, "return_call_indirect": true, "call_ref": true, "return_call_ref": true,
+	"drop": true, "select": true, "throw": true, "throw_ref": true, "rethrow": true,
+	"try": true, "try_table": true, "catch": true, "catch_all": true, "delegate": true,
+	"br_on_null": true, "br_on_non_null": true, "br_on_cast": true, "br_on_cast_fail": true,
+}
+
+func isInstruction(text string) bool {
+	if text == "" || text[0] < 'a' || text[0] > 'z' {
+		return false
+	}
+	return plainInstructions[text] || (strings.Contains(text, ".") && !strings.Contains(text, "="))
+}
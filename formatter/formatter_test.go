@@ -0,0 +1,200 @@
+package formatter
+
+import (
+	"strings"
+	"testing"
+)
+
+// The inputs of the golden tests: every one is formatted to the same output, whatever its layout
+var samples = map[string]string{
+	"factorial": `(module (func $fac (export "fac") (param i64) (result i64)
+  local.get 0 i64.eqz
+  if (result i64)   i64.const 1
+  else local.get 0 local.get 0 i64.const 1 i64.sub call $fac i64.mul end)
+
+
+  (func (param i32) (result i32) block $b local.get 0 br_table 0 $b end i32.const 7))
+`,
+	"comments": `;; the counter
+(module
+  (global $n (mut i32) (i32.const 0)) ;; how many times
+  (func $inc (export "inc") (result i32)
+    (; add one ;)
+    global.get $n i32.const 1 i32.add global.set $n
+    global.get $n))
+`,
+}
+
+var golden = []struct {
+	sample  string
+	options Options
+	want    string
+}{
+	{"factorial", Options{}, `(module
+  (func $fac (export "fac") (param i64) (result i64)
+    local.get 0
+    i64.eqz
+    if (result i64)
+      i64.const 1
+    else
+      local.get 0
+      local.get 0
+      i64.const 1
+      i64.sub
+      call $fac
+      i64.mul
+    end)
+
+  (func (param i32) (result i32)
+    block $b
+      local.get 0
+      br_table 0 $b
+    end
+    i32.const 7))
+`},
+	// the (result i64) of the flat if is not a result of $fac, its call is folded
+	{"factorial", Options{Fold: true}, `(module
+  (func $fac (export "fac") (param i64) (result i64)
+    (if (result i64)
+      (i64.eqz
+        (local.get 0))
+      (then
+        (i64.const 1))
+      (else
+        (i64.mul
+          (local.get 0)
+          (call $fac
+            (i64.sub
+              (local.get 0)
+              (i64.const 1)))))))
+
+  (func (param i32) (result i32)
+    (block $b
+      (br_table 0 $b
+        (local.get 0)))
+    (i32.const 7)))
+`},
+	// the comments stay where they were: on their own line or at the end of a line
+	{"comments", Options{}, `;; the counter
+(module
+  (global $n (mut i32) (i32.const 0)) ;; how many times
+  (func $inc (export "inc") (result i32)
+    (; add one ;)
+    global.get $n
+    i32.const 1
+    i32.add
+    global.set $n
+    global.get $n))
+`},
+	{"comments", Options{Fold: true, Indent: "\t"}, `;; the counter
+(module
+	(global $n (mut i32) (i32.const 0)) ;; how many times
+	(func $inc (export "inc") (result i32)
+		(global.set $n
+			(i32.add
+				(; add one ;)
+				(global.get $n)
+				(i32.const 1)))
+		(global.get $n)))
+`},
+}
+
+func TestFormatGolden(t *testing.T) {
+	for _, test := range golden {
+		got, err := Format(samples[test.sample], test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s %+v:\n got:\n%s\nwant:\n%s", test.sample, test.options, got, test.want)
+		}
+	}
+}
+
+// Formatting a formatted module changes nothing
+func TestFormatIdempotent(t *testing.T) {
+	for name, sample := range samples {
+		for _, options := range []Options{{}, {Fold: true}, {Flatten: true}} {
+			once, err := Format(sample, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			twice, _ := Format(once, options)
+			if twice != once {
+				t.Errorf("%s %+v: formatted again:\n%s\nwas:\n%s", name, options, twice, once)
+			}
+			if formatted, _ := Check(once, options); !formatted {
+				t.Errorf("%s %+v: Check reports a formatted module", name, options)
+			}
+		}
+		if formatted, _ := Check(sample, Options{}); formatted {
+			t.Errorf("%s: Check does not report a module that is not formatted", name)
+		}
+	}
+}
+
+// -fold then -flat gives back the flat module, -flat then -fold the folded one
+func TestFormatRoundTrip(t *testing.T) {
+	for name, sample := range samples {
+		flat, _ := Format(sample, Options{})
+		folded, _ := Format(sample, Options{Fold: true})
+
+		if got, _ := Format(folded, Options{Flatten: true}); got != flat {
+			t.Errorf("%s: folded and flattened:\n%s\nwant:\n%s", name, got, flat)
+		}
+		if got, _ := Format(flat, Options{Fold: true}); got != folded {
+			t.Errorf("%s: flattened and folded:\n%s\nwant:\n%s", name, got, folded)
+		}
+		// no comment is lost on the way
+		for _, comment := range []string{";; the counter", ";; how many times", "(; add one ;)"} {
+			if strings.Contains(sample, comment) && (!strings.Contains(flat, comment) || !strings.Contains(folded, comment)) {
+				t.Errorf("%s: lost the comment %s", name, comment)
+			}
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	if _, err := Format("(module)", Options{Fold: true, Flatten: true}); err == nil {
+		t.Error("-fold and -flat: expected an error")
+	}
+	for _, input := range []string{"(module", "(module))", `(module (data "abc))`, "(module (; never closed)"} {
+		if _, err := Format(input, Options{}); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+// Malformed input is formatted (or reported) without panicking, the formatter runs in pre-commit hooks
+func TestFormatMalformed(t *testing.T) {
+	inputs := []string{
+		"(module (func i32.const 0 br_table))",
+		"(module (func br_table))",
+		"(module (func br))",
+		"(module (func br_if))",
+		"(module (func call))",
+		"(module (func call_indirect))",
+		"(module (func return))",
+		"(module (func (block i32.const 0 br_table)))",
+		"(module (func end))",
+		"(module (func block))",
+		"(module (func if else))",
+		"(module (func (i32.add))",
+		"(module (func)))",
+		"(",
+		")",
+		"",
+	}
+	for _, input := range inputs {
+		for _, options := range []Options{{}, {Fold: true}, {Flatten: true}} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%q (%+v): panic: %v", input, options, r)
+					}
+				}()
+				Format(input, options)
+			}()
+		}
+	}
+}
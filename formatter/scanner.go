@@ -0,0 +1,248 @@
+package formatter
+
+import (
+	"errors"
+	"strings"
+)
+
+// The formatter does not need to understand WebAssembly, it only needs to understand
+// S-expressions (https://en.wikipedia.org/wiki/S-expression).
+// A .wat file is just a list of lists, where every list starts with a keyword
+// (module, func, param, i32.add...) followed by atoms (ids, numbers, strings) and other lists.
+
+// node is either an atom (e.g. $x, 42, "addNumbers", i32.add) or a list (everything between parens)
+// Comments are not nodes: they travel together with the node they belong to,
+// so they survive any rearrangement of the tree.
+type node struct {
+	text     string
+	isList   bool
+	children []*node
+
+	// comments on their own line(s) right before the node
+	leading []string
+	// comments following the node on the same line
+	trailing []string
+	// comments right before the closing paren of a list
+	inner []string
+	// the node was preceded by (at least) one empty line
+	blank bool
+}
+
+// head returns the keyword a list starts with (e.g. "func" for (func ...))
+func (n *node) head() string {
+	if !n.isList || len(n.children) == 0 || n.children[0].isList {
+		return ""
+	}
+	return n.children[0].text
+}
+
+// hasComments reports whether there are comments inside a list
+func (n *node) hasComments() bool {
+	if len(n.inner) > 0 {
+		return true
+	}
+	for _, child := range n.children {
+		if len(child.leading) > 0 || len(child.trailing) > 0 || child.hasComments() {
+			return true
+		}
+	}
+	return false
+}
+
+type scanner struct {
+	input string
+	pos   int
+	// newlines seen since the last token (or comment)
+	newlines int
+	blank    bool
+	// comments waiting for the next node
+	pending []string
+	// last completed node, same line comments are attached to it
+	last *node
+}
+
+var (
+	errUnbalanced       = errors.New("unbalanced parentheses")
+	errUnterminatedStr  = errors.New("unterminated string")
+	errUnterminatedComm = errors.New("unterminated block comment")
+)
+
+// parse builds the tree of nodes of the input.
+// The returned root is a "virtual" list (it has no parens) holding the top level nodes.
+func parse(input string) (*node, error) {
+	s := &scanner{input: input}
+	root := &node{isList: true}
+
+	if err := s.parseList(root, true); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (s *scanner) parseList(list *node, isRoot bool) error {
+	for {
+		s.skipWhitespace()
+
+		if s.pos >= len(s.input) {
+			if !isRoot {
+				return errUnbalanced
+			}
+			list.inner = s.pending
+			s.pending = nil
+			return nil
+		}
+
+		switch {
+		// Line comment ;; ... until the end of the line
+		// See https://webassembly.github.io/spec/core/text/lexical.html#comments
+		case strings.HasPrefix(s.input[s.pos:], ";;"):
+			end := strings.IndexByte(s.input[s.pos:], '\n')
+			if end == -1 {
+				end = len(s.input) - s.pos
+			}
+			s.comment(strings.TrimRight(s.input[s.pos:s.pos+end], " \t\r"))
+			s.pos += end
+
+		// Block comment (; ... ;) they can be nested
+		case strings.HasPrefix(s.input[s.pos:], "(;"):
+			start := s.pos
+			if err := s.skipBlockComment(); err != nil {
+				return err
+			}
+			s.comment(s.input[start:s.pos])
+
+		case s.input[s.pos] == '(':
+			child := &node{isList: true}
+			s.attach(list, child)
+			s.pos++
+			s.last = nil
+
+			if err := s.parseList(child, false); err != nil {
+				return err
+			}
+			s.last = child
+
+		case s.input[s.pos] == ')':
+			if isRoot {
+				return errUnbalanced
+			}
+			list.inner = s.pending
+			s.pending = nil
+			s.pos++
+			s.newlines = 0
+			s.blank = false
+			return nil
+
+		case s.input[s.pos] == '"':
+			start := s.pos
+			if err := s.skipString(); err != nil {
+				return err
+			}
+			s.atom(list, s.input[start:s.pos])
+
+		default:
+			start := s.pos
+			for s.pos < len(s.input) && !isDelimiter(s.input, s.pos) {
+				s.pos++
+			}
+			// a lonely ';' that does not start a comment
+			if s.pos == start {
+				s.pos++
+			}
+			s.atom(list, s.input[start:s.pos])
+		}
+	}
+}
+
+func isDelimiter(input string, pos int) bool {
+	switch input[pos] {
+	case ' ', '\t', '\n', '\r', '(', ')', '"':
+		return true
+	case ';':
+		return strings.HasPrefix(input[pos:], ";;")
+	}
+	return false
+}
+
+func (s *scanner) skipWhitespace() {
+	for s.pos < len(s.input) {
+		switch s.input[s.pos] {
+		case '\n':
+			s.newlines++
+			if s.newlines >= 2 {
+				s.blank = true
+			}
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		s.pos++
+	}
+}
+
+func (s *scanner) skipBlockComment() error {
+	depth := 0
+	for s.pos < len(s.input) {
+		switch {
+		case strings.HasPrefix(s.input[s.pos:], "(;"):
+			depth++
+			s.pos += 2
+		case strings.HasPrefix(s.input[s.pos:], ";)"):
+			depth--
+			s.pos += 2
+			if depth == 0 {
+				return nil
+			}
+		default:
+			s.pos++
+		}
+	}
+	return errUnterminatedComm
+}
+
+func (s *scanner) skipString() error {
+	// skip the opening quote
+	s.pos++
+	for s.pos < len(s.input) {
+		switch s.input[s.pos] {
+		case '\\':
+			s.pos += 2
+			continue
+		case '"':
+			s.pos++
+			return nil
+		case '\n':
+			return errUnterminatedStr
+		}
+		s.pos++
+	}
+	return errUnterminatedStr
+}
+
+// A comment on the same line of the previous node belongs to it,
+// otherwise it belongs to the next node
+func (s *scanner) comment(text string) {
+	if s.newlines == 0 && s.last != nil {
+		s.last.trailing = append(s.last.trailing, text)
+	} else {
+		s.pending = append(s.pending, text)
+		s.last = nil
+	}
+	s.newlines = 0
+}
+
+func (s *scanner) atom(list *node, text string) {
+	child := &node{text: text}
+	s.attach(list, child)
+	s.last = child
+}
+
+func (s *scanner) attach(list *node, child *node) {
+	child.leading = s.pending
+	child.blank = s.blank
+	list.children = append(list.children, child)
+
+	s.pending = nil
+	s.blank = false
+	s.newlines = 0
+}
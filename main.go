@@ -34,6 +34,14 @@ func main() {
 
 //export compile
 func compile(input string) string {
+	module, err := compileModule(input)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return module
+}
+
+func compileModule(input string) (string, error) {
 	// c, err := ioutil.ReadFile()
 
 	// if err != nil {
@@ -47,22 +55,36 @@ func compile(input string) string {
 	fmt.Println("Tokens:", tokens)
 	fmt.Println("----------------------------------------------------------------")
 	// Ast
-	ast := compiler.Parser(tokens)
+	ast, err := compiler.Parser(tokens)
+	if err != nil {
+		return "", err
+	}
 	fmt.Println("Ast:", ast)
 
 	// Emitters
-	wasm := compiler.Compile(ast)
+	wasm, err := compiler.Compile(ast)
+	if err != nil {
+		return "", err
+	}
 	fmt.Println("Wasm", wasm)
 
 	// Str for Javascript
 	str := stringify.InterfaceSliceToStringSlice(wasm)
-	return strings.Join(str, " ")
+	return strings.Join(str, " "), nil
 }
 
 // TINYGO NOTE:  there is no export as we registered this function in global
 func startLuna(this js.Value, args []js.Value) interface{} {
 	input := args[0].String()
+	module, err := compileModule(input)
+	if err != nil {
+		fmt.Println(err)
+		return js.ValueOf(map[string]interface{}{
+			"module": "",
+			"error":  err.Error(),
+		})
+	}
 	return js.ValueOf(map[string]interface{}{
-		"module": compile(input),
+		"module": module,
 	})
 }
@@ -1,4 +1,3 @@
-
 export default class WasmReader {
   constructor(wasm) {
       this.data = wasm;
@@ -24,4 +23,36 @@ export default class WasmReader {
       this.pos += 1;
       return this.data[prev];
   }
+
+  // Numbers (sizes, counts, indices...) are encoded as LEB128
+  // 7 bits per byte, the highest bit tells if another byte follows
+  // See https://webassembly.github.io/spec/core/binary/values.html#integers
+  u32() {
+      let result = 0;
+      let shift = 0;
+      let byte;
+      do {
+          byte = this.readByte();
+          result += (byte & 0x7f) * 2 ** shift;
+          shift += 7;
+      } while (byte & 0x80);
+      return result;
+  }
+
+  // Signed numbers (e.g. i32.const) extend the sign bit of the last byte
+  s32() {
+      let result = 0;
+      let shift = 0;
+      let byte;
+      do {
+          byte = this.readByte();
+          result |= (byte & 0x7f) << shift;
+          shift += 7;
+      } while (byte & 0x80);
+
+      if (shift < 32 && (byte & 0x40)) {
+          result |= -1 << shift;
+      }
+      return result | 0;
+  }
 }
@@ -1,5 +1,7 @@
 import WasmReader from "../helpers/reader.js";
-import { parseExportSection, parseTypeSection, parseFunctionSection, parseCodeSection, checkHeader } from "./parser.js";
+import { Section } from "../utils/defaults.js";
+import { RuntimeErrors } from "../utils/errors.js";
+import { parseExportSection, parseTypeSection, parseFunctionSection, parseTableSection, parseElemSection, parseCodeSection, skipSection, checkHeader } from "./parser.js";
 
 
 // we create an AST of the parsed module
@@ -7,22 +9,65 @@ export function createAST(wasmBinary) {
   const wasm = new WasmReader(wasmBinary);
   checkHeader(wasm);
   //console.log("headers", headers);
-  const typeSection = parseTypeSection(wasm);
-  //console.log("typeSection", typeSection);
-  const functionTypes = parseFunctionSection(wasm);
-  //console.log(functionTypes)
-  const exportSection = parseExportSection(wasm);
-  //console.log("exportSection", exportSection)
-  const codeSection = parseCodeSection(wasm);
-  //console.log("codeSection", codeSection)
 
   const moduleAst = {
-      typeSection,
-      functionTypes,
-      exportSection,
-      codeSection,
+      typeSection: [],
+      functionTypes: [],
+      tableSection: [],
+      exportSection: [],
+      elemSection: [],
+      codeSection: [],
   }
 
+  // Sections come one after the other, the first byte of each one tells which one it is
+  while (wasm.pos < wasm.data.length) {
+    switch (wasm.data[wasm.pos]) {
+      case Section.type:
+        moduleAst.typeSection = parseTypeSection(wasm);
+        break;
+      case Section.import:
+        // imports would shift the index spaces, Aeon runs self contained modules only
+        throw new Error(RuntimeErrors.UnsupportedSection + ": import");
+      case Section.func:
+        moduleAst.functionTypes = parseFunctionSection(wasm);
+        break;
+      case Section.table:
+        moduleAst.tableSection = parseTableSection(wasm);
+        break;
+      case Section.export:
+        moduleAst.exportSection = parseExportSection(wasm);
+        break;
+      case Section.elem:
+        moduleAst.elemSection = parseElemSection(wasm);
+        break;
+      case Section.code:
+        moduleAst.codeSection = parseCodeSection(wasm);
+        break;
+      default:
+        skipSection(wasm);
+    }
+  }
+
+  moduleAst.tables = instantiateTables(moduleAst);
+
   //console.log("Module", moduleAst)
   return moduleAst;
 }
+
+// The active element segments are copied into the tables
+// See https://webassembly.github.io/spec/core/exec/modules.html#instantiation
+function instantiateTables(moduleAst) {
+  const tables = moduleAst.tableSection.map(table => new Array(table.size).fill(null));
+
+  for (const segment of moduleAst.elemSection) {
+    if (!segment.active) continue;
+
+    const table = tables[segment.table];
+    if (segment.offset + segment.functions.length > table.length) {
+      throw new Error(RuntimeErrors.UndefinedElement);
+    }
+    segment.functions.forEach((func, i) => table[segment.offset + i] = func);
+  }
+
+  return tables;
+}
@@ -1,24 +1,25 @@
 import { RuntimeErrors } from '../utils/errors.js';
+import { ExportSection } from '../utils/defaults.js';
 import Processor from './processor.js';
 
 // we need to call the exported function(s)
 export function invokeFunction(ast, funcName, params) {
   // we search if the export name does exists
   // if not we throw an error
-  let exportIndex = ast.exportSection.findIndex(exp => exp.name === funcName);
-  if (exportIndex === -1) throw new Error(RuntimeErrors.ExportNotFound);
+  let exported = ast.exportSection.find(exp => exp.name === funcName && exp.kind === ExportSection.func);
+  if (exported === undefined) throw new Error(RuntimeErrors.ExportNotFound);
 
-  // Get the exported function's body
-  let func = ast.codeSection[exportIndex];
   // Check if the number of parameters of the exported function
   // corresponds to the number of provided parameters
-  if (ast.typeSection[exportIndex][0].length !== params.length) {
+  const [funcParams] = ast.typeSection[ast.functionTypes[exported.index]];
+  if (funcParams.length !== params.length) {
       throw new Error(RuntimeErrors.InvalidArgumentsNumber);
   }
 
   // execute the function
-  const processor = new Processor(func, params);
-  processor.executeFunc();
+  const processor = new Processor(ast);
+  const results = processor.executeFunc(exported.index, params.map(param => param | 0));
 
-  return processor.getResult();
-}
\ No newline at end of file
+  // a single result is returned as it is (like the JS API does)
+  return results.length > 1 ? results : results[0];
+}
@@ -100,6 +100,8 @@ export function checkHeader(wasm) {
 // - the section's size 
 // - the number, type or the number of types of the content inside the section
 
+// Sizes, counts and indices are LEB128 numbers (see WasmReader.u32)
+
 // We parse and check the type section
 // See https://webassembly.github.io/spec/core/binary/modules.html#type-section
 export function parseTypeSection(wasm) {
@@ -121,20 +123,20 @@ export function parseTypeSection(wasm) {
         }
     }
     
-    let sizeOfSection = wasm.readByte();
-    const numTypes = wasm.readByte();
+    let sizeOfSection = wasm.u32();
+    const numTypes = wasm.u32();
     let types = [];
 
     for (let i = 0; i < numTypes; i++) {
         let func = wasm.readByte();
 
-        let numOfParams = wasm.readByte();
+        let numOfParams = wasm.u32();
         let params = [];
         for (let j = 0; j < numOfParams; j++) {
             params.push(parseValueType(wasm))
         }
 
-        let numOfResults = wasm.readByte();
+        let numOfResults = wasm.u32();
         let results = [];
         for (let w = 0; w < numOfResults; w++) {
             results.push(parseValueType(wasm))
@@ -153,19 +155,46 @@ export function parseFunctionSection(wasm) {
         throw new Error(RuntimeErrors.InvalidSection);
     }
 
-    let sectionSize = wasm.readByte();
+    let sectionSize = wasm.u32();
     // number of functions
-    let numberOfFunctions = wasm.readByte();
-    // Index of the function aka the position
+    let numberOfFunctions = wasm.u32();
+    // The type of every function (an index in the type section)
     let functionSigIndex = [];
 
     for (let i = 0; i < numberOfFunctions; i++) {
-        functionSigIndex.push(wasm.readByte())
+        functionSigIndex.push(wasm.u32())
     }
 
     return functionSigIndex;
 }
 
+// we parse the table section (4)
+// Tables hold references to functions, call_indirect calls them by their position in the table
+// See https://webassembly.github.io/spec/core/binary/modules.html#table-section
+export function parseTableSection(wasm) {
+    const isTableSection = wasm.readByte();
+    if (isTableSection !== Section.table) {
+        throw new Error(RuntimeErrors.InvalidSection);
+    }
+
+    let sectionSize = wasm.u32();
+    let numberOfTables = wasm.u32();
+    let tables = [];
+
+    for (let i = 0; i < numberOfTables; i++) {
+        // funcref (0x70) or externref (0x6f)
+        let refType = wasm.readByte();
+        // limits: 0x00 min or 0x01 min max
+        let flags = wasm.readByte();
+        let min = wasm.u32();
+        if (flags & 0x01) wasm.u32();
+
+        tables.push({ refType, size: min })
+    }
+
+    return tables;
+}
+
 // We parse export section
 // See https://webassembly.github.io/spec/core/binary/modules.html#export-section
 export function parseExportSection(wasm) {
@@ -174,32 +203,87 @@ export function parseExportSection(wasm) {
         throw new Error(RuntimeErrors.InvalidSection);
     }
 
-    let sectionSize = wasm.readByte();
-    // How many exports in the module (we only have one)
-    let numberOfExports = wasm.readByte();
+    let sectionSize = wasm.u32();
+    // How many exports in the module
+    let numberOfExports = wasm.u32();
     let exportsArr = [];
 
     for (let i = 0; i < numberOfExports; i++) {
         // we get the exported name
-        const exportNameLength = wasm.readByte();
-        const exportName = String.fromCharCode(...wasm.readBytes(exportNameLength));
+        const exportNameLength = wasm.u32();
+        const exportName = new TextDecoder().decode(wasm.readBytes(exportNameLength));
 
         if (!!exportName === false) throw new Error(RuntimeErrors.InvalidExportName);
-        // export kind
-        let zero = wasm.readByte();
-        // Index of the exported function
-        let indexOfExportedFunction = (wasm.readByte() == ExportSection.func) && ExportSection.func;
-        
-        if (typeof indexOfExportedFunction !== 'number' && !!indexOfExportedFunction === false) {
+        // export kind (function, table, memory, global)
+        let kind = wasm.readByte();
+        if (!Object.values(ExportSection).includes(kind)) {
             throw new Error(RuntimeErrors.InvalidExportType)
         }
-     
-        exportsArr.push({name: exportName.replace(/"/g, ""), index: indexOfExportedFunction})
+        // Index of the exported function (or table...)
+        let index = wasm.u32();
+
+        exportsArr.push({name: exportName, kind, index})
     }
 
     return exportsArr;
 }
 
+// We parse the element section (9)
+// Active segments fill the tables when the module is instantiated
+// Aeon supports the segments made of function indices
+// - 0x00 table 0, offset, functions
+// - 0x01 passive, element kind, functions
+// - 0x02 table index, offset, element kind, functions
+// - 0x03 declarative, element kind, functions
+// See https://webassembly.github.io/spec/core/binary/modules.html#element-section
+export function parseElemSection(wasm) {
+    const isElemSection = wasm.readByte();
+    if (isElemSection !== Section.elem) {
+        throw new Error(RuntimeErrors.InvalidSection);
+    }
+
+    let sectionSize = wasm.u32();
+    let numberOfSegments = wasm.u32();
+    let segments = [];
+
+    for (let i = 0; i < numberOfSegments; i++) {
+        const flags = wasm.u32();
+        if (flags > 0x03) {
+            throw new Error(RuntimeErrors.UnsupportedElemSegment);
+        }
+
+        const active = (flags & 0x01) === 0;
+        let table = 0;
+        let offset = 0;
+        if (flags === 0x02) table = wasm.u32();
+        if (active) offset = parseOffset(wasm);
+        // element kind (0x00 funcref)
+        if (flags !== 0x00) wasm.readByte();
+
+        const numberOfFunctions = wasm.u32();
+        let functions = [];
+        for (let j = 0; j < numberOfFunctions; j++) {
+            functions.push(wasm.u32());
+        }
+
+        segments.push({ active, table, offset, functions })
+    }
+
+    return segments;
+}
+
+// The offset of a segment is a constant expression: i32.const n end
+function parseOffset(wasm) {
+    if (wasm.readByte() !== Opcodes.i32_const) {
+        throw new Error(RuntimeErrors.InvalidInstruction);
+    }
+    const offset = wasm.s32();
+    if (wasm.readByte() !== Opcodes.end) {
+        throw new Error(RuntimeErrors.InvalidInstruction);
+    }
+    return offset;
+}
+
 // we parse the code section
 // See https://webassembly.github.io/spec/core/binary/modules.html#code-section
 export function parseCodeSection(wasm) {
@@ -210,34 +294,106 @@ export function parseCodeSection(wasm) {
         throw new Error(RuntimeErrors.InvalidSection);
     } 
     
-    let sectionSize = wasm.readByte();
-    let numberOfFunctions = wasm.readByte();
+    let sectionSize = wasm.u32();
+    let numberOfFunctions = wasm.u32();
     let code = [];
     
     
     for (let i = 0; i < numberOfFunctions; i++) {
-        let funcBodySize = wasm.readByte();
-        let numberOfLocals = wasm.readByte();
+        let funcBodySize = wasm.u32();
+        const funcEnd = wasm.pos + funcBodySize;
 
-        let instructions = [];
+        // Locals are declared in groups: (count, type)
+        let numberOfLocals = wasm.u32();
         let locals = [];
-        let internals = [];
-        
-        while (wasm.pos < wasm.data.length) {
-            const instruction = wasm.readByte();
-            
-            instructions.push(instruction)
-            
-            if (instruction == Opcodes.get_local) {
-                locals.push(wasm.readByte())
-            }
+        for (let j = 0; j < numberOfLocals; j++) {
+            const count = wasm.u32();
+            const valType = wasm.readByte();
+            for (let k = 0; k < count; k++) locals.push(valType);
+        }
 
-            if (instruction == Opcodes.i32_const) {
-                internals.push(wasm.readByte())
+        let instructions = [];
+        // The blocks that are still open, to find their else and end
+        let blocks = [];
+        
+        while (wasm.pos < funcEnd) {
+            const instruction = parseInstruction(wasm);
+            const position = instructions.length;
+            instructions.push(instruction);
+
+            switch (instruction.opcode) {
+                case Opcodes.block:
+                case Opcodes.loop:
+                case Opcodes.if:
+                    blocks.push(instruction);
+                    break;
+                case Opcodes.else:
+                    blocks[blocks.length - 1].else = position;
+                    break;
+                case Opcodes.end:
+                    // the last end closes the function, not a block
+                    if (blocks.length > 0) blocks.pop().end = position;
+                    break;
             }
         } 
-        code.push({locals, internals, instructions});
+        code.push({locals, instructions});
     }
 
     return code
 }
+
+// An instruction is its opcode followed by its immediates
+// See https://webassembly.github.io/spec/core/binary/instructions.html
+function parseInstruction(wasm) {
+    const opcode = wasm.readByte();
+
+    switch (opcode) {
+        // The block type is 0x40 (no results), a value type (one result) or a type index
+        // all of them can be read as a signed number: 0x40 is -64, 0x7f (i32) is -1
+        case Opcodes.block:
+        case Opcodes.loop:
+        case Opcodes.if:
+            return { opcode, blockType: wasm.s32() };
+
+        case Opcodes.br:
+        case Opcodes.br_if:
+        case Opcodes.call:
+        case Opcodes.return_call:
+        case Opcodes.get_local:
+        case Opcodes.set_local:
+        case Opcodes.tee_local:
+            return { opcode, index: wasm.u32() };
+
+        case Opcodes.call_indirect:
+        case Opcodes.return_call_indirect:
+            return { opcode, type: wasm.u32(), table: wasm.u32() };
+
+        case Opcodes.i32_const:
+            return { opcode, value: wasm.s32() };
+
+        case Opcodes.unreachable:
+        case Opcodes.nop:
+        case Opcodes.else:
+        case Opcodes.end:
+        case Opcodes.return:
+        case Opcodes.drop:
+        case Opcodes.select:
+        case Opcodes.i32_eqz:
+        case Opcodes.i32_eq:
+        case Opcodes.i32_and:
+        case Opcodes.i32_add:
+        case Opcodes.i32_sub:
+        case Opcodes.i32_mul:
+        case Opcodes.i32_div:
+            return { opcode };
+    }
+
+    throw new Error(`${RuntimeErrors.UnsupportedInstruction} 0x${opcode.toString(16)}`);
+}
+
+// Sections that Aeon does not need (e.g. custom sections) are skipped
+export function skipSection(wasm) {
+    wasm.readByte();
+    const sectionSize = wasm.u32();
+    wasm.readBytes(sectionSize);
+}
@@ -1,47 +1,262 @@
 import { Opcodes } from "../utils/defaults.js";
+import { RuntimeErrors } from "../utils/errors.js";
 
-// The processor executes the exported function
+// The processor executes the functions of the module
+// It is a stack machine: instructions pop their operands from the stack and push their results
+// See https://webassembly.github.io/spec/core/exec/index.html
 export default class Processor {
-  constructor(func, params) {
-    this.func = func;
-    this.params = params;
+  constructor(ast) {
+    this.ast = ast;
     this.stack = [];
   }
 
-  executeFunc() {
-    for (const instruction of this.func.instructions) {
-      if (instruction == Opcodes.get_local) this.stack.push(this.params[this.func.locals.shift()]);
-      if (instruction == Opcodes.i32_const) this.stack.push(this.func.internals.shift());
-      
-      this.#parseInstruction(instruction)
+  // Runs the function at index with the given arguments and returns its results
+  executeFunc(index, args) {
+    // The current frame: the function, its locals, its labels and where we are (pc)
+    let func, results, locals, labels, height, pc;
+
+    const enter = (index, args) => {
+      func = this.ast.codeSection[index];
+      results = this.#type(this.ast.functionTypes[index])[1].length;
+      // locals are the arguments followed by the declared locals (zeroed)
+      locals = [...args, ...func.locals.map(() => 0)];
+      // every block, loop and if pushes a label, br jumps to one of them
+      labels = [];
+      height = this.stack.length;
+      pc = 0;
+    };
+
+    enter(index, args);
+
+    while (true) {
+      const instruction = func.instructions[pc];
+
+      switch (instruction.opcode) {
+        case Opcodes.unreachable:
+          throw new Error(RuntimeErrors.Unreachable);
+
+        case Opcodes.nop:
+          break;
+
+        case Opcodes.block:
+        case Opcodes.loop: {
+          const [params, blockResults] = this.#blockType(instruction.blockType);
+          labels.push({
+            instruction,
+            start: pc,
+            // br to a loop starts it again (with its params), br to a block exits it (with its results)
+            arity: instruction.opcode === Opcodes.loop ? params : blockResults,
+            height: this.stack.length - params,
+          });
+          break;
+        }
+
+        case Opcodes.if: {
+          const [params, blockResults] = this.#blockType(instruction.blockType);
+          const condition = this.stack.pop();
+          labels.push({ instruction, arity: blockResults, height: this.stack.length - params });
+          if (condition === 0) {
+            // jump to the else branch, or to the end if there's none
+            if (instruction.else !== undefined) {
+              pc = instruction.else + 1;
+              continue;
+            }
+            pc = instruction.end;
+            continue;
+          }
+          break;
+        }
+
+        // we get here at the end of the then branch: skip the else branch
+        case Opcodes.else:
+          pc = labels[labels.length - 1].instruction.end;
+          continue;
+
+        case Opcodes.end:
+          // the last end is the end of the function
+          if (labels.length === 0) return this.#return(results, height);
+          labels.pop();
+          break;
+
+        case Opcodes.br:
+        case Opcodes.br_if: {
+          if (instruction.opcode === Opcodes.br_if && this.stack.pop() === 0) break;
+
+          // a branch to the outermost label is a branch to the function's body
+          if (instruction.index >= labels.length) return this.#return(results, height);
+
+          const label = labels[labels.length - 1 - instruction.index];
+          const values = this.stack.splice(this.stack.length - label.arity);
+          this.stack.length = label.height;
+          this.stack.push(...values);
+
+          labels.length -= instruction.index;
+          if (label.instruction.opcode === Opcodes.loop) {
+            pc = label.start + 1;
+            continue;
+          }
+          // the end of the block pops its label
+          pc = label.instruction.end;
+          continue;
+        }
+
+        case Opcodes.return:
+          return this.#return(results, height);
+
+        case Opcodes.call: {
+          const args = this.#arguments(this.ast.functionTypes[instruction.index]);
+          this.stack.push(...this.executeFunc(instruction.index, args));
+          break;
+        }
+
+        case Opcodes.call_indirect: {
+          const callee = this.#indirect(instruction);
+          const args = this.#arguments(instruction.type);
+          this.stack.push(...this.executeFunc(callee, args));
+          break;
+        }
+
+        // Tail calls replace the current frame with the callee's one
+        // so they don't grow the (JavaScript) call stack, no matter how deep the recursion goes
+        // See https://github.com/WebAssembly/tail-call/blob/main/proposals/tail-call/Overview.md
+        case Opcodes.return_call: {
+          const args = this.#arguments(this.ast.functionTypes[instruction.index]);
+          this.stack.length = height;
+          enter(instruction.index, args);
+          continue;
+        }
+
+        case Opcodes.return_call_indirect: {
+          const callee = this.#indirect(instruction);
+          const args = this.#arguments(instruction.type);
+          this.stack.length = height;
+          enter(callee, args);
+          continue;
+        }
+
+        case Opcodes.drop:
+          this.stack.pop();
+          break;
+
+        case Opcodes.select: {
+          const condition = this.stack.pop();
+          const b = this.stack.pop();
+          const a = this.stack.pop();
+          this.stack.push(condition !== 0 ? a : b);
+          break;
+        }
+
+        case Opcodes.get_local:
+          this.stack.push(locals[instruction.index]);
+          break;
+
+        case Opcodes.set_local:
+          locals[instruction.index] = this.stack.pop();
+          break;
+
+        // like set_local, but the value stays on the stack
+        case Opcodes.tee_local:
+          locals[instruction.index] = this.stack[this.stack.length - 1];
+          break;
+
+        case Opcodes.i32_const:
+          this.stack.push(instruction.value);
+          break;
+
+        case Opcodes.i32_eqz:
+          this.stack.push(this.stack.pop() === 0 ? 1 : 0);
+          break;
+
+        default:
+          this.#parseInstruction(instruction.opcode);
+      }
+
+      pc++;
     }
   }
 
   #parseInstruction(instruction) {
-    let result;
-
-    // We Array.prototype.reduce because we do not know in advance
-    // how many parameters are there
+    // Binary operations pop their two operands and push the result
+    // See https://webassembly.github.io/spec/core/exec/instructions.html#t-mathsf-xref-syntax-instructions-syntax-binop-mathit-binop
     switch(instruction) {
+      case Opcodes.i32_eq:
+        return this.#binary((a, b) => a === b ? 1 : 0);
+
+      case Opcodes.i32_and:
+        return this.#binary((a, b) => a & b);
+
       case Opcodes.i32_add:
-        result = this.stack.reduce((prev, current) => prev + current, 0);
-        return this.stack.push(result);
+        return this.#binary((a, b) => a + b);
 
       case Opcodes.i32_sub:
-        result = this.stack.reduce((prev, current) => prev - current);
-        return this.stack.push(result);
-      
+        return this.#binary((a, b) => a - b);
+
       case Opcodes.i32_mul:
-        result = this.stack.reduce((prev, current) => prev * current, 1);
-        return this.stack.push(result);
-      
+        return this.#binary((a, b) => Math.imul(a, b));
+
       case Opcodes.i32_div:
-        result = this.stack.reduce((prev, current) => prev / current);
-        return this.stack.push(result);
+        return this.#binary((a, b) => {
+          if (b === 0) throw new Error(RuntimeErrors.DivideByZero);
+          if (a === -2147483648 && b === -1) throw new Error(RuntimeErrors.IntegerOverflow);
+          return Math.trunc(a / b);
+        });
+    }
+
+    throw new Error(RuntimeErrors.InvalidInstruction);
+  }
+
+  #binary(operation) {
+    const b = this.stack.pop();
+    const a = this.stack.pop();
+    return this.stack.push(operation(a, b) | 0);
+  }
+
+  // [params, results] of a function type
+  #type(index) {
+    return this.ast.typeSection[index];
+  }
+
+  // The number of params and results of a block
+  // See https://webassembly.github.io/spec/core/binary/instructions.html#binary-blocktype
+  #blockType(blockType) {
+    // 0x40, the empty block type
+    if (blockType === -64) return [0, 0];
+    // a single value type
+    if (blockType < 0) return [0, 1];
+    // a type index
+    const [params, results] = this.#type(blockType);
+    return [params.length, results.length];
+  }
+
+  // pops the arguments of a call
+  #arguments(typeIndex) {
+    const params = this.#type(typeIndex)[0].length;
+    return this.stack.splice(this.stack.length - params);
+  }
+
+  // The function called by call_indirect, checked against the expected type
+  // See https://webassembly.github.io/spec/core/exec/instructions.html#xref-syntax-instructions-syntax-instr-control-mathsf-call-indirect-x-y
+  #indirect(instruction) {
+    const table = this.ast.tables[instruction.table];
+    const element = this.stack.pop();
+
+    if (element < 0 || element >= table.length) throw new Error(RuntimeErrors.UndefinedElement);
+    const callee = table[element];
+    if (callee === null) throw new Error(RuntimeErrors.UninitializedElement);
+
+    const expected = this.#type(instruction.type);
+    const actual = this.#type(this.ast.functionTypes[callee]);
+    if (JSON.stringify(expected) !== JSON.stringify(actual)) {
+      throw new Error(RuntimeErrors.IndirectCallTypeMismatch);
     }
-  } 
 
-  getResult() {
-    return this.stack.pop()
+    return callee;
+  }
+
+  // The function returns its results and leaves the stack as it found it
+  #return(results, height) {
+    const values = this.stack.splice(this.stack.length - results);
+    this.stack.length = height;
+    return values;
   }
-}
\ No newline at end of file
+}
@@ -2,17 +2,29 @@ export const MAGIC   = [0x00, 0x61, 0x73, 0x6d]
 export const VERSION = [0x01, 0x00, 0x00, 0x00]
 
 export const Opcodes = {
-	// unreachable = 0x00
+	unreachable : 0x00,
+	nop         : 0x01,
 	block       : 0x02,
 	loop        : 0x03,
+	if          : 0x04,
+	else        : 0x05,
 	br          : 0x0c,
 	br_if       : 0x0d,
 	end         : 0x0b,
+	return      : 0x0f,
 	call        : 0x10,
+	call_indirect : 0x11,
+	// tail calls https://github.com/WebAssembly/tail-call
+	return_call : 0x12,
+	return_call_indirect : 0x13,
+	drop        : 0x1a,
+	select      : 0x1b,
 	get_local   : 0x20,
 	set_local   : 0x21,
+	tee_local   : 0x22,
 	i32_store_8 : 0x3a,
 	i32_const   : 0x41,
+	i64_const   : 0x42,
 	f32_const   : 0x43,
 	i32_eqz     : 0x45,
 	i32_eq      : 0x46,
@@ -39,7 +51,10 @@ export const Section = {
 	memory: 0x05,
 	global: 0x06,
 	export: 0x07,
+	start:  0x08,
+	elem:   0x09,
 	code:   0xa,
+	data:   0xb,
 }
 
 export const ExportSection = {
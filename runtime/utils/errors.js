@@ -10,6 +10,16 @@ const RuntimeErrors = {
   InvalidInstruction: "Invalid instruction",
   InvalidArgumentsNumber: "Invalid number of arguments",
   ExportNotFound: "Export not found",
+  UnsupportedSection: "Unsupported section",
+  UnsupportedElemSegment: "Unsupported element segment",
+  UnsupportedInstruction: "Unsupported instruction",
+  // Traps https://webassembly.github.io/spec/core/intro/overview.html#trap
+  Unreachable: "unreachable executed",
+  DivideByZero: "integer divide by zero",
+  IntegerOverflow: "integer overflow",
+  UndefinedElement: "undefined element",
+  UninitializedElement: "uninitialized element",
+  IndirectCallTypeMismatch: "indirect call type mismatch",
 }
 
 const _RuntimeErrors = RuntimeErrors;
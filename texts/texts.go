@@ -3,31 +3,56 @@ package texts
 const (
 	TypeToken = "token"
 
-	TypeLiteral   = "literal"
-	NumberLiteral = "numberLiteral"
-	FuncLiteral   = "funcLiteral"
+	TypeLiteral = "literal"
 
-	ModuleStatement = "moduleStatement"
-	ParamStatement  = "paramStatement"
-	ExportStatement = "exportStatement"
-	ResultStatement = "resultStatement"
-	FuncStatement   = "funcStatement"
+	TypeNum = "typeNum"
 
-	AddNumbers = "addNumbers"
-	TypeNum    = "typeNum"
-	TypeNum32  = "typeNum32"
-
-	TypeInstruction     = "instruction"
-	FuncInstruction     = "funcInstruction"
-	InternalInstruction = "internalInstruction"
-	GetLocalInstruction = "getLocalInstruction"
+	TypeInstruction = "instruction"
 
 	Number = "number"
-	Export = "export"
-	Result = "result"
-	Func   = "func"
-	Param  = "param"
-	Module = "module"
 
 	Whitespace = "whitespace"
+
+	Id         = "id"
+	LeftParen  = "leftParen"
+	RightParen = "rightParen"
+	TypeError  = "error"
+
+	// A list of nodes between parens in the AST
+	ListNode = "list"
+
+	// Immediates of the instructions
+	LabelIdx = "labelidx"
+	// The labels of br_table, the last one is the default
+	Labels   = "labels"
+	FuncIdx  = "funcidx"
+	TypeIdx  = "typeidx"
+	TableIdx = "tableidx"
+	MemIdx   = "memidx"
+	DataIdx  = "dataidx"
+	ElemIdx  = "elemidx"
+	TagIdx   = "tagidx"
+	// The handlers of try_table: (catch $tag $label)*
+	Catches    = "catches"
+	LocalIdx   = "localidx"
+	GlobalIdx  = "globalidx"
+	BlockType  = "blocktype"
+	MemArg     = "memarg"
+	HeapType   = "heaptype"
+	SelectType = "selecttype"
+	ConstI32   = "i32"
+	ConstI64   = "i64"
+	ConstF32   = "f32"
+	ConstF64   = "f64"
+	// SIMD: a lane of a vector, the 16 bytes of a vector and the 16 lanes of a shuffle
+	LaneIdx   = "laneidx"
+	V128Const = "v128"
+	Shuffle   = "shuffle"
+	// A 0x00 byte that is not written in the text format
+	Reserved = "reserved"
+	// GC: the field of a struct (by index or by its $id in the struct type),
+	// the number of elements of array.new_fixed and the (ref null? heaptype) of casts
+	FieldIdx = "fieldidx"
+	Count    = "count"
+	RefType  = "reftype"
 )
@@ -6,24 +6,27 @@ type Matcher struct {
 }
 
 type Token struct {
-	Type  string
-	Value string
-	Index int
+	Type   string
+	Value  string
+	Index  int
+	Line   int
+	Column int
+	// Why the token is not valid (only for error tokens)
+	Error string
+	// Comments right before the token (trivia)
+	// they are not part of the program but tools like formatters need them
+	Comments []string
 }
 
+// The AST is a tree of S-expressions (https://en.wikipedia.org/wiki/S-expression)
+// every node is either a list of nodes between parens (module (func ...) ...)
+// or an atom (a keyword, an instruction, an id, a number or a string)
 type AstNode struct {
-	Type       string
-	Expression ExpressionNode
-	// Map instructions to their hex dump - empty string for all other nodes
-	MapTo interface{}
-}
-
-type ExpressionNode struct {
-	Type  string
-	Value interface{}
-}
-
-type ExpressionParams struct {
-	Type  string
-	Value int
+	// ListNode for lists, the type of the token for atoms
+	Type     string
+	Value    string
+	Children []AstNode
+	// Position in the source (for the error messages)
+	Line   int
+	Column int
 }
@@ -0,0 +1,223 @@
+package types
+
+// The compiler turns the AST into a Module, that follows the structure of
+// a WebAssembly module as defined by the specification.
+// Names ($ids) are already resolved to indices, so it maps one to one to the binary format.
+// See https://webassembly.github.io/spec/core/syntax/modules.html
+type Module struct {
+	Types    []TypeDef
+	Funcs    []Func
+	Tables   []Table
+	Memories []Memory
+	Globals  []Global
+	Tags     []Tag
+	Exports  []Export
+	Elems    []Elem
+	Datas    []Data
+	// The function called when the module is instantiated (if any)
+	// See https://webassembly.github.io/spec/core/syntax/modules.html#start-function
+	Start *uint32
+}
+
+// Imports
+// Functions, tables, memories, globals and tags can be imported from the host (or from another module)
+// Imported ones have an Import and come before the ones defined in the module,
+// since they take the first indices of their index space.
+// See https://webassembly.github.io/spec/core/syntax/modules.html#imports
+type Import struct {
+	Module string
+	Name   string
+}
+
+// Value types are encoded with a single byte (e.g. i32 is 0x7f)
+// references to a type of the module are encoded differently (see Ref)
+// See https://webassembly.github.io/spec/core/syntax/types.html#value-types
+type ValueType int
+
+// See https://webassembly.github.io/spec/core/syntax/types.html#function-types
+type FunctionType struct {
+	Params  []ValueType
+	Results []ValueType
+}
+
+// A type of the type section
+// Function types and, with the GC proposal, structs and arrays made of fields
+// See https://webassembly.github.io/gc/core/syntax/types.html#composite-types
+type TypeDef struct {
+	// FuncType, StructType or ArrayType
+	Kind int
+	// Params and results of a function type
+	FunctionType
+	// Fields of a struct, an array has a single one (its element)
+	Fields []Field
+	// Subtyping: the type it extends (if any) and whether it can be extended itself
+	// (type $t (struct)) is final, (type $t (sub $super (struct))) is not
+	Supers []uint32
+	Final  bool
+	// Types of a (rec ...) group can reference each other
+	// the first type of a group has its size, the others 0 (a type outside of a group is a group of 1)
+	Rec int
+}
+
+// A field of a struct (or the element of an array)
+// its type can be packed (I8 or I16), it is stored in 1 or 2 bytes but read and written as an i32
+// See https://webassembly.github.io/gc/core/syntax/types.html#aggregate-types
+type Field struct {
+	Type    ValueType
+	Mutable bool
+}
+
+// See https://webassembly.github.io/spec/core/syntax/types.html#limits
+type Limits struct {
+	Min    uint64
+	Max    uint64
+	HasMax bool
+	// Only memories can be shared (between threads)
+	// See https://webassembly.github.io/threads/core/syntax/types.html#limits
+	Shared bool
+	// Memories with 64 bit addresses (memory i64 ...), their limits can be bigger than 32 bits
+	// See https://github.com/WebAssembly/memory64/blob/main/proposals/memory64/Overview.md
+	Is64 bool
+}
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#functions
+type Func struct {
+	// $id of the function (if any)
+	Name string
+	// Index of the function type in Types
+	Type   uint32
+	Locals []ValueType
+	// Instructions of the function, without the final end
+	Body []Instruction
+	// Imported functions have no locals and no body
+	Import *Import
+}
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#tables
+type Table struct {
+	Name     string
+	Limits   Limits
+	ElemType ValueType
+	Import   *Import
+}
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#memories
+type Memory struct {
+	Name   string
+	Limits Limits
+	Import *Import
+}
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#globals
+type Global struct {
+	Name    string
+	Type    ValueType
+	Mutable bool
+	// Constant expression that initializes the global (imported globals have none)
+	Init   []Instruction
+	Import *Import
+}
+
+// Tags are the types of the exceptions, their params are the values thrown with them
+// See https://webassembly.github.io/exception-handling/core/syntax/modules.html#tags
+type Tag struct {
+	Name string
+	// Index of the function type in Types, it has no results
+	Type   uint32
+	Import *Import
+}
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#exports
+type Export struct {
+	Name string
+	// One of defaults.ExportSection
+	Kind  interface{}
+	Index uint32
+}
+
+// An instruction and its immediates
+// The immediates follow the order (and the kinds) of defaults.Immediates
+// - indices are uint32
+// - i32 and i64 constants are int32 and int64
+// - f32 constants are the uint32 bits of the float
+// - block types are BlockType, memory arguments are MemArg
+type Instruction struct {
+	Name       string
+	Immediates []interface{}
+}
+
+// The type of a block (block, loop, if)
+// Blocks take params from the stack and leave results on it, like functions.
+// With no params and at most one result the type is encoded inline,
+// otherwise it is the index of a function type (HasIndex)
+// See https://webassembly.github.io/spec/core/binary/instructions.html#binary-blocktype
+type BlockType struct {
+	Params   []ValueType
+	Results  []ValueType
+	Index    uint32
+	HasIndex bool
+}
+
+// Memory arguments of loads and stores
+// Align is the exponent of the alignment: 2 means 2^2 = 4 bytes
+// the offset is 64 bits for the memories with 64 bit addresses
+// See https://webassembly.github.io/spec/core/syntax/instructions.html#memory-instructions
+type MemArg struct {
+	Align  uint32
+	Offset uint64
+	// Index of the memory (multi-memory), 0 if not written
+	Memory uint32
+}
+
+// The handlers of try_table
+// - catch and catch_ref catch the exceptions with a given tag, catch_all and catch_all_ref any exception
+// - the values thrown (and the exnref for the _ref ones) are passed to the label
+// See https://webassembly.github.io/exception-handling/core/syntax/instructions.html#control-instructions
+const (
+	CatchTag = iota
+	CatchTagRef
+	CatchAll
+	CatchAllRef
+)
+
+type Catch struct {
+	Kind  int
+	Tag   uint32
+	Label uint32
+}
+
+// Segments are either active or passive
+// - active segments are copied into a memory (or table) when the module is instantiated
+// - passive segments are copied on demand by memory.init (or table.init)
+// - declarative (elem) segments are never copied, they declare the functions referenced by ref.func
+// See https://webassembly.github.io/spec/core/syntax/modules.html#data-segments
+const (
+	SegmentActive = iota
+	SegmentPassive
+	SegmentDeclarative
+)
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#data-segments
+type Data struct {
+	Name string
+	Mode int
+	// Only for active segments: where the bytes are copied
+	Memory uint32
+	Offset []Instruction
+	Bytes  []byte
+}
+
+// See https://webassembly.github.io/spec/core/syntax/modules.html#element-segments
+type Elem struct {
+	Name string
+	Mode int
+	// Only for active segments: where the elements are copied
+	Table  uint32
+	Offset []Instruction
+	// The reference type of the elements
+	Type ValueType
+	// The elements are either function indices (Funcs)
+	// or constant expressions (Exprs, when it is not nil)
+	Funcs []uint32
+	Exprs [][]Instruction
+}
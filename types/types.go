@@ -17,11 +17,155 @@ const V128 = 0x7b
 // See https://webassembly.github.io/spec/core/binary/types.html#function-types
 const FuncType = 0x60
 
+// Composite types of the GC proposal and how they are grouped
+// - struct and array are encoded like func, the byte followed by their fields
+// - (sub $super (struct ...)) can be extended, (sub final $super ...) can not
+// - (rec ...) groups types that reference each other
+// See https://webassembly.github.io/gc/core/binary/types.html#composite-types
+const (
+	StructType   = 0x5f
+	ArrayType    = 0x5e
+	SubType      = 0x50
+	SubFinalType = 0x4f
+	RecType      = 0x4e
+)
+
+// Packed types can only be the type of a field (i8 and i16)
+// See https://webassembly.github.io/gc/core/binary/types.html#storage-types
+const (
+	I8  = 0x78
+	I16 = 0x77
+)
+
+var PackedType = map[string]interface{}{
+	"i8":  I8,
+	"i16": I16,
+}
+
 // Value types
 // See https://webassembly.github.io/spec/core/binary/types.html#value-types
 var ValType = map[string]interface{}{
-	"i32": 0x7f,
-	"i64": 0x7e,
-	"f32": 0x7d,
-	"f64": 0x7c,
+	"i32":       0x7f,
+	"i64":       0x7e,
+	"f32":       0x7d,
+	"f64":       0x7c,
+	"v128":      V128,
+	"funcref":   0x70,
+	"externref": 0x6f,
+	"exnref":    0x69,
+	// GC
+	"anyref":        0x6e,
+	"eqref":         0x6d,
+	"i31ref":        0x6c,
+	"structref":     0x6b,
+	"arrayref":      0x6a,
+	"nullref":       0x71,
+	"nullexternref": 0x72,
+	"nullfuncref":   0x73,
+	"nullexnref":    0x74,
+}
+
+// Reference types
+// The shorthands of the nullable references to an abstract heap type, funcref is (ref null func)
+// See https://webassembly.github.io/spec/core/binary/types.html#reference-types
+var RefType = map[string]interface{}{
+	"funcref":   0x70,
+	"externref": 0x6f,
+	// A caught exception, it can be thrown again with throw_ref
+	// See https://webassembly.github.io/exception-handling/core/syntax/types.html#reference-types
+	"exnref": 0x69,
+	// GC
+	// See https://webassembly.github.io/gc/core/binary/types.html#reference-types
+	"anyref":        0x6e,
+	"eqref":         0x6d,
+	"i31ref":        0x6c,
+	"structref":     0x6b,
+	"arrayref":      0x6a,
+	"nullref":       0x71,
+	"nullexternref": 0x72,
+	"nullfuncref":   0x73,
+	"nullexnref":    0x74,
+}
+
+// Heap types
+// What a reference points to, e.g. ref.null func is a null funcref
+// See https://webassembly.github.io/spec/core/binary/types.html#heap-types
+var HeapType = map[string]interface{}{
+	"func":   0x70,
+	"extern": 0x6f,
+	"exn":    0x69,
+	// The GC hierarchy: any is the top of the internal references,
+	// eq can be compared with ref.eq, i31 are 31 bit integers that are not allocated
+	// none, nofunc, noextern and noexn are the bottom types (only null)
+	// See https://webassembly.github.io/gc/core/syntax/types.html#heap-types
+	"any":      0x6e,
+	"eq":       0x6d,
+	"i31":      0x6c,
+	"struct":   0x6b,
+	"array":    0x6a,
+	"none":     0x71,
+	"noextern": 0x72,
+	"nofunc":   0x73,
+	"noexn":    0x74,
+}
+
+// References
+// A reference type is nullable or not and points to a heap type: an abstract one (its byte, e.g. 0x70 func)
+// or a type of the module (its index with the Concrete bit).
+// They are stored in a ValueType:
+// - (ref null func) is 0x70, the byte of its shorthand funcref
+// - (ref func) is 0x70 with the NonNull bit
+// - (ref null $t) is the index of $t with the Concrete bit, (ref $t) has the NonNull bit too
+// See https://webassembly.github.io/gc/core/syntax/types.html#reference-types
+const (
+	Concrete = 1 << 24
+	NonNull  = 1 << 25
+)
+
+// Binary prefixes of the references that have no shorthand
+// See https://webassembly.github.io/gc/core/binary/types.html#reference-types
+const (
+	RefNullPrefix = 0x63
+	RefPrefix     = 0x64
+)
+
+// Ref is the reference to a heap type
+func Ref(heap int, nullable bool) ValueType {
+	if nullable {
+		return ValueType(heap)
+	}
+	return ValueType(heap | NonNull)
+}
+
+// ConcreteHeap is the heap type of a type of the module
+func ConcreteHeap(index uint32) int {
+	return Concrete | int(index)
+}
+
+func (v ValueType) IsRef() bool {
+	heap := v.Heap()
+	return heap&Concrete != 0 || (heap >= 0x69 && heap <= 0x74)
+}
+
+func (v ValueType) Nullable() bool {
+	return v&NonNull == 0
+}
+
+// Heap is the heap type of a reference
+func (v ValueType) Heap() int {
+	return int(v &^ NonNull)
+}
+
+// TypeIndex is the index of the type a concrete reference points to
+func (v ValueType) TypeIndex() (uint32, bool) {
+	heap := v.Heap()
+	return uint32(heap &^ Concrete), heap&Concrete != 0
+}
+
+// Packed fields are read and written as i32
+func (v ValueType) Unpacked() ValueType {
+	if v == I8 || v == I16 {
+		return ValueType(ValType["i32"].(int))
+	}
+	return v
 }